@@ -0,0 +1,249 @@
+// Package admin implements the local HTTP+JSON API used to inspect and control
+// a running JadeSocks process.
+//
+//	GET    /v1/status          version, start time and uptime
+//	GET    /v1/sessions        active sessions
+//	DELETE /v1/sessions/{id}   kill a session
+//	GET    /v1/bans            blocked client addresses
+//	POST   /v1/bans            block an address, body {"ip": "...", "duration": "1h"}
+//	DELETE /v1/bans/{ip}       unblock an address
+//	POST   /v1/reload          reload the configuration file
+//
+// Every request must carry "Authorization: Bearer <token>". A token may only be
+// omitted when the API listens on a unix socket.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/archervanderwaal/JadeSocks/socks5"
+)
+
+const unixPrefix = "unix:"
+
+type Config struct {
+	// ListenAddr is a TCP address, or "unix:" followed by a socket path
+	ListenAddr string
+	Token      string
+	Version    string
+	Servers    []*socks5.Server
+	Bans       *socks5.BanList
+	// Reload reloads the configuration, the endpoint fails when it is nil
+	Reload func() error
+}
+
+type Server struct {
+	conf  *Config
+	start time.Time
+	mux   *http.ServeMux
+}
+
+func New(conf *Config) (*Server, error) {
+	if conf.Token == "" && !strings.HasPrefix(conf.ListenAddr, unixPrefix) {
+		return nil, errors.New("An admin token is required unless the admin API listens on a unix socket ")
+	}
+	server := &Server{conf: conf, start: time.Now(), mux: http.NewServeMux()}
+	server.mux.HandleFunc("/v1/status", server.handleStatus)
+	server.mux.HandleFunc("/v1/sessions", server.handleSessions)
+	server.mux.HandleFunc("/v1/sessions/", server.handleSession)
+	server.mux.HandleFunc("/v1/bans", server.handleBans)
+	server.mux.HandleFunc("/v1/bans/", server.handleBan)
+	server.mux.HandleFunc("/v1/reload", server.handleReload)
+	return server, nil
+}
+
+func (server *Server) ListenAndServe() error {
+	listener, err := listen(server.conf.ListenAddr)
+	if err != nil {
+		return err
+	}
+	return http.Serve(listener, server)
+}
+
+func listen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, unixPrefix) {
+		return net.Listen("tcp", addr)
+	}
+	path := strings.TrimPrefix(addr, unixPrefix)
+	// a socket left behind by an unclean shutdown makes bind fail
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		_ = os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !server.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="JadeSocks"`)
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	server.mux.ServeHTTP(w, r)
+}
+
+func (server *Server) authorized(r *http.Request) bool {
+	if server.conf.Token == "" {
+		return true
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(server.conf.Token)) == 1
+}
+
+type status struct {
+	Version        string    `json:"version"`
+	Start          time.Time `json:"start"`
+	UptimeSeconds  int64     `json:"uptime_seconds"`
+	ActiveSessions int       `json:"active_sessions"`
+}
+
+func (server *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, status{
+		Version:        server.conf.Version,
+		Start:          server.start,
+		UptimeSeconds:  int64(time.Since(server.start) / time.Second),
+		ActiveSessions: len(server.sessions()),
+	})
+}
+
+func (server *Server) sessions() []socks5.Session {
+	sessions := make([]socks5.Session, 0)
+	for _, s := range server.conf.Servers {
+		sessions = append(sessions, s.Sessions()...)
+	}
+	return sessions
+}
+
+func (server *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, server.sessions())
+}
+
+func (server *Server) handleSession(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodDelete) {
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/v1/sessions/")
+	for _, s := range server.conf.Servers {
+		if s.KillSession(id) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, fmt.Sprintf("session %q not found", id))
+}
+
+type banRequest struct {
+	IP       string `json:"ip"`
+	Duration string `json:"duration"`
+}
+
+func (server *Server) handleBans(w http.ResponseWriter, r *http.Request) {
+	if server.conf.Bans == nil {
+		writeError(w, http.StatusNotFound, "ban list is not enabled")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, server.conf.Bans.List())
+	case http.MethodPost:
+		req := &banRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+			return
+		}
+		ip := net.ParseIP(req.IP)
+		if ip == nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid ip %q", req.IP))
+			return
+		}
+		var d time.Duration
+		if req.Duration != "" {
+			var err error
+			if d, err = time.ParseDuration(req.Duration); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid duration: "+err.Error())
+				return
+			}
+		}
+		server.conf.Bans.Ban(ip, d)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (server *Server) handleBan(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodDelete) {
+		return
+	}
+	if server.conf.Bans == nil {
+		writeError(w, http.StatusNotFound, "ban list is not enabled")
+		return
+	}
+	raw := strings.TrimPrefix(r.URL.Path, "/v1/bans/")
+	ip := net.ParseIP(raw)
+	if ip == nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid ip %q", raw))
+		return
+	}
+	if !server.conf.Bans.Unban(ip) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("%s is not banned", ip))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (server *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	if server.conf.Reload == nil {
+		writeError(w, http.StatusNotImplemented, "reload is not supported")
+		return
+	}
+	if err := server.conf.Reload(); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
@@ -0,0 +1,115 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/archervanderwaal/JadeSocks/socks5"
+)
+
+func newTestServer(t *testing.T, reload func() error) (*httptest.Server, *socks5.BanList) {
+	bans := socks5.NewBanList()
+	server, err := New(&Config{
+		ListenAddr: "127.0.0.1:0",
+		Token:      "secret",
+		Version:    "test",
+		Bans:       bans,
+		Reload:     reload,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ts := httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+	return ts, bans
+}
+
+func do(t *testing.T, method, url, token, body string) *http.Response {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	return resp
+}
+
+func TestNew_RequiresToken(t *testing.T) {
+	if _, err := New(&Config{ListenAddr: "127.0.0.1:0"}); err == nil {
+		t.Fatalf("expected an error without token")
+	}
+	if _, err := New(&Config{ListenAddr: "unix:/tmp/jadesocks-admin.sock"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestServer_Unauthorized(t *testing.T) {
+	ts, _ := newTestServer(t, nil)
+	if resp := do(t, http.MethodGet, ts.URL+"/v1/status", "", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", resp.StatusCode)
+	}
+	if resp := do(t, http.MethodGet, ts.URL+"/v1/status", "wrong", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", resp.StatusCode)
+	}
+}
+
+func TestServer_Status(t *testing.T) {
+	ts, _ := newTestServer(t, nil)
+	resp := do(t, http.MethodGet, ts.URL+"/v1/status", "secret", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	st := &status{}
+	if err := json.NewDecoder(resp.Body).Decode(st); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if st.Version != "test" || st.ActiveSessions != 0 {
+		t.Fatalf("unexpected status %+v", st)
+	}
+}
+
+func TestServer_Bans(t *testing.T) {
+	ts, bans := newTestServer(t, nil)
+	if resp := do(t, http.MethodPost, ts.URL+"/v1/bans", "secret", `{"ip":"10.0.0.1","duration":"1h"}`); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+	resp := do(t, http.MethodGet, ts.URL+"/v1/bans", "secret", "")
+	var list []socks5.Ban
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(list) != 1 || list[0].IP != "10.0.0.1" {
+		t.Fatalf("unexpected bans %+v", list)
+	}
+	if resp := do(t, http.MethodDelete, ts.URL+"/v1/bans/10.0.0.1", "secret", ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+	if len(bans.List()) != 0 {
+		t.Fatalf("expected no bans")
+	}
+	if resp := do(t, http.MethodDelete, ts.URL+"/v1/bans/10.0.0.1", "secret", ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestServer_Reload(t *testing.T) {
+	reloadErr := errors.New("bad config")
+	ts, _ := newTestServer(t, func() error { return reloadErr })
+	if resp := do(t, http.MethodPost, ts.URL+"/v1/reload", "secret", ""); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %d", resp.StatusCode)
+	}
+	reloadErr = nil
+	if resp := do(t, http.MethodPost, ts.URL+"/v1/reload", "secret", ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+}
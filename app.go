@@ -0,0 +1,767 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/archervanderwaal/JadeSocks/admin"
+	"github.com/archervanderwaal/JadeSocks/config"
+	"github.com/archervanderwaal/JadeSocks/metrics"
+	"github.com/archervanderwaal/JadeSocks/routing"
+	"github.com/archervanderwaal/JadeSocks/socks5"
+	"github.com/archervanderwaal/JadeSocks/systemd"
+)
+
+// app owns everything that lives for the whole process: the SOCKS servers and
+// the listeners, sinks and state shared across configuration reloads
+type app struct {
+	conf      *config.Config
+	registry  *metrics.Registry
+	bans      *socks5.BanList
+	accessLog socks5.AccessLogger
+	servers   []*socks5.Server
+	reloads   *metrics.CounterVec
+	// agents are the agents connected to inbounds that accept them, and
+	// clients the agents of this process connecting to remote servers
+	agents  *socks5.Agents
+	clients []*socks5.Agent
+
+	// reloadMu serialises reloads triggered by signals, the file watcher and
+	// the admin API
+	reloadMu sync.Mutex
+}
+
+func newApp(conf *config.Config) *app {
+	return &app{conf: conf, bans: socks5.NewBanList(), agents: socks5.NewAgents()}
+}
+
+func (a *app) run() error {
+	a.startMetrics()
+	accessLog, err := openAccessLog(a.conf)
+	if err != nil {
+		return fmt.Errorf("Error opening access log: %v ", err)
+	}
+	a.accessLog = accessLog
+	serverConfigs, err := a.buildServerConfigs(a.conf)
+	if err != nil {
+		return err
+	}
+	for _, serverConfig := range serverConfigs {
+		server, err := socks5.New(serverConfig)
+		if err != nil {
+			return err
+		}
+		a.servers = append(a.servers, server)
+	}
+	a.agents.Allow(agentNames(a.conf))
+	if a.conf.Admin.Listen != "" {
+		if err := a.startAdmin(); err != nil {
+			return err
+		}
+	}
+	listeners, packetConns, err := a.listen()
+	if err != nil {
+		return err
+	}
+	stop := stopSignals()
+	errs := make(chan error, 2*len(a.servers))
+	for i, server := range a.servers {
+		go func(server *socks5.Server, listener net.Listener) {
+			errs <- server.Serve(listener)
+		}(server, listeners[i])
+		if packetConns[i] != nil {
+			go func(server *socks5.Server, conn net.PacketConn) {
+				errs <- server.ServeUDP(conn)
+			}(server, packetConns[i])
+		}
+	}
+	a.startAgents()
+	// reloads replace a.conf, everything reading it at startup comes first
+	a.watchReloads()
+	notify(systemd.Ready)
+	go watchdog()
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-stop:
+		log.Infof("Received %v, shutting down", sig)
+		notify(systemd.Stopping)
+		for _, server := range a.servers {
+			_ = server.Close()
+		}
+		for _, client := range a.clients {
+			_ = client.Close()
+		}
+		return nil
+	}
+}
+
+// listen opens the listener, and the UDP socket of transparent inbounds with
+// UDP, of every inbound before any is served, so that systemd is told the
+// service is ready only once all of them accept clients
+func (a *app) listen() ([]net.Listener, []net.PacketConn, error) {
+	activated, err := systemd.Listeners()
+	if err != nil {
+		return nil, nil, err
+	}
+	listeners := make([]net.Listener, 0, len(a.servers))
+	packetConns := make([]net.PacketConn, len(a.servers))
+	closeAll := func() {
+		for _, listener := range listeners {
+			_ = listener.Close()
+		}
+		for _, conn := range packetConns {
+			if conn != nil {
+				_ = conn.Close()
+			}
+		}
+		for _, listener := range activated {
+			_ = listener.Close()
+		}
+	}
+	for i, inbound := range a.conf.Inbounds {
+		var listener net.Listener
+		if strings.HasPrefix(inbound.Listen, config.SystemdPrefix) {
+			name := strings.TrimPrefix(inbound.Listen, config.SystemdPrefix)
+			var ok bool
+			if listener, ok = activated[name]; !ok {
+				closeAll()
+				return nil, nil, fmt.Errorf("Inbound %s: systemd passed no socket named %s ", inbound.Name, name)
+			}
+			delete(activated, name)
+		} else if listener, err = a.servers[i].Listen(); err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("Inbound %s: failed to listen on %s: %v ", inbound.Name, inbound.Listen, err)
+		}
+		log.Infof("Inbound %s (%s) listening on %s:%s", inbound.Name, inbound.Type, listener.Addr().Network(), listener.Addr())
+		listeners = append(listeners, listener)
+		if inbound.UDP {
+			if packetConns[i], err = a.servers[i].ListenPacket(); err != nil {
+				closeAll()
+				return nil, nil, fmt.Errorf("Inbound %s: failed to listen for UDP on %s: %v ", inbound.Name, inbound.Listen, err)
+			}
+			log.Infof("Inbound %s (%s) listening on udp:%s", inbound.Name, inbound.Type, packetConns[i].LocalAddr())
+		}
+	}
+	for name, listener := range activated {
+		log.Warnf("Closing socket %s passed by systemd, no inbound listens on it", name)
+		_ = listener.Close()
+	}
+	return listeners, packetConns, nil
+}
+
+// notify tells systemd about the state of the service when it supervises it
+func notify(state string) {
+	if _, err := systemd.Notify(state); err != nil {
+		log.Warnf("Failed to notify systemd of %s: %v", state, err)
+	}
+}
+
+// watchdog keeps the systemd watchdog from restarting the service for as long
+// as the process runs, when WatchdogSec= is set
+func watchdog() {
+	interval, ok := systemd.WatchdogInterval()
+	if !ok {
+		return
+	}
+	for range time.Tick(interval) {
+		notify(systemd.Watchdog)
+	}
+}
+
+// buildServerConfigs builds the configuration of the server of every inbound,
+// in the order of conf.Inbounds. Inbounds share one resolver and router, and
+// so their DNS cache and outbounds. conf must have been validated, the
+// certificates of TLS inbounds and outbounds are loaded again.
+func (a *app) buildServerConfigs(conf *config.Config) ([]*socks5.ServerConfig, error) {
+	resolver := buildResolver(conf)
+	router, err := buildRouter(conf, a.agents)
+	if err != nil {
+		return nil, err
+	}
+	configs := make([]*socks5.ServerConfig, 0, len(conf.Inbounds))
+	for _, inbound := range conf.Inbounds {
+		tlsConfig, err := buildServerTLS(inbound.TLS)
+		if err != nil {
+			return nil, fmt.Errorf("Inbound %s: %v ", inbound.Name, err)
+		}
+		webSocket, err := buildWebSocket(inbound.WebSocket, inbound.Transport)
+		if err != nil {
+			return nil, fmt.Errorf("Inbound %s: %v ", inbound.Name, err)
+		}
+		obfs, err := buildObfs(inbound.Obfs)
+		if err != nil {
+			return nil, fmt.Errorf("Inbound %s: %v ", inbound.Name, err)
+		}
+		if inbound.Obfs.UserKeys {
+			obfs.Users = buildAccounts(inbound.Auth.Users)
+		}
+		var shadowsocks *socks5.Shadowsocks
+		if inbound.Type == socks5.ProtocolShadowsocks {
+			shadowsocks = buildShadowsocks(inbound.Shadowsocks)
+			if inbound.Shadowsocks.UserKeys {
+				shadowsocks.Users = buildAccounts(inbound.Auth.Users)
+			}
+		}
+		var trojan *socks5.Trojan
+		if inbound.Type == socks5.ProtocolTrojan {
+			trojan = &socks5.Trojan{Users: buildAccounts(inbound.Auth.Users), Fallback: inbound.Trojan.Fallback}
+		}
+		network, listenAddr := inbound.Network, inbound.Listen
+		if strings.HasPrefix(listenAddr, config.UnixPrefix) {
+			network, listenAddr = "unix", strings.TrimPrefix(listenAddr, config.UnixPrefix)
+		}
+		var authMethods []socks5.Authenticator
+		if inbound.Type == socks5.ProtocolSOCKS5 || inbound.Type == socks5.ProtocolHTTP {
+			authMethods = buildAuthMethods(inbound.Auth)
+		}
+		var agents *socks5.Agents
+		if inbound.Agents {
+			agents = a.agents
+		}
+		configs = append(configs, &socks5.ServerConfig{
+			Name:                 inbound.Name,
+			Protocol:             inbound.Type,
+			AuthMethods:          authMethods,
+			Resolver:             resolver,
+			Rules:                buildRules(inbound.Rules, inbound.DefaultAction),
+			Router:               router,
+			Outbound:             inbound.Outbound,
+			Agents:               agents,
+			ListenAddr:           listenAddr,
+			Network:              network,
+			SocketMode:           inbound.FileMode(),
+			SocketOwner:          inbound.SocketOwner,
+			TransparentMode:      inbound.Mode,
+			TransparentUDP:       inbound.UDP && inbound.Type == socks5.ProtocolTransparent,
+			ForwardTarget:        inbound.Target,
+			ForwardUDP:           inbound.UDP && inbound.Type == socks5.ProtocolForward,
+			Shadowsocks:          shadowsocks,
+			ShadowsocksUDP:       inbound.UDP && inbound.Type == socks5.ProtocolShadowsocks,
+			Trojan:               trojan,
+			TrustedProxies:       inbound.TrustedNetworks(),
+			TLS:                  tlsConfig,
+			WebSocket:            webSocket,
+			Obfs:                 obfs,
+			Mux:                  buildMux(inbound.Mux),
+			Logger:               log,
+			DialTimeout:          conf.Timeouts.Dial.Duration,
+			HandshakeTimeout:     conf.Timeouts.Handshake.Duration,
+			IdleTimeout:          conf.Timeouts.Idle.Duration,
+			MaxConnections:       conf.Limits.MaxConnections,
+			MaxConnectionsPerIP:  conf.Limits.MaxConnectionsPerIP,
+			Metrics:              a.registry,
+			Bans:                 a.bans,
+			BanAfterAuthFailures: conf.Limits.BanAfterAuthFailures,
+			BanDuration:          conf.Limits.BanDuration.Duration,
+			AccessLog:            a.accessLog,
+		})
+	}
+	return configs, nil
+}
+
+func buildAuthMethods(auth config.Auth) []socks5.Authenticator {
+	var methods []socks5.Authenticator
+	for _, method := range auth.Methods {
+		switch method {
+		case "none":
+			methods = append(methods, socks5.NoAuthAuthenticator{})
+		case "userpass":
+			methods = append(methods, socks5.UserPassAuthenticator{Accounts: buildAccounts(auth.Users)})
+		}
+	}
+	return methods
+}
+
+func buildAccounts(users []config.User) socks5.Accounts {
+	passwords := make(map[string]string, len(users))
+	for _, user := range users {
+		passwords[user.Name] = user.Password
+	}
+	return socks5.Accounts{MemoryUser: passwords}
+}
+
+func buildResolver(conf *config.Config) socks5.NameResolver {
+	if conf.Resolver == "" {
+		var resolver socks5.NameResolver = socks5.DNSResolver{}
+		if conf.DNSCacheTTL > 0 {
+			resolver = socks5.NewCachingResolver(resolver, time.Duration(conf.DNSCacheTTL)*time.Second)
+		}
+		return resolver
+	}
+	var resolver socks5.NameResolver = socks5.DNSResolver{}
+	for _, r := range conf.Resolvers {
+		if r.Name != conf.Resolver {
+			continue
+		}
+		if r.Type == "dns" {
+			resolver = &socks5.ServerResolver{Servers: r.Servers, Timeout: r.Timeout.Duration}
+		}
+		if r.CacheTTL.Duration > 0 {
+			resolver = socks5.NewCachingResolver(resolver, r.CacheTTL.Duration)
+		}
+	}
+	return resolver
+}
+
+// buildRules returns nil, which permits everything, when no rule is configured
+func buildRules(list []config.Rule, defaultAction string) socks5.RuleSet {
+	if len(list) == 0 && defaultAction == "allow" {
+		return nil
+	}
+	rules := &socks5.RuleList{DefaultAllow: defaultAction == "allow"}
+	for _, rule := range list {
+		rules.Rules = append(rules.Rules, socks5.Rule{Name: rule.Name, Allow: rule.Action == "allow", Matcher: buildMatcher(rule.Match)})
+	}
+	return rules
+}
+
+// buildMatcher converts the criteria of a rule or route, the configuration
+// was validated so they all parse
+func buildMatcher(m config.Match) socks5.Matcher {
+	matcher := socks5.Matcher{Domains: m.Domains, Users: m.Users}
+	for _, name := range m.Commands {
+		command, _ := routing.ParseCommand(name)
+		matcher.Commands = append(matcher.Commands, command)
+	}
+	for _, cidr := range m.CIDRs {
+		network, _ := routing.ParseCIDR(cidr)
+		matcher.Networks = append(matcher.Networks, network)
+	}
+	for _, port := range m.Ports {
+		r, _ := routing.ParsePortRange(port)
+		matcher.Ports = append(matcher.Ports, r)
+	}
+	return matcher
+}
+
+// buildRouter returns nil, which connects directly, when no route or outbound
+// is configured or named by an inbound. Reverse outbounds reach their agents
+// through agents.
+func buildRouter(conf *config.Config, agents *socks5.Agents) (*socks5.Router, error) {
+	named := false
+	for _, inbound := range conf.Inbounds {
+		named = named || inbound.Outbound != ""
+	}
+	if len(conf.Routes) == 0 && len(conf.Outbounds) == 0 && conf.DefaultOutbound == socks5.DirectOutboundName && !named {
+		return nil, nil
+	}
+	dialTimeout := conf.Timeouts.Dial.Duration
+	router := &socks5.Router{
+		Outbounds: map[string]socks5.Outbound{
+			socks5.DirectOutboundName: &socks5.DirectOutbound{Timeout: dialTimeout},
+			socks5.RejectOutboundName: socks5.RejectOutbound{},
+		},
+		Default: conf.DefaultOutbound,
+	}
+	for _, outbound := range conf.Outbounds {
+		switch outbound.Type {
+		case "direct":
+			router.Outbounds[outbound.Name] = &socks5.DirectOutbound{
+				Timeout:       dialTimeout,
+				ProxyProtocol: outbound.ProxyProtocol,
+				SocketOptions: buildSocketOptions(outbound),
+			}
+		case "reject":
+			router.Outbounds[outbound.Name] = socks5.RejectOutbound{}
+		case "socks5":
+			tlsConfig, err := buildClientTLS(outbound.TLS)
+			if err != nil {
+				return nil, fmt.Errorf("Outbound %s: %v ", outbound.Name, err)
+			}
+			webSocket, err := buildWebSocket(outbound.WebSocket, outbound.Transport)
+			if err != nil {
+				return nil, fmt.Errorf("Outbound %s: %v ", outbound.Name, err)
+			}
+			obfs, err := buildObfs(outbound.Obfs)
+			if err != nil {
+				return nil, fmt.Errorf("Outbound %s: %v ", outbound.Name, err)
+			}
+			router.Outbounds[outbound.Name] = &socks5.Socks5Outbound{
+				Address:       outbound.Address,
+				Username:      outbound.Username,
+				Password:      outbound.Password,
+				Timeout:       dialTimeout,
+				ProxyProtocol: outbound.ProxyProtocol,
+				TLS:           tlsConfig,
+				WebSocket:     webSocket,
+				Obfs:          obfs,
+				HTTPProxy:     outbound.ProxyURL(),
+				Mux:           buildMux(outbound.Mux),
+				SocketOptions: buildSocketOptions(outbound),
+			}
+		case "shadowsocks":
+			shadowsocks := buildShadowsocksOutbound(outbound.Shadowsocks, outbound.Address)
+			shadowsocks.Timeout = dialTimeout
+			shadowsocks.SocketOptions = buildSocketOptions(outbound)
+			router.Outbounds[outbound.Name] = shadowsocks
+		case "trojan":
+			settings := outbound.TLS
+			settings.Enabled = true
+			tlsConfig, err := buildClientTLS(settings)
+			if err != nil {
+				return nil, fmt.Errorf("Outbound %s: %v ", outbound.Name, err)
+			}
+			router.Outbounds[outbound.Name] = &socks5.TrojanOutbound{
+				Address:       outbound.Address,
+				Password:      outbound.Password,
+				TLS:           tlsConfig,
+				Timeout:       dialTimeout,
+				SocketOptions: buildSocketOptions(outbound),
+			}
+		case "reverse":
+			router.Outbounds[outbound.Name] = &socks5.ReverseOutbound{
+				Agents:  agents,
+				Agent:   outbound.Agent,
+				Timeout: dialTimeout,
+			}
+		}
+	}
+	for _, route := range conf.Routes {
+		router.Routes = append(router.Routes, socks5.Route{Name: route.Name, Outbound: route.Outbound, Matcher: buildMatcher(route.Match)})
+	}
+	return router, nil
+}
+
+// buildServerTLS returns the TLS configuration of an inbound, nil when TLS is
+// not enabled. The certificate is read again when its files change.
+func buildServerTLS(t config.ServerTLS) (*tls.Config, error) {
+	tlsConfig, _, err := t.Config()
+	if tlsConfig == nil {
+		return nil, err
+	}
+	cert, err := socks5.LoadCertificateFile(t.Cert, t.Key)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.GetCertificate = cert.GetCertificate
+	return tlsConfig, nil
+}
+
+// buildClientTLS returns the TLS configuration of an outbound, nil when TLS is
+// not enabled
+func buildClientTLS(t config.ClientTLS) (*tls.Config, error) {
+	tlsConfig, _, err := t.Config()
+	if tlsConfig == nil {
+		return nil, err
+	}
+	if t.Cert != "" {
+		cert, err := socks5.LoadCertificateFile(t.Cert, t.Key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.GetClientCertificate = cert.GetClientCertificate
+	}
+	return tlsConfig, nil
+}
+
+// buildWebSocket returns nil for transports other than ws. The decoy page is
+// read.
+func buildWebSocket(ws config.WebSocket, transport string) (*socks5.WebSocket, error) {
+	if transport != "ws" {
+		return nil, nil
+	}
+	webSocket := &socks5.WebSocket{Path: ws.Path, Host: ws.Host}
+	if len(ws.Headers) > 0 {
+		webSocket.Header = make(http.Header, len(ws.Headers))
+		for name, value := range ws.Headers {
+			webSocket.Header.Set(name, value)
+		}
+	}
+	if ws.Decoy != "" {
+		decoy, err := ioutil.ReadFile(ws.Decoy)
+		if err != nil {
+			return nil, err
+		}
+		webSocket.Decoy = decoy
+	}
+	return webSocket, nil
+}
+
+// buildObfs returns nil when obfuscation is not enabled. The decoy page is
+// read, the keys of users are left to the caller.
+func buildObfs(o config.Obfs) (*socks5.Obfs, error) {
+	if o.Key == "" && !o.UserKeys {
+		return nil, nil
+	}
+	obfs := &socks5.Obfs{
+		Key:            o.Key,
+		Window:         o.Window.Duration,
+		ReplayCapacity: o.ReplayCapacity,
+		Camouflage:     o.Camouflage,
+		SNI:            o.SNI,
+		PaddedRecords:  o.PaddedRecords,
+		MaxRecord:      o.MaxRecord,
+		Fallback:       o.Fallback,
+	}
+	if o.Decoy != "" {
+		decoy, err := ioutil.ReadFile(o.Decoy)
+		if err != nil {
+			return nil, err
+		}
+		obfs.Decoy = decoy
+	}
+	return obfs, nil
+}
+
+// buildMux returns nil when mux is not enabled
+func buildMux(m config.Mux) *socks5.Mux {
+	if !m.Enabled {
+		return nil
+	}
+	return &socks5.Mux{
+		Carriers:    m.Carriers,
+		MaxStreams:  m.MaxStreams,
+		IdleTimeout: m.IdleTimeout.Duration,
+		KeepAlive:   m.KeepAlive.Duration,
+	}
+}
+
+// buildShadowsocks leaves the keys of users to the caller
+func buildShadowsocks(s config.Shadowsocks) *socks5.Shadowsocks {
+	return &socks5.Shadowsocks{Method: s.Method, Password: s.Password}
+}
+
+// buildShadowsocksOutbound returns an outbound to address, the URI takes
+// precedence. The outbound must have been validated.
+func buildShadowsocksOutbound(s config.Shadowsocks, address string) *socks5.ShadowsocksOutbound {
+	if s.URI != "" {
+		outbound, _ := socks5.ParseShadowsocksURI(s.URI)
+		return outbound
+	}
+	return &socks5.ShadowsocksOutbound{Address: address, Shadowsocks: buildShadowsocks(s)}
+}
+
+// buildSocketOptions expects the outbound to have been validated
+func buildSocketOptions(outbound config.Outbound) socks5.SocketOptions {
+	parse := func(list []string) []net.IP {
+		ips := make([]net.IP, 0, len(list))
+		for _, s := range list {
+			ips = append(ips, net.ParseIP(s))
+		}
+		return ips
+	}
+	options := socks5.SocketOptions{
+		SourceIPs: parse(outbound.SourceIPs),
+		Interface: outbound.Interface,
+		Mark:      outbound.Mark,
+		KeepAlive: outbound.KeepAlive.Duration,
+		Nagle:     outbound.Nagle,
+		FastOpen:  outbound.FastOpen,
+	}
+	if len(outbound.UserSourceIPs) > 0 {
+		options.UserSourceIPs = make(map[string][]net.IP, len(outbound.UserSourceIPs))
+		for user, ips := range outbound.UserSourceIPs {
+			options.UserSourceIPs[user] = parse(ips)
+		}
+	}
+	return options
+}
+
+// reload reads the configuration file again and applies it to new sessions.
+// An invalid file is rejected as a whole and the running configuration kept.
+func (a *app) reload(trigger string) error {
+	a.reloadMu.Lock()
+	defer a.reloadMu.Unlock()
+	conf := &config.Config{}
+	if err := conf.LoadConfig(f); err != nil {
+		a.reloads.With("failure").Inc()
+		log.Errorf("Reload of %s (%s) rejected, keeping the running configuration: %v", f, trigger, err)
+		return err
+	}
+	configs, err := a.buildServerConfigs(conf)
+	if err != nil {
+		a.reloads.With("failure").Inc()
+		log.Errorf("Reload of %s (%s) rejected, keeping the running configuration: %v", f, trigger, err)
+		return err
+	}
+	// servers are matched to inbounds by name, the servers of removed
+	// inbounds keep their configuration until the next restart. Every
+	// configuration is checked before any is applied.
+	next := make(map[*socks5.Server]*socks5.ServerConfig, len(a.servers))
+	for _, server := range a.servers {
+		name := server.CurrentConfig().Name
+		for j, inbound := range conf.Inbounds {
+			if inbound.Name != name {
+				continue
+			}
+			if err := server.CheckReload(configs[j]); err != nil {
+				a.reloads.With("failure").Inc()
+				log.Errorf("Reload of %s (%s) rejected, keeping the running configuration: %v", f, trigger, err)
+				return fmt.Errorf("Inbound %s: %v ", name, err)
+			}
+			next[server] = configs[j]
+		}
+	}
+	for server, serverConfig := range next {
+		// checked above, Reload cannot fail
+		_ = server.Reload(serverConfig)
+	}
+	a.agents.Allow(agentNames(conf))
+	for _, setting := range restartOnly(a.conf, conf) {
+		log.Warnf("Reload of %s: %s changed but only takes effect after a restart", f, setting)
+	}
+	a.conf = conf
+	a.reloads.With("success").Inc()
+	log.Infof("Reloaded configuration from %s (%s)", f, trigger)
+	return nil
+}
+
+// restartOnly lists the settings that differ between old and next but cannot
+// be applied to a running process
+func restartOnly(old, next *config.Config) []string {
+	var changed []string
+	if listeners(old) != listeners(next) {
+		changed = append(changed, "inbounds")
+	}
+	if old.MetricsAddr != next.MetricsAddr {
+		changed = append(changed, "metrics")
+	}
+	if old.Admin != next.Admin {
+		changed = append(changed, "admin")
+	}
+	if fmt.Sprint(old.Agents) != fmt.Sprint(next.Agents) {
+		changed = append(changed, "agents")
+	}
+	if old.AccessLog != next.AccessLog {
+		changed = append(changed, "access_log")
+	}
+	if fmt.Sprint(old.Log) != fmt.Sprint(next.Log) {
+		changed = append(changed, "log")
+	}
+	return changed
+}
+
+// listeners describes the listening side of the inbounds, which unlike their
+// auth and rules cannot be reloaded
+func listeners(conf *config.Config) string {
+	var b strings.Builder
+	for _, inbound := range conf.Inbounds {
+		fmt.Fprintf(&b, "%s %s %s %s %s %s %s %t\n", inbound.Name, inbound.Type, inbound.Network, inbound.Listen,
+			inbound.SocketMode, inbound.SocketOwner, inbound.Mode, inbound.UDP)
+	}
+	return b.String()
+}
+
+// agentNames lists the agents reverse outbounds reach, only they may register
+// with inbounds that accept agents
+func agentNames(conf *config.Config) []string {
+	var names []string
+	for _, outbound := range conf.Outbounds {
+		if outbound.Type == "reverse" {
+			names = append(names, outbound.Agent)
+		}
+	}
+	return names
+}
+
+// startAgents connects the agents of the configuration to their servers, they
+// keep reconnecting until the process shuts down
+func (a *app) startAgents() {
+	for _, agent := range a.conf.Agents {
+		client := &socks5.Agent{
+			Server:     agent.Server,
+			Username:   agent.Username,
+			Password:   agent.Password,
+			Rules:      buildRules(agent.Rules, agent.DefaultAction),
+			Outbound:   &socks5.DirectOutbound{Timeout: a.conf.Timeouts.Dial.Duration},
+			Timeout:    a.conf.Timeouts.Handshake.Duration,
+			MaxBackoff: agent.MaxBackoff.Duration,
+			Logger:     log,
+		}
+		a.clients = append(a.clients, client)
+		log.Infof("Agent %s connecting to %s", agent.Name, agent.Server)
+		go func() { _ = client.Run() }()
+	}
+}
+
+// openAccessLog opens the access log sink, the sink is kept for the lifetime
+// of the process and is not reopened on reload
+func openAccessLog(config *config.Config) (socks5.AccessLogger, error) {
+	var w io.Writer
+	switch config.AccessLog.Path {
+	case "":
+		return nil, nil
+	case "stdout":
+		w = os.Stdout
+	case "stderr":
+		w = os.Stderr
+	default:
+		file, err := os.OpenFile(config.AccessLog.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		w = file
+	}
+	return socks5.NewAccessLog(w, config.AccessLog.Format)
+}
+
+func (a *app) startMetrics() {
+	if a.conf.MetricsAddr == "" {
+		return
+	}
+	a.registry = metrics.NewRegistry()
+	a.reloads = a.registry.NewCounterVec("jadesocks_config_reloads_total",
+		"Total number of configuration reloads, by result.", "result")
+	addr := a.conf.MetricsAddr
+	go func() {
+		log.Infof("Serving metrics on http://%s/metrics", addr)
+		if err := metrics.ListenAndServe(addr, a.registry); err != nil {
+			log.Errorf("Metrics listener on %s failed: %v", addr, err)
+		}
+	}()
+}
+
+func (a *app) startAdmin() error {
+	adminServer, err := admin.New(&admin.Config{
+		ListenAddr: a.conf.Admin.Listen,
+		Token:      a.conf.Admin.Token,
+		Version:    Version,
+		Servers:    a.servers,
+		Bans:       a.bans,
+		Reload: func() error {
+			return a.reload("admin API")
+		},
+	})
+	if err != nil {
+		return err
+	}
+	addr := a.conf.Admin.Listen
+	go func() {
+		log.Infof("Serving admin API on %s", addr)
+		if err := adminServer.ListenAndServe(); err != nil {
+			log.Errorf("Admin API on %s failed: %v", addr, err)
+		}
+	}()
+	return nil
+}
+
+// watchReloads reloads the configuration on SIGHUP and, when enabled, whenever
+// the configuration file changes
+func (a *app) watchReloads() {
+	hup := reloadSignals()
+	go func() {
+		for range hup {
+			_ = a.reload("SIGHUP")
+		}
+	}()
+	if !a.conf.WatchConfig {
+		return
+	}
+	onChange := func() {
+		_ = a.reload("file change")
+	}
+	if err := config.Watch(f, onChange, nil); err != nil {
+		log.Errorf("Failed to watch %s for changes: %v", f, err)
+		return
+	}
+	log.Infof("Watching %s for changes", f)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/archervanderwaal/JadeSocks/config"
+)
+
+// writeCertificate writes a self-signed certificate and its key to dir
+func writeCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "proxy.example.com"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return certFile, keyFile
+}
+
+func TestBuildTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jadesocks-tls")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	cert, key := writeCertificate(t, dir)
+
+	server, err := buildServerTLS(config.ServerTLS{Cert: cert, Key: key, MinVersion: "1.3"})
+	if err != nil || server.GetCertificate == nil || server.MinVersion == 0 {
+		t.Fatalf("bad server config %+v: %v", server, err)
+	}
+	client, err := buildClientTLS(config.ClientTLS{Enabled: true, Cert: cert, Key: key})
+	if err != nil || client.GetClientCertificate == nil {
+		t.Fatalf("bad client config %+v: %v", client, err)
+	}
+	if client, err := buildClientTLS(config.ClientTLS{Enabled: true}); err != nil || client.GetClientCertificate != nil {
+		t.Fatalf("bad client config without certificate %+v: %v", client, err)
+	}
+	if none, err := buildServerTLS(config.ServerTLS{}); none != nil || err != nil {
+		t.Fatalf("expected TLS to be disabled: %v", err)
+	}
+	if _, err := buildServerTLS(config.ServerTLS{Cert: filepath.Join(dir, "missing.pem"), Key: key}); err == nil {
+		t.Fatalf("expected a missing certificate to fail")
+	}
+}
+
+func TestBuildWebSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jadesocks-websocket")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	decoy := filepath.Join(dir, "index.html")
+	if err := ioutil.WriteFile(decoy, []byte("<h1>Welcome</h1>"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	inbound, err := buildWebSocket(config.WebSocket{Path: "/tunnel", Decoy: decoy}, "ws")
+	if err != nil || inbound.Path != "/tunnel" || string(inbound.Decoy) != "<h1>Welcome</h1>" {
+		t.Fatalf("bad inbound websocket %+v: %v", inbound, err)
+	}
+	outbound, err := buildWebSocket(config.WebSocket{Host: "cdn.example.com", Headers: map[string]string{"user-agent": "Mozilla/5.0"}}, "ws")
+	if err != nil || outbound.Host != "cdn.example.com" || outbound.Header.Get("User-Agent") != "Mozilla/5.0" {
+		t.Fatalf("bad outbound websocket %+v: %v", outbound, err)
+	}
+	if none, _ := buildWebSocket(config.WebSocket{Path: "/tunnel"}, "tcp"); none != nil {
+		t.Fatalf("expected WebSocket to be disabled")
+	}
+}
+
+func TestBuildObfs(t *testing.T) {
+	inbound, err := buildObfs(config.Obfs{Key: "s3cret", Camouflage: true, Window: config.Duration{Duration: time.Minute}, ReplayCapacity: 5000})
+	if err != nil || inbound.Key != "s3cret" || !inbound.Camouflage || inbound.Window != time.Minute || inbound.ReplayCapacity != 5000 {
+		t.Fatalf("bad inbound obfs %+v: %v", inbound, err)
+	}
+	if users, err := buildObfs(config.Obfs{UserKeys: true}); err != nil || users == nil || users.Key != "" {
+		t.Fatalf("bad user keys obfs %+v: %v", users, err)
+	}
+	if none, _ := buildObfs(config.Obfs{Camouflage: true}); none != nil {
+		t.Fatalf("expected obfs to be disabled")
+	}
+	if _, err := buildObfs(config.Obfs{Key: "s3cret", Decoy: "/nonexistent/index.html"}); err == nil {
+		t.Fatalf("expected a missing decoy to fail")
+	}
+}
+
+func TestBuildMux(t *testing.T) {
+	mux := buildMux(config.Mux{Enabled: true, Carriers: 2, IdleTimeout: config.Duration{Duration: 10 * time.Minute}})
+	if mux == nil || mux.Carriers != 2 || mux.IdleTimeout != 10*time.Minute {
+		t.Fatalf("bad mux %+v", mux)
+	}
+	if none := buildMux(config.Mux{Carriers: 2}); none != nil {
+		t.Fatalf("expected mux to be disabled")
+	}
+}
+
+func TestBuildShadowsocksOutbound(t *testing.T) {
+	uri := config.Shadowsocks{URI: "ss://YWVzLTI1Ni1nY206c2VjcmV0@203.0.113.1:8388#upstream"}
+	if outbound := buildShadowsocksOutbound(uri, ""); outbound.Address != "203.0.113.1:8388" ||
+		outbound.Shadowsocks.Method != "aes-256-gcm" || outbound.Shadowsocks.Password != "secret" {
+		t.Fatalf("bad uri outbound %+v", outbound)
+	}
+	keys := config.Shadowsocks{Method: "aes-128-gcm", Password: "secret"}
+	if outbound := buildShadowsocksOutbound(keys, "ss.example.com:8388"); outbound.Address != "ss.example.com:8388" ||
+		outbound.Shadowsocks.Method != "aes-128-gcm" {
+		t.Fatalf("bad outbound %+v", outbound)
+	}
+}
+
+func TestBuildSocketOptions(t *testing.T) {
+	options := buildSocketOptions(config.Outbound{
+		SourceIPs:     []string{"192.0.2.10", "192.0.2.11"},
+		Mark:          100,
+		KeepAlive:     config.Duration{Duration: 30 * time.Second},
+		FastOpen:      true,
+		UserSourceIPs: map[string][]string{"bob": {"192.0.2.21"}},
+	})
+	if len(options.SourceIPs) != 2 || options.Mark != 100 || options.KeepAlive != 30*time.Second ||
+		!options.FastOpen || !options.UserSourceIPs["bob"][0].Equal(net.ParseIP("192.0.2.21")) {
+		t.Fatalf("bad socket options: %+v", options)
+	}
+}
@@ -1,29 +1,529 @@
 package config
 
 import (
-	"errors"
-	"github.com/BurntSushi/toml"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/archervanderwaal/JadeSocks/routing"
+	"github.com/archervanderwaal/JadeSocks/utils"
 )
 
 const (
-	defaultListenAddr = ":8989"
+	// CurrentVersion is the newest configuration schema version
+	CurrentVersion = 1
+
+	// UnixPrefix and SystemdPrefix start the listen addresses of unix
+	// sockets and of sockets passed by systemd
+	UnixPrefix    = "unix:"
+	SystemdPrefix = "systemd:"
+
+	defaultListenAddr       = ":8989"
+	defaultInboundName      = "default"
+	defaultLogLevel         = "info"
+	defaultLogMaxSize       = 1
+	defaultHandshakeTimeout = 30 * time.Second
+	defaultDialTimeout      = 30 * time.Second
+	defaultResolverTimeout  = 5 * time.Second
+	defaultAgentMaxBackoff  = time.Minute
 )
 
 type Config struct {
+	// Version is the schema version of the file, files without a version are
+	// read as the current version
+	Version int `toml:"version"`
+	// ListenAddr and Users are shorthands for a single inbound and for
+	// auth.users
 	ListenAddr string            `toml:"listen"`
 	Users      map[string]string `toml:"users"`
+	Inbounds   []Inbound         `toml:"inbounds"`
+	Auth       Auth              `toml:"auth"`
+	Rules      []Rule            `toml:"rules"`
+	// DefaultAction applies to requests no rule matches, allow or deny
+	DefaultAction string  `toml:"default_action"`
+	Routes        []Route `toml:"routes"`
+	// DefaultOutbound is used for requests no route matches, direct by
+	// default
+	DefaultOutbound string     `toml:"default_outbound"`
+	Outbounds       []Outbound `toml:"outbounds"`
+	Resolvers       []Resolver `toml:"resolvers"`
+	// Agents expose the network of this host through remote servers
+	Agents []Agent `toml:"agents"`
+	// Resolver names the resolver used for destination domains, the system
+	// resolver is used when it is empty
+	Resolver string `toml:"resolver"`
+	// DNSCacheTTL is how many seconds the system resolver caches answers, 0
+	// disables the cache
+	DNSCacheTTL int      `toml:"dns_cache_ttl"`
+	Timeouts    Timeouts `toml:"timeouts"`
+	Limits      Limits   `toml:"limits"`
+	// MetricsAddr is the address of the Prometheus metrics listener, metrics
+	// are disabled when it is empty
+	MetricsAddr string    `toml:"metrics"`
+	Admin       Admin     `toml:"admin"`
+	AccessLog   AccessLog `toml:"access_log"`
+	Log         Log       `toml:"log"`
+	// WatchConfig reloads the configuration whenever the file changes, it is
+	// always reloaded on SIGHUP
+	WatchConfig bool `toml:"watch_config"`
+}
+
+// Inbound is a listener accepting proxy clients. Auth, Rules and
+// DefaultAction apply to this inbound only and replace the top-level ones when
+// set, resolvers, routes and outbounds are shared by all inbounds.
+type Inbound struct {
+	Name string `toml:"name"`
+	// Type is socks5 (the default), http, transparent for connections the
+	// firewall redirects to the inbound, forward to relay every connection
+	// to Target, shadowsocks or trojan
+	Type string `toml:"type"`
+	// Listen is a TCP address, "unix:" followed by a socket path, or
+	// "systemd:" followed by the FileDescriptorName= of a socket passed by
+	// systemd socket activation
+	Listen string `toml:"listen"`
+	// Network is tcp (the default), tcp4 or tcp6, it does not apply to unix
+	// and systemd sockets
+	Network string `toml:"network"`
+	// SocketMode, in octal such as "0660", and SocketOwner, "user",
+	// "user:group" or ":group", apply to unix sockets
+	SocketMode  string `toml:"socket_mode"`
+	SocketOwner string `toml:"socket_owner"`
+	// Mode is how a transparent inbound learns the original destination,
+	// redirect (the default) for iptables REDIRECT or tproxy for TPROXY.
+	// UDP also relays UDP diverted with TPROXY to transparent inbounds, and
+	// the UDP datagrams received on the listen address to Target for
+	// forward inbounds, and serves Shadowsocks UDP on the listen address
+	// of shadowsocks inbounds.
+	Mode string `toml:"mode"`
+	UDP  bool   `toml:"udp"`
+	// Target is the host:port a forward inbound relays to, through Outbound
+	// when it is set and through the routes otherwise
+	Target   string `toml:"target"`
+	Outbound string `toml:"outbound"`
+	// Agents accepts agents on a socks5 inbound, they authenticate as users
+	// of the inbound's auth and are reached through reverse outbounds
+	Agents bool `toml:"agents"`
+	// TrustedProxies lists the addresses and CIDRs of load balancers that
+	// send a PROXY protocol v1 or v2 header with the client's address
+	TrustedProxies []string `toml:"trusted_proxies"`
+	// TLS serves socks5 and http inbounds over TLS, trojan inbounds require
+	// it
+	TLS ServerTLS `toml:"tls"`
+	// Transport is tcp (the default) or ws, which serves socks5 inbounds in
+	// WebSocket connections, over TLS when TLS is set
+	Transport string    `toml:"transport"`
+	WebSocket WebSocket `toml:"websocket"`
+	// Mux accepts carriers of multiplexed streams from socks5 outbounds of
+	// other JadeSocks instances on a socks5 inbound
+	Mux Mux `toml:"mux"`
+	// Obfs serves a socks5 inbound in obfuscated connections, under tls and
+	// the ws transport
+	Obfs Obfs `toml:"obfs"`
+	// Shadowsocks is the cipher and key of a shadowsocks inbound, whose
+	// clients are anonymous unless it gives users keys
+	Shadowsocks Shadowsocks `toml:"shadowsocks"`
+	// Trojan is the fallback of a trojan inbound, its auth users are its
+	// clients
+	Trojan        Trojan `toml:"trojan"`
+	Auth          Auth   `toml:"auth"`
+	Rules         []Rule `toml:"rules"`
+	DefaultAction string `toml:"default_action"`
+}
+
+// FileMode returns the permissions of a unix socket, 0 keeps those the umask
+// gives. The inbound must have been validated.
+func (inbound Inbound) FileMode() os.FileMode {
+	mode, _ := parseSocketMode(inbound.SocketMode)
+	return mode
+}
+
+// TrustedNetworks returns the networks of TrustedProxies. The inbound must
+// have been validated.
+func (inbound Inbound) TrustedNetworks() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, proxy := range inbound.TrustedProxies {
+		network, _ := routing.ParseCIDR(proxy)
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// Auth configures how clients authenticate
+type Auth struct {
+	// Methods lists none and userpass, userpass alone when users are
+	// configured and none otherwise by default
+	Methods []string `toml:"methods"`
+	Users   []User   `toml:"users"`
+}
+
+type User struct {
+	Name     string `toml:"name"`
+	Password string `toml:"password"`
+	// PasswordFile reads the password from a file instead
+	PasswordFile string `toml:"password_file"`
+}
+
+// Match selects requests, every criterion that is set must match
+type Match struct {
+	// Commands lists connect, bind or associate
+	Commands []string `toml:"commands"`
+	// CIDRs are networks or single addresses of the destination
+	CIDRs []string `toml:"cidrs"`
+	// Domains match a destination domain and its subdomains
+	Domains []string `toml:"domains"`
+	// Ports are destination ports or ranges such as "8000-8080"
+	Ports []string `toml:"ports"`
+	Users []string `toml:"users"`
+}
+
+// Rule allows or denies the requests it matches, the first matching rule
+// decides
+type Rule struct {
+	Name string `toml:"name"`
+	// Action is allow or deny
+	Action string `toml:"action"`
+	Match
+}
+
+// Route sends the requests it matches to an outbound, the first matching
+// route wins
+type Route struct {
+	Name     string `toml:"name"`
+	Outbound string `toml:"outbound"`
+	Match
+}
+
+// Outbound is a way of reaching destinations, direct and reject are always
+// defined
+type Outbound struct {
+	Name string `toml:"name"`
+	// Type is direct, socks5, shadowsocks, trojan, reject or reverse
+	Type string `toml:"type"`
+	// Agent is the user a reverse outbound's agent authenticates as, the
+	// agent connects to the destinations from its own network
+	Agent string `toml:"agent"`
+	// Address, Username and Password are those of the upstream SOCKS5
+	// server, Address is also that of the server of a shadowsocks outbound
+	// and Address and Password those of the server of a trojan outbound
+	Address  string `toml:"address"`
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+	// PasswordFile reads the password from a file instead
+	PasswordFile string `toml:"password_file"`
+	// ProxyProtocol is the version, 1 or 2, of the PROXY protocol header a
+	// direct or socks5 outbound sends to announce the client, 0 sends none
+	ProxyProtocol int `toml:"proxy_protocol"`
+
+	// The socket options of direct and socks5 outbounds.
+	// SourceIPs are used in turn as the source address of connections,
+	// UserSourceIPs replace them for the users they list.
+	SourceIPs     []string            `toml:"source_ips"`
+	UserSourceIPs map[string][]string `toml:"user_source_ips"`
+	// Interface binds connections to a network interface and Mark sets
+	// their firewall mark, both are only supported on Linux
+	Interface string `toml:"interface"`
+	Mark      int    `toml:"mark"`
+	// KeepAlive is the TCP keepalive interval, 15s by default, negative
+	// disables keepalives
+	KeepAlive Duration `toml:"keepalive"`
+	// Nagle enables Nagle's algorithm, TCP_NODELAY is set by default
+	Nagle bool `toml:"nagle"`
+	// FastOpen enables TCP Fast Open, Linux only
+	FastOpen bool `toml:"fast_open"`
+	// TLS connects to the server of a socks5 outbound over TLS, trojan
+	// outbounds always use TLS and take their settings from it
+	TLS ClientTLS `toml:"tls"`
+	// Transport is tcp (the default) or ws, which reaches the server of a
+	// socks5 outbound in a WebSocket connection, over TLS when TLS is set
+	Transport string    `toml:"transport"`
+	WebSocket WebSocket `toml:"websocket"`
+	// HTTPProxy is the http://[user:password@]host:port of a proxy that the
+	// server of a socks5 outbound is reached through with CONNECT
+	HTTPProxy string `toml:"http_proxy"`
+	// Mux carries the connections of a socks5 outbound as streams of a few
+	// carrier connections, the server must be a JadeSocks socks5 inbound with
+	// mux enabled
+	Mux Mux `toml:"mux"`
+	// Obfs obfuscates the connections of a socks5 outbound to its server,
+	// under tls and the ws transport
+	Obfs Obfs `toml:"obfs"`
+	// Shadowsocks is the cipher and key of the server of a shadowsocks
+	// outbound, which carries UDP as well
+	Shadowsocks Shadowsocks `toml:"shadowsocks"`
+}
+
+// Agent keeps a connection to a server whose socks5 inbound accepts agents,
+// the server reaches destinations through it with a reverse outbound.
+// Rules and DefaultAction decide which destinations the agent connects to.
+type Agent struct {
+	Name string `toml:"name"`
+	// Server is the host:port of the inbound
+	Server   string `toml:"server"`
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+	// PasswordFile reads the password from a file instead
+	PasswordFile  string `toml:"password_file"`
+	Rules         []Rule `toml:"rules"`
+	DefaultAction string `toml:"default_action"`
+	// MaxBackoff caps the wait between reconnections, 1m by default
+	MaxBackoff Duration `toml:"max_backoff"`
+}
+
+// Resolver resolves destination domains
+type Resolver struct {
+	Name string `toml:"name"`
+	// Type is system or dns
+	Type string `toml:"type"`
+	// Servers are the DNS servers queried by the dns type, the port
+	// defaults to 53
+	Servers []string `toml:"servers"`
+	Timeout Duration `toml:"timeout"`
+	// CacheTTL caches answers for that long, 0 disables the cache
+	CacheTTL Duration `toml:"cache_ttl"`
 }
 
+type Timeouts struct {
+	// Handshake bounds negotiation, authentication and the request
+	Handshake Duration `toml:"handshake"`
+	Dial      Duration `toml:"dial"`
+	// Idle closes relays without traffic for that long, 0 disables it
+	Idle Duration `toml:"idle"`
+}
+
+// Limits protect the server from clients, 0 means unlimited
+type Limits struct {
+	MaxConnections      int `toml:"max_connections"`
+	MaxConnectionsPerIP int `toml:"max_connections_per_ip"`
+	// BanAfterAuthFailures bans a client for BanDuration after that many
+	// authentication failures within 15 minutes, 0 disables it
+	BanAfterAuthFailures int      `toml:"ban_after_auth_failures"`
+	BanDuration          Duration `toml:"ban_duration"`
+}
+
+// Log configures the diagnostic log of the process
+type Log struct {
+	// Level is debug, info, warn or error
+	Level string `toml:"level"`
+	// Outputs lists console, file, syslog or none
+	Outputs []string `toml:"outputs"`
+	// Dir is the directory of the file output, ~/.JadeSocks/logger by default
+	Dir string `toml:"dir"`
+	// MaxSize rotates the log file after that many megabytes
+	MaxSize int `toml:"max_size"`
+	// MaxAge removes rotated log files after that many days, 0 keeps them
+	MaxAge int  `toml:"max_age"`
+	Color  bool `toml:"color"`
+	JSON   bool `toml:"json"`
+}
+
+// AccessLog configures the per-session access log, it is disabled when Path
+// is empty
+type AccessLog struct {
+	// Path is a file name, "stdout" or "stderr"
+	Path string `toml:"path"`
+	// Format is "json" (the default) or "logfmt"
+	Format string `toml:"format"`
+}
+
+// Admin configures the admin API, it is disabled when Listen is empty
+type Admin struct {
+	// Listen is a TCP address or "unix:/path/to/socket"
+	Listen string `toml:"listen"`
+	Token  string `toml:"token"`
+	// TokenFile reads the token from a file instead
+	TokenFile string `toml:"token_file"`
+}
+
+// Duration is written as a string such as "30s" or "5m"
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	duration, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.Duration.String()), nil
+}
+
+// LoadConfig reads, validates and completes the configuration at path. The
+// format follows the extension: .yaml or .yml for YAML, .json for JSON and
+// TOML otherwise. ${NAME} in string values is replaced with the environment
+// variable NAME, $${ is written for a literal ${, and JADESOCKS_ variables
+// override settings of the file.
+// A *ValidationError lists every problem found with its line.
 func (conf *Config) LoadConfig(path string) error {
-	md, err := toml.DecodeFile(path, conf)
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return err
 	}
-	if len(md.Undecoded()) > 0 {
-		return errors.New("Unknown config keys in " + path)
+	// defaults that a zero value in the file must be able to override
+	conf.Log.Color = true
+	v := &validator{err: &ValidationError{File: path}}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = conf.decodeYAML(data, v)
+	case ".json":
+		err = conf.decodeJSON(data, v)
+	default:
+		err = conf.decodeTOML(data, v)
 	}
-	if len(conf.ListenAddr) == 0 {
-		conf.ListenAddr = defaultListenAddr
+	if err != nil {
+		return err
+	}
+	config := reflect.ValueOf(conf).Elem()
+	applyEnvOverrides(v, "", config)
+	interpolate(v, "", config)
+	conf.readSecretFiles(v)
+	conf.validate(v)
+	if len(v.err.Problems) > 0 {
+		return v.err
 	}
+	conf.setDefaults()
 	return nil
-}
\ No newline at end of file
+}
+
+// setDefaults fills in what a valid file left out
+func (conf *Config) setDefaults() {
+	if conf.Version == 0 {
+		conf.Version = CurrentVersion
+	}
+	if len(conf.Inbounds) == 0 {
+		listen := conf.ListenAddr
+		if listen == "" {
+			listen = defaultListenAddr
+		}
+		conf.Inbounds = []Inbound{{Name: defaultInboundName, Listen: listen}}
+	}
+	for name, password := range conf.Users {
+		conf.Auth.Users = append(conf.Auth.Users, User{Name: name, Password: password})
+	}
+	conf.Users = nil
+	conf.Auth.setDefaults()
+	if conf.DefaultAction == "" {
+		conf.DefaultAction = "allow"
+	}
+	for i := range conf.Inbounds {
+		inbound := &conf.Inbounds[i]
+		if inbound.Type == "" {
+			inbound.Type = "socks5"
+		}
+		if inbound.Network == "" {
+			inbound.Network = "tcp"
+		}
+		if inbound.Type == "transparent" && inbound.Mode == "" {
+			inbound.Mode = "redirect"
+		}
+		if inbound.Auth.isSet() {
+			inbound.Auth.setDefaults()
+		} else {
+			inbound.Auth = conf.Auth
+		}
+		if len(inbound.Rules) == 0 && inbound.DefaultAction == "" {
+			inbound.Rules = conf.Rules
+			inbound.DefaultAction = conf.DefaultAction
+		} else if inbound.DefaultAction == "" {
+			inbound.DefaultAction = "allow"
+		}
+	}
+	if conf.DefaultOutbound == "" {
+		conf.DefaultOutbound = "direct"
+	}
+	for i := range conf.Resolvers {
+		if conf.Resolvers[i].Type == "" {
+			conf.Resolvers[i].Type = "system"
+		}
+		if conf.Resolvers[i].Timeout.Duration == 0 {
+			conf.Resolvers[i].Timeout.Duration = defaultResolverTimeout
+		}
+		for j, server := range conf.Resolvers[i].Servers {
+			if _, _, err := net.SplitHostPort(server); err != nil {
+				conf.Resolvers[i].Servers[j] = server + ":53"
+			}
+		}
+	}
+	for i := range conf.Agents {
+		if conf.Agents[i].DefaultAction == "" {
+			conf.Agents[i].DefaultAction = "allow"
+		}
+		if conf.Agents[i].MaxBackoff.Duration == 0 {
+			conf.Agents[i].MaxBackoff.Duration = defaultAgentMaxBackoff
+		}
+	}
+	if conf.Timeouts.Handshake.Duration == 0 {
+		conf.Timeouts.Handshake.Duration = defaultHandshakeTimeout
+	}
+	if conf.Timeouts.Dial.Duration == 0 {
+		conf.Timeouts.Dial.Duration = defaultDialTimeout
+	}
+	if conf.Log.Level == "" {
+		conf.Log.Level = defaultLogLevel
+	}
+	if len(conf.Log.Outputs) == 0 {
+		conf.Log.Outputs = []string{"console"}
+	}
+	if conf.Log.Dir == "" {
+		conf.Log.Dir = filepath.Join(utils.Home(), "logger")
+	}
+	if conf.Log.MaxSize == 0 {
+		conf.Log.MaxSize = defaultLogMaxSize
+	}
+}
+
+func (auth *Auth) isSet() bool {
+	return len(auth.Methods) > 0 || len(auth.Users) > 0
+}
+
+func (auth *Auth) setDefaults() {
+	if len(auth.Methods) > 0 {
+		return
+	}
+	if len(auth.Users) > 0 {
+		auth.Methods = []string{"userpass"}
+	} else {
+		auth.Methods = []string{"none"}
+	}
+}
+
+// ValidationError lists the problems of a configuration file
+type ValidationError struct {
+	File     string
+	Problems []Problem
+}
+
+// Problem is one invalid setting, Line is 0 when it could not be located
+type Problem struct {
+	Line    int
+	Key     string
+	Message string
+}
+
+func (p Problem) String() string {
+	if p.Key == "" {
+		return p.Message
+	}
+	return fmt.Sprintf("%s: %s", p.Key, p.Message)
+}
+
+func (e *ValidationError) Error() string {
+	lines := make([]string, 0, len(e.Problems))
+	for _, p := range e.Problems {
+		if p.Line > 0 {
+			lines = append(lines, fmt.Sprintf("%s:%d: %s", e.File, p.Line, p))
+		} else {
+			lines = append(lines, fmt.Sprintf("%s: %s", e.File, p))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -1,7 +1,11 @@
 package config
 
 import (
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestLoadConfig(t *testing.T) {
@@ -10,4 +14,474 @@ func TestLoadConfig(t *testing.T) {
 	if err != nil {
 		t.Fail()
 	}
-}
\ No newline at end of file
+}
+
+func TestLoadConfig_Defaults(t *testing.T) {
+	conf := &Config{}
+	if err := conf.LoadConfig("JadeSocks.toml"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if conf.Version != CurrentVersion {
+		t.Fatalf("bad version: %d", conf.Version)
+	}
+	if len(conf.Inbounds) != 1 || conf.Inbounds[0].Listen != ":8989" || conf.Inbounds[0].Network != "tcp" {
+		t.Fatalf("bad inbounds: %v", conf.Inbounds)
+	}
+	if len(conf.Auth.Users) != 2 || len(conf.Auth.Methods) != 1 || conf.Auth.Methods[0] != "userpass" {
+		t.Fatalf("bad auth: %v", conf.Auth)
+	}
+	if conf.DefaultAction != "allow" || conf.DefaultOutbound != "direct" {
+		t.Fatalf("bad defaults: %q %q", conf.DefaultAction, conf.DefaultOutbound)
+	}
+	if conf.Timeouts.Handshake.Duration != defaultHandshakeTimeout || conf.Timeouts.Dial.Duration != defaultDialTimeout {
+		t.Fatalf("bad timeouts: %v", conf.Timeouts)
+	}
+}
+
+func TestLoadConfig_Full(t *testing.T) {
+	conf := &Config{}
+	if err := conf.LoadConfig("JadeSocks-Full.toml"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(conf.Inbounds) != 3 || len(conf.Rules) != 2 || len(conf.Routes) != 1 {
+		t.Fatalf("bad config: %+v", conf)
+	}
+	if conf.Limits.BanDuration.Duration != 15*time.Minute {
+		t.Fatalf("bad ban duration: %v", conf.Limits.BanDuration)
+	}
+	if servers := conf.Resolvers[0].Servers; servers[0] != "1.1.1.1:53" || servers[1] != "8.8.8.8:53" {
+		t.Fatalf("bad servers: %v", servers)
+	}
+	if cidrs := conf.Rules[1].CIDRs; len(cidrs) != 3 {
+		t.Fatalf("bad cidrs: %v", cidrs)
+	}
+}
+
+func TestLoadConfig_Invalid(t *testing.T) {
+	path := writeConfig(t, `version = 1
+users = {alice = "x"}
+
+[[auth.users]]
+name = "alice"
+password = "y"
+
+[[rules]]
+name = "lan"
+action = "deny"
+
+[[rules]]
+name = "private"
+action = "deny"
+cidrs = ["10.0.0.0/8", "192.168.0.0/33"]
+
+[[routes]]
+name = "corp"
+outbound = "upstream"
+
+[timeouts]
+dial = "10s"
+bogus = 1
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	err := (&Config{}).LoadConfig(path)
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+	expected := []Problem{
+		{Line: 5, Key: "auth.users[0].name", Message: `duplicate user "alice"`},
+		{Line: 15, Key: "rules[1].cidrs", Message: `invalid CIDR "192.168.0.0/33"`},
+		{Line: 19, Key: "routes[0].outbound", Message: `unknown outbound "upstream"`},
+		{Line: 23, Key: "timeouts.bogus", Message: "unknown key"},
+	}
+	if len(verr.Problems) != len(expected) {
+		t.Fatalf("bad problems: %v", verr)
+	}
+	for i, p := range expected {
+		if verr.Problems[i] != p {
+			t.Fatalf("bad problem %d: %+v, expected %+v", i, verr.Problems[i], p)
+		}
+	}
+}
+
+func TestLoadConfig_DottedKeys(t *testing.T) {
+	path := writeConfig(t, `version = 1
+limits.max_connections = -1
+"timeouts" . 'dial' = "10s"
+
+[[inbounds]]
+listen = "127.0.0.1:1080"
+rules = [{name = "ports", action = "deny", ports = ["80-20"]}]
+auth."methods" = ["bogus"]
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	err := (&Config{}).LoadConfig(path)
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+	lines := map[string]int{"limits.max_connections": 2, "inbounds[0].auth.methods[0]": 8}
+	for _, p := range verr.Problems {
+		if line, ok := lines[p.Key]; ok && p.Line != line {
+			t.Fatalf("bad line of %s: %d, expected %d", p.Key, p.Line, line)
+		}
+		delete(lines, p.Key)
+	}
+	if len(lines) != 0 {
+		t.Fatalf("missing problems %v in %v", lines, verr)
+	}
+}
+
+func TestLoadConfig_Inbounds(t *testing.T) {
+	conf := &Config{}
+	if err := conf.LoadConfig("JadeSocks-Full.toml"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	local, public, web := conf.Inbounds[0], conf.Inbounds[1], conf.Inbounds[2]
+	if local.Type != "socks5" || len(local.Auth.Users) != 0 || local.Auth.Methods[0] != "none" {
+		t.Fatalf("bad local inbound: %+v", local)
+	}
+	// inbounds without their own auth and rules use the top-level ones
+	if public.Type != "socks5" || len(public.Auth.Users) != 2 || len(public.Rules) != 2 || public.DefaultAction != "allow" {
+		t.Fatalf("bad public inbound: %+v", public)
+	}
+	if web.Type != "http" || len(web.Auth.Users) != 2 || len(web.Rules) != 1 || web.DefaultAction != "deny" {
+		t.Fatalf("bad web inbound: %+v", web)
+	}
+
+	path := writeConfig(t, `[[inbounds]]
+name = "a"
+listen = ":1080"
+
+[[inbounds]]
+name = "b"
+type = "ftp"
+listen = ":1081"
+
+[[inbounds.rules]]
+name = "r"
+action = "allow"
+
+[[inbounds.rules]]
+name = "r"
+action = "allow"
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+	err := (&Config{}).LoadConfig(path)
+	verr, ok := err.(*ValidationError)
+	if !ok || len(verr.Problems) != 2 {
+		t.Fatalf("bad error: %v", err)
+	}
+	if p := verr.Problems[0]; p.Key != "inbounds[1].type" || p.Line != 7 {
+		t.Fatalf("bad problem: %+v", p)
+	}
+	if p := verr.Problems[1]; p.Key != "inbounds[1].rules[1].name" || p.Line != 15 {
+		t.Fatalf("bad problem: %+v", p)
+	}
+}
+
+func TestLoadConfig_Sockets(t *testing.T) {
+	path := writeConfig(t, `[[inbounds]]
+name = "local"
+listen = "unix:/run/jadesocks/socks.sock"
+socket_mode = "0660"
+socket_owner = "root:jadesocks"
+
+[[inbounds]]
+name = "activated"
+listen = "systemd:socks"
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+	conf := &Config{}
+	if err := conf.LoadConfig(path); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if mode := conf.Inbounds[0].FileMode(); mode != 0660 {
+		t.Fatalf("bad socket mode %v", mode)
+	}
+
+	path = writeConfig(t, `[[inbounds]]
+name = "a"
+listen = "unix:"
+
+[[inbounds]]
+name = "b"
+listen = "127.0.0.1:1080"
+socket_mode = "0660"
+
+[[inbounds]]
+name = "c"
+listen = "unix:/tmp/c.sock"
+socket_mode = "rw"
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+	err := (&Config{}).LoadConfig(path)
+	verr, ok := err.(*ValidationError)
+	if !ok || len(verr.Problems) != 3 {
+		t.Fatalf("bad error: %v", err)
+	}
+	for i, key := range []string{"inbounds[0].listen", "inbounds[1].socket_mode", "inbounds[2].socket_mode"} {
+		if verr.Problems[i].Key != key {
+			t.Fatalf("bad problem: %+v", verr.Problems[i])
+		}
+	}
+}
+
+func TestLoadConfig_Transparent(t *testing.T) {
+	path := writeConfig(t, `[[inbounds]]
+name = "redirect"
+type = "transparent"
+listen = ":12345"
+
+[[inbounds]]
+name = "tproxy"
+type = "transparent"
+listen = ":12346"
+mode = "tproxy"
+udp = true
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+	conf := &Config{}
+	if err := conf.LoadConfig(path); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if conf.Inbounds[0].Mode != "redirect" || conf.Inbounds[1].Mode != "tproxy" || !conf.Inbounds[1].UDP {
+		t.Fatalf("bad inbounds: %+v", conf.Inbounds)
+	}
+
+	path = writeConfig(t, `[[inbounds]]
+name = "a"
+type = "transparent"
+listen = ":12345"
+udp = true
+
+[[inbounds]]
+name = "b"
+listen = ":1080"
+mode = "tproxy"
+
+[[inbounds]]
+name = "c"
+type = "transparent"
+listen = ":12346"
+mode = "nat"
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+	err := (&Config{}).LoadConfig(path)
+	verr, ok := err.(*ValidationError)
+	if !ok || len(verr.Problems) != 3 {
+		t.Fatalf("bad error: %v", err)
+	}
+	for i, key := range []string{"inbounds[0].udp", "inbounds[1].mode", "inbounds[2].mode"} {
+		if verr.Problems[i].Key != key {
+			t.Fatalf("bad problem: %+v", verr.Problems[i])
+		}
+	}
+}
+
+func TestLoadConfig_Forward(t *testing.T) {
+	path := writeConfig(t, `[[inbounds]]
+name = "db"
+type = "forward"
+listen = "127.0.0.1:5432"
+target = "db.internal:5432"
+outbound = "upstream"
+
+[[inbounds]]
+name = "dns"
+type = "forward"
+listen = ":53"
+target = "[2001:db8::53]:53"
+udp = true
+
+[[outbounds]]
+name = "upstream"
+type = "socks5"
+address = "10.0.0.1:1080"
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+	conf := &Config{}
+	if err := conf.LoadConfig(path); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if conf.Inbounds[0].Target != "db.internal:5432" || conf.Inbounds[0].Outbound != "upstream" || !conf.Inbounds[1].UDP {
+		t.Fatalf("bad inbounds: %+v", conf.Inbounds)
+	}
+
+	path = writeConfig(t, `[[inbounds]]
+name = "a"
+type = "forward"
+listen = ":5432"
+
+[[inbounds]]
+name = "b"
+type = "forward"
+listen = "unix:/run/b.sock"
+target = "db.internal:0"
+udp = true
+outbound = "missing"
+
+[[inbounds]]
+name = "c"
+listen = ":1080"
+target = "db.internal:5432"
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+	err := (&Config{}).LoadConfig(path)
+	verr, ok := err.(*ValidationError)
+	if !ok || len(verr.Problems) != 5 {
+		t.Fatalf("bad error: %v", err)
+	}
+	for i, key := range []string{"inbounds[0].target", "inbounds[1].target", "inbounds[1].udp", "inbounds[1].outbound", "inbounds[2].target"} {
+		if verr.Problems[i].Key != key {
+			t.Fatalf("bad problem: %+v", verr.Problems[i])
+		}
+	}
+}
+
+func TestLoadConfig_Agents(t *testing.T) {
+	path := writeConfig(t, `[[inbounds]]
+name = "public"
+listen = ":1080"
+agents = true
+
+[[outbounds]]
+name = "home"
+type = "reverse"
+agent = "home"
+
+[[agents]]
+name = "office"
+server = "proxy.example.com:1080"
+username = "office"
+password = "secret"
+
+[[agents.rules]]
+name = "lan"
+action = "allow"
+cidrs = ["192.168.0.0/16"]
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+	conf := &Config{}
+	if err := conf.LoadConfig(path); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	agent := conf.Agents[0]
+	if !conf.Inbounds[0].Agents || conf.Outbounds[0].Agent != "home" || agent.Server != "proxy.example.com:1080" ||
+		agent.DefaultAction != "allow" || agent.MaxBackoff.Duration != time.Minute || len(agent.Rules) != 1 {
+		t.Fatalf("bad config: %+v", conf)
+	}
+
+	path = writeConfig(t, `[[inbounds]]
+name = "web"
+type = "http"
+listen = ":8080"
+agents = true
+
+[[outbounds]]
+name = "home"
+type = "reverse"
+proxy_protocol = 1
+
+[[outbounds]]
+name = "office"
+type = "reverse"
+agent = "office"
+
+[[agents]]
+name = "office"
+server = "proxy.example.com"
+max_backoff = "-1s"
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+	err := (&Config{}).LoadConfig(path)
+	verr, ok := err.(*ValidationError)
+	if !ok || len(verr.Problems) != 7 {
+		t.Fatalf("bad error: %v", err)
+	}
+	for i, key := range []string{"inbounds[0].agents", "outbounds[0].agent", "outbounds[0].proxy_protocol", "outbounds[1].agent",
+		"agents[0].username", "agents[0].server", "agents[0].max_backoff"} {
+		if verr.Problems[i].Key != key {
+			t.Fatalf("bad problem: %+v", verr.Problems[i])
+		}
+	}
+}
+
+func TestLoadConfig_ProxyProtocol(t *testing.T) {
+	path := writeConfig(t, `[[inbounds]]
+name = "behind-lb"
+listen = ":1080"
+trusted_proxies = ["10.0.0.0/8", "192.0.2.10", "fe80::/10x"]
+
+[[outbounds]]
+name = "backend"
+type = "direct"
+proxy_protocol = 3
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+	err := (&Config{}).LoadConfig(path)
+	verr, ok := err.(*ValidationError)
+	if !ok || len(verr.Problems) != 2 {
+		t.Fatalf("bad error: %v", err)
+	}
+	if p := verr.Problems[0]; p.Key != "inbounds[0].trusted_proxies[2]" || p.Line != 4 {
+		t.Fatalf("bad problem: %+v", p)
+	}
+	if p := verr.Problems[1]; p.Key != "outbounds[0].proxy_protocol" || p.Line != 9 {
+		t.Fatalf("bad problem: %+v", p)
+	}
+}
+
+func TestLoadConfig_SocketOptions(t *testing.T) {
+	content := `[[outbounds]]
+name = "egress"
+type = "direct"
+source_ips = ["192.0.2.10", "192.0.2.11"]
+interface = "eth1"
+mark = 100
+keepalive = "30s"
+fast_open = true
+
+[outbounds.user_source_ips]
+alice = ["192.0.2.20"]
+bob = ["192.0.2.x"]
+`
+	path := writeConfig(t, content)
+	defer os.RemoveAll(filepath.Dir(path))
+	err := (&Config{}).LoadConfig(path)
+	verr, ok := err.(*ValidationError)
+	if !ok || len(verr.Problems) != 1 {
+		t.Fatalf("bad error: %v", err)
+	}
+	if p := verr.Problems[0]; p.Key != "outbounds[0].user_source_ips.bob[0]" || p.Line != 12 {
+		t.Fatalf("bad problem: %+v", p)
+	}
+
+	path = writeConfig(t, strings.Replace(content, "192.0.2.x", "192.0.2.21", 1))
+	defer os.RemoveAll(filepath.Dir(path))
+	conf := &Config{}
+	if err := conf.LoadConfig(path); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	outbound := conf.Outbounds[0]
+	if len(outbound.SourceIPs) != 2 || outbound.Mark != 100 || outbound.KeepAlive.Duration != 30*time.Second ||
+		!outbound.FastOpen || outbound.UserSourceIPs["bob"][0] != "192.0.2.21" {
+		t.Fatalf("bad socket options: %+v", outbound)
+	}
+}
+
+func TestLoadConfig_BadVersion(t *testing.T) {
+	path := writeConfig(t, "version = 2\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	err := (&Config{}).LoadConfig(path)
+	if verr, ok := err.(*ValidationError); !ok || verr.Problems[0].Key != "version" || verr.Problems[0].Line != 1 {
+		t.Fatalf("bad error: %v", err)
+	}
+}
+
+func writeConfig(t *testing.T, content string) string {
+	return writeNamedConfig(t, "JadeSocks.toml", content)
+}
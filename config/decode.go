@@ -0,0 +1,261 @@
+package config
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/BurntSushi/toml"
+)
+
+func (conf *Config) decodeTOML(data []byte, v *validator) error {
+	md, err := toml.Decode(string(data), conf)
+	if err != nil {
+		return err
+	}
+	v.lines = newLocator(string(data))
+	for _, key := range md.Undecoded() {
+		v.add(key.String(), "unknown key")
+	}
+	return nil
+}
+
+func (conf *Config) decodeYAML(data []byte, v *validator) error {
+	tree, lines, err := parseYAML(string(data))
+	if err != nil {
+		yamlErr := err.(*yamlError)
+		return syntaxError(v.err.File, yamlErr.line, "%s", yamlErr.msg)
+	}
+	v.lines = lines
+	decodeTree(v, "", tree, reflect.ValueOf(conf).Elem())
+	return nil
+}
+
+func (conf *Config) decodeJSON(data []byte, v *validator) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var tree interface{}
+	if err := dec.Decode(&tree); err != nil {
+		if syntax, ok := err.(*json.SyntaxError); ok {
+			return syntaxError(v.err.File, bytes.Count(data[:syntax.Offset], []byte("\n"))+1, "%v", syntax)
+		}
+		return err
+	}
+	v.lines = jsonLocator(data)
+	decodeTree(v, "", tree, reflect.ValueOf(conf).Elem())
+	return nil
+}
+
+// decodeTree stores the maps, lists and scalars the YAML and JSON parsers
+// produce into out, following the toml tags of the configuration structs.
+// Scalars are converted to whatever type the setting has, so YAML's untyped
+// strings work as numbers and booleans.
+func decodeTree(v *validator, key string, in interface{}, out reflect.Value) {
+	if in == nil {
+		return
+	}
+	if unmarshaler, ok := out.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		s, ok := scalarString(in)
+		if !ok {
+			v.add(key, "expected a string")
+			return
+		}
+		if err := unmarshaler.UnmarshalText([]byte(s)); err != nil {
+			v.add(key, "%v", err)
+		}
+		return
+	}
+	switch out.Kind() {
+	case reflect.String:
+		s, ok := scalarString(in)
+		if !ok {
+			v.add(key, "expected a string")
+			return
+		}
+		out.SetString(s)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		s, _ := scalarString(in)
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || out.OverflowInt(n) {
+			v.add(key, "expected an integer")
+			return
+		}
+		out.SetInt(n)
+	case reflect.Bool:
+		s, _ := scalarString(in)
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			v.add(key, "expected true or false")
+			return
+		}
+		out.SetBool(b)
+	case reflect.Slice:
+		list, ok := in.([]interface{})
+		if !ok {
+			v.add(key, "expected a list")
+			return
+		}
+		slice := reflect.MakeSlice(out.Type(), len(list), len(list))
+		for i, item := range list {
+			decodeTree(v, fmt.Sprintf("%s[%d]", key, i), item, slice.Index(i))
+		}
+		out.Set(slice)
+	case reflect.Map:
+		table, ok := in.(map[string]interface{})
+		if !ok {
+			v.add(key, "expected a table")
+			return
+		}
+		m := reflect.MakeMapWithSize(out.Type(), len(table))
+		for _, name := range sortedKeys(table) {
+			elem := reflect.New(out.Type().Elem()).Elem()
+			decodeTree(v, joinKey(key, name), table[name], elem)
+			m.SetMapIndex(reflect.ValueOf(name), elem)
+		}
+		out.Set(m)
+	case reflect.Struct:
+		table, ok := in.(map[string]interface{})
+		if !ok {
+			v.add(key, "expected a table")
+			return
+		}
+		fields := settingFields(out.Type())
+		for _, name := range sortedKeys(table) {
+			index, ok := fields[name]
+			if !ok {
+				v.add(joinKey(key, name), "unknown key")
+				continue
+			}
+			decodeTree(v, joinKey(key, name), table[name], out.FieldByIndex(index))
+		}
+	default:
+		v.add(key, "unsupported setting type %s", out.Type())
+	}
+}
+
+// scalarString returns the text of a string, number or boolean
+func scalarString(in interface{}) (string, bool) {
+	switch value := in.(type) {
+	case string:
+		return value, true
+	case json.Number:
+		return value.String(), true
+	case bool:
+		return strconv.FormatBool(value), true
+	}
+	return "", false
+}
+
+// settingFields maps the toml names of a struct's fields to their index,
+// fields of embedded structs are promoted like the TOML decoder does
+func settingFields(t reflect.Type) map[string][]int {
+	fields := make(map[string][]int)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := field.Tag.Get("toml")
+		if field.Anonymous && name == "" {
+			for embedded, index := range settingFields(field.Type) {
+				fields[embedded] = append([]int{i}, index...)
+			}
+			continue
+		}
+		if name != "" && name != "-" {
+			fields[name] = []int{i}
+		}
+	}
+	return fields
+}
+
+func sortedKeys(table map[string]interface{}) []string {
+	keys := make([]string, 0, len(table))
+	for key := range table {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedFields(fields map[string][]int) []string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func joinKey(parent, key string) string {
+	if parent == "" {
+		return key
+	}
+	return parent + "." + key
+}
+
+// jsonLocator finds the line of every key and list item of a JSON document
+func jsonLocator(data []byte) *locator {
+	type frame struct {
+		key     string
+		object  bool
+		wantKey bool
+		name    string
+		index   int
+	}
+	l := &locator{lines: make(map[string]int)}
+	lineAt := func(offset int64) int {
+		return bytes.Count(data[:offset], []byte("\n")) + 1
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var stack []*frame
+	// next moves the innermost container past the value that just ended
+	next := func() {
+		if len(stack) == 0 {
+			return
+		}
+		top := stack[len(stack)-1]
+		if top.object {
+			top.wantKey = true
+		} else {
+			top.index++
+		}
+	}
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return l
+		}
+		if delim, ok := tok.(json.Delim); ok && (delim == '}' || delim == ']') {
+			stack = stack[:len(stack)-1]
+			next()
+			continue
+		}
+		key := ""
+		if len(stack) > 0 {
+			top := stack[len(stack)-1]
+			if top.object && top.wantKey {
+				top.name, top.wantKey = tok.(string), false
+				l.set(joinKey(top.key, top.name), lineAt(dec.InputOffset()))
+				continue
+			}
+			if top.object {
+				key = joinKey(top.key, top.name)
+			} else {
+				key = fmt.Sprintf("%s[%d]", top.key, top.index)
+				l.set(key, lineAt(dec.InputOffset()))
+			}
+		}
+		if delim, ok := tok.(json.Delim); ok {
+			stack = append(stack, &frame{key: key, object: delim == '{', wantKey: delim == '{'})
+			continue
+		}
+		next()
+	}
+}
+
+// syntaxError reports a problem that stopped a file from being parsed
+func syntaxError(file string, line int, format string, args ...interface{}) error {
+	return &ValidationError{File: file, Problems: []Problem{{Line: line, Message: fmt.Sprintf(format, args...)}}}
+}
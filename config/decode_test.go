@@ -0,0 +1,209 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig_YAML(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jadesocks-secrets")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "user2"), []byte("passwd2\n"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "admin-token"), []byte("token"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	setenv(t, "CREDENTIALS_DIRECTORY", dir)
+	setenv(t, "UPSTREAM_PASSWORD", "secret")
+
+	yaml := &Config{}
+	if err := yaml.LoadConfig("JadeSocks.yaml"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if yaml.Auth.Users[1].Password != "passwd2" || yaml.Admin.Token != "token" || yaml.Outbounds[0].Password != "secret" {
+		t.Fatalf("bad secrets: %+v %+v %+v", yaml.Auth.Users, yaml.Admin, yaml.Outbounds)
+	}
+
+	// apart from the secrets the YAML and TOML samples are the same
+	toml := &Config{}
+	if err := toml.LoadConfig("JadeSocks-Full.toml"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	yaml.Auth.Users[1].PasswordFile = ""
+	yaml.Admin.TokenFile = ""
+	toml.Admin.Token = "token"
+	if !reflect.DeepEqual(yaml, toml) {
+		t.Fatalf("YAML and TOML differ:\n%+v\n%+v", yaml, toml)
+	}
+}
+
+func TestLoadConfig_JSON(t *testing.T) {
+	conf := &Config{}
+	if err := conf.LoadConfig("JadeSocks.json"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if conf.Inbounds[0].Listen != "127.0.0.1:1080" || conf.Timeouts.Idle.Duration != 10*time.Minute ||
+		conf.Limits.MaxConnectionsPerIP != 100 || len(conf.Rules[0].CIDRs) != 2 {
+		t.Fatalf("bad config: %+v", conf)
+	}
+}
+
+func TestLoadConfig_Lines(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+		problem Problem
+	}{
+		{"bad.yaml", "inbounds:\n  - name: a\n    listen: x\n", Problem{Line: 3, Key: "inbounds[0].listen", Message: `invalid listen address "x"`}},
+		{"unknown.yaml", "log:\n  level: info\n  colour: true\n", Problem{Line: 3, Key: "log.colour", Message: "unknown key"}},
+		{"type.yaml", "limits:\n  max_connections: many\n", Problem{Line: 2, Key: "limits.max_connections", Message: "expected an integer"}},
+		{"syntax.yaml", "log:\n  level: x: y\n", Problem{Line: 2, Message: "mapping values are not allowed in this context"}},
+		{"bad.json", "{\n  \"rules\": [\n    {\"name\": \"a\", \"action\": \"drop\"}\n  ]\n}\n", Problem{Line: 3, Key: "rules[0].action", Message: "must be allow or deny"}},
+		{"syntax.json", "{\n  \"listen\": \n}\n", Problem{Line: 3, Message: "invalid character '}' looking for beginning of value"}},
+	}
+	for _, c := range cases {
+		path := writeNamedConfig(t, c.name, c.content)
+		err := (&Config{}).LoadConfig(path)
+		os.RemoveAll(filepath.Dir(path))
+		verr, ok := err.(*ValidationError)
+		if !ok || len(verr.Problems) != 1 || verr.Problems[0] != c.problem {
+			t.Fatalf("%s: bad error %#v", c.name, err)
+		}
+	}
+}
+
+func TestLoadConfig_Environment(t *testing.T) {
+	path := writeConfig(t, "listen = \"${LISTEN_HOST}:1080\"\n\n[log]\nlevel = \"error\"\n\n[admin]\ntoken = \"a$${LISTEN_HOST}$$\"\n")
+	defer os.RemoveAll(filepath.Dir(path))
+	setenv(t, "LISTEN_HOST", "127.0.0.1")
+	setenv(t, "JADESOCKS_LOG_LEVEL", "debug")
+	setenv(t, "JADESOCKS_LOG_OUTPUTS", "console, file")
+	setenv(t, "JADESOCKS_TIMEOUTS_IDLE", "1m")
+	setenv(t, "JADESOCKS_WATCH_CONFIG", "true")
+
+	conf := &Config{}
+	if err := conf.LoadConfig(path); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if conf.Inbounds[0].Listen != "127.0.0.1:1080" || conf.Log.Level != "debug" || len(conf.Log.Outputs) != 2 ||
+		conf.Timeouts.Idle.Duration != time.Minute || !conf.WatchConfig || conf.Admin.Token != "a${LISTEN_HOST}$$" {
+		t.Fatalf("bad config: %+v", conf)
+	}
+
+	setenv(t, "JADESOCKS_LIMITS_MAX_CONNECTIONS", "lots")
+	os.Unsetenv("LISTEN_HOST")
+	err := (&Config{}).LoadConfig(path)
+	verr, ok := err.(*ValidationError)
+	if !ok || len(verr.Problems) != 2 {
+		t.Fatalf("bad error: %v", err)
+	}
+	if p := verr.Problems[0]; p.Key != "JADESOCKS_LIMITS_MAX_CONNECTIONS" || p.Line != 0 {
+		t.Fatalf("bad problem: %+v", p)
+	}
+	if p := verr.Problems[1]; p.Key != "listen" || p.Line != 1 || p.Message != "environment variable LISTEN_HOST is not set" {
+		t.Fatalf("bad problem: %+v", p)
+	}
+}
+
+func TestLoadConfig_SecretFileConflict(t *testing.T) {
+	path := writeConfig(t, "[[auth.users]]\nname = \"a\"\npassword = \"x\"\npassword_file = \"/dev/null\"\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	err := (&Config{}).LoadConfig(path)
+	verr, ok := err.(*ValidationError)
+	if !ok || verr.Problems[0].Key != "auth.users[0].password_file" || verr.Problems[0].Line != 4 {
+		t.Fatalf("bad error: %v", err)
+	}
+}
+
+func TestParseYAML(t *testing.T) {
+	tree, lines, err := parseYAML(`
+a: 1            # comment
+b: "x # y"
+c:
+- 1
+- [2, '3''s', {k: v}]
+-
+  - nested
+d: {e: ~, "f g": null}
+h:
+  - i: 1
+    j: 2
+k: &base
+  l: |
+    one
+    two
+  m: >-
+    folded
+    text
+n:
+  <<: *base
+  m: !!str own
+o: *base
+p: !custom tagged
+`)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := map[string]interface{}{
+		"a": "1",
+		"b": "x # y",
+		"c": []interface{}{"1", []interface{}{"2", "3's", map[string]interface{}{"k": "v"}}, []interface{}{"nested"}},
+		"d": map[string]interface{}{"e": nil, "f g": nil},
+		"h": []interface{}{map[string]interface{}{"i": "1", "j": "2"}},
+		"k": map[string]interface{}{"l": "one\ntwo\n", "m": "folded text"},
+		"n": map[string]interface{}{"l": "one\ntwo\n", "m": "own"},
+		"o": map[string]interface{}{"l": "one\ntwo\n", "m": "folded text"},
+		"p": "tagged",
+	}
+	if !reflect.DeepEqual(tree, expected) {
+		t.Fatalf("bad tree: %#v", tree)
+	}
+	if line := lines.find("h[0].j"); line != 12 {
+		t.Fatalf("bad line of h[0].j: %d", line)
+	}
+	if _, _, err := parseYAML("a: &a [*a]\n"); err == nil {
+		t.Fatalf("expected an alias of itself to be rejected")
+	}
+	laughs := "a: &a [x, x, x, x, x, x, x, x, x, x]\n"
+	for c := 'b'; c <= 'i'; c++ {
+		prev := string(c - 1)
+		laughs += fmt.Sprintf("%c: &%c [*%s, *%s, *%s, *%s, *%s, *%s, *%s, *%s, *%s, *%s]\n", c, c, prev, prev, prev, prev, prev, prev, prev, prev, prev, prev)
+	}
+	if _, _, err := parseYAML(laughs); err == nil {
+		t.Fatalf("expected a document of a billion nodes to be rejected")
+	}
+}
+
+func setenv(t *testing.T, name, value string) {
+	old, ok := os.LookupEnv(name)
+	os.Setenv(name, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(name, old)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+}
+
+func writeNamedConfig(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "jadesocks-config")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return path
+}
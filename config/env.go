@@ -0,0 +1,153 @@
+package config
+
+import (
+	"encoding"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// EnvPrefix starts the names of the environment variables that override
+// settings, JADESOCKS_LISTEN overrides listen and JADESOCKS_LOG_LEVEL
+// overrides log.level
+const EnvPrefix = "JADESOCKS_"
+
+// envReference matches ${NAME} references to environment variables and the
+// $${ escape of a literal ${
+var envReference = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// applyEnvOverrides sets every scalar setting outside of lists from its
+// JADESOCKS_ environment variable, lists of strings are comma separated
+func applyEnvOverrides(v *validator, prefix string, out reflect.Value) {
+	fields := settingFields(out.Type())
+	for _, name := range sortedFields(fields) {
+		field := out.FieldByIndex(fields[name])
+		env := EnvPrefix + strings.ToUpper(prefix+name)
+		if isTable(field) {
+			applyEnvOverrides(v, prefix+name+"_", field)
+			continue
+		}
+		value, ok := os.LookupEnv(env)
+		if !ok {
+			continue
+		}
+		switch {
+		case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String:
+			var items []interface{}
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			decodeTree(v, env, items, field)
+		case field.Kind() == reflect.Slice || field.Kind() == reflect.Map:
+			// lists of tables and maps can only be set in the file
+		default:
+			decodeTree(v, env, value, field)
+		}
+	}
+}
+
+// isTable reports whether a setting is a table of further settings
+func isTable(field reflect.Value) bool {
+	if field.Kind() != reflect.Struct {
+		return false
+	}
+	_, text := field.Addr().Interface().(encoding.TextUnmarshaler)
+	return !text
+}
+
+// interpolate replaces ${NAME} in every string setting with the value of the
+// environment variable NAME and $${ with ${, undefined variables are
+// reported
+func interpolate(v *validator, key string, value reflect.Value) {
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(expandEnv(v, key, value.String()))
+	case reflect.Slice:
+		for i := 0; i < value.Len(); i++ {
+			interpolate(v, fmt.Sprintf("%s[%d]", key, i), value.Index(i))
+		}
+	case reflect.Map:
+		if value.Type().Elem().Kind() != reflect.String {
+			return
+		}
+		for _, name := range value.MapKeys() {
+			childKey := joinKey(key, name.String())
+			expanded := expandEnv(v, childKey, value.MapIndex(name).String())
+			value.SetMapIndex(name, reflect.ValueOf(expanded))
+		}
+	case reflect.Struct:
+		if !isTable(value) {
+			return
+		}
+		fields := settingFields(value.Type())
+		for _, name := range sortedFields(fields) {
+			interpolate(v, joinKey(key, name), value.FieldByIndex(fields[name]))
+		}
+	}
+}
+
+func expandEnv(v *validator, key, s string) string {
+	return envReference.ReplaceAllStringFunc(s, func(reference string) string {
+		if reference == "$${" {
+			return "${"
+		}
+		name := envReference.FindStringSubmatch(reference)[1]
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			v.add(key, "environment variable %s is not set", name)
+		}
+		return value
+	})
+}
+
+// readSecretFiles replaces the _file variants of secrets with the content
+// of the files they name
+func (conf *Config) readSecretFiles(v *validator) {
+	conf.Auth.readSecretFiles(v, "auth")
+	for i := range conf.Inbounds {
+		inbound := &conf.Inbounds[i]
+		inbound.Auth.readSecretFiles(v, fmt.Sprintf("inbounds[%d].auth", i))
+		readSecretFile(v, fmt.Sprintf("inbounds[%d].obfs.key", i), &inbound.Obfs.Key, inbound.Obfs.KeyFile)
+		readSecretFile(v, fmt.Sprintf("inbounds[%d].shadowsocks.password", i), &inbound.Shadowsocks.Password, inbound.Shadowsocks.PasswordFile)
+	}
+	for i := range conf.Outbounds {
+		outbound := &conf.Outbounds[i]
+		readSecretFile(v, fmt.Sprintf("outbounds[%d].password", i), &outbound.Password, outbound.PasswordFile)
+		readSecretFile(v, fmt.Sprintf("outbounds[%d].obfs.key", i), &outbound.Obfs.Key, outbound.Obfs.KeyFile)
+		readSecretFile(v, fmt.Sprintf("outbounds[%d].shadowsocks.password", i), &outbound.Shadowsocks.Password, outbound.Shadowsocks.PasswordFile)
+	}
+	for i := range conf.Agents {
+		agent := &conf.Agents[i]
+		readSecretFile(v, fmt.Sprintf("agents[%d].password", i), &agent.Password, agent.PasswordFile)
+	}
+	readSecretFile(v, "admin.token", &conf.Admin.Token, conf.Admin.TokenFile)
+}
+
+func (auth *Auth) readSecretFiles(v *validator, key string) {
+	for i := range auth.Users {
+		user := &auth.Users[i]
+		readSecretFile(v, fmt.Sprintf("%s.users[%d].password", key, i), &user.Password, user.PasswordFile)
+	}
+}
+
+func readSecretFile(v *validator, key string, secret *string, path string) {
+	if path == "" {
+		return
+	}
+	if *secret != "" {
+		v.add(key+"_file", "cannot be combined with %s", key[strings.LastIndexByte(key, '.')+1:])
+		return
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		v.add(key+"_file", "%v", err)
+		return
+	}
+	// files written by editors and secret stores usually end with a newline
+	*secret = strings.TrimRight(string(data), "\r\n")
+}
@@ -0,0 +1,58 @@
+package config
+
+// Mux carries the connections of a socks5 outbound as streams of a few long
+// lived carrier connections, a socks5 inbound with mux enabled accepts them
+type Mux struct {
+	Enabled bool `toml:"enabled"`
+	// Carriers is how many carriers an outbound opens at most, 4 by default
+	Carriers int `toml:"carriers"`
+	// MaxStreams is how many streams a carrier carries at once, 128 by
+	// default
+	MaxStreams int `toml:"max_streams"`
+	// IdleTimeout closes the carriers of an outbound that carried no stream
+	// for that long, 5m by default
+	IdleTimeout Duration `toml:"idle_timeout"`
+	// KeepAlive is how often carriers are pinged, 30s by default. Carriers
+	// silent for three times as long are closed.
+	KeepAlive Duration `toml:"keepalive"`
+}
+
+func (m Mux) isSet() bool {
+	return m.Enabled || m.Carriers != 0 || m.MaxStreams != 0 || m.IdleTimeout.Duration != 0 || m.KeepAlive.Duration != 0
+}
+
+// validate checks the mux settings of a socks5 inbound or outbound, applies
+// tells whether the type of the inbound or outbound supports mux
+func (m Mux) validate(v *validator, key string, applies, outbound bool) {
+	if !m.isSet() {
+		return
+	}
+	key += ".mux"
+	switch {
+	case !applies && outbound:
+		v.add(key, "only applies to socks5 outbounds")
+		return
+	case !applies:
+		v.add(key, "only applies to socks5 inbounds")
+		return
+	case !m.Enabled:
+		v.add(key+".enabled", "must be true for the other mux settings to apply")
+		return
+	case !outbound && (m.Carriers != 0 || m.IdleTimeout.Duration != 0):
+		v.add(key, "carriers and idle_timeout only apply to outbounds")
+	}
+	negative := []struct {
+		key   string
+		value int64
+	}{
+		{"carriers", int64(m.Carriers)},
+		{"max_streams", int64(m.MaxStreams)},
+		{"idle_timeout", int64(m.IdleTimeout.Duration)},
+		{"keepalive", int64(m.KeepAlive.Duration)},
+	}
+	for _, setting := range negative {
+		if setting.value < 0 {
+			v.add(key+"."+setting.key, "must not be negative")
+		}
+	}
+}
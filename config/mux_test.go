@@ -0,0 +1,95 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig_Mux(t *testing.T) {
+	path := writeConfig(t, `[[inbounds]]
+name = "tunnel"
+listen = ":1080"
+
+[inbounds.mux]
+enabled = true
+max_streams = 256
+
+[[outbounds]]
+name = "upstream"
+type = "socks5"
+address = "proxy.example.com:1080"
+
+[outbounds.mux]
+enabled = true
+carriers = 2
+idle_timeout = "10m"
+keepalive = "15s"
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+	conf := &Config{}
+	if err := conf.LoadConfig(path); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if mux := conf.Inbounds[0].Mux; !mux.Enabled || mux.MaxStreams != 256 {
+		t.Fatalf("bad inbound mux %+v", mux)
+	}
+	mux := conf.Outbounds[0].Mux
+	if !mux.Enabled || mux.Carriers != 2 || mux.IdleTimeout.Duration != 10*time.Minute || mux.KeepAlive.Duration != 15*time.Second {
+		t.Fatalf("bad outbound mux %+v", mux)
+	}
+
+	path = writeConfig(t, `[[inbounds]]
+name = "a"
+type = "http"
+listen = ":8080"
+
+[inbounds.mux]
+enabled = true
+
+[[inbounds]]
+name = "b"
+listen = ":1080"
+
+[inbounds.mux]
+enabled = true
+carriers = 2
+
+[[outbounds]]
+name = "c"
+type = "direct"
+
+[outbounds.mux]
+enabled = true
+
+[[outbounds]]
+name = "d"
+type = "socks5"
+address = "proxy.example.com:1080"
+
+[outbounds.mux]
+carriers = 2
+
+[[outbounds]]
+name = "e"
+type = "socks5"
+address = "proxy.example.com:1080"
+
+[outbounds.mux]
+enabled = true
+max_streams = -1
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+	err := (&Config{}).LoadConfig(path)
+	verr, ok := err.(*ValidationError)
+	if !ok || len(verr.Problems) != 5 {
+		t.Fatalf("bad error: %v", err)
+	}
+	for i, key := range []string{"inbounds[0].mux", "inbounds[1].mux", "outbounds[0].mux", "outbounds[1].mux.enabled",
+		"outbounds[2].mux.max_streams"} {
+		if verr.Problems[i].Key != key {
+			t.Fatalf("bad problem: %+v", verr.Problems[i])
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package config
+
+import (
+	"io/ioutil"
+	"net"
+)
+
+// Obfs obfuscates the connections between a socks5 outbound and a socks5
+// inbound of another JadeSocks instance, it is enabled when Key is set
+type Obfs struct {
+	// Key is shared by both ends, peers that do not know it are answered
+	// like a web server. KeyFile reads it from a file instead.
+	Key     string `toml:"key"`
+	KeyFile string `toml:"key_file"`
+	// UserKeys gives each auth user of an inbound a key of their own, their
+	// password. Outbounds use it as their key and authenticate as the user
+	// without sending the name.
+	UserKeys bool `toml:"user_keys"`
+	// Window is how far the clocks of outbounds may be off, 2m by default.
+	// Inbounds refuse hellos outside of it and hellos they have seen before,
+	// remembering up to ReplayCapacity of them, 100000 by default.
+	Window         Duration `toml:"window"`
+	ReplayCapacity int      `toml:"replay_capacity"`
+	// Camouflage makes connections look like TLS 1.3, outbounds send a
+	// ClientHello for SNI
+	Camouflage bool   `toml:"camouflage"`
+	SNI        string `toml:"sni"`
+	// PaddedRecords is how many records each side starts with that are
+	// padded to a random size, 8 by default, negative disables padding
+	PaddedRecords int `toml:"padded_records"`
+	// MaxRecord bounds the size of records, larger writes are split at
+	// random sizes, 16384 by default
+	MaxRecord int `toml:"max_record"`
+	// Fallback is the host:port of a web server inbounds relay
+	// unauthenticated peers to. Without it they answer HTTP requests with
+	// the Decoy HTML file, a placeholder page by default.
+	Fallback string `toml:"fallback"`
+	Decoy    string `toml:"decoy"`
+}
+
+func (o Obfs) isSet() bool {
+	return o.Key != "" || o.KeyFile != "" || o.UserKeys || o.Window.Duration != 0 || o.ReplayCapacity != 0 ||
+		o.Camouflage || o.SNI != "" || o.PaddedRecords != 0 || o.MaxRecord != 0 || o.Fallback != "" || o.Decoy != ""
+}
+
+// validate checks the obfuscation settings of a socks5 inbound or outbound,
+// applies tells whether the type of the inbound or outbound supports them
+func (o Obfs) validate(v *validator, key string, applies, outbound bool) {
+	if !o.isSet() {
+		return
+	}
+	key += ".obfs"
+	switch {
+	case !applies && outbound:
+		v.add(key, "only applies to socks5 outbounds")
+		return
+	case !applies:
+		v.add(key, "only applies to socks5 inbounds")
+		return
+	case o.Key == "" && !(o.UserKeys && !outbound):
+		v.add(key+".key", "is required for the other obfs settings to apply")
+		return
+	}
+	if outbound && (o.Fallback != "" || o.Decoy != "") {
+		v.add(key, "fallback and decoy only apply to inbounds")
+	}
+	if outbound && (o.UserKeys || o.Window.Duration != 0 || o.ReplayCapacity != 0) {
+		v.add(key, "user_keys, window and replay_capacity only apply to inbounds")
+	}
+	if o.Window.Duration < 0 {
+		v.add(key+".window", "must not be negative")
+	}
+	if o.ReplayCapacity < 0 {
+		v.add(key+".replay_capacity", "must not be negative")
+	}
+	if !outbound && o.SNI != "" {
+		v.add(key+".sni", "only applies to outbounds")
+	}
+	if o.MaxRecord != 0 && (o.MaxRecord < 256 || o.MaxRecord > 16384) {
+		v.add(key+".max_record", "must be between 256 and 16384")
+	}
+	if o.Fallback != "" {
+		if _, _, err := net.SplitHostPort(o.Fallback); err != nil {
+			v.add(key+".fallback", "invalid address %q", o.Fallback)
+		}
+	}
+	if o.Decoy != "" {
+		if _, err := ioutil.ReadFile(o.Decoy); err != nil {
+			v.add(key+".decoy", "%v", err)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig_Obfs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jadesocks-obfs")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "obfs.key")
+	if err := ioutil.WriteFile(keyFile, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	path := writeConfig(t, fmt.Sprintf(`[[inbounds]]
+name = "tunnel"
+listen = ":443"
+
+[inbounds.obfs]
+key_file = %q
+camouflage = true
+fallback = "127.0.0.1:8443"
+window = "1m"
+replay_capacity = 5000
+
+[[inbounds]]
+name = "users"
+listen = ":444"
+
+[inbounds.auth]
+users = [{ name = "alice", password = "alice key" }]
+
+[inbounds.obfs]
+user_keys = true
+
+[[outbounds]]
+name = "upstream"
+type = "socks5"
+address = "proxy.example.com:443"
+
+[outbounds.obfs]
+key = "s3cret"
+camouflage = true
+sni = "www.example.com"
+padded_records = 4
+max_record = 4096
+`, keyFile))
+	defer os.RemoveAll(filepath.Dir(path))
+	conf := &Config{}
+	if err := conf.LoadConfig(path); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	inbound := conf.Inbounds[0].Obfs
+	if inbound.Key != "s3cret" || !inbound.Camouflage || inbound.Fallback != "127.0.0.1:8443" ||
+		inbound.Window.Duration != time.Minute || inbound.ReplayCapacity != 5000 {
+		t.Fatalf("bad inbound obfs %+v", inbound)
+	}
+	if users := conf.Inbounds[1].Obfs; !users.UserKeys || users.Key != "" {
+		t.Fatalf("bad user keys obfs %+v", users)
+	}
+	outbound := conf.Outbounds[0].Obfs
+	if outbound.SNI != "www.example.com" || outbound.PaddedRecords != 4 || outbound.MaxRecord != 4096 {
+		t.Fatalf("bad outbound obfs %+v", outbound)
+	}
+
+	path = writeConfig(t, fmt.Sprintf(`[[inbounds]]
+name = "a"
+type = "http"
+listen = ":8080"
+
+[inbounds.obfs]
+key = "s3cret"
+
+[[inbounds]]
+name = "b"
+listen = ":443"
+
+[inbounds.obfs]
+key = "s3cret"
+sni = "www.example.com"
+fallback = "localhost"
+decoy = %q
+window = "-1s"
+replay_capacity = -1
+
+[[inbounds]]
+name = "e"
+listen = ":444"
+
+[inbounds.obfs]
+user_keys = true
+
+[[outbounds]]
+name = "c"
+type = "socks5"
+address = "proxy.example.com:443"
+
+[outbounds.obfs]
+camouflage = true
+
+[[outbounds]]
+name = "d"
+type = "socks5"
+address = "proxy.example.com:443"
+
+[outbounds.obfs]
+key = "s3cret"
+max_record = 100000
+fallback = "127.0.0.1:8443"
+user_keys = true
+`, filepath.Join(dir, "missing.html")))
+	defer os.RemoveAll(filepath.Dir(path))
+	err = (&Config{}).LoadConfig(path)
+	verr, ok := err.(*ValidationError)
+	if !ok || len(verr.Problems) != 11 {
+		t.Fatalf("bad error: %v", err)
+	}
+	for i, key := range []string{"inbounds[0].obfs", "inbounds[1].obfs.sni", "inbounds[1].obfs.fallback",
+		"inbounds[1].obfs.decoy", "inbounds[1].obfs.window", "inbounds[1].obfs.replay_capacity", "inbounds[2].obfs.user_keys",
+		"outbounds[0].obfs.key", "outbounds[1].obfs", "outbounds[1].obfs", "outbounds[1].obfs.max_record"} {
+		if verr.Problems[i].Key != key {
+			t.Fatalf("bad problem: %+v", verr.Problems[i])
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package config
+
+import (
+	"net"
+
+	"github.com/archervanderwaal/JadeSocks/shadowsocks"
+)
+
+// Shadowsocks is the cipher and key of a shadowsocks inbound or outbound
+type Shadowsocks struct {
+	// URI is the ss:// URI of the server of an outbound, which gives its
+	// address, method and password
+	URI string `toml:"uri"`
+	// Method is aes-128-gcm, aes-256-gcm, chacha20-ietf-poly1305 or one of
+	// the 2022 edition, 2022-blake3-aes-128-gcm, 2022-blake3-aes-256-gcm or
+	// 2022-blake3-chacha20-poly1305, whose password is a key in base64.
+	// PasswordFile reads the password from a file instead.
+	Method       string `toml:"method"`
+	Password     string `toml:"password"`
+	PasswordFile string `toml:"password_file"`
+	// UserKeys gives each auth user of an inbound a password of their own,
+	// clients using it authenticate as the user. With an AES method of the
+	// 2022 edition, Password is the identity key of the inbound and clients
+	// join it and their own key with a colon.
+	UserKeys bool `toml:"user_keys"`
+}
+
+func (s Shadowsocks) isSet() bool {
+	return s.URI != "" || s.Method != "" || s.Password != "" || s.PasswordFile != "" || s.UserKeys
+}
+
+// validate checks the shadowsocks settings of an inbound or outbound,
+// applies tells whether it is of type shadowsocks and users are the auth
+// users of an inbound
+func (s Shadowsocks) validate(v *validator, key string, applies, outbound bool, users []User) {
+	key += ".shadowsocks"
+	switch {
+	case !applies && s.isSet() && outbound:
+		v.add(key, "only applies to shadowsocks outbounds")
+		return
+	case !applies && s.isSet():
+		v.add(key, "only applies to shadowsocks inbounds")
+		return
+	case !applies:
+		return
+	case s.URI != "":
+		if !outbound {
+			v.add(key+".uri", "only applies to outbounds")
+		} else if s.Method != "" || s.Password != "" {
+			v.add(key+".uri", "cannot be combined with method and password")
+		} else if _, _, _, err := shadowsocks.ParseURI(s.URI); err != nil {
+			v.add(key+".uri", "%v", err)
+		}
+		return
+	case s.Method == "":
+		v.add(key+".method", "is required")
+		return
+	}
+	if outbound && s.UserKeys {
+		v.add(key+".user_keys", "only applies to inbounds")
+	}
+	if !outbound && s.UserKeys && len(users) == 0 {
+		v.add(key+".user_keys", "requires auth users")
+	}
+	var passwords map[string]string
+	if s.UserKeys && !outbound {
+		passwords = make(map[string]string, len(users))
+		for _, user := range users {
+			passwords[user.Name] = user.Password
+		}
+	}
+	if _, err := shadowsocks.ParseKeys(s.Method, s.Password, passwords); err != nil {
+		v.add(key, "%v", err)
+	}
+}
+
+// validateAddress checks the address of a shadowsocks outbound without a URI
+func (s Shadowsocks) validateAddress(v *validator, key, address string) {
+	if s.URI != "" {
+		if address != "" {
+			v.add(key+".address", "cannot be combined with shadowsocks.uri")
+		}
+		return
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		v.add(key+".address", "invalid address %q", address)
+	}
+}
@@ -0,0 +1,139 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfig_Shadowsocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jadesocks-shadowsocks")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	passwordFile := filepath.Join(dir, "ss.key")
+	if err := ioutil.WriteFile(passwordFile, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	path := writeConfig(t, fmt.Sprintf(`[[inbounds]]
+name = "ss"
+type = "shadowsocks"
+listen = ":8388"
+udp = true
+
+[inbounds.shadowsocks]
+method = "chacha20-ietf-poly1305"
+password_file = %q
+
+[[inbounds]]
+name = "ss2022"
+type = "shadowsocks"
+listen = ":8389"
+
+[inbounds.shadowsocks]
+method = "2022-blake3-aes-128-gcm"
+password = "aWlpaWlpaWlpaWlpaWlpaQ=="
+user_keys = true
+
+[inbounds.auth]
+users = [{ name = "alice", password = "YWFhYWFhYWFhYWFhYWFhYQ==" }]
+
+[[outbounds]]
+name = "uri"
+type = "shadowsocks"
+
+[outbounds.shadowsocks]
+uri = "ss://YWVzLTI1Ni1nY206c2VjcmV0@203.0.113.1:8388#upstream"
+
+[[outbounds]]
+name = "keys"
+type = "shadowsocks"
+address = "ss.example.com:8388"
+
+[outbounds.shadowsocks]
+method = "2022-blake3-aes-128-gcm"
+password = "aWlpaWlpaWlpaWlpaWlpaQ==:YWFhYWFhYWFhYWFhYWFhYQ=="
+`, passwordFile))
+	defer os.RemoveAll(filepath.Dir(path))
+	conf := &Config{}
+	if err := conf.LoadConfig(path); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ss := conf.Inbounds[0].Shadowsocks; ss.Password != "s3cret" || !conf.Inbounds[0].UDP {
+		t.Fatalf("bad inbound shadowsocks %+v", ss)
+	}
+	if outbound := conf.Outbounds[1]; outbound.Address != "ss.example.com:8388" || outbound.Shadowsocks.Method != "2022-blake3-aes-128-gcm" {
+		t.Fatalf("bad outbound %+v", outbound)
+	}
+
+	path = writeConfig(t, `[[inbounds]]
+name = "a"
+listen = ":1080"
+udp = true
+
+[inbounds.shadowsocks]
+method = "aes-128-gcm"
+
+[[inbounds]]
+name = "b"
+type = "shadowsocks"
+listen = ":8388"
+
+[inbounds.shadowsocks]
+password = "s3cret"
+
+[[inbounds]]
+name = "c"
+type = "shadowsocks"
+listen = ":8389"
+
+[inbounds.shadowsocks]
+method = "rc4-md5"
+password = "s3cret"
+
+[[inbounds]]
+name = "d"
+type = "shadowsocks"
+listen = ":8390"
+
+[inbounds.shadowsocks]
+method = "2022-blake3-aes-128-gcm"
+password = "aWlpaWlpaWlpaWlpaWlpaQ=="
+user_keys = true
+
+[[outbounds]]
+name = "e"
+type = "shadowsocks"
+address = "ss.example.com:8388"
+
+[outbounds.shadowsocks]
+uri = "ss://YWVzLTI1Ni1nY206c2VjcmV0@203.0.113.1:8388/?plugin=obfs-local"
+
+[[outbounds]]
+name = "f"
+type = "shadowsocks"
+address = "ss.example.com:8388"
+proxy_protocol = 1
+
+[outbounds.shadowsocks]
+method = "2022-blake3-aes-256-gcm"
+password = "aWlpaWlpaWlpaWlpaWlpaQ=="
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+	err = (&Config{}).LoadConfig(path)
+	verr, ok := err.(*ValidationError)
+	if !ok || len(verr.Problems) != 9 {
+		t.Fatalf("bad error: %v", err)
+	}
+	for i, key := range []string{"inbounds[0].udp", "inbounds[0].shadowsocks", "inbounds[1].shadowsocks.method",
+		"inbounds[2].shadowsocks", "inbounds[3].shadowsocks.user_keys", "outbounds[0].address", "outbounds[0].shadowsocks.uri",
+		"outbounds[1].proxy_protocol", "outbounds[1].shadowsocks"} {
+		if verr.Problems[i].Key != key {
+			t.Fatalf("bad problem: %+v", verr.Problems[i])
+		}
+	}
+}
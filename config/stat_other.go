@@ -0,0 +1,10 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package config
+
+import "os"
+
+func inode(os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,153 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// ServerTLS serves an inbound over TLS, it is enabled when Cert is set
+type ServerTLS struct {
+	// Cert and Key are PEM files, they are read again when they change so
+	// that renewed certificates are used without a restart
+	Cert string `toml:"cert"`
+	Key  string `toml:"key"`
+	// MinVersion is 1.0, 1.1, 1.2 (the default) or 1.3
+	MinVersion string `toml:"min_version"`
+	// Ciphers are the names of the cipher suites offered up to TLS 1.2,
+	// such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, Go's defaults when empty
+	Ciphers []string `toml:"ciphers"`
+	// ClientCA is a PEM file of the authorities client certificates are
+	// verified against. Clients with a verified certificate authenticate as
+	// its subject common name, or its first subject alternative name.
+	ClientCA string `toml:"client_ca"`
+	// RequireClientCert refuses clients without a verified certificate
+	RequireClientCert bool `toml:"require_client_cert"`
+}
+
+// ClientTLS connects to an upstream server over TLS
+type ClientTLS struct {
+	Enabled bool `toml:"enabled"`
+	// ServerName is verified against the certificate of the server, the host
+	// of the address by default
+	ServerName string `toml:"server_name"`
+	// CA is a PEM file of the authorities the server certificate is verified
+	// against, the system ones by default
+	CA string `toml:"ca"`
+	// Cert and Key are the PEM files of a client certificate
+	Cert       string   `toml:"cert"`
+	Key        string   `toml:"key"`
+	MinVersion string   `toml:"min_version"`
+	Ciphers    []string `toml:"ciphers"`
+	// InsecureSkipVerify accepts any server certificate
+	InsecureSkipVerify bool `toml:"insecure_skip_verify"`
+}
+
+func (t ServerTLS) isSet() bool {
+	return t.Cert != "" || t.Key != "" || t.MinVersion != "" || len(t.Ciphers) > 0 || t.ClientCA != "" || t.RequireClientCert
+}
+
+func (t ClientTLS) isSet() bool {
+	return t.Enabled || t.ServerName != "" || t.CA != "" || t.Cert != "" || t.Key != "" || t.MinVersion != "" ||
+		len(t.Ciphers) > 0 || t.InsecureSkipVerify
+}
+
+// Config returns the TLS configuration of the inbound, nil when TLS is not
+// enabled. The certificate is checked but left to the caller, which reads it
+// again when it changes. The key of the failing setting is returned along
+// with an error.
+func (t ServerTLS) Config() (*tls.Config, string, error) {
+	if t.Cert == "" {
+		return nil, "", nil
+	}
+	config, key, err := baseConfig(t.MinVersion, t.Ciphers)
+	if err != nil {
+		return nil, key, err
+	}
+	if _, err := tls.LoadX509KeyPair(t.Cert, t.Key); err != nil {
+		return nil, "cert", err
+	}
+	if t.ClientCA != "" {
+		if config.ClientCAs, err = loadCertPool(t.ClientCA); err != nil {
+			return nil, "client_ca", err
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if t.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return config, "", nil
+}
+
+// Config returns the TLS configuration of the outbound, nil when TLS is not
+// enabled. The client certificate is checked but left to the caller. The key
+// of the failing setting is returned along with an error.
+func (t ClientTLS) Config() (*tls.Config, string, error) {
+	if !t.Enabled {
+		return nil, "", nil
+	}
+	config, key, err := baseConfig(t.MinVersion, t.Ciphers)
+	if err != nil {
+		return nil, key, err
+	}
+	config.ServerName = t.ServerName
+	config.InsecureSkipVerify = t.InsecureSkipVerify
+	if t.CA != "" {
+		if config.RootCAs, err = loadCertPool(t.CA); err != nil {
+			return nil, "ca", err
+		}
+	}
+	if t.Cert != "" {
+		if _, err := tls.LoadX509KeyPair(t.Cert, t.Key); err != nil {
+			return nil, "cert", err
+		}
+	}
+	return config, "", nil
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func baseConfig(minVersion string, ciphers []string) (*tls.Config, string, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if minVersion != "" {
+		version, ok := tlsVersions[minVersion]
+		if !ok {
+			return nil, "min_version", errors.New("must be 1.0, 1.1, 1.2 or 1.3")
+		}
+		config.MinVersion = version
+	}
+	if len(ciphers) > 0 {
+		ids := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			ids[suite.Name] = suite.ID
+		}
+		for _, name := range ciphers {
+			id, ok := ids[strings.ToUpper(name)]
+			if !ok {
+				return nil, "ciphers", fmt.Errorf("unknown or insecure cipher suite %q", name)
+			}
+			config.CipherSuites = append(config.CipherSuites, id)
+		}
+	}
+	return config, "", nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
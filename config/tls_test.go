@@ -0,0 +1,165 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self-signed certificate and its key to dir
+func writeCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "proxy.example.com"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return certFile, keyFile
+}
+
+func TestLoadConfig_TLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jadesocks-tls")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	cert, key := writeCertificate(t, dir)
+
+	path := writeConfig(t, fmt.Sprintf(`[[inbounds]]
+name = "tls"
+listen = ":1080"
+
+[inbounds.tls]
+cert = %q
+key = %q
+min_version = "1.3"
+ciphers = ["TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"]
+client_ca = %q
+require_client_cert = true
+
+[[outbounds]]
+name = "upstream"
+type = "socks5"
+address = "proxy.example.com:1080"
+
+[outbounds.tls]
+enabled = true
+ca = %q
+cert = %q
+key = %q
+`, cert, key, cert, cert, cert, key))
+	defer os.RemoveAll(filepath.Dir(path))
+	conf := &Config{}
+	if err := conf.LoadConfig(path); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	server, _, err := conf.Inbounds[0].TLS.Config()
+	if err != nil || server.MinVersion != tls.VersionTLS13 || len(server.CipherSuites) != 1 ||
+		server.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Fatalf("bad server config %+v: %v", server, err)
+	}
+	client, _, err := conf.Outbounds[0].TLS.Config()
+	if err != nil || client.MinVersion != tls.VersionTLS12 || client.RootCAs == nil {
+		t.Fatalf("bad client config %+v: %v", client, err)
+	}
+	if none, _, _ := (ServerTLS{}).Config(); none != nil {
+		t.Fatalf("expected TLS to be disabled")
+	}
+
+	path = writeConfig(t, fmt.Sprintf(`[[inbounds]]
+name = "a"
+listen = ":1080"
+
+[inbounds.tls]
+cert = %q
+key = %q
+min_version = "1.4"
+
+[[inbounds]]
+name = "b"
+listen = ":1081"
+
+[inbounds.tls]
+cert = %q
+key = %q
+ciphers = ["TLS_RSA_WITH_RC4_128_SHA"]
+require_client_cert = true
+
+[[inbounds]]
+name = "c"
+type = "forward"
+listen = ":5432"
+target = "db.internal:5432"
+
+[inbounds.tls]
+cert = %q
+
+[[outbounds]]
+name = "d"
+type = "direct"
+
+[outbounds.tls]
+enabled = true
+
+[[outbounds]]
+name = "e"
+type = "socks5"
+address = "proxy.example.com:1080"
+
+[outbounds.tls]
+server_name = "proxy"
+
+[[outbounds]]
+name = "f"
+type = "socks5"
+address = "proxy.example.com:1080"
+
+[outbounds.tls]
+enabled = true
+ca = %q
+`, cert, key, cert, key, cert, filepath.Join(dir, "missing.pem")))
+	defer os.RemoveAll(filepath.Dir(path))
+	err = (&Config{}).LoadConfig(path)
+	verr, ok := err.(*ValidationError)
+	if !ok || len(verr.Problems) != 7 {
+		t.Fatalf("bad error: %v", err)
+	}
+	for i, key := range []string{"inbounds[0].tls.min_version", "inbounds[1].tls.ciphers", "inbounds[1].tls.require_client_cert",
+		"inbounds[2].tls", "outbounds[0].tls", "outbounds[1].tls.enabled", "outbounds[2].tls.ca"} {
+		if verr.Problems[i].Key != key {
+			t.Fatalf("bad problem: %+v", verr.Problems[i])
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package config
+
+import "net"
+
+// Trojan is the fallback of a trojan inbound, whose clients authenticate
+// with the password of one of its auth users
+type Trojan struct {
+	// Fallback is the host:port of a web server that peers without the hash
+	// of a password are relayed to, they are answered with 400 Bad Request
+	// otherwise
+	Fallback string `toml:"fallback"`
+}
+
+func (t Trojan) isSet() bool {
+	return t.Fallback != ""
+}
+
+// validate checks the trojan settings of an inbound, applies tells whether
+// it is of type trojan and users are its auth users
+func (t Trojan) validate(v *validator, key string, applies bool, users []User) {
+	key += ".trojan"
+	if !applies {
+		if t.isSet() {
+			v.add(key, "only applies to trojan inbounds")
+		}
+		return
+	}
+	if t.Fallback != "" {
+		if _, _, err := net.SplitHostPort(t.Fallback); err != nil {
+			v.add(key+".fallback", "invalid address %q", t.Fallback)
+		}
+	}
+	if len(users) == 0 {
+		v.add(key, "requires auth users")
+		return
+	}
+	// clients are told apart by the hash of their password
+	owners := make(map[string]string, len(users))
+	for _, user := range users {
+		if other, ok := owners[user.Password]; ok {
+			v.add(key, "users %q and %q share a password", other, user.Name)
+			return
+		}
+		owners[user.Password] = user.Name
+	}
+}
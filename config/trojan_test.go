@@ -0,0 +1,107 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfig_Trojan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jadesocks-trojan")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	cert, key := writeCertificate(t, dir)
+	passwordFile := filepath.Join(dir, "trojan.pass")
+	if err := ioutil.WriteFile(passwordFile, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	path := writeConfig(t, fmt.Sprintf(`[[inbounds]]
+name = "trojan"
+type = "trojan"
+listen = ":443"
+
+[inbounds.tls]
+cert = %q
+key = %q
+
+[inbounds.trojan]
+fallback = "127.0.0.1:8080"
+
+[inbounds.auth]
+users = [{ name = "alice", password = "alice secret" }, { name = "bob", password = "bob secret" }]
+
+[[outbounds]]
+name = "upstream"
+type = "trojan"
+address = "trojan.example.com:443"
+password_file = %q
+
+[outbounds.tls]
+server_name = "proxy.example.com"
+ca = %q
+`, cert, key, passwordFile, cert))
+	defer os.RemoveAll(filepath.Dir(path))
+	conf := &Config{}
+	if err := conf.LoadConfig(path); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	inbound := conf.Inbounds[0]
+	if inbound.Trojan.Fallback != "127.0.0.1:8080" || len(inbound.Auth.Users) != 2 || inbound.Auth.Users[1].Password != "bob secret" {
+		t.Fatalf("bad inbound %+v", inbound)
+	}
+	if outbound := conf.Outbounds[0]; outbound.Password != "s3cret" || outbound.TLS.ServerName != "proxy.example.com" {
+		t.Fatalf("bad outbound %+v", outbound)
+	}
+
+	path = writeConfig(t, fmt.Sprintf(`[[inbounds]]
+name = "a"
+type = "trojan"
+listen = ":443"
+
+[inbounds.trojan]
+fallback = "nowhere"
+
+[[inbounds]]
+name = "b"
+type = "trojan"
+listen = ":8443"
+
+[inbounds.tls]
+cert = %q
+key = %q
+
+[inbounds.auth]
+methods = ["userpass"]
+users = [{ name = "alice", password = "secret" }, { name = "bob", password = "secret" }]
+
+[[inbounds]]
+name = "c"
+listen = ":1080"
+
+[inbounds.trojan]
+fallback = "127.0.0.1:8080"
+
+[[outbounds]]
+name = "d"
+type = "trojan"
+address = "trojan.example.com"
+proxy_protocol = 1
+`, cert, key))
+	defer os.RemoveAll(filepath.Dir(path))
+	err = (&Config{}).LoadConfig(path)
+	verr, ok := err.(*ValidationError)
+	if !ok || len(verr.Problems) != 9 {
+		t.Fatalf("bad error: %v", err)
+	}
+	for i, key := range []string{"inbounds[0].tls", "inbounds[0].trojan", "inbounds[0].trojan.fallback", "inbounds[1].trojan",
+		"inbounds[1].auth.methods", "inbounds[2].trojan", "outbounds[0].password", "outbounds[0].address", "outbounds[0].proxy_protocol"} {
+		if verr.Problems[i].Key != key {
+			t.Fatalf("bad problem: %+v", verr.Problems[i])
+		}
+	}
+}
@@ -0,0 +1,759 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/archervanderwaal/JadeSocks/routing"
+)
+
+// maxCredentialLength is the longest username or password RFC 1929 can carry
+const maxCredentialLength = 255
+
+// validator collects the problems of a configuration together with the line
+// of the offending key
+type validator struct {
+	err   *ValidationError
+	lines *locator
+}
+
+func (v *validator) add(key, format string, args ...interface{}) {
+	v.err.Problems = append(v.err.Problems, Problem{
+		Line:    v.lines.find(key),
+		Key:     key,
+		Message: fmt.Sprintf(format, args...),
+	})
+	sort.SliceStable(v.err.Problems, func(i, j int) bool {
+		return v.err.Problems[i].Line < v.err.Problems[j].Line
+	})
+}
+
+// names reports duplicate and empty names of a list of sections
+func (v *validator) names(section string, names []string) map[string]bool {
+	seen := make(map[string]bool, len(names))
+	for i, name := range names {
+		key := fmt.Sprintf("%s[%d].name", section, i)
+		switch {
+		case name == "":
+			v.add(key, "name is required")
+		case seen[name]:
+			v.add(key, "duplicate name %q", name)
+		}
+		seen[name] = true
+	}
+	return seen
+}
+
+func (conf *Config) validate(v *validator) {
+	if conf.Version < 0 || conf.Version > CurrentVersion {
+		v.add("version", "unsupported version %d, the newest supported is %d", conf.Version, CurrentVersion)
+	}
+	conf.validateInbounds(v)
+	validateAuth(v, "auth", conf.Auth, conf.Users)
+	validateRules(v, "", conf.Rules, conf.DefaultAction)
+	outbounds := conf.validateOutbounds(v)
+	conf.validateRoutes(v, outbounds)
+	conf.validateForwards(v, outbounds)
+	conf.validateAgents(v)
+	conf.validateResolvers(v)
+
+	negative := []struct {
+		key   string
+		value int64
+	}{
+		{"dns_cache_ttl", int64(conf.DNSCacheTTL)},
+		{"timeouts.handshake", int64(conf.Timeouts.Handshake.Duration)},
+		{"timeouts.dial", int64(conf.Timeouts.Dial.Duration)},
+		{"timeouts.idle", int64(conf.Timeouts.Idle.Duration)},
+		{"limits.max_connections", int64(conf.Limits.MaxConnections)},
+		{"limits.max_connections_per_ip", int64(conf.Limits.MaxConnectionsPerIP)},
+		{"limits.ban_after_auth_failures", int64(conf.Limits.BanAfterAuthFailures)},
+		{"limits.ban_duration", int64(conf.Limits.BanDuration.Duration)},
+	}
+	for _, setting := range negative {
+		if setting.value < 0 {
+			v.add(setting.key, "must not be negative")
+		}
+	}
+
+	if conf.MetricsAddr != "" {
+		if err := checkListenAddr(conf.MetricsAddr); err != nil {
+			v.add("metrics", "%v", err)
+		}
+	}
+	if conf.Admin.Listen != "" {
+		if !strings.HasPrefix(conf.Admin.Listen, UnixPrefix) {
+			if err := checkListenAddr(conf.Admin.Listen); err != nil {
+				v.add("admin.listen", "%v", err)
+			}
+			if conf.Admin.Token == "" {
+				v.add("admin.token", "a token is required unless the admin API listens on a unix socket")
+			}
+		}
+	}
+	switch conf.AccessLog.Format {
+	case "", "json", "logfmt":
+	default:
+		v.add("access_log.format", "must be json or logfmt")
+	}
+	conf.Log.validate(v)
+}
+
+func (inbound Inbound) validateTransparent(v *validator, key string) {
+	if strings.HasPrefix(inbound.Listen, UnixPrefix) {
+		v.add(key+".listen", "transparent inbounds listen on a TCP address")
+	}
+	if inbound.Auth.isSet() {
+		v.add(key+".auth", "transparent inbounds serve clients without authentication")
+	}
+	switch inbound.Mode {
+	case "", "redirect":
+		if inbound.UDP {
+			v.add(key+".udp", "requires mode tproxy")
+		}
+	case "tproxy":
+		if inbound.UDP && strings.HasPrefix(inbound.Listen, SystemdPrefix) {
+			v.add(key+".udp", "cannot be combined with a socket passed by systemd")
+		}
+	default:
+		v.add(key+".mode", "must be redirect or tproxy")
+	}
+}
+
+// validateForward checks the target of a forward inbound, its outbound is
+// checked with the outbounds
+func (inbound Inbound) validateForward(v *validator, key string) {
+	if inbound.Auth.isSet() {
+		v.add(key+".auth", "forward inbounds serve clients without authentication")
+	}
+	if inbound.Target == "" {
+		v.add(key+".target", "forward inbounds require a target")
+	} else if err := checkTarget(inbound.Target); err != nil {
+		v.add(key+".target", "%v", err)
+	}
+	if inbound.UDP && (strings.HasPrefix(inbound.Listen, UnixPrefix) || strings.HasPrefix(inbound.Listen, SystemdPrefix)) {
+		v.add(key+".udp", "requires a TCP listen address")
+	}
+}
+
+func (inbound Inbound) validateTLS(v *validator, key string) {
+	t := inbound.TLS
+	if !t.isSet() {
+		return
+	}
+	key += ".tls"
+	switch inbound.Type {
+	case "", "socks5", "http", "trojan":
+	default:
+		v.add(key, "only applies to socks5, http and trojan inbounds")
+		return
+	}
+	if t.Cert == "" || t.Key == "" {
+		v.add(key, "cert and key are required")
+		return
+	}
+	if t.RequireClientCert && t.ClientCA == "" {
+		v.add(key+".require_client_cert", "requires client_ca")
+	}
+	if _, field, err := t.Config(); err != nil {
+		v.add(key+"."+field, "%v", err)
+	}
+}
+
+func (outbound Outbound) validateTLS(v *validator, key string) {
+	t := outbound.TLS
+	if !t.isSet() {
+		return
+	}
+	key += ".tls"
+	switch outbound.Type {
+	case "socks5":
+	case "trojan":
+		// always over TLS
+		t.Enabled = true
+	default:
+		v.add(key, "only applies to socks5 and trojan outbounds")
+		return
+	}
+	if !t.Enabled {
+		v.add(key+".enabled", "must be true for the other tls settings to apply")
+		return
+	}
+	if (t.Cert == "") != (t.Key == "") {
+		v.add(key, "cert and key must be set together")
+		return
+	}
+	if _, field, err := t.Config(); err != nil {
+		v.add(key+"."+field, "%v", err)
+	}
+}
+
+func (conf *Config) validateForwards(v *validator, outbounds map[string]bool) {
+	for i, inbound := range conf.Inbounds {
+		if inbound.Outbound != "" && !outbounds[inbound.Outbound] {
+			v.add(fmt.Sprintf("inbounds[%d].outbound", i), "unknown outbound %q", inbound.Outbound)
+		}
+	}
+}
+
+// acceptsAgents reports whether a socks5 inbound accepts agents
+func (conf *Config) acceptsAgents() bool {
+	for _, inbound := range conf.Inbounds {
+		if inbound.Agents && (inbound.Type == "" || inbound.Type == "socks5") {
+			return true
+		}
+	}
+	return false
+}
+
+func (conf *Config) validateAgents(v *validator) {
+	names := make([]string, len(conf.Agents))
+	for i, agent := range conf.Agents {
+		names[i] = agent.Name
+		key := fmt.Sprintf("agents[%d]", i)
+		if err := checkTarget(agent.Server); err != nil {
+			v.add(key+".server", "%v", err)
+		}
+		if len(agent.Username) == 0 || len(agent.Username) > maxCredentialLength {
+			v.add(key+".username", "must be 1 to %d bytes", maxCredentialLength)
+		}
+		if len(agent.Password) > maxCredentialLength {
+			v.add(key+".password", "must be at most %d bytes", maxCredentialLength)
+		}
+		if agent.MaxBackoff.Duration < 0 {
+			v.add(key+".max_backoff", "must not be negative")
+		}
+		validateRules(v, key+".", agent.Rules, agent.DefaultAction)
+	}
+	v.names("agents", names)
+}
+
+func (conf *Config) validateInbounds(v *validator) {
+	if conf.ListenAddr != "" {
+		if len(conf.Inbounds) > 0 {
+			v.add("listen", "listen cannot be combined with inbounds")
+		} else if err := checkInboundListen(conf.ListenAddr); err != nil {
+			v.add("listen", "%v", err)
+		}
+	}
+	names := make([]string, len(conf.Inbounds))
+	for i, inbound := range conf.Inbounds {
+		names[i] = inbound.Name
+		key := fmt.Sprintf("inbounds[%d]", i)
+		if err := checkInboundListen(inbound.Listen); err != nil {
+			v.add(key+".listen", "%v", err)
+		}
+		unix := strings.HasPrefix(inbound.Listen, UnixPrefix)
+		if inbound.SocketMode != "" {
+			if !unix {
+				v.add(key+".socket_mode", "only applies to unix sockets")
+			} else if _, err := parseSocketMode(inbound.SocketMode); err != nil {
+				v.add(key+".socket_mode", "%v", err)
+			}
+		}
+		if inbound.SocketOwner != "" && !unix {
+			v.add(key+".socket_owner", "only applies to unix sockets")
+		}
+		for j, proxy := range inbound.TrustedProxies {
+			if _, err := routing.ParseCIDR(proxy); err != nil {
+				v.add(fmt.Sprintf("%s.trusted_proxies[%d]", key, j), "%v", err)
+			}
+		}
+		if len(inbound.TrustedProxies) > 0 && (unix || inbound.Type == "transparent") {
+			v.add(key+".trusted_proxies", "does not apply to unix sockets and transparent inbounds")
+		}
+		switch inbound.Type {
+		case "", "socks5", "http":
+		case "transparent":
+			inbound.validateTransparent(v, key)
+		case "forward":
+			inbound.validateForward(v, key)
+		case "shadowsocks":
+			if len(inbound.Auth.Methods) > 0 {
+				v.add(key+".auth.methods", "do not apply to shadowsocks inbounds, clients authenticate with their keys")
+			}
+		case "trojan":
+			if len(inbound.Auth.Methods) > 0 {
+				v.add(key+".auth.methods", "do not apply to trojan inbounds, clients authenticate with their passwords")
+			}
+			if inbound.TLS.Cert == "" {
+				v.add(key+".tls", "is required by trojan inbounds")
+			}
+		default:
+			v.add(key+".type", "unknown type %q, must be socks5, http, transparent, forward, shadowsocks or trojan", inbound.Type)
+		}
+		if inbound.Type != "transparent" && inbound.Mode != "" {
+			v.add(key+".mode", "only applies to transparent inbounds")
+		}
+		if inbound.Type != "transparent" && inbound.Type != "forward" && inbound.Type != "shadowsocks" && inbound.UDP {
+			v.add(key+".udp", "only applies to transparent, forward and shadowsocks inbounds")
+		}
+		if inbound.Type == "shadowsocks" && inbound.UDP && strings.HasPrefix(inbound.Listen, SystemdPrefix) {
+			v.add(key+".udp", "cannot be combined with a socket passed by systemd")
+		}
+		inbound.validateTLS(v, key)
+		if inbound.Transport == "ws" && inbound.Type != "" && inbound.Type != "socks5" {
+			v.add(key+".transport", "ws only applies to socks5 inbounds")
+		}
+		inbound.WebSocket.validate(v, key, inbound.Transport, false)
+		inbound.Mux.validate(v, key, inbound.Type == "" || inbound.Type == "socks5", false)
+		inbound.Obfs.validate(v, key, inbound.Type == "" || inbound.Type == "socks5", false)
+		users := conf.inboundUsers(inbound)
+		if inbound.Obfs.UserKeys && len(users) == 0 {
+			v.add(key+".obfs.user_keys", "requires auth users")
+		}
+		inbound.Shadowsocks.validate(v, key, inbound.Type == "shadowsocks", false, users)
+		inbound.Trojan.validate(v, key, inbound.Type == "trojan", users)
+		if inbound.Agents && inbound.Type != "" && inbound.Type != "socks5" {
+			v.add(key+".agents", "only applies to socks5 inbounds")
+		}
+		if inbound.Type != "forward" {
+			if inbound.Target != "" {
+				v.add(key+".target", "only applies to forward inbounds")
+			}
+			if inbound.Outbound != "" {
+				v.add(key+".outbound", "only applies to forward inbounds")
+			}
+		}
+		switch inbound.Network {
+		case "", "tcp", "tcp4", "tcp6":
+		default:
+			v.add(key+".network", "must be tcp, tcp4 or tcp6")
+		}
+		validateAuth(v, key+".auth", inbound.Auth, nil)
+		validateRules(v, key+".", inbound.Rules, inbound.DefaultAction)
+	}
+	v.names("inbounds", names)
+}
+
+// inboundUsers returns the auth users of an inbound, which inherits those at
+// the top of the file unless it has an auth table of its own
+func (conf *Config) inboundUsers(inbound Inbound) []User {
+	if inbound.Auth.isSet() {
+		return inbound.Auth.Users
+	}
+	users := append([]User(nil), conf.Auth.Users...)
+	for name, password := range conf.Users {
+		users = append(users, User{Name: name, Password: password})
+	}
+	return users
+}
+
+// validateAuth checks an auth table, users are the shorthand form at the top
+// of the file
+func validateAuth(v *validator, key string, auth Auth, users map[string]string) {
+	userpass := len(auth.Methods) == 0
+	for i, method := range auth.Methods {
+		switch method {
+		case "none":
+		case "userpass":
+			userpass = true
+		default:
+			v.add(fmt.Sprintf("%s.methods[%d]", key, i), "unknown method %q, must be none or userpass", method)
+		}
+	}
+	seen := make(map[string]bool)
+	for name, password := range users {
+		if len(name) == 0 || len(name) > maxCredentialLength || len(password) > maxCredentialLength {
+			v.add("users."+name, "user names and passwords must be 1 to %d bytes", maxCredentialLength)
+		}
+		seen[name] = true
+	}
+	for i, user := range auth.Users {
+		userKey := fmt.Sprintf("%s.users[%d]", key, i)
+		switch {
+		case len(user.Name) == 0 || len(user.Name) > maxCredentialLength:
+			v.add(userKey+".name", "must be 1 to %d bytes", maxCredentialLength)
+		case seen[user.Name]:
+			v.add(userKey+".name", "duplicate user %q", user.Name)
+		}
+		if len(user.Password) > maxCredentialLength {
+			v.add(userKey+".password", "must be at most %d bytes", maxCredentialLength)
+		}
+		seen[user.Name] = true
+	}
+	if userpass && len(auth.Methods) > 0 && len(seen) == 0 {
+		v.add(key+".methods", "userpass needs at least one user")
+	}
+}
+
+// validateRules checks a rule list, prefix is "" at the top of the file and
+// the key of the inbound with a trailing dot otherwise
+func validateRules(v *validator, prefix string, rules []Rule, defaultAction string) {
+	names := make([]string, len(rules))
+	for i, rule := range rules {
+		names[i] = rule.Name
+		key := fmt.Sprintf("%srules[%d]", prefix, i)
+		switch rule.Action {
+		case "allow", "deny":
+		default:
+			v.add(key+".action", "must be allow or deny")
+		}
+		rule.Match.validate(v, key)
+	}
+	v.names(prefix+"rules", names)
+	switch defaultAction {
+	case "", "allow", "deny":
+	default:
+		v.add(prefix+"default_action", "must be allow or deny")
+	}
+}
+
+// validateOutbounds returns the names of all outbounds routes may refer to
+func (conf *Config) validateOutbounds(v *validator) map[string]bool {
+	names := make([]string, len(conf.Outbounds))
+	for i, outbound := range conf.Outbounds {
+		names[i] = outbound.Name
+		key := fmt.Sprintf("outbounds[%d]", i)
+		switch outbound.Type {
+		case "direct", "reject":
+		case "socks5":
+			if _, _, err := net.SplitHostPort(outbound.Address); err != nil {
+				v.add(key+".address", "invalid address %q", outbound.Address)
+			}
+		case "shadowsocks":
+			outbound.Shadowsocks.validateAddress(v, key, outbound.Address)
+		case "trojan":
+			if _, _, err := net.SplitHostPort(outbound.Address); err != nil {
+				v.add(key+".address", "invalid address %q", outbound.Address)
+			}
+			if outbound.Password == "" {
+				v.add(key+".password", "is required by trojan outbounds")
+			}
+			if outbound.Username != "" {
+				v.add(key+".username", "does not apply to trojan outbounds")
+			}
+		case "reverse":
+			if outbound.Agent == "" {
+				v.add(key+".agent", "reverse outbounds require an agent")
+			} else if !conf.acceptsAgents() {
+				v.add(key+".agent", "requires a socks5 inbound with agents enabled")
+			}
+		default:
+			v.add(key+".type", "unknown type %q, must be direct, socks5, shadowsocks, trojan, reject or reverse", outbound.Type)
+		}
+		if outbound.Type != "reverse" && outbound.Agent != "" {
+			v.add(key+".agent", "only applies to reverse outbounds")
+		}
+		if len(outbound.Username) > maxCredentialLength || len(outbound.Password) > maxCredentialLength {
+			v.add(key+".username", "username and password must be at most %d bytes", maxCredentialLength)
+		}
+		switch {
+		case outbound.ProxyProtocol == 0:
+		case outbound.Type == "reject" || outbound.Type == "reverse" || outbound.Type == "shadowsocks" || outbound.Type == "trojan":
+			v.add(key+".proxy_protocol", "does not apply to reject, reverse, shadowsocks and trojan outbounds")
+		case outbound.ProxyProtocol != 1 && outbound.ProxyProtocol != 2:
+			v.add(key+".proxy_protocol", "must be 1 or 2")
+		}
+		outbound.validateSocketOptions(v, key)
+		outbound.validateTLS(v, key)
+		if outbound.Type != "socks5" && (outbound.Transport == "ws" || outbound.HTTPProxy != "") {
+			v.add(key+".type", "transport ws and http_proxy only apply to socks5 outbounds")
+		}
+		outbound.WebSocket.validate(v, key, outbound.Transport, true)
+		outbound.Mux.validate(v, key, outbound.Type == "socks5", true)
+		outbound.Obfs.validate(v, key, outbound.Type == "socks5", true)
+		outbound.Shadowsocks.validate(v, key, outbound.Type == "shadowsocks", true, nil)
+		if outbound.HTTPProxy != "" {
+			if _, err := parseHTTPProxy(outbound.HTTPProxy); err != nil {
+				v.add(key+".http_proxy", "%v", err)
+			}
+		}
+	}
+	known := v.names("outbounds", names)
+	known[routing.DirectOutboundName] = true
+	known[routing.RejectOutboundName] = true
+	return known
+}
+
+func (outbound Outbound) validateSocketOptions(v *validator, key string) {
+	checkIPs := func(key string, ips []string) {
+		for i, ip := range ips {
+			if net.ParseIP(ip) == nil {
+				v.add(fmt.Sprintf("%s[%d]", key, i), "invalid IP address %q", ip)
+			}
+		}
+	}
+	checkIPs(key+".source_ips", outbound.SourceIPs)
+	for _, user := range sortedStrings(outbound.UserSourceIPs) {
+		checkIPs(key+".user_source_ips."+user, outbound.UserSourceIPs[user])
+	}
+	if outbound.Mark < 0 {
+		v.add(key+".mark", "must not be negative")
+	}
+	set := len(outbound.SourceIPs) > 0 || len(outbound.UserSourceIPs) > 0 || outbound.Interface != "" ||
+		outbound.Mark != 0 || outbound.KeepAlive.Duration != 0 || outbound.Nagle || outbound.FastOpen
+	if set && (outbound.Type == "reject" || outbound.Type == "reverse") {
+		v.add(key+".type", "socket options do not apply to reject and reverse outbounds")
+	}
+}
+
+func sortedStrings(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (conf *Config) validateRoutes(v *validator, outbounds map[string]bool) {
+	names := make([]string, len(conf.Routes))
+	for i, route := range conf.Routes {
+		names[i] = route.Name
+		key := fmt.Sprintf("routes[%d]", i)
+		if !outbounds[route.Outbound] {
+			v.add(key+".outbound", "unknown outbound %q", route.Outbound)
+		}
+		route.Match.validate(v, key)
+	}
+	v.names("routes", names)
+	if conf.DefaultOutbound != "" && !outbounds[conf.DefaultOutbound] {
+		v.add("default_outbound", "unknown outbound %q", conf.DefaultOutbound)
+	}
+}
+
+func (conf *Config) validateResolvers(v *validator) {
+	names := make([]string, len(conf.Resolvers))
+	for i, resolver := range conf.Resolvers {
+		names[i] = resolver.Name
+		key := fmt.Sprintf("resolvers[%d]", i)
+		switch resolver.Type {
+		case "", "system":
+			if len(resolver.Servers) > 0 {
+				v.add(key+".servers", "servers are only used by the dns type")
+			}
+		case "dns":
+			if len(resolver.Servers) == 0 {
+				v.add(key+".servers", "at least one server is required")
+			}
+			for _, server := range resolver.Servers {
+				if !validServer(server) {
+					v.add(key+".servers", "invalid server %q", server)
+				}
+			}
+		default:
+			v.add(key+".type", "unknown type %q, must be system or dns", resolver.Type)
+		}
+		if resolver.Timeout.Duration < 0 {
+			v.add(key+".timeout", "must not be negative")
+		}
+		if resolver.CacheTTL.Duration < 0 {
+			v.add(key+".cache_ttl", "must not be negative")
+		}
+	}
+	known := v.names("resolvers", names)
+	if conf.Resolver != "" && !known[conf.Resolver] {
+		v.add("resolver", "unknown resolver %q", conf.Resolver)
+	}
+}
+
+func (log *Log) validate(v *validator) {
+	switch log.Level {
+	case "", "debug", "info", "warn", "error":
+	default:
+		v.add("log.level", "must be debug, info, warn or error")
+	}
+	for _, output := range log.Outputs {
+		switch output {
+		case "console", "file", "syslog", "none":
+		default:
+			v.add("log.outputs", "may only contain console, file, syslog or none")
+		}
+	}
+	if log.MaxSize < 0 {
+		v.add("log.max_size", "must not be negative")
+	}
+	if log.MaxAge < 0 {
+		v.add("log.max_age", "must not be negative")
+	}
+}
+
+func (m *Match) validate(v *validator, key string) {
+	for _, name := range m.Commands {
+		if _, err := routing.ParseCommand(name); err != nil {
+			v.add(key+".commands", "%v", err)
+			return
+		}
+	}
+	for _, cidr := range m.CIDRs {
+		if _, err := routing.ParseCIDR(cidr); err != nil {
+			v.add(key+".cidrs", "%v", err)
+			return
+		}
+	}
+	for _, port := range m.Ports {
+		if _, err := routing.ParsePortRange(port); err != nil {
+			v.add(key+".ports", "%v", err)
+			return
+		}
+	}
+	for _, domain := range m.Domains {
+		if err := routing.CheckDomain(domain); err != nil {
+			v.add(key+".domains", "%v", err)
+			return
+		}
+	}
+}
+
+// checkInboundListen accepts the TCP, unix and systemd listen addresses of
+// inbounds
+func checkInboundListen(addr string) error {
+	for _, prefix := range []string{UnixPrefix, SystemdPrefix} {
+		if strings.HasPrefix(addr, prefix) {
+			if addr == prefix {
+				return fmt.Errorf("missing name after %q", prefix)
+			}
+			return nil
+		}
+	}
+	return checkListenAddr(addr)
+}
+
+func parseSocketMode(mode string) (os.FileMode, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || perm > 0777 {
+		return 0, fmt.Errorf("invalid mode %q, must be octal permissions such as 0660", mode)
+	}
+	return os.FileMode(perm), nil
+}
+
+func checkListenAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid listen address %q", addr)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("invalid port in listen address %q", addr)
+	}
+	return nil
+}
+
+func checkTarget(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return fmt.Errorf("invalid target %q, must be host:port", addr)
+	}
+	if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 {
+		return fmt.Errorf("invalid port in target %q", addr)
+	}
+	return nil
+}
+
+// validServer accepts an address with or without a port
+func validServer(server string) bool {
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		host, port = server, "53"
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return false
+	}
+	return host != "" && !strings.ContainsAny(host, " /")
+}
+
+var (
+	arrayHeader = regexp.MustCompile(`^\[\[\s*([^\]]+?)\s*\]\]`)
+	tableHeader = regexp.MustCompile(`^\[\s*([^\]]+?)\s*\]`)
+	keyLine     = regexp.MustCompile(`^((?:"[^"]*"|'[^']*'|[A-Za-z0-9_-]+)(?:\s*\.\s*(?:"[^"]*"|'[^']*'|[A-Za-z0-9_-]+))*)\s*=`)
+	keyPart     = regexp.MustCompile(`"[^"]*"|'[^']*'|[A-Za-z0-9_-]+`)
+	arrayIndex  = regexp.MustCompile(`\[\d+\]`)
+)
+
+// locator maps keys such as "rules[2].cidrs" to the line they are set on.
+// It only scans table headers and assignments, which is enough for files the
+// TOML decoder accepted.
+type locator struct {
+	lines map[string]int
+}
+
+func newLocator(text string) *locator {
+	l := &locator{lines: make(map[string]int)}
+	// current is the index of the latest table of each array of tables, so
+	// that [[inbounds.rules]] is placed under the inbound it follows
+	current := make(map[string]int)
+	counts := make(map[string]int)
+	resolve := func(name string) string {
+		key, plain := "", ""
+		parts := splitKey(name)
+		for i, part := range parts {
+			key, plain = joinKey(key, part), joinKey(plain, part)
+			if index, ok := current[plain]; ok && i < len(parts)-1 {
+				key = fmt.Sprintf("%s[%d]", key, index)
+			}
+		}
+		return key
+	}
+	table := ""
+	depth := 0
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		// skip the continuation lines of multi-line arrays
+		if depth > 0 {
+			depth += strings.Count(line, "[") - strings.Count(line, "]")
+			continue
+		}
+		if m := arrayHeader.FindStringSubmatch(line); m != nil {
+			array := resolve(m[1])
+			current[m[1]] = counts[array]
+			counts[array]++
+			table = fmt.Sprintf("%s[%d]", array, current[m[1]])
+			l.set(table, i+1)
+			continue
+		}
+		if m := tableHeader.FindStringSubmatch(line); m != nil {
+			table = resolve(m[1])
+			l.set(table, i+1)
+			continue
+		}
+		if m := keyLine.FindStringSubmatch(line); m != nil {
+			// a dotted key such as limits.ban_duration also sets its parents
+			key := table
+			for _, part := range splitKey(m[1]) {
+				key = joinKey(key, part)
+				l.set(key, i+1)
+			}
+			value := line[len(m[0]):]
+			depth = strings.Count(value, "[") - strings.Count(value, "]")
+		}
+	}
+	return l
+}
+
+// splitKey splits a dotted TOML key into its parts without their quotes
+func splitKey(key string) []string {
+	parts := keyPart.FindAllString(key, -1)
+	for i, part := range parts {
+		parts[i] = strings.Trim(part, `"'`)
+	}
+	return parts
+}
+
+func (l *locator) set(key string, line int) {
+	for _, k := range []string{key, arrayIndex.ReplaceAllString(key, "")} {
+		if _, ok := l.lines[k]; !ok {
+			l.lines[k] = line
+		}
+	}
+}
+
+// find returns the line of key, or of its closest parent that is set in the
+// file, and 0 when neither is
+func (l *locator) find(key string) int {
+	for key != "" {
+		if line, ok := l.lines[key]; ok {
+			return line
+		}
+		i := strings.LastIndexAny(key, ".[")
+		if i < 0 {
+			break
+		}
+		key = key[:i]
+	}
+	return 0
+}
@@ -0,0 +1,94 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// watchDebounce groups the bursts of events editors produce when saving
+	watchDebounce = 250 * time.Millisecond
+	// watchPollInterval is used where file system notifications are not
+	// available
+	watchPollInterval = 2 * time.Second
+)
+
+// Watch calls onChange whenever the file at path is written, replaced or
+// re-linked, until stop is closed. The parent directory is watched rather than
+// the file itself, so editors that save by renaming and symlink swaps as done
+// by Kubernetes config maps are noticed too.
+func Watch(path string, onChange func(), stop <-chan struct{}) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	w := &watcher{path: abs, onChange: onChange, last: stat(abs)}
+	events, err := notify(filepath.Dir(abs), stop)
+	if err != nil {
+		return err
+	}
+	go w.run(events, stop)
+	return nil
+}
+
+type fileState struct {
+	exists  bool
+	size    int64
+	modTime time.Time
+	inode   uint64
+}
+
+func stat(path string) fileState {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileState{}
+	}
+	return fileState{exists: true, size: fi.Size(), modTime: fi.ModTime(), inode: inode(fi)}
+}
+
+type watcher struct {
+	path     string
+	onChange func()
+	last     fileState
+}
+
+// run compares the file with its last known state after every batch of
+// events, events is nil when the platform only supports polling
+func (w *watcher) run(events <-chan struct{}, stop <-chan struct{}) {
+	var poll <-chan time.Time
+	if events == nil {
+		ticker := time.NewTicker(watchPollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-stop:
+			return
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+			debounce = time.After(watchDebounce)
+		case <-poll:
+			w.check()
+		case <-debounce:
+			debounce = nil
+			w.check()
+		}
+	}
+}
+
+func (w *watcher) check() {
+	current := stat(w.path)
+	if current == w.last {
+		return
+	}
+	w.last = current
+	// a file that is being replaced may briefly not exist
+	if current.exists {
+		w.onChange()
+	}
+}
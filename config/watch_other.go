@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package config
+
+// notify is not implemented on this platform, Watch falls back to polling
+func notify(string, <-chan struct{}) (<-chan struct{}, error) {
+	return nil, nil
+}
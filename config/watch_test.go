@@ -0,0 +1,48 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jadesocks-watch")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "JadeSocks.toml")
+	if err := ioutil.WriteFile(path, []byte(`listen = ":1080"`), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	changed := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	onChange := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+	if err := Watch(path, onChange, stop); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// replace the file the way editors do, by writing a new one and renaming
+	tmp := filepath.Join(dir, ".JadeSocks.toml.swp")
+	if err := ioutil.WriteFile(tmp, []byte(`listen = ":1081"`), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case <-changed:
+	case <-time.After(2*watchPollInterval + time.Second):
+		t.Fatalf("change was not noticed")
+	}
+}
@@ -0,0 +1,78 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// WebSocket configures the ws transport of socks5 inbounds and outbounds,
+// wss is ws over TLS
+type WebSocket struct {
+	// Path is the path of the upgrade request, "/" by default
+	Path string `toml:"path"`
+	// Host and Headers are the Host header and the extra headers outbounds
+	// send, the host of the address by default
+	Host    string            `toml:"host"`
+	Headers map[string]string `toml:"headers"`
+	// Decoy is an HTML file inbounds answer other HTTP requests with, a
+	// placeholder page by default
+	Decoy string `toml:"decoy"`
+}
+
+func (ws WebSocket) isSet() bool {
+	return ws.Path != "" || ws.Host != "" || len(ws.Headers) > 0 || ws.Decoy != ""
+}
+
+// validate checks the transport and websocket settings, outbound tells which
+// side they belong to
+func (ws WebSocket) validate(v *validator, key, transport string, outbound bool) {
+	switch transport {
+	case "", "tcp":
+		if ws.isSet() {
+			v.add(key+".websocket", "only applies to the ws transport")
+		}
+		return
+	case "ws":
+	default:
+		v.add(key+".transport", "must be tcp or ws")
+		return
+	}
+	if ws.Path != "" && !strings.HasPrefix(ws.Path, "/") {
+		v.add(key+".websocket.path", "must start with /")
+	}
+	if outbound && ws.Decoy != "" {
+		v.add(key+".websocket.decoy", "only applies to inbounds")
+	}
+	if !outbound && (ws.Host != "" || len(ws.Headers) > 0) {
+		v.add(key+".websocket", "host and headers only apply to outbounds")
+	}
+	if ws.Decoy != "" {
+		if _, err := ioutil.ReadFile(ws.Decoy); err != nil {
+			v.add(key+".websocket.decoy", "%v", err)
+		}
+	}
+}
+
+// ProxyURL returns the HTTP proxy of the outbound, nil when it has none. The
+// outbound must have been validated.
+func (outbound Outbound) ProxyURL() *url.URL {
+	if outbound.HTTPProxy == "" {
+		return nil
+	}
+	proxy, _ := parseHTTPProxy(outbound.HTTPProxy)
+	return proxy
+}
+
+func parseHTTPProxy(s string) (*url.URL, error) {
+	proxy, err := url.Parse(s)
+	if err != nil || proxy.Scheme != "http" || proxy.Host == "" || (proxy.Path != "" && proxy.Path != "/") {
+		return nil, fmt.Errorf("invalid HTTP proxy %q, must be http://[user:password@]host:port", s)
+	}
+	if _, _, err := net.SplitHostPort(proxy.Host); err != nil {
+		return nil, fmt.Errorf("invalid HTTP proxy %q, must be http://[user:password@]host:port", s)
+	}
+	return proxy, nil
+}
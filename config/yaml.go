@@ -0,0 +1,139 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// maxYAMLNodes bounds the nodes of a document once its aliases are expanded,
+// so that aliases of aliases cannot blow it up
+const maxYAMLNodes = 100000
+
+// yamlErrorLine is how the YAML decoder starts the errors it knows the line of
+var yamlErrorLine = regexp.MustCompile(`^yaml: line (\d+): `)
+
+type yamlError struct {
+	line int
+	msg  string
+}
+
+func (e *yamlError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.line, e.msg)
+}
+
+// parseYAML returns the document as nested map[string]interface{},
+// []interface{} and string values together with the line of every key.
+// Aliases are expanded and merge keys applied, scalars are left as text
+// whatever their tag.
+func parseYAML(text string) (interface{}, *locator, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(text), &doc); err != nil {
+		msg := err.Error()
+		if m := yamlErrorLine.FindStringSubmatch(msg); m != nil {
+			line, _ := strconv.Atoi(m[1])
+			return nil, nil, &yamlError{line, msg[len(m[0]):]}
+		}
+		return nil, nil, &yamlError{0, msg}
+	}
+	w := &yamlWalker{loc: &locator{lines: make(map[string]int)}, expanding: make(map[*yaml.Node]bool)}
+	if len(doc.Content) == 0 {
+		return nil, w.loc, nil
+	}
+	tree, err := w.walk("", doc.Content[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	return tree, w.loc, nil
+}
+
+type yamlWalker struct {
+	loc   *locator
+	nodes int
+	// expanding are the anchors whose aliases are being expanded
+	expanding map[*yaml.Node]bool
+}
+
+func (w *yamlWalker) walk(key string, node *yaml.Node) (interface{}, error) {
+	w.nodes++
+	if w.nodes > maxYAMLNodes {
+		return nil, &yamlError{node.Line, "too many nodes once aliases are expanded"}
+	}
+	switch node.Kind {
+	case yaml.AliasNode:
+		if w.expanding[node.Alias] {
+			return nil, &yamlError{node.Line, fmt.Sprintf("alias %s refers to itself", node.Value)}
+		}
+		w.expanding[node.Alias] = true
+		defer delete(w.expanding, node.Alias)
+		return w.walk(key, node.Alias)
+	case yaml.ScalarNode:
+		if node.ShortTag() == "!!null" {
+			return nil, nil
+		}
+		return node.Value, nil
+	case yaml.SequenceNode:
+		items := make([]interface{}, 0, len(node.Content))
+		for i, item := range node.Content {
+			itemKey := fmt.Sprintf("%s[%d]", key, i)
+			w.loc.set(itemKey, item.Line)
+			value, err := w.walk(itemKey, item)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, value)
+		}
+		return items, nil
+	case yaml.MappingNode:
+		return w.mapping(key, node)
+	}
+	return nil, &yamlError{node.Line, "unexpected document"}
+}
+
+// mapping returns the entries of node, those set in the mapping itself take
+// precedence over those of merge keys
+func (w *yamlWalker) mapping(key string, node *yaml.Node) (map[string]interface{}, error) {
+	table := make(map[string]interface{}, len(node.Content)/2)
+	var merges []*yaml.Node
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		name, value := node.Content[i], node.Content[i+1]
+		if name.ShortTag() == "!!merge" {
+			merges = append(merges, value)
+			continue
+		}
+		if name.Kind != yaml.ScalarNode {
+			return nil, &yamlError{name.Line, "keys must be scalars"}
+		}
+		entryKey := joinKey(key, name.Value)
+		w.loc.set(entryKey, name.Line)
+		entry, err := w.walk(entryKey, value)
+		if err != nil {
+			return nil, err
+		}
+		table[name.Value] = entry
+	}
+	for _, merge := range merges {
+		sources := []*yaml.Node{merge}
+		if merge.Kind == yaml.SequenceNode {
+			sources = merge.Content
+		}
+		for _, source := range sources {
+			merged, err := w.walk(key, source)
+			if err != nil {
+				return nil, err
+			}
+			entries, ok := merged.(map[string]interface{})
+			if !ok {
+				return nil, &yamlError{source.Line, "only mappings can be merged"}
+			}
+			for name, entry := range entries {
+				if _, ok := table[name]; !ok {
+					table[name] = entry
+				}
+			}
+		}
+	}
+	return table, nil
+}
@@ -0,0 +1,131 @@
+package logger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const rotatedTimeFormat = "20060102-150405.000"
+
+// fileWriter appends to a file and rotates it by size, removing rotated files
+// older than maxAge. Callers serialise writes.
+type fileWriter struct {
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+	// file is nil when it could not be opened again after a rotation, writes
+	// try to open it
+	file *os.File
+	size int64
+	// failing is set once a failed rotation was reported, until one succeeds
+	failing bool
+}
+
+func newFileWriter(path string, maxSize int64, maxAge time.Duration) (*fileWriter, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	w := &fileWriter{path: path, maxSize: maxSize, maxAge: maxAge}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	w.removeExpired()
+	return w, nil
+}
+
+func (w *fileWriter) open() error {
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	w.file, w.size = file, fi.Size()
+	return nil
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return 0, err
+		}
+	}
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// rotate moves the file aside and opens a new one at path. When the file
+// cannot be moved the writer goes on appending to it, and tries again after
+// another maxSize bytes. Failures are reported once on standard error.
+func (w *fileWriter) rotate() error {
+	// the file is opened again whatever happens to it
+	_ = w.file.Close()
+	w.file = nil
+	ext := filepath.Ext(w.path)
+	rotated := strings.TrimSuffix(w.path, ext) + "-" + time.Now().Format(rotatedTimeFormat) + ext
+	renameErr := os.Rename(w.path, rotated)
+	if err := w.open(); err != nil {
+		w.fail(err)
+		return err
+	}
+	if renameErr != nil {
+		w.fail(renameErr)
+		w.size = 0
+		return nil
+	}
+	w.failing = false
+	w.removeExpired()
+	return nil
+}
+
+func (w *fileWriter) fail(err error) {
+	if !w.failing {
+		w.failing = true
+		_, _ = fmt.Fprintf(os.Stderr, "Rotating the log file %s failed: %v\n", w.path, err)
+	}
+}
+
+// removeExpired deletes rotated files whose modification time is older than
+// maxAge
+func (w *fileWriter) removeExpired() {
+	if w.maxAge <= 0 {
+		return
+	}
+	dir := filepath.Dir(w.path)
+	ext := filepath.Ext(w.path)
+	prefix := strings.TrimSuffix(filepath.Base(w.path), ext) + "-"
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	cutoff := time.Now().Add(-w.maxAge)
+	for _, fi := range infos {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		if fi.ModTime().Before(cutoff) {
+			_ = os.Remove(filepath.Join(dir, name))
+		}
+	}
+}
+
+func (w *fileWriter) Close() error {
+	if w.file == nil {
+		return nil
+	}
+	return w.file.Close()
+}
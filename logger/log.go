@@ -1,41 +1,195 @@
+// Package logger implements the leveled logger used by the JadeSocks binary.
+// Nothing is created or written until New is called.
 package logger
 
 import (
-	"github.com/archervanderwaal/JadeSocks/utils"
-	go_logger "github.com/phachon/go-logger"
+	"encoding/json"
+	"fmt"
+	"io"
 	"os"
-	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
 )
 
-const format = "%millisecond_format% [%level_string%] [%function%:%line%] %body%"
-
-var Logger *go_logger.Logger
-
-func init() {
-	logDir := path.Join(utils.Home(), "logger")
-	if !utils.Exists(logDir) {
-		_ = os.Mkdir(logDir, 0755)
-	}
-	Logger = go_logger.NewLogger()
-	_ = Logger.Detach("console")
-	consoleConfig := &go_logger.ConsoleConfig{
-		Color: true,
-		JsonFormat: false,
-		Format: format,
-	}
-	_ = Logger.Attach("console", go_logger.LOGGER_LEVEL_DEBUG, consoleConfig)
-	fileConfig := &go_logger.FileConfig {
-		Filename : path.Join(logDir, "all.logger"),
-		LevelFileName : map[int]string {
-			Logger.LoggerLevel("error"): path.Join(logDir, "error.logger"),
-			Logger.LoggerLevel("info"):  path.Join(logDir, "info.logger"),
-			Logger.LoggerLevel("debug"): path.Join(logDir, "debug.logger"),
-		},
-		MaxSize : 1024 * 1024,
-		MaxLine : 100000,
-		DateSlice : "d",
-		JsonFormat: false,
-		Format: format,
-	}
-	_ = Logger.Attach("file", go_logger.LOGGER_LEVEL_DEBUG, fileConfig)
-}
\ No newline at end of file
+const (
+	LevelDebug = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+const (
+	OutputConsole = "console"
+	OutputFile    = "file"
+	OutputSyslog  = "syslog"
+	OutputNone    = "none"
+)
+
+const timeFormat = "2006-01-02 15:04:05.000"
+
+var levelNames = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+// ANSI colours of the console output, by level
+var levelColors = []string{"\x1b[36m", "\x1b[32m", "\x1b[33m", "\x1b[31m"}
+
+type Options struct {
+	// Level is one of debug, info, warn or error
+	Level string
+	// Outputs lists console, file, syslog or none
+	Outputs []string
+	// Dir is the directory of the file output
+	Dir string
+	// MaxSize rotates the log file once it grows beyond that many bytes
+	MaxSize int64
+	// MaxAge removes rotated files older than that, 0 keeps them forever
+	MaxAge time.Duration
+	// Color colours console output by level
+	Color bool
+	// JSON writes one JSON object per line instead of text
+	JSON bool
+}
+
+// Logger writes leveled messages to one or more outputs
+type Logger struct {
+	level   int
+	json    bool
+	mu      sync.Mutex
+	outputs []output
+}
+
+type output struct {
+	w     io.Writer
+	color bool
+	// syslog outputs receive the bare message and map levels themselves
+	syslog *syslogWriter
+}
+
+// ParseLevel converts a level name to its value
+func ParseLevel(name string) (int, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LevelDebug, nil
+	case "", "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return 0, fmt.Errorf("Unknown log level %q ", name)
+}
+
+func New(opts Options) (*Logger, error) {
+	level, err := ParseLevel(opts.Level)
+	if err != nil {
+		return nil, err
+	}
+	logger := &Logger{level: level, json: opts.JSON}
+	for _, name := range opts.Outputs {
+		switch strings.ToLower(name) {
+		case OutputConsole:
+			logger.outputs = append(logger.outputs, output{w: os.Stdout, color: opts.Color && !opts.JSON})
+		case OutputFile:
+			w, err := newFileWriter(filepath.Join(opts.Dir, "JadeSocks.log"), opts.MaxSize, opts.MaxAge)
+			if err != nil {
+				_ = logger.Close()
+				return nil, err
+			}
+			logger.outputs = append(logger.outputs, output{w: w})
+		case OutputSyslog:
+			w, err := newSyslogWriter()
+			if err != nil {
+				_ = logger.Close()
+				return nil, err
+			}
+			logger.outputs = append(logger.outputs, output{syslog: w})
+		case OutputNone:
+		default:
+			_ = logger.Close()
+			return nil, fmt.Errorf("Unknown log output %q ", name)
+		}
+	}
+	return logger, nil
+}
+
+// Console returns a logger writing text to the console at the info level
+func Console() *Logger {
+	return &Logger{level: LevelInfo, outputs: []output{{w: os.Stdout, color: true}}}
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.log(LevelDebug, format, args...)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.log(LevelInfo, format, args...)
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.log(LevelWarn, format, args...)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.log(LevelError, format, args...)
+}
+
+// Close releases the file and syslog outputs
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var first error
+	for _, out := range l.outputs {
+		var err error
+		if out.syslog != nil {
+			err = out.syslog.Close()
+		} else if c, ok := out.w.(io.Closer); ok && out.w != os.Stdout {
+			err = c.Close()
+		}
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	l.outputs = nil
+	return first
+}
+
+func (l *Logger) log(level int, format string, args ...interface{}) {
+	if l == nil || level < l.level {
+		return
+	}
+	msg := strings.TrimRight(fmt.Sprintf(format, args...), " \n")
+	now := time.Now()
+	caller := "???:0"
+	if _, file, line, ok := runtime.Caller(2); ok {
+		caller = fmt.Sprintf("%s:%d", filepath.Base(file), line)
+	}
+
+	var line string
+	if l.json {
+		b, _ := json.Marshal(struct {
+			Time    string `json:"time"`
+			Level   string `json:"level"`
+			Caller  string `json:"caller"`
+			Message string `json:"msg"`
+		}{now.Format(time.RFC3339Nano), strings.ToLower(levelNames[level]), caller, msg})
+		line = string(b)
+	} else {
+		line = fmt.Sprintf("%s [%s] [%s] %s", now.Format(timeFormat), levelNames[level], caller, msg)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, out := range l.outputs {
+		switch {
+		case out.syslog != nil:
+			out.syslog.write(level, msg)
+		case out.color:
+			_, _ = fmt.Fprintf(out.w, "%s%s\x1b[0m\n", levelColors[level], line)
+		default:
+			_, _ = io.WriteString(out.w, line+"\n")
+		}
+	}
+}
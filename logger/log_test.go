@@ -0,0 +1,106 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogger_Level(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := &Logger{level: LevelWarn, outputs: []output{{w: buf}}}
+	l.Infof("hidden")
+	l.Warnf("shown %d", 1)
+	out := buf.String()
+	if strings.Contains(out, "hidden") || !strings.Contains(out, "[WARN] [log_test.go:") || !strings.Contains(out, "shown 1") {
+		t.Fatalf("unexpected output %q", out)
+	}
+}
+
+func TestLogger_JSON(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := &Logger{level: LevelDebug, json: true, outputs: []output{{w: buf}}}
+	l.Errorf("failed: %s ", "boom")
+	record := map[string]string{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if record["level"] != "error" || record["msg"] != "failed: boom" {
+		t.Fatalf("unexpected record %v", record)
+	}
+}
+
+func TestNew_Errors(t *testing.T) {
+	if _, err := New(Options{Level: "loud"}); err == nil {
+		t.Fatalf("expected an error for an unknown level")
+	}
+	if _, err := New(Options{Outputs: []string{"printer"}}); err == nil {
+		t.Fatalf("expected an error for an unknown output")
+	}
+	l, err := New(Options{Outputs: []string{OutputNone}})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l.Errorf("discarded")
+}
+
+func TestFileWriter_Rotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jadesocks-log")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := New(Options{Outputs: []string{OutputFile}, Dir: dir, MaxSize: 100})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		l.Infof("%s", strings.Repeat("x", 40))
+	}
+	_ = l.Close()
+	files, _ := filepath.Glob(filepath.Join(dir, "JadeSocks*.log"))
+	if len(files) < 2 {
+		t.Fatalf("expected rotated files, got %v", files)
+	}
+}
+
+func TestFileWriter_RotateFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jadesocks-log")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "JadeSocks.log")
+	w, err := newFileWriter(path, 100, 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer w.Close()
+	line := []byte(strings.Repeat("x", 59) + "\n")
+	if _, err := w.Write(line); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	// the file is moved away behind the writer's back, so it cannot be
+	// rotated
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := w.Write(line); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "JadeSocks*.log"))
+	kept := 0
+	for _, file := range files {
+		data, _ := ioutil.ReadFile(file)
+		kept += len(data)
+	}
+	if kept != 2*len(line) {
+		t.Fatalf("expected the writes after the failed rotation to be kept, got %d bytes in %v", kept, files)
+	}
+}
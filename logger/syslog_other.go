@@ -0,0 +1,18 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package logger
+
+import "errors"
+
+type syslogWriter struct{}
+
+func newSyslogWriter() (*syslogWriter, error) {
+	return nil, errors.New("Syslog output is not supported on this platform ")
+}
+
+func (s *syslogWriter) write(int, string) {}
+
+func (s *syslogWriter) Close() error {
+	return nil
+}
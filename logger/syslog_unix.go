@@ -0,0 +1,35 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package logger
+
+import "log/syslog"
+
+type syslogWriter struct {
+	w *syslog.Writer
+}
+
+func newSyslogWriter() (*syslogWriter, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "JadeSocks")
+	if err != nil {
+		return nil, err
+	}
+	return &syslogWriter{w: w}, nil
+}
+
+func (s *syslogWriter) write(level int, msg string) {
+	switch level {
+	case LevelDebug:
+		_ = s.w.Debug(msg)
+	case LevelInfo:
+		_ = s.w.Info(msg)
+	case LevelWarn:
+		_ = s.w.Warning(msg)
+	default:
+		_ = s.w.Err(msg)
+	}
+}
+
+func (s *syslogWriter) Close() error {
+	return s.w.Close()
+}
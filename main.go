@@ -4,17 +4,18 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/archervanderwaal/JadeSocks/config"
 	"github.com/archervanderwaal/JadeSocks/logger"
-	"github.com/archervanderwaal/JadeSocks/socks5"
 	"github.com/archervanderwaal/JadeSocks/utils"
 	"github.com/aybabtme/rgbterm"
 )
 
 const (
 	Version        = "1.0"
-	Usage          = "Usage of JadeSocks: JadeSocks <options>"
+	Usage          = "Usage of JadeSocks: JadeSocks <options>\n       JadeSocks check -f <file>"
 	configFilePath = "~/.JadeSocks/JadeSocks.toml"
 	Logo           = `
       _           _       _____            _        
@@ -31,17 +32,34 @@ var (
 	v bool
 	h bool
 	f string
+
+	logLevel  string
+	logOutput string
+	logDir    string
+	logColor  bool
+	logJSON   bool
 )
 
+// log is replaced by the configured logger once the configuration is loaded
+var log = logger.Console()
+
 func init() {
 	flag.BoolVar(&h, "h", false, "Show usage of JadeSocks and exit")
 	flag.BoolVar(&v, "v", false, "Show version of JadeSocks and exit")
 	flag.StringVar(&f, "f", configFilePath, "Specify the configuration file path and start the SOCKs5 server")
+	flag.StringVar(&logLevel, "log-level", "", "Override the log level: debug, info, warn or error")
+	flag.StringVar(&logOutput, "log-output", "", "Override the log outputs, comma separated: console, file, syslog or none")
+	flag.StringVar(&logDir, "log-dir", "", "Override the directory of the file log output")
+	flag.BoolVar(&logColor, "log-color", true, "Colour console log output")
+	flag.BoolVar(&logJSON, "log-json", false, "Write the log as JSON lines")
 	flag.Usage = usage
 	flag.Parse()
 }
 
 func main() {
+	if flag.Arg(0) == "check" {
+		os.Exit(check(flag.Args()[1:]))
+	}
 	_, args := utils.ParseArgs(os.Args)
 	if v {
 		showVersion()
@@ -57,35 +75,65 @@ func main() {
 		_, _ = fmt.Fprintf(os.Stderr, rgbterm.FgString("Error reading configuration file"+err.Error(), 255, 0, 0))
 		return
 	}
-	startServer(conf)
-}
-
-func startServer(config *config.Config) {
-	var authMethods []socks5.Authenticator
-	if config.Users == nil {
-		authMethods = []socks5.Authenticator{socks5.NoAuthAuthenticator{}}
-	} else {
-		accounts := socks5.Accounts{MemoryUser: config.Users}
-		authMethods = []socks5.Authenticator{socks5.UserPassAuthenticator{Accounts: accounts}}
-	}
-	serverConf := &socks5.ServerConfig{
-		AuthMethods: authMethods,
-		Resolver:    socks5.DNSResolver{},
-		ListenAddr:  config.ListenAddr,
-		Network:     "tcp",
-		Logger:      logger.Logger,
-	}
-	serve, err := socks5.New(serverConf)
+	configured, err := newLogger(conf.Log)
 	if err != nil {
-		_, _ = fmt.Fprintf(os.Stderr, rgbterm.FgString("Internal error: "+err.Error(), 255, 0, 0))
+		_, _ = fmt.Fprintf(os.Stderr, rgbterm.FgString("Error configuring the logger: "+err.Error(), 255, 0, 0))
 		return
 	}
-	if err := serve.ListenAndServe(); err != nil {
+	log = configured
+	defer log.Close()
+	if err := newApp(conf).run(); err != nil {
 		_, _ = fmt.Fprintf(os.Stderr, rgbterm.FgString("Internal error: "+err.Error(), 255, 0, 0))
 		return
 	}
 }
 
+// check validates a configuration file without starting anything and returns
+// the exit status
+func check(arguments []string) int {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	path := flags.String("f", f, "Specify the configuration file path to validate")
+	if err := flags.Parse(arguments); err != nil {
+		return 2
+	}
+	conf := &config.Config{}
+	if err := conf.LoadConfig(*path); err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, rgbterm.FgString(err.Error(), 255, 0, 0))
+		return 1
+	}
+	fmt.Println(rgbterm.FgString(*path+": configuration is valid", 0, 255, 0))
+	return 0
+}
+
+// newLogger builds the logger from the configuration, flags given on the
+// command line take precedence
+func newLogger(conf config.Log) (*logger.Logger, error) {
+	opts := logger.Options{
+		Level:   conf.Level,
+		Outputs: conf.Outputs,
+		Dir:     conf.Dir,
+		MaxSize: int64(conf.MaxSize) * 1024 * 1024,
+		MaxAge:  time.Duration(conf.MaxAge) * 24 * time.Hour,
+		Color:   conf.Color,
+		JSON:    conf.JSON,
+	}
+	flag.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "log-level":
+			opts.Level = logLevel
+		case "log-output":
+			opts.Outputs = strings.Split(logOutput, ",")
+		case "log-dir":
+			opts.Dir = logDir
+		case "log-color":
+			opts.Color = logColor
+		case "log-json":
+			opts.JSON = logJSON
+		}
+	})
+	return logger.New(opts)
+}
+
 func usage() {
 	// #00FF00
 	logo := rgbterm.FgString(Logo, 0, 255, 0)
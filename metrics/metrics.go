@@ -0,0 +1,435 @@
+// Package metrics implements a small registry of counters, gauges and
+// histograms that can be scraped in the Prometheus text exposition format.
+//
+// Every method is safe to call on a nil receiver, so code that records
+// metrics does not need to check whether metrics are enabled at all.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefBuckets are the default histogram buckets, in seconds
+var DefBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type collector interface {
+	name() string
+	describe() (kind string, labels []string)
+	write(w *bufio.Writer)
+}
+
+// Registry holds a set of metric families
+type Registry struct {
+	mu         sync.Mutex
+	collectors map[string]collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{collectors: make(map[string]collector)}
+}
+
+// register returns the collector already registered under the same name, so
+// several servers can share one registry and end up with the same series. It
+// panics when that collector is of another type or has other labels.
+func (r *Registry) register(c collector) collector {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if existing, ok := r.collectors[c.name()]; ok {
+		kind, labels := c.describe()
+		existingKind, existingLabels := existing.describe()
+		if kind != existingKind || strings.Join(labels, ",") != strings.Join(existingLabels, ",") {
+			panic(fmt.Sprintf("metrics: %s is already registered as a %s with labels %v, not a %s with labels %v",
+				c.name(), existingKind, existingLabels, kind, labels))
+		}
+		return existing
+	}
+	r.collectors[c.name()] = c
+	return c
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	if r == nil {
+		return nil
+	}
+	v := &CounterVec{family: newFamily(name, help, "counter", labels)}
+	return r.register(v).(*CounterVec)
+}
+
+func (r *Registry) NewCounter(name, help string) *Counter {
+	return r.NewCounterVec(name, help).With()
+}
+
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	if r == nil {
+		return nil
+	}
+	v := &GaugeVec{family: newFamily(name, help, "gauge", labels)}
+	return r.register(v).(*GaugeVec)
+}
+
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	return r.NewGaugeVec(name, help).With()
+}
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if r == nil {
+		return nil
+	}
+	if len(buckets) == 0 {
+		buckets = DefBuckets
+	}
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	v := &HistogramVec{family: newFamily(name, help, "histogram", labels), buckets: b}
+	return r.register(v).(*HistogramVec)
+}
+
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	return r.NewHistogramVec(name, help, buckets).With()
+}
+
+// WriteTo writes every registered family in the text exposition format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	if r == nil {
+		return 0, nil
+	}
+	r.mu.Lock()
+	names := make([]string, 0, len(r.collectors))
+	for name := range r.collectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	collectors := make([]collector, 0, len(names))
+	for _, name := range names {
+		collectors = append(collectors, r.collectors[name])
+	}
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, c := range collectors {
+		c.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// Handler returns an http.Handler serving the registry
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		_, _ = r.WriteTo(w)
+	})
+}
+
+// ListenAndServe serves the registry on addr under /metrics
+func ListenAndServe(addr string, r *Registry) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r.Handler())
+	return http.ListenAndServe(addr, mux)
+}
+
+type family struct {
+	metricName string
+	help       string
+	kind       string
+	labels     []string
+
+	mu     sync.Mutex
+	series map[string]interface{}
+	keys   map[string][]string
+}
+
+func newFamily(name, help, kind string, labels []string) family {
+	return family{
+		metricName: name,
+		help:       help,
+		kind:       kind,
+		labels:     labels,
+		series:     make(map[string]interface{}),
+		keys:       make(map[string][]string),
+	}
+}
+
+func (f *family) name() string {
+	return f.metricName
+}
+
+func (f *family) describe() (string, []string) {
+	return f.kind, f.labels
+}
+
+func (f *family) get(values []string, create func() interface{}) interface{} {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.metricName, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if s, ok := f.series[key]; ok {
+		return s
+	}
+	s := create()
+	f.series[key] = s
+	f.keys[key] = append([]string(nil), values...)
+	return s
+}
+
+// each calls fn for every series in a stable order
+func (f *family) each(fn func(labels []string, s interface{})) {
+	f.mu.Lock()
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	type entry struct {
+		labels []string
+		s      interface{}
+	}
+	entries := make([]entry, 0, len(keys))
+	for _, key := range keys {
+		entries = append(entries, entry{f.keys[key], f.series[key]})
+	}
+	f.mu.Unlock()
+	for _, e := range entries {
+		fn(e.labels, e.s)
+	}
+}
+
+func (f *family) writeHeader(w *bufio.Writer) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n", f.metricName, escapeHelp(f.help))
+	_, _ = fmt.Fprintf(w, "# TYPE %s %s\n", f.metricName, f.kind)
+}
+
+// CounterVec is a counter partitioned by label values
+type CounterVec struct {
+	family
+}
+
+func (v *CounterVec) With(values ...string) *Counter {
+	if v == nil {
+		return nil
+	}
+	return v.get(values, func() interface{} { return &Counter{} }).(*Counter)
+}
+
+func (v *CounterVec) write(w *bufio.Writer) {
+	v.writeHeader(w)
+	v.each(func(labels []string, s interface{}) {
+		writeSample(w, v.metricName, v.labels, labels, "", "", s.(*Counter).Value())
+	})
+}
+
+// Counter is a monotonically increasing value
+type Counter struct {
+	bits uint64
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Add(n float64) {
+	if c == nil || n < 0 {
+		return
+	}
+	addFloat(&c.bits, n)
+}
+
+func (c *Counter) Value() float64 {
+	if c == nil {
+		return 0
+	}
+	return math.Float64frombits(atomic.LoadUint64(&c.bits))
+}
+
+// GaugeVec is a gauge partitioned by label values
+type GaugeVec struct {
+	family
+}
+
+func (v *GaugeVec) With(values ...string) *Gauge {
+	if v == nil {
+		return nil
+	}
+	return v.get(values, func() interface{} { return &Gauge{} }).(*Gauge)
+}
+
+func (v *GaugeVec) write(w *bufio.Writer) {
+	v.writeHeader(w)
+	v.each(func(labels []string, s interface{}) {
+		writeSample(w, v.metricName, v.labels, labels, "", "", s.(*Gauge).Value())
+	})
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	bits uint64
+}
+
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+func (g *Gauge) Add(n float64) {
+	if g == nil {
+		return
+	}
+	addFloat(&g.bits, n)
+}
+
+func (g *Gauge) Set(n float64) {
+	if g == nil {
+		return
+	}
+	atomic.StoreUint64(&g.bits, math.Float64bits(n))
+}
+
+func (g *Gauge) Value() float64 {
+	if g == nil {
+		return 0
+	}
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+// HistogramVec is a histogram partitioned by label values
+type HistogramVec struct {
+	family
+	buckets []float64
+}
+
+func (v *HistogramVec) With(values ...string) *Histogram {
+	if v == nil {
+		return nil
+	}
+	return v.get(values, func() interface{} {
+		return &Histogram{upper: v.buckets, counts: make([]uint64, len(v.buckets))}
+	}).(*Histogram)
+}
+
+func (v *HistogramVec) write(w *bufio.Writer) {
+	v.writeHeader(w)
+	v.each(func(labels []string, s interface{}) {
+		h := s.(*Histogram)
+		h.mu.Lock()
+		counts := append([]uint64(nil), h.counts...)
+		count, sum := h.count, h.sum
+		h.mu.Unlock()
+		var cumulative uint64
+		for i, upper := range h.upper {
+			cumulative += counts[i]
+			writeSample(w, v.metricName+"_bucket", v.labels, labels, "le", formatFloat(upper), float64(cumulative))
+		}
+		writeSample(w, v.metricName+"_bucket", v.labels, labels, "le", "+Inf", float64(count))
+		writeSample(w, v.metricName+"_sum", v.labels, labels, "", "", sum)
+		writeSample(w, v.metricName+"_count", v.labels, labels, "", "", float64(count))
+	})
+}
+
+// Histogram counts observations into configurable buckets
+type Histogram struct {
+	upper []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *Histogram) Observe(v float64) {
+	if h == nil {
+		return
+	}
+	i := sort.SearchFloat64s(h.upper, v)
+	h.mu.Lock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+	h.mu.Unlock()
+}
+
+func addFloat(bits *uint64, n float64) {
+	for {
+		old := atomic.LoadUint64(bits)
+		next := math.Float64bits(math.Float64frombits(old) + n)
+		if atomic.CompareAndSwapUint64(bits, old, next) {
+			return
+		}
+	}
+}
+
+func writeSample(w *bufio.Writer, name string, labelNames, labelValues []string, extraName, extraValue string, value float64) {
+	_, _ = w.WriteString(name)
+	if len(labelNames) > 0 || extraName != "" {
+		_ = w.WriteByte('{')
+		for i, label := range labelNames {
+			if i > 0 {
+				_ = w.WriteByte(',')
+			}
+			_, _ = fmt.Fprintf(w, "%s=\"%s\"", label, escapeLabel(labelValues[i]))
+		}
+		if extraName != "" {
+			if len(labelNames) > 0 {
+				_ = w.WriteByte(',')
+			}
+			_, _ = fmt.Fprintf(w, "%s=\"%s\"", extraName, extraValue)
+		}
+		_ = w.WriteByte('}')
+	}
+	_ = w.WriteByte(' ')
+	_, _ = w.WriteString(formatFloat(value))
+	_ = w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
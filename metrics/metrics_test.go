@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRegistry_WriteTo(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("test_bytes_total", "Bytes.", "direction", "user").With("up", `a"b`).Add(42)
+	r.NewGauge("test_active", "Active.").Inc()
+	h := r.NewHistogram("test_seconds", "Latency.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	buf := &bytes.Buffer{}
+	if _, err := r.WriteTo(buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"# TYPE test_bytes_total counter\n",
+		`test_bytes_total{direction="up",user="a\"b"} 42` + "\n",
+		"test_active 1\n",
+		"# TYPE test_seconds histogram\n",
+		`test_seconds_bucket{le="0.1"} 1` + "\n",
+		`test_seconds_bucket{le="1"} 2` + "\n",
+		`test_seconds_bucket{le="+Inf"} 3` + "\n",
+		"test_seconds_sum 5.55\n",
+		"test_seconds_count 3\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+}
+
+func TestRegistry_SharedFamilies(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("test_total", "Total.").Inc()
+	r.NewCounter("test_total", "Total.").Inc()
+	if v := r.NewCounter("test_total", "Total.").Value(); v != 2 {
+		t.Fatalf("expected 2, got %v", v)
+	}
+}
+
+func TestRegistry_ConflictingFamilies(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("test_total", "Total.", "label")
+	for name, register := range map[string]func(){
+		"kind":   func() { r.NewGaugeVec("test_total", "Total.", "label") },
+		"labels": func() { r.NewCounterVec("test_total", "Total.", "other") },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("%s: expected a conflicting registration to panic", name)
+				}
+			}()
+			register()
+		}()
+	}
+}
+
+func TestNilRegistry(t *testing.T) {
+	var r *Registry
+	r.NewCounterVec("test_total", "Total.", "label").With("x").Inc()
+	r.NewGauge("test_gauge", "Gauge.").Dec()
+	r.NewHistogram("test_seconds", "Latency.", nil).Observe(1)
+	if _, err := r.WriteTo(&bytes.Buffer{}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+// Package routing parses the criteria of rules and routes. The configuration
+// validates with it and the SOCKS server matches with what it returns, so
+// neither has to know about the other.
+package routing
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DirectOutboundName and RejectOutboundName are always available
+	DirectOutboundName = "direct"
+	RejectOutboundName = "reject"
+)
+
+// commands are the codes of the SOCKS5 commands rules can select
+var commands = map[string]uint8{
+	"connect":   0x01,
+	"bind":      0x02,
+	"associate": 0x03,
+}
+
+// ParseCommand converts connect, bind or associate to its command code
+func ParseCommand(name string) (uint8, error) {
+	if code, ok := commands[strings.ToLower(name)]; ok {
+		return code, nil
+	}
+	return 0, fmt.Errorf("unknown command %q", name)
+}
+
+// PortRange is an inclusive range of ports
+type PortRange struct {
+	From uint16
+	To   uint16
+}
+
+// ParsePortRange parses "80" or "8000-8080"
+func ParsePortRange(s string) (PortRange, error) {
+	from, to := s, s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		from, to = s[:i], s[i+1:]
+	}
+	f, err := strconv.ParseUint(strings.TrimSpace(from), 10, 16)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	t, err := strconv.ParseUint(strings.TrimSpace(to), 10, 16)
+	if err != nil || t < f {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	return PortRange{From: uint16(f), To: uint16(t)}, nil
+}
+
+// ParseCIDR also accepts a single address
+func ParseCIDR(s string) (*net.IPNet, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR %q", s)
+	}
+	return network, nil
+}
+
+// CheckDomain rejects domains that are empty once a leading "*." is ignored
+func CheckDomain(domain string) error {
+	if strings.Trim(domain, "*.") == "" {
+		return fmt.Errorf("invalid domain %q", domain)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package routing
+
+import "testing"
+
+func TestParseCommand(t *testing.T) {
+	if code, err := ParseCommand("Associate"); err != nil || code != 0x03 {
+		t.Fatalf("bad command %d: %v", code, err)
+	}
+	if _, err := ParseCommand("register"); err == nil {
+		t.Fatalf("expected register to be rejected")
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	if r, err := ParsePortRange("8000-8080"); err != nil || r.From != 8000 || r.To != 8080 {
+		t.Fatalf("bad range %v: %v", r, err)
+	}
+	for _, s := range []string{"", "70000", "80-20", "a-b"} {
+		if _, err := ParsePortRange(s); err == nil {
+			t.Fatalf("expected %q to be rejected", s)
+		}
+	}
+}
+
+func TestParseCIDR(t *testing.T) {
+	if network, err := ParseCIDR("192.0.2.1"); err != nil || network.String() != "192.0.2.1/32" {
+		t.Fatalf("bad network %v: %v", network, err)
+	}
+	if network, err := ParseCIDR("2001:db8::/32"); err != nil || network.String() != "2001:db8::/32" {
+		t.Fatalf("bad network %v: %v", network, err)
+	}
+	if _, err := ParseCIDR("192.0.2.0/33"); err == nil {
+		t.Fatalf("expected an invalid CIDR to be rejected")
+	}
+}
@@ -0,0 +1,188 @@
+// Package shadowsocks knows the methods of Shadowsocks, decodes their keys
+// and parses ss:// URIs. The configuration validates with it and the server
+// in socks5 derives its ciphers from what it returns.
+package shadowsocks
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Method describes a Shadowsocks cipher
+type Method struct {
+	KeySize     int
+	Edition2022 bool
+	ChaCha      bool
+}
+
+var methods = map[string]Method{
+	"aes-128-gcm":                   {KeySize: 16},
+	"aes-256-gcm":                   {KeySize: 32},
+	"chacha20-ietf-poly1305":        {KeySize: 32, ChaCha: true},
+	"2022-blake3-aes-128-gcm":       {KeySize: 16, Edition2022: true},
+	"2022-blake3-aes-256-gcm":       {KeySize: 32, Edition2022: true},
+	"2022-blake3-chacha20-poly1305": {KeySize: 32, Edition2022: true, ChaCha: true},
+}
+
+// LookupMethod returns the method called name
+func LookupMethod(name string) (Method, bool) {
+	method, ok := methods[name]
+	return method, ok
+}
+
+// Keys are the keys of a Shadowsocks server or client
+type Keys struct {
+	Method Method
+	// Key is that of a client, and that of a server besides users
+	Key []byte
+	// Identity are the identity keys of a client, the first one is that of
+	// the server and the next one that of the hop after it, the last one
+	// protects the hash of Key
+	Identity [][]byte
+	// Users are the keys of the users of a server, IdentityKey protects
+	// their hashes on the 2022 edition
+	Users       map[string][]byte
+	IdentityKey []byte
+}
+
+// ParseKeys checks that method is known and decodes the password and the
+// passwords of users into keys that fit it
+func ParseKeys(method, password string, users map[string]string) (*Keys, error) {
+	m, ok := methods[method]
+	if !ok {
+		return nil, fmt.Errorf("Unknown Shadowsocks method %q ", method)
+	}
+	keys := &Keys{Method: m}
+	if !m.Edition2022 {
+		if password == "" && len(users) == 0 {
+			return nil, errors.New("Shadowsocks requires a password ")
+		}
+		if password != "" {
+			keys.Key = evpBytesToKey(password, m.KeySize)
+		}
+		keys.Users = make(map[string][]byte)
+		for user, password := range users {
+			keys.Users[user] = evpBytesToKey(password, m.KeySize)
+		}
+		return keys, nil
+	}
+
+	var chain [][]byte
+	for _, encoded := range strings.Split(password, ":") {
+		key, err := decode2022Key(encoded, m.KeySize)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, key)
+	}
+	keys.Key, keys.Identity = chain[len(chain)-1], chain[:len(chain)-1]
+	if len(users) == 0 {
+		if len(keys.Identity) > 0 && m.ChaCha {
+			return nil, errors.New("Shadowsocks 2022 identity keys require an AES method ")
+		}
+		return keys, nil
+	}
+	if m.ChaCha {
+		return nil, errors.New("Shadowsocks 2022 users require an AES method ")
+	}
+	if len(keys.Identity) > 0 {
+		return nil, errors.New("The password of a Shadowsocks 2022 server with users is a single identity key ")
+	}
+	keys.IdentityKey, keys.Key = keys.Key, nil
+	keys.Users = make(map[string][]byte)
+	for user, password := range users {
+		key, err := decode2022Key(password, m.KeySize)
+		if err != nil {
+			return nil, fmt.Errorf("User %s: %v ", user, err)
+		}
+		keys.Users[user] = key
+	}
+	return keys, nil
+}
+
+// evpBytesToKey derives the key of AEAD methods from a password like
+// OpenSSL's EVP_BytesToKey with MD5 does
+func evpBytesToKey(password string, size int) []byte {
+	var key, prev []byte
+	for len(key) < size {
+		sum := md5.Sum(append(prev, password...))
+		prev = sum[:]
+		key = append(key, prev...)
+	}
+	return key[:size]
+}
+
+func decode2022Key(encoded string, size int) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != size {
+		return nil, fmt.Errorf("Shadowsocks 2022 keys must be %d bytes in base64 ", size)
+	}
+	return key, nil
+}
+
+// ParseURI parses an ss:// URI of SIP002, whose user info is the method and
+// password in URL-safe base64 or percent-encoded, or the legacy form that
+// encodes all of method:password@host:port in base64. The keys are checked
+// to fit the method.
+func ParseURI(uri string) (method, password, address string, err error) {
+	if !strings.HasPrefix(uri, "ss://") {
+		return "", "", "", errors.New("Not an ss:// URI ")
+	}
+	rest := strings.TrimPrefix(uri, "ss://")
+	if i := strings.IndexByte(rest, '#'); i >= 0 {
+		rest = rest[:i]
+	}
+	if !strings.Contains(rest, "@") {
+		decoded, err := decodeBase64(strings.TrimSuffix(rest, "/"))
+		if err != nil {
+			return "", "", "", fmt.Errorf("Invalid ss:// URI: %v ", err)
+		}
+		rest = string(decoded)
+		at := strings.LastIndexByte(rest, '@')
+		if at < 0 {
+			return "", "", "", errors.New("Invalid ss:// URI: no server address ")
+		}
+		rest = url.PathEscape(rest[:at]) + rest[at:]
+	}
+	u, err := url.Parse("ss://" + rest)
+	if err != nil {
+		return "", "", "", fmt.Errorf("Invalid ss:// URI: %v ", err)
+	}
+	if u.Query().Get("plugin") != "" {
+		return "", "", "", errors.New("Shadowsocks plugins are not supported ")
+	}
+	if u.User == nil || u.Port() == "" {
+		return "", "", "", errors.New("Invalid ss:// URI: no method or server address ")
+	}
+	ok := false
+	if password, ok = u.User.Password(); ok {
+		method = u.User.Username()
+	} else {
+		decoded, err := decodeBase64(u.User.Username())
+		if err != nil {
+			return "", "", "", fmt.Errorf("Invalid ss:// URI: %v ", err)
+		}
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) != 2 {
+			return "", "", "", errors.New("Invalid ss:// URI: no password ")
+		}
+		method, password = parts[0], parts[1]
+	}
+	if _, err := ParseKeys(method, password, nil); err != nil {
+		return "", "", "", err
+	}
+	return method, password, u.Host, nil
+}
+
+// decodeBase64 decodes standard or URL-safe base64, padded or not
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	if strings.ContainsAny(s, "-_") {
+		return base64.RawURLEncoding.DecodeString(s)
+	}
+	return base64.RawStdEncoding.DecodeString(s)
+}
@@ -0,0 +1,39 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseKeys(t *testing.T) {
+	keys, err := ParseKeys("aes-128-gcm", "secret", map[string]string{"alice": "alice secret"})
+	if err != nil || len(keys.Key) != 16 || len(keys.Users["alice"]) != 16 || bytes.Equal(keys.Key, keys.Users["alice"]) {
+		t.Fatalf("bad AEAD keys %+v: %v", keys, err)
+	}
+
+	identity, key := "aWlpaWlpaWlpaWlpaWlpaQ==", "YWFhYWFhYWFhYWFhYWFhYQ=="
+	keys, err = ParseKeys("2022-blake3-aes-128-gcm", identity+":"+key, nil)
+	if err != nil || len(keys.Identity) != 1 || string(keys.Identity[0]) != "iiiiiiiiiiiiiiii" || string(keys.Key) != "aaaaaaaaaaaaaaaa" {
+		t.Fatalf("bad client keys %+v: %v", keys, err)
+	}
+	keys, err = ParseKeys("2022-blake3-aes-128-gcm", identity, map[string]string{"alice": key})
+	if err != nil || keys.Key != nil || string(keys.IdentityKey) != "iiiiiiiiiiiiiiii" || string(keys.Users["alice"]) != "aaaaaaaaaaaaaaaa" {
+		t.Fatalf("bad server keys %+v: %v", keys, err)
+	}
+
+	for _, bad := range []struct {
+		method, password string
+		users            map[string]string
+	}{
+		{"rc4-md5", "secret", nil},
+		{"aes-256-gcm", "", nil},
+		{"2022-blake3-aes-128-gcm", "secret", nil},
+		{"2022-blake3-chacha20-poly1305", identity + ":" + key, nil},
+		{"2022-blake3-aes-128-gcm", identity, map[string]string{"alice": "short"}},
+		{"2022-blake3-aes-128-gcm", identity + ":" + key, map[string]string{"alice": key}},
+	} {
+		if _, err := ParseKeys(bad.method, bad.password, bad.users); err == nil {
+			t.Fatalf("expected %s %q to be refused", bad.method, bad.password)
+		}
+	}
+}
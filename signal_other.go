@@ -0,0 +1,22 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"os"
+	"os/signal"
+)
+
+// reloadSignals returns a channel that never delivers, there is no reload
+// signal on this platform
+func reloadSignals() <-chan os.Signal {
+	return make(chan os.Signal)
+}
+
+// stopSignals delivers the interrupt signal
+func stopSignals() <-chan os.Signal {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt)
+	return ch
+}
@@ -0,0 +1,126 @@
+package socks5
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reasons a session ended, as reported in access records
+const (
+	closeClientClosed = "client_closed"
+	closeRemoteClosed = "remote_closed"
+	closeKilled       = "killed"
+	closeHandshake    = "handshake_failed"
+	closeAuth         = "auth_failed"
+	closeBadRequest   = "bad_request"
+	closeResolve      = "resolve_failed"
+	closeRule         = "rule_denied"
+	closeUnsupported  = "unsupported_command"
+	closeDial         = "dial_failed"
+	closeRelayError   = "relay_error"
+	closeIdle         = "idle_timeout"
+	closeCompleted    = "completed"
+)
+
+const (
+	accessLogJSON   = "json"
+	accessLogLogfmt = "logfmt"
+	noReplyCode     = -1
+)
+
+// AccessRecord summarises one session once it has ended
+type AccessRecord struct {
+	SessionID   string    `json:"session_id"`
+	Inbound     string    `json:"inbound"`
+	Time        time.Time `json:"time"`
+	Client      string    `json:"client"`
+	User        string    `json:"user"`
+	Command     string    `json:"command"`
+	Destination string    `json:"destination"`
+	ResolvedIP  string    `json:"resolved_ip"`
+	Rule        string    `json:"rule"`
+	Route       string    `json:"route"`
+	// ReplyCode is the SOCKS reply sent to the client, -1 if none was sent.
+	// HTTP proxy sessions record the SOCKS reply matching their status.
+	ReplyCode   int     `json:"reply_code"`
+	BytesUp     uint64  `json:"bytes_up"`
+	BytesDown   uint64  `json:"bytes_down"`
+	Duration    float64 `json:"duration_seconds"`
+	CloseReason string  `json:"close_reason"`
+}
+
+// AccessLogger receives one record for every session
+type AccessLogger interface {
+	Log(record *AccessRecord)
+}
+
+// NewAccessLog writes records to w, one per line, as "json" or "logfmt"
+func NewAccessLog(w io.Writer, format string) (AccessLogger, error) {
+	switch format {
+	case "", accessLogJSON:
+		return &writerAccessLog{w: w, encode: encodeJSON}, nil
+	case accessLogLogfmt:
+		return &writerAccessLog{w: w, encode: encodeLogfmt}, nil
+	default:
+		return nil, fmt.Errorf("Unknown access log format %q ", format)
+	}
+}
+
+type writerAccessLog struct {
+	mu     sync.Mutex
+	w      io.Writer
+	encode func(record *AccessRecord) []byte
+}
+
+func (l *writerAccessLog) Log(record *AccessRecord) {
+	line := l.encode(record)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.w.Write(line)
+}
+
+func encodeJSON(record *AccessRecord) []byte {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return nil
+	}
+	return append(line, '\n')
+}
+
+func encodeLogfmt(record *AccessRecord) []byte {
+	b := &strings.Builder{}
+	field := func(key, value string) {
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(key)
+		b.WriteByte('=')
+		if value == "" || strings.ContainsAny(value, " =\"\\\t\n") {
+			b.WriteString(strconv.Quote(value))
+		} else {
+			b.WriteString(value)
+		}
+	}
+	field("session_id", record.SessionID)
+	field("inbound", record.Inbound)
+	field("time", record.Time.Format(time.RFC3339Nano))
+	field("client", record.Client)
+	field("user", record.User)
+	field("command", record.Command)
+	field("destination", record.Destination)
+	field("resolved_ip", record.ResolvedIP)
+	field("rule", record.Rule)
+	field("route", record.Route)
+	field("reply_code", strconv.Itoa(record.ReplyCode))
+	field("bytes_up", strconv.FormatUint(record.BytesUp, 10))
+	field("bytes_down", strconv.FormatUint(record.BytesDown, 10))
+	field("duration_seconds", strconv.FormatFloat(record.Duration, 'f', 3, 64))
+	field("close_reason", record.CloseReason)
+	b.WriteByte('\n')
+	return []byte(b.String())
+}
@@ -0,0 +1,93 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+type chanAccessLog chan *AccessRecord
+
+func (c chanAccessLog) Log(record *AccessRecord) {
+	c <- record
+}
+
+func TestServer_AccessRecord(t *testing.T) {
+	echo := startEchoServer(t)
+	records := make(chanAccessLog, 1)
+	_, addr := startTestServer(t, &ServerConfig{
+		AuthMethods: []Authenticator{NoAuthAuthenticator{}},
+		AccessLog:   records,
+	})
+
+	conn, _ := dialConnect(t, addr, echo)
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_ = conn.Close()
+
+	select {
+	case record := <-records:
+		if record.Destination != echo.String() || record.Command != "connect" ||
+			record.ReplyCode != int(succeeded) || record.BytesUp != 5 || record.BytesDown != 5 ||
+			record.CloseReason != closeClientClosed || record.SessionID == "" {
+			t.Fatalf("unexpected record %+v", record)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no access record written")
+	}
+}
+
+func TestNewAccessLog(t *testing.T) {
+	record := &AccessRecord{
+		SessionID:   "abc",
+		Time:        time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Client:      "127.0.0.1:5000",
+		User:        "bob smith",
+		Command:     "connect",
+		Destination: "example.com:443",
+		ResolvedIP:  "93.184.216.34",
+		ReplyCode:   0,
+		BytesUp:     10,
+		BytesDown:   20,
+		Duration:    1.5,
+		CloseReason: closeClientClosed,
+	}
+
+	buf := &bytes.Buffer{}
+	l, err := NewAccessLog(buf, "json")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l.Log(record)
+	decoded := &AccessRecord{}
+	if err := json.Unmarshal(buf.Bytes(), decoded); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if decoded.User != record.User || decoded.BytesDown != 20 {
+		t.Fatalf("unexpected record %+v", decoded)
+	}
+
+	buf.Reset()
+	if l, err = NewAccessLog(buf, "logfmt"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l.Log(record)
+	line := buf.String()
+	for _, want := range []string{`session_id=abc `, `user="bob smith" `, `rule="" `, `reply_code=0 `, `duration_seconds=1.500 `, "close_reason=client_closed\n"} {
+		if !strings.Contains(line, want) {
+			t.Errorf("missing %q in %q", want, line)
+		}
+	}
+
+	if _, err := NewAccessLog(buf, "xml"); err == nil {
+		t.Fatalf("expected an error for an unknown format")
+	}
+}
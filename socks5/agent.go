@@ -0,0 +1,233 @@
+package socks5
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrAgentClosed is returned by Agent.Run after Close
+var ErrAgentClosed = errors.New("Agent closed ")
+
+const (
+	defaultAgentTimeout    = 10 * time.Second
+	defaultAgentMaxBackoff = time.Minute
+)
+
+// Agent exposes the network it runs in through a server that accepts agents,
+// typically from behind NAT. It keeps a control connection to the server and
+// connects to the destinations the server asks for, attaching every
+// connection to the server on a new connection of its own.
+type Agent struct {
+	// Server is the host:port of the SOCKS5 server
+	Server string
+	// Username and Password authenticate the agent, its name is the username
+	Username string
+	Password string
+	// Rules decide which destinations the agent connects to, all of them
+	// when it is nil
+	Rules RuleSet
+	// Outbound connects to the destinations, directly when it is nil
+	Outbound Outbound
+	// Timeout bounds connecting to the server and its handshake
+	Timeout time.Duration
+	// MaxBackoff caps the wait between reconnections, the wait starts at a
+	// second and doubles after every failure
+	MaxBackoff time.Duration
+	Logger     Logger
+
+	mu      sync.Mutex
+	control net.Conn
+	closed  bool
+	done    chan struct{}
+}
+
+// Run keeps the agent connected until Close, reconnecting with backoff
+func (a *Agent) Run() error {
+	a.init()
+	backoff := time.Second
+	for {
+		registered, err := a.session()
+		if a.isClosed() {
+			return ErrAgentClosed
+		}
+		if registered {
+			backoff = time.Second
+		}
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		a.Logger.Warnf("Agent %s lost server %s: %v, reconnecting in %v", a.Username, a.Server, err, wait)
+		select {
+		case <-time.After(wait):
+		case <-a.done:
+			return ErrAgentClosed
+		}
+		if backoff *= 2; backoff > a.MaxBackoff {
+			backoff = a.MaxBackoff
+		}
+	}
+}
+
+// Close disconnects the agent and stops Run, connections already attached
+// are left to finish
+func (a *Agent) Close() error {
+	a.init()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return nil
+	}
+	a.closed = true
+	close(a.done)
+	if a.control != nil {
+		return a.control.Close()
+	}
+	return nil
+}
+
+func (a *Agent) init() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.done != nil {
+		return
+	}
+	a.done = make(chan struct{})
+	if a.Rules == nil {
+		a.Rules = PermitAll()
+	}
+	if a.Timeout <= 0 {
+		a.Timeout = defaultAgentTimeout
+	}
+	if a.Outbound == nil {
+		a.Outbound = &DirectOutbound{Timeout: a.Timeout}
+	}
+	if a.MaxBackoff < time.Second {
+		a.MaxBackoff = defaultAgentMaxBackoff
+	}
+	if a.Logger == nil {
+		a.Logger = nopLogger{}
+	}
+}
+
+func (a *Agent) isClosed() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.closed
+}
+
+// setControl records the control connection so Close can interrupt it, it
+// returns false when the agent is closed
+func (a *Agent) setControl(conn net.Conn) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return false
+	}
+	a.control = conn
+	return true
+}
+
+// connect dials the server and sends it a request, the connection is ready
+// for use when it returns
+func (a *Agent) connect(command uint8, addr AddrSpec) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", a.Server, a.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(a.Timeout))
+	if _, err := clientHandshake(conn, a.Username, a.Password, command, addr); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// session registers the agent and serves its control connection until it is
+// lost, it reports whether the registration succeeded
+func (a *Agent) session() (bool, error) {
+	conn, err := a.connect(registerCommand, AddrSpec{IP: net.IPv4zero, AddrType: IPV4Address})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if !a.setControl(conn) {
+		return false, ErrAgentClosed
+	}
+	a.Logger.Infof("Agent %s registered with %s", a.Username, a.Server)
+
+	control := &agentConn{name: a.Username, conn: conn, done: make(chan struct{})}
+	defer control.close()
+	r := bufio.NewReader(conn)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(3 * agentHeartbeat))
+		kind, err := r.ReadByte()
+		if err != nil {
+			return true, err
+		}
+		switch kind {
+		case agentPing:
+			if err := control.send([]byte{agentPing}); err != nil {
+				return true, err
+			}
+		case agentOpen:
+			id := make([]byte, agentIDLength)
+			if _, err := io.ReadFull(r, id); err != nil {
+				return true, err
+			}
+			addr, err := parseAddrSpec(r)
+			if err != nil {
+				return true, err
+			}
+			go a.open(control, id, *addr)
+		default:
+			return true, fmt.Errorf("Unknown message %d from server ", kind)
+		}
+	}
+}
+
+// open connects to addr for the open id and attaches the connection, failures
+// are reported on the control connection
+func (a *Agent) open(control *agentConn, id []byte, addr AddrSpec) {
+	fail := func(code uint8) {
+		_ = control.send(append(append([]byte{agentFail}, id...), code))
+	}
+	req := &Request{
+		Version:     Socks5Version,
+		Command:     connectCommand,
+		AuthContext: anonymous(),
+		DestAddr:    &addr,
+	}
+	if !a.Rules.Allow(req) {
+		a.Logger.Warnf("Agent %s refused to connect to %v", a.Username, &addr)
+		fail(ruleNotAllowed)
+		return
+	}
+	target, err := a.Outbound.Dial("tcp", addr)
+	if err != nil {
+		a.Logger.Errorf("Agent %s failed to connect to %v: %v", a.Username, &addr, err)
+		fail(replyCode(err))
+		return
+	}
+	defer target.Close()
+	conn, err := a.connect(attachCommand, AddrSpec{Domain: hex.EncodeToString(id), AddrType: DomainAddress})
+	if err != nil {
+		a.Logger.Errorf("Agent %s failed to attach a connection to %v: %v", a.Username, &addr, err)
+		fail(serverFailure)
+		return
+	}
+	defer conn.Close()
+
+	var total uint64
+	var activity int64
+	errCh := make(chan relayResult, 2)
+	go copyData(&countingWriter{Writer: target, total: &total, activity: &activity}, conn, "", errCh)
+	go copyData(&countingWriter{Writer: conn, total: &total, activity: &activity}, target, "", errCh)
+	<-errCh
+	<-errCh
+}
@@ -7,33 +7,62 @@ import (
 )
 
 const (
-	NoAuth          = uint8(0)
-	UserPassAuth    = uint8(2)
-	noAcceptable    = uint8(255)
-	Socks5Version 	= uint8(5)
+	NoAuth        = uint8(0)
+	UserPassAuth  = uint8(2)
+	noAcceptable  = uint8(255)
+	Socks5Version = uint8(5)
 
 	userAuthVersion = uint8(1)
 
-	authSuccess     = uint8(0)
-	authFailure     = uint8(1)
+	authSuccess = uint8(0)
+	authFailure = uint8(1)
 )
 
+// AuthContext describes the outcome of a successful authentication
+type AuthContext struct {
+	// Method is the negotiated authentication method
+	Method uint8
+	// Payload holds method specific values, such as "Username"
+	Payload map[string]string
+}
+
+// User returns the authenticated user name, or "" for anonymous sessions
+func (a *AuthContext) User() string {
+	if a == nil {
+		return ""
+	}
+	return a.Payload["Username"]
+}
+
 type Authenticator interface {
 	Authenticate(reader io.Reader, writer io.Writer) error
 	GetCode() uint8
 }
 
+// ContextAuthenticator is an Authenticator that also tells who the client
+// is, for rules, quotas and logs. Clients of other authenticators are
+// anonymous.
+type ContextAuthenticator interface {
+	Authenticator
+	AuthenticateContext(reader io.Reader, writer io.Writer) (*AuthContext, error)
+}
+
 type NoAuthAuthenticator struct{}
 
 func (a NoAuthAuthenticator) GetCode() uint8 {
 	return NoAuth
 }
 
-func (a NoAuthAuthenticator) Authenticate(_ io.Reader, writer io.Writer) error {
-	_, err := writer.Write([]byte{Socks5Version, NoAuth})
+func (a NoAuthAuthenticator) Authenticate(reader io.Reader, writer io.Writer) error {
+	_, err := a.AuthenticateContext(reader, writer)
 	return err
 }
 
+func (a NoAuthAuthenticator) AuthenticateContext(_ io.Reader, writer io.Writer) (*AuthContext, error) {
+	_, err := writer.Write([]byte{Socks5Version, NoAuth})
+	return &AuthContext{Method: NoAuth, Payload: map[string]string{}}, err
+}
+
 type UserPassAuthenticator struct {
 	Accounts Accounts
 }
@@ -43,26 +72,42 @@ func (a UserPassAuthenticator) GetCode() uint8 {
 }
 
 func (a UserPassAuthenticator) Authenticate(reader io.Reader, writer io.Writer) error {
+	_, err := a.AuthenticateContext(reader, writer)
+	return err
+}
+
+func (a UserPassAuthenticator) AuthenticateContext(reader io.Reader, writer io.Writer) (*AuthContext, error) {
 	if _, err := writer.Write([]byte{Socks5Version, UserPassAuth}); err != nil {
-		return err
+		return nil, err
 	}
 	req := &UserPassAuthRequest{}
 	if err := req.Read(reader); err != nil {
-		return err
+		return nil, err
 	}
 	if req.Ver != userAuthVersion {
-		return fmt.Errorf("Unsupported auth version: %v ", req.Ver)
+		return nil, fmt.Errorf("Unsupported auth version: %v ", req.Ver)
 	}
 	if a.Accounts.contains(string(req.Uname), string(req.Passwd)) {
 		if _, err := writer.Write([]byte{userAuthVersion, authSuccess}); err != nil {
-			return err
+			return nil, err
 		}
-		return nil
+		return &AuthContext{Method: UserPassAuth, Payload: map[string]string{"Username": string(req.Uname)}}, nil
 	}
 	if _, err := writer.Write([]byte{userAuthVersion, authFailure}); err != nil {
-		return err
+		return nil, err
 	}
-	return errors.New("User authentication failed ")
+	return nil, errors.New("User authentication failed ")
+}
+
+// authenticate runs authenticator and returns the context of the client
+func authenticate(authenticator Authenticator, reader io.Reader, writer io.Writer) (*AuthContext, error) {
+	if withContext, ok := authenticator.(ContextAuthenticator); ok {
+		return withContext.AuthenticateContext(reader, writer)
+	}
+	if err := authenticator.Authenticate(reader, writer); err != nil {
+		return nil, err
+	}
+	return &AuthContext{Method: authenticator.GetCode(), Payload: map[string]string{}}, nil
 }
 
 func NoAcceptableAuth(conn io.Writer) error {
@@ -81,4 +126,4 @@ func (a *Accounts) contains(username, password string) bool {
 		return false
 	}
 	return true
-}
\ No newline at end of file
+}
@@ -0,0 +1,158 @@
+package socks5
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Ban is a blocked client address
+type Ban struct {
+	IP string `json:"ip"`
+	// Until is the zero time for bans that never expire
+	Until time.Time `json:"until,omitempty"`
+}
+
+const (
+	// authFailureWindow is how long a failed authentication counts towards
+	// a ban, an address that fails less often is never banned
+	authFailureWindow = 15 * time.Minute
+	// maxAuthFailures bounds the addresses whose failures are counted, the
+	// stalest is forgotten to make room
+	maxAuthFailures = 1 << 16
+)
+
+// authFailures is the failed authentications of an address since first,
+// the count starts again once first is older than authFailureWindow
+type authFailures struct {
+	count int
+	first time.Time
+}
+
+// BanList blocks client addresses, either by hand or after repeated
+// authentication failures. It is safe for concurrent use and may be shared by
+// several servers.
+type BanList struct {
+	mu       sync.Mutex
+	bans     map[string]time.Time
+	failures map[string]authFailures
+}
+
+func NewBanList() *BanList {
+	return &BanList{
+		bans:     make(map[string]time.Time),
+		failures: make(map[string]authFailures),
+	}
+}
+
+// Ban blocks ip for d, or forever when d is not positive
+func (b *BanList) Ban(ip net.IP, d time.Duration) {
+	var until time.Time
+	if d > 0 {
+		until = time.Now().Add(d)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bans[ip.String()] = until
+	delete(b.failures, ip.String())
+}
+
+// Unban lifts a ban and reports whether ip was banned
+func (b *BanList) Unban(ip net.IP) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.bans[ip.String()]
+	delete(b.bans, ip.String())
+	delete(b.failures, ip.String())
+	return ok
+}
+
+// Banned reports whether ip is currently blocked
+func (b *BanList) Banned(ip net.IP) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	until, ok := b.bans[ip.String()]
+	if !ok {
+		return false
+	}
+	if !until.IsZero() && time.Now().After(until) {
+		delete(b.bans, ip.String())
+		return false
+	}
+	return true
+}
+
+// List returns the active bans sorted by address
+func (b *BanList) List() []Ban {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	bans := make([]Ban, 0, len(b.bans))
+	for ip, until := range b.bans {
+		if !until.IsZero() && now.After(until) {
+			delete(b.bans, ip)
+			continue
+		}
+		bans = append(bans, Ban{IP: ip, Until: until})
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].IP < bans[j].IP
+	})
+	return bans
+}
+
+// authFailed counts a failed authentication from ip and bans it for d once
+// limit failures are reached within authFailureWindow. It reports whether ip
+// got banned.
+func (b *BanList) authFailed(ip net.IP, limit int, d time.Duration) bool {
+	if b == nil || limit <= 0 {
+		return false
+	}
+	now := time.Now()
+	b.mu.Lock()
+	failures, ok := b.failures[ip.String()]
+	if !ok || now.Sub(failures.first) > authFailureWindow {
+		if !ok && len(b.failures) >= maxAuthFailures {
+			b.forgetFailures(now)
+		}
+		failures = authFailures{first: now}
+	}
+	failures.count++
+	b.failures[ip.String()] = failures
+	reached := failures.count >= limit
+	b.mu.Unlock()
+	if reached {
+		b.Ban(ip, d)
+	}
+	return reached
+}
+
+// authSucceeded resets the failure count of ip
+func (b *BanList) authSucceeded(ip net.IP) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.failures, ip.String())
+}
+
+// forgetFailures drops the failures that are out of the window, and the
+// stalest when all are still counting
+func (b *BanList) forgetFailures(now time.Time) {
+	var stalest string
+	for ip, failures := range b.failures {
+		if now.Sub(failures.first) > authFailureWindow {
+			delete(b.failures, ip)
+		} else if stalest == "" || failures.first.Before(b.failures[stalest].first) {
+			stalest = ip
+		}
+	}
+	if len(b.failures) >= maxAuthFailures {
+		delete(b.failures, stalest)
+	}
+}
@@ -0,0 +1,45 @@
+package socks5
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBanList_AuthFailures(t *testing.T) {
+	bans := NewBanList()
+	ip := net.ParseIP("203.0.113.7")
+	if bans.authFailed(ip, 2, time.Minute) {
+		t.Fatalf("expected no ban after one failure")
+	}
+	// the first failure falls out of the window
+	bans.failures[ip.String()] = authFailures{count: 1, first: time.Now().Add(-authFailureWindow - time.Second)}
+	if bans.authFailed(ip, 2, time.Minute) || bans.Banned(ip) {
+		t.Fatalf("expected failures outside the window not to count")
+	}
+	if !bans.authFailed(ip, 2, time.Minute) || !bans.Banned(ip) {
+		t.Fatalf("expected a ban after two failures within the window")
+	}
+	if _, ok := bans.failures[ip.String()]; ok {
+		t.Fatalf("expected the failures of a banned address to be dropped")
+	}
+}
+
+func TestBanList_AuthFailuresBounded(t *testing.T) {
+	bans := NewBanList()
+	start := time.Now().Add(-time.Minute)
+	for i := 0; i < maxAuthFailures; i++ {
+		ip := net.IPv4(10, byte(i>>16), byte(i>>8), byte(i))
+		bans.failures[ip.String()] = authFailures{count: 1, first: start.Add(time.Duration(i))}
+	}
+	stale := net.IPv4(10, 0, 0, 5)
+	bans.failures[stale.String()] = authFailures{count: 1, first: start.Add(-authFailureWindow)}
+	_ = bans.authFailed(net.ParseIP("203.0.113.7"), 5, time.Minute)
+	if _, ok := bans.failures[stale.String()]; ok || len(bans.failures) != maxAuthFailures {
+		t.Fatalf("expected the expired failures to make room, %d tracked", len(bans.failures))
+	}
+	_ = bans.authFailed(net.ParseIP("203.0.113.8"), 5, time.Minute)
+	if _, ok := bans.failures[net.IPv4(10, 0, 0, 0).String()]; ok || len(bans.failures) != maxAuthFailures {
+		t.Fatalf("expected the stalest failures to make room, %d tracked", len(bans.failures))
+	}
+}
@@ -0,0 +1,111 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// forwardTarget parses the host:port of a forward server
+func forwardTarget(target string) (*AddrSpec, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid forward target %q: %v ", target, err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 || host == "" {
+		return nil, fmt.Errorf("Invalid forward target %q ", target)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return addrSpec(ip, int(port)), nil
+	}
+	if len(host) > 255 {
+		return nil, fmt.Errorf("Invalid forward target %q ", target)
+	}
+	return &AddrSpec{Domain: host, Port: uint16(port), AddrType: DomainAddress}, nil
+}
+
+// handleForwardConn serves a connection to a forward server. It is processed
+// like a SOCKS5 CONNECT to ForwardTarget by an anonymous client, there is no
+// handshake and no reply.
+func (server *Server) handleForwardConn(conf *ServerConfig, conn net.Conn) error {
+	conf.Logger.Infof("Start handle forward connection, remoteAddr: %s", clientAddr(conn))
+	defer conn.Close()
+	server.metrics.activeConns.Inc()
+	defer server.metrics.activeConns.Dec()
+	sess := newSession(conf, conn)
+	server.trackSession(sess)
+	defer server.untrackSession(sess)
+	sess.writeReply = func(uint8, *AddrSpec) error {
+		return nil
+	}
+
+	dest, err := forwardTarget(conf.ForwardTarget)
+	if err != nil {
+		server.metrics.rejected.With(rejectRequest).Inc()
+		sess.setReason(closeBadRequest)
+		conf.Logger.Errorf("%v", err)
+		return err
+	}
+	request := &Request{
+		Version:     Socks5Version,
+		Command:     connectCommand,
+		AuthContext: anonymous(),
+		DestAddr:    dest,
+		reader:      conn,
+		session:     sess,
+	}
+	request.RemoteAddr = remoteAddrSpec(conn.RemoteAddr())
+	sess.setRequest(request)
+
+	if err := server.process(request, conn); err != nil {
+		err = fmt.Errorf("Failed to handle forward connection: %v ", err)
+		conf.Logger.Errorf("%v ", err)
+		return err
+	}
+	return nil
+}
+
+// udpClientConn is the client side of a UDP flow of a forward server, the
+// client's datagrams reach the flow through its channel and the replies are
+// sent from the server's socket. Reads only wait for the flow to end.
+type udpClientConn struct {
+	conn   *net.UDPConn
+	client *net.UDPAddr
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newUDPClientConn(conn *net.UDPConn, client *net.UDPAddr) *udpClientConn {
+	return &udpClientConn{conn: conn, client: client, done: make(chan struct{})}
+}
+
+func (c *udpClientConn) Read([]byte) (int, error) {
+	<-c.done
+	return 0, io.EOF
+}
+
+func (c *udpClientConn) Write(p []byte) (int, error) {
+	select {
+	case <-c.done:
+		return 0, errors.New("UDP flow closed ")
+	default:
+	}
+	return c.conn.WriteToUDP(p, c.client)
+}
+
+// Close ends the flow, the server's socket stays open
+func (c *udpClientConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
+
+func (c *udpClientConn) LocalAddr() net.Addr                { return c.conn.LocalAddr() }
+func (c *udpClientConn) RemoteAddr() net.Addr               { return c.client }
+func (c *udpClientConn) SetDeadline(t time.Time) error      { return nil }
+func (c *udpClientConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *udpClientConn) SetWriteDeadline(t time.Time) error { return nil }
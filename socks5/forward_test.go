@@ -0,0 +1,154 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type staticResolver map[string]net.IP
+
+func (r staticResolver) Resolve(name string) (net.IP, error) {
+	if ip, ok := r[name]; ok {
+		return ip, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func TestForwardTarget(t *testing.T) {
+	for target, want := range map[string]string{
+		"db.internal:5432": "db.internal:5432",
+		"10.0.0.1:53":      "10.0.0.1:53",
+		"[2001:db8::1]:22": "[2001:db8::1]:22",
+	} {
+		addr, err := forwardTarget(target)
+		if err != nil || addr.String() != want {
+			t.Fatalf("%s: bad target %v: %v", target, addr, err)
+		}
+	}
+	for _, target := range []string{"", "db.internal", ":5432", "db.internal:0", "db.internal:http", "db.internal:70000"} {
+		if _, err := forwardTarget(target); err == nil {
+			t.Fatalf("expected %q to be rejected", target)
+		}
+	}
+	if _, err := New(&ServerConfig{Protocol: ProtocolForward}); err == nil {
+		t.Fatalf("expected a forward server without a target to be rejected")
+	}
+	if _, err := New(&ServerConfig{Protocol: ProtocolForward, ForwardTarget: "db.internal:5432", Outbound: "upstream"}); err == nil {
+		t.Fatalf("expected an outbound without a router to be rejected")
+	}
+}
+
+func TestForward_Connect(t *testing.T) {
+	echo := startEchoServer(t)
+	server, addr := startTestServer(t, &ServerConfig{
+		Protocol:      ProtocolForward,
+		ForwardTarget: net.JoinHostPort("db.internal", strconv.Itoa(echo.Port)),
+		Resolver:      staticResolver{"db.internal": echo.IP},
+	})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("unexpected echo %q: %v", buf, err)
+	}
+	sessions := server.Sessions()
+	if len(sessions) != 1 || sessions[0].Command != "connect" || sessions[0].Destination != "db.internal:"+strconv.Itoa(echo.Port) {
+		t.Fatalf("unexpected sessions %+v", sessions)
+	}
+}
+
+func TestForward_Outbound(t *testing.T) {
+	echo := startEchoServer(t)
+	router := &Router{
+		Routes:    []Route{{Name: "all", Outbound: RejectOutboundName}},
+		Outbounds: map[string]Outbound{},
+	}
+	for outbound, relayed := range map[string]bool{DirectOutboundName: true, RejectOutboundName: false, "": false} {
+		_, addr := startTestServer(t, &ServerConfig{
+			Protocol:      ProtocolForward,
+			ForwardTarget: echo.String(),
+			Router:        router,
+			Outbound:      outbound,
+		})
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, _ = conn.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(conn, buf)
+		if relayed != (err == nil) {
+			t.Fatalf("outbound %q: unexpected echo %q: %v", outbound, buf, err)
+		}
+		_ = conn.Close()
+	}
+}
+
+func TestForward_UDP(t *testing.T) {
+	echo, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	server, err := New(&ServerConfig{
+		Protocol:      ProtocolForward,
+		ForwardTarget: echo.LocalAddr().String(),
+		ForwardUDP:    true,
+		Network:       "tcp4",
+		ListenAddr:    "127.0.0.1:0",
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn, err := server.ListenPacket()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer server.Close()
+	go func() { _ = server.ServeUDP(conn) }()
+
+	for _, msgs := range [][]string{{"ping", "pong"}, {"hello"}} {
+		client, err := net.DialUDP("udp4", nil, conn.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer client.Close()
+		_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+		for _, msg := range msgs {
+			if _, err := client.Write([]byte(msg)); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			buf := make([]byte, 16)
+			n, err := client.Read(buf)
+			if err != nil || string(buf[:n]) != msg {
+				t.Fatalf("unexpected reply %q: %v", buf[:n], err)
+			}
+		}
+	}
+	sessions := server.Sessions()
+	if len(sessions) != 2 || sessions[0].Command != "associate" || sessions[0].Destination != echo.LocalAddr().String() {
+		t.Fatalf("unexpected sessions %+v", sessions)
+	}
+}
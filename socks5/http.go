@@ -0,0 +1,229 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// httpStatus is the HTTP status an HTTP proxy answers for a SOCKS reply
+var httpStatus = map[uint8]int{
+	succeeded:            http.StatusOK,
+	serverFailure:        http.StatusBadGateway,
+	ruleNotAllowed:       http.StatusForbidden,
+	networkUnreachable:   http.StatusBadGateway,
+	hostUnreachable:      http.StatusBadGateway,
+	connectionRefused:    http.StatusBadGateway,
+	ttlExpired:           http.StatusGatewayTimeout,
+	commandNotSupported:  http.StatusMethodNotAllowed,
+	addrTypeNotSupported: http.StatusBadRequest,
+}
+
+// hopHeaders only concern the connection to the proxy and are not forwarded
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+}
+
+// handleHTTPConn serves a client of an HTTP proxy. A CONNECT request opens a
+// tunnel, any other request must use an absolute URI and is forwarded to its
+// host with the connection closed after the response. Either way the request
+// goes through the same resolver, rules, outbounds and accounting as a SOCKS5
+// CONNECT.
+func (server *Server) handleHTTPConn(conf *ServerConfig, conn net.Conn) error {
+	conf.Logger.Infof("Start handle HTTP proxy connection, remoteAddr: %s", clientAddr(conn))
+	defer conn.Close()
+	server.metrics.activeConns.Inc()
+	defer server.metrics.activeConns.Dec()
+	sess := newSession(conf, conn)
+	server.trackSession(sess)
+	defer server.untrackSession(sess)
+	if conf.HandshakeTimeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(conf.HandshakeTimeout))
+	}
+	reader := newBufferedConn(conn)
+	sess.writeReply = func(resp uint8, _ *AddrSpec) error {
+		return writeHTTPStatus(conn, httpStatus[resp], nil)
+	}
+
+	httpReq, err := http.ReadRequest(reader.Reader)
+	if err != nil {
+		server.metrics.rejected.With(rejectRequest).Inc()
+		sess.setReason(closeHandshake)
+		conf.Logger.Errorf("Failed to parse HTTP proxy request: %v", err)
+		return err
+	}
+	authContext, err := server.authenticateHTTP(sess, httpReq)
+	if err != nil {
+		server.metrics.rejected.With(rejectAuth).Inc()
+		sess.setReason(closeAuth)
+		return err
+	}
+	dest, err := httpDestination(httpReq)
+	if err != nil {
+		server.metrics.rejected.With(rejectRequest).Inc()
+		sess.setReason(closeBadRequest)
+		_ = writeHTTPStatus(conn, http.StatusBadRequest, nil)
+		return err
+	}
+
+	request := &Request{
+		Version:     Socks5Version,
+		Command:     connectCommand,
+		AuthContext: authContext,
+		DestAddr:    dest,
+		reader:      reader,
+		session:     sess,
+	}
+	if httpReq.Method == http.MethodConnect {
+		sess.writeReply = func(resp uint8, _ *AddrSpec) error {
+			if resp == succeeded {
+				_, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				return err
+			}
+			return writeHTTPStatus(conn, httpStatus[resp], nil)
+		}
+	} else {
+		// the request is relayed ahead of its body, which is still unread
+		request.reader = io.MultiReader(bytes.NewReader(originRequest(httpReq)), reader)
+		sess.writeReply = func(resp uint8, _ *AddrSpec) error {
+			if resp == succeeded {
+				return nil
+			}
+			return writeHTTPStatus(conn, httpStatus[resp], nil)
+		}
+	}
+	if conf.HandshakeTimeout > 0 {
+		_ = conn.SetDeadline(time.Time{})
+	}
+	request.RemoteAddr = remoteAddrSpec(conn.RemoteAddr())
+	sess.setRequest(request)
+
+	if err := server.process(request, conn); err != nil {
+		err = fmt.Errorf("Failed to handle HTTP proxy request: %v ", err)
+		conf.Logger.Errorf("%v ", err)
+		return err
+	}
+	return nil
+}
+
+// authenticateHTTP checks the Proxy-Authorization of req against the
+// user/password authenticator, anonymous requests are accepted when the no
+// authentication method is enabled
+func (server *Server) authenticateHTTP(sess *session, req *http.Request) (*AuthContext, error) {
+	var userPass *UserPassAuthenticator
+	noAuth := false
+	for _, authenticator := range sess.conf.AuthMethods {
+		switch a := authenticator.(type) {
+		case NoAuthAuthenticator:
+			noAuth = true
+		case UserPassAuthenticator:
+			userPass = &a
+		}
+	}
+	username, password, ok := proxyBasicAuth(req)
+	if user := peerIdentity(sess.conn); user != "" && !ok {
+		server.recordAuth(sess, NoAuth, nil)
+		return certificateAuth(user), nil
+	}
+	if userPass == nil || (!ok && noAuth) {
+		if noAuth {
+			server.recordAuth(sess, NoAuth, nil)
+			return &AuthContext{Method: NoAuth, Payload: map[string]string{}}, nil
+		}
+		_ = writeHTTPStatus(sess.conn, http.StatusForbidden, nil)
+		return nil, errors.New("No supported authentication mechanism ")
+	}
+	challenge := http.Header{"Proxy-Authenticate": {`Basic realm="JadeSocks"`}}
+	if !ok {
+		// clients send credentials only after the challenge, so this is not
+		// an authentication failure
+		_ = writeHTTPStatus(sess.conn, http.StatusProxyAuthRequired, challenge)
+		return nil, errors.New("Proxy credentials required ")
+	}
+	if !userPass.Accounts.contains(username, password) {
+		err := errors.New("User authentication failed ")
+		server.recordAuth(sess, UserPassAuth, err)
+		_ = writeHTTPStatus(sess.conn, http.StatusProxyAuthRequired, challenge)
+		return nil, err
+	}
+	server.recordAuth(sess, UserPassAuth, nil)
+	return &AuthContext{Method: UserPassAuth, Payload: map[string]string{"Username": username}}, nil
+}
+
+// proxyBasicAuth returns the credentials of the Proxy-Authorization header
+func proxyBasicAuth(req *http.Request) (string, string, bool) {
+	auth := &http.Request{Header: http.Header{"Authorization": req.Header["Proxy-Authorization"]}}
+	return auth.BasicAuth()
+}
+
+// httpDestination returns where req should be sent, the authority of a
+// CONNECT request or the host of an absolute http URI
+func httpDestination(req *http.Request) (*AddrSpec, error) {
+	hostPort := req.URL.Host
+	if req.Method != http.MethodConnect {
+		if !req.URL.IsAbs() || req.URL.Scheme != "http" {
+			return nil, fmt.Errorf("Not a proxy request: %s ", req.RequestURI)
+		}
+		if req.URL.Port() == "" {
+			hostPort = net.JoinHostPort(req.URL.Hostname(), "80")
+		}
+	}
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid destination %q: %v ", hostPort, err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid destination port %q ", portStr)
+	}
+	dest := &AddrSpec{Port: uint16(port)}
+	if ip := net.ParseIP(host); ip != nil {
+		dest.IP = ip
+		dest.AddrType = IPV6Address
+		if ip.To4() != nil {
+			dest.AddrType = IPV4Address
+		}
+	} else {
+		dest.Domain = host
+		dest.AddrType = DomainAddress
+	}
+	return dest, nil
+}
+
+// originRequest renders the head of req as sent to the origin server, with
+// the proxy's hop-by-hop headers removed and the connection closed after the
+// response
+func originRequest(req *http.Request) []byte {
+	header := req.Header.Clone()
+	for _, h := range hopHeaders {
+		header.Del(h)
+	}
+	header.Set("Connection", "close")
+	if len(req.TransferEncoding) > 0 {
+		// the reader of the request moved it out of the header
+		header.Set("Transfer-Encoding", req.TransferEncoding[0])
+	}
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "%s %s %s\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), req.Proto, req.Host)
+	_ = header.Write(b)
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+func writeHTTPStatus(w io.Writer, code int, header http.Header) error {
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "HTTP/1.1 %d %s\r\n", code, http.StatusText(code))
+	_ = header.Write(b)
+	b.WriteString("Content-Length: 0\r\nConnection: close\r\n\r\n")
+	_, err := w.Write(b.Bytes())
+	return err
+}
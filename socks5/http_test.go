@@ -0,0 +1,102 @@
+package socks5
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func startHTTPProxy(t *testing.T, methods ...Authenticator) string {
+	_, addr := startTestServer(t, &ServerConfig{Protocol: ProtocolHTTP, AuthMethods: methods})
+	return addr
+}
+
+func dialProxy(t *testing.T, proxy, request string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, request); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return conn, reader, resp
+}
+
+func TestHTTPProxy_Connect(t *testing.T) {
+	echo := startEchoServer(t)
+	accounts := Accounts{MemoryUser: map[string]string{"user": "pass"}}
+	proxy := startHTTPProxy(t, UserPassAuthenticator{Accounts: accounts})
+
+	_, _, resp := dialProxy(t, proxy, fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", echo, echo))
+	if resp.StatusCode != http.StatusProxyAuthRequired || resp.Header.Get("Proxy-Authenticate") == "" {
+		t.Fatalf("expected a challenge, got %v", resp.Status)
+	}
+
+	credentials := base64.StdEncoding.EncodeToString([]byte("user:pass"))
+	conn, reader, resp := dialProxy(t, proxy, fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\nProxy-Authorization: Basic %s\r\n\r\n", echo, echo, credentials))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %v", resp.Status)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(reader, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("unexpected echo %q: %v", buf, err)
+	}
+}
+
+func TestHTTPProxy_Forward(t *testing.T) {
+	origin := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Connection") != "" || r.RequestURI != "/path?q=1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = fmt.Fprintf(w, "hello %s", r.Host)
+	})}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go func() { _ = origin.Serve(listener) }()
+	t.Cleanup(func() { _ = origin.Close() })
+	proxy := startHTTPProxy(t, NoAuthAuthenticator{})
+
+	host := listener.Addr().String()
+	_, _, resp := dialProxy(t, proxy, fmt.Sprintf("GET http://%s/path?q=1 HTTP/1.1\r\nHost: %s\r\nProxy-Connection: keep-alive\r\n\r\n", host, host))
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "hello "+host {
+		t.Fatalf("unexpected response %v %q", resp.Status, body)
+	}
+
+	_, _, resp = dialProxy(t, proxy, "GET /relative HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected a relative request to be rejected, got %v", resp.Status)
+	}
+}
+
+func TestHTTPProxy_RuleDenied(t *testing.T) {
+	echo := startEchoServer(t)
+	_, proxy := startTestServer(t, &ServerConfig{
+		Protocol:    ProtocolHTTP,
+		AuthMethods: []Authenticator{NoAuthAuthenticator{}},
+		Rules:       &RuleList{},
+	})
+	_, _, resp := dialProxy(t, proxy, fmt.Sprintf("CONNECT %s HTTP/1.1\r\n\r\n", echo))
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("unexpected status %v", resp.Status)
+	}
+}
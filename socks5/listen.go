@@ -0,0 +1,160 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Close
+var ErrServerClosed = errors.New("Server closed ")
+
+// Listen opens the listener of the server. A unix socket left behind by an
+// unclean shutdown is replaced, and new sockets get SocketMode and SocketOwner.
+// Transparent servers in TPROXY mode accept connections to any address.
+func (server *Server) Listen() (net.Listener, error) {
+	conf := server.CurrentConfig()
+	if conf.Protocol == ProtocolTransparent && conf.TransparentMode == TransparentTProxy {
+		return listenTransparentTCP(conf.Network, conf.ListenAddr)
+	}
+	if conf.Network != "unix" {
+		return net.Listen(conf.Network, conf.ListenAddr)
+	}
+	path := conf.ListenAddr
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		_ = os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := setSocketPermissions(path, conf.SocketMode, conf.SocketOwner); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func setSocketPermissions(path string, mode os.FileMode, owner string) error {
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+	}
+	if owner == "" {
+		return nil
+	}
+	uid, gid, err := lookupOwner(owner)
+	if err != nil {
+		return err
+	}
+	return os.Chown(path, uid, gid)
+}
+
+// lookupOwner resolves "user", "user:group" or ":group", names or numeric
+// ids, to the ids os.Chown takes, -1 leaves an id unchanged
+func lookupOwner(owner string) (int, int, error) {
+	name, group := owner, ""
+	if i := strings.IndexByte(owner, ':'); i >= 0 {
+		name, group = owner[:i], owner[i+1:]
+	}
+	uid, gid := -1, -1
+	if name != "" {
+		u, err := user.Lookup(name)
+		if err != nil {
+			u, err = user.LookupId(name)
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("Unknown socket owner %q ", name)
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			g, err = user.LookupGroupId(group)
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("Unknown socket group %q ", group)
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	return uid, gid, nil
+}
+
+// Close stops the server accepting connections, sessions already being served
+// run until they end
+func (server *Server) Close() error {
+	server.connsMu.Lock()
+	defer server.connsMu.Unlock()
+	server.closed = true
+	var err error
+	for listener := range server.listeners {
+		if closeErr := listener.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	server.listeners = nil
+	return err
+}
+
+// trackListener registers a listener or packet socket with Close, and
+// reports false when the server is already closed
+func (server *Server) trackListener(listener io.Closer) bool {
+	server.connsMu.Lock()
+	defer server.connsMu.Unlock()
+	if server.closed {
+		return false
+	}
+	if server.listeners == nil {
+		server.listeners = make(map[io.Closer]struct{})
+	}
+	server.listeners[listener] = struct{}{}
+	return true
+}
+
+func (server *Server) isClosed() bool {
+	server.connsMu.Lock()
+	defer server.connsMu.Unlock()
+	return server.closed
+}
+
+// clientAddr describes the client of conn, clients of unix sockets are
+// usually unnamed and then all described as "unix"
+func clientAddr(conn net.Conn) string {
+	if addr, ok := conn.RemoteAddr().(*net.UnixAddr); ok {
+		if addr.Name == "" || addr.Name == "@" {
+			return "unix"
+		}
+		return "unix:" + addr.Name
+	}
+	return conn.RemoteAddr().String()
+}
+
+// remoteAddrSpec returns the IP address and port of a peer, nil for peers
+// without one such as the clients of unix sockets
+func remoteAddrSpec(addr net.Addr) *AddrSpec {
+	switch addr := addr.(type) {
+	case nil:
+		return nil
+	case *net.TCPAddr:
+		return &AddrSpec{IP: addr.IP, Port: uint16(addr.Port)}
+	case *net.UDPAddr:
+		return &AddrSpec{IP: addr.IP, Port: uint16(addr.Port)}
+	}
+	host, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if ip == nil || err != nil {
+		return nil
+	}
+	return &AddrSpec{IP: ip, Port: uint16(port)}
+}
@@ -0,0 +1,162 @@
+package socks5
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServer_UnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jadesocks-unix")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "socks.sock")
+	// a stale socket from an earlier run must not prevent the bind
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	server, err := New(&ServerConfig{
+		AuthMethods: []Authenticator{NoAuthAuthenticator{}},
+		Network:     "unix",
+		ListenAddr:  path,
+		SocketMode:  0600,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	listener, err := server.Listen()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(listener) }()
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected socket mode %v: %v", fi, err)
+	}
+
+	echo := startEchoServer(t)
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	req := []byte{Socks5Version, 1, NoAuth, Socks5Version, connectCommand, 0, IPV4Address}
+	req = append(req, echo.IP.To4()...)
+	req = append(req, byte(echo.Port>>8), byte(echo.Port))
+	if _, err := conn.Write(req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	reply := make([]byte, 2+10)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[3] != succeeded {
+		t.Fatalf("unexpected reply %v: %v", reply, err)
+	}
+	if sessions := server.Sessions(); len(sessions) != 1 || sessions[0].ClientAddr != "unix" {
+		t.Fatalf("unexpected sessions %+v", sessions)
+	}
+
+	if err := server.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case err := <-served:
+		if err != ErrServerClosed {
+			t.Fatalf("unexpected error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Serve did not return after Close")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected the socket to be removed: %v", err)
+	}
+}
+
+func TestLookupOwner(t *testing.T) {
+	uid, gid, err := lookupOwner("0:0")
+	if err != nil || uid != 0 || gid != 0 {
+		t.Fatalf("unexpected owner %d:%d %v", uid, gid, err)
+	}
+	if uid, gid, err = lookupOwner(":0"); err != nil || uid != -1 || gid != 0 {
+		t.Fatalf("unexpected owner %d:%d %v", uid, gid, err)
+	}
+	if _, _, err := lookupOwner("no-such-user-jadesocks"); err == nil {
+		t.Fatalf("expected an unknown user to be rejected")
+	}
+}
+
+func TestRemoteAddrSpec(t *testing.T) {
+	for _, c := range []struct {
+		addr net.Addr
+		want string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 4000}, "203.0.113.7:4000"},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db8::7"), Port: 53}, "[2001:db8::7]:53"},
+		{namedAddr("203.0.113.7:4000"), "203.0.113.7:4000"},
+		{namedAddr("proxy.example.com:4000"), "<nil>"},
+		{&net.UnixAddr{Name: "@", Net: "unix"}, "<nil>"},
+		{nil, "<nil>"},
+	} {
+		got := "<nil>"
+		if spec := remoteAddrSpec(c.addr); spec != nil {
+			got = spec.String()
+		}
+		if got != c.want {
+			t.Fatalf("%v: got %s, want %s", c.addr, got, c.want)
+		}
+	}
+}
+
+func TestServer_UnixClientProxyHeader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jadesocks-unix")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "socks.sock")
+	server, err := New(&ServerConfig{
+		AuthMethods: []Authenticator{NoAuthAuthenticator{}},
+		Router:      &Router{Outbounds: map[string]Outbound{"direct": &DirectOutbound{ProxyProtocol: 1}}},
+		Network:     "unix",
+		ListenAddr:  path,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	listener, err := server.Listen()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go func() { _ = server.Serve(listener) }()
+	defer server.Close()
+
+	// the echo server sends back the header announcing the client, which
+	// has no address
+	echo := startEchoServer(t)
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	req := []byte{Socks5Version, 1, NoAuth, Socks5Version, connectCommand, 0, IPV4Address}
+	req = append(req, echo.IP.To4()...)
+	req = append(req, byte(echo.Port>>8), byte(echo.Port))
+	if _, err := conn.Write(req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	reply := make([]byte, 2+10+len("PROXY UNKNOWN\r\n"))
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[3] != succeeded || string(reply[12:]) != "PROXY UNKNOWN\r\n" {
+		t.Fatalf("unexpected reply %q: %v", reply, err)
+	}
+}
@@ -0,0 +1,22 @@
+package socks5
+
+// Logger is the logging interface of the server. zap's SugaredLogger and
+// logrus' Logger satisfy it as is, slog and others need a small adapter.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// nopLogger discards everything, it is used when ServerConfig.Logger is nil so
+// that embedding the package does not produce output nobody asked for
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...interface{}) {}
+
+func (nopLogger) Infof(string, ...interface{}) {}
+
+func (nopLogger) Warnf(string, ...interface{}) {}
+
+func (nopLogger) Errorf(string, ...interface{}) {}
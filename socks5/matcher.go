@@ -0,0 +1,103 @@
+package socks5
+
+import (
+	"net"
+	"strings"
+
+	"github.com/archervanderwaal/JadeSocks/routing"
+)
+
+// Matcher selects requests by command, destination, port and user. Every
+// criterion that is set must match, empty criteria match everything.
+type Matcher struct {
+	Commands []uint8
+	Networks []*net.IPNet
+	// Domains match the domain itself and all of its subdomains, a leading
+	// "*." is accepted and ignored
+	Domains []string
+	Ports   []PortRange
+	Users   []string
+}
+
+// PortRange is an inclusive range of ports
+type PortRange = routing.PortRange
+
+// ParsePortRange parses "80" or "8000-8080"
+func ParsePortRange(s string) (PortRange, error) {
+	return routing.ParsePortRange(s)
+}
+
+// ParseCommand converts connect, bind or associate to its command code
+func ParseCommand(name string) (uint8, error) {
+	return routing.ParseCommand(name)
+}
+
+func (m *Matcher) Match(req *Request) bool {
+	if len(m.Commands) > 0 && !m.matchCommand(req.Command) {
+		return false
+	}
+	if len(m.Users) > 0 && !m.matchUser(req.AuthContext.User()) {
+		return false
+	}
+	if len(m.Ports) > 0 && !m.matchPort(req.DestAddr.Port) {
+		return false
+	}
+	// a request is matched by its domain or by the address it resolved to
+	if len(m.Networks) > 0 || len(m.Domains) > 0 {
+		return m.matchNetwork(req.DestAddr.IP) || m.matchDomain(req.DestAddr.Domain)
+	}
+	return true
+}
+
+func (m *Matcher) matchCommand(command uint8) bool {
+	for _, c := range m.Commands {
+		if c == command {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Matcher) matchUser(user string) bool {
+	for _, u := range m.Users {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Matcher) matchPort(port uint16) bool {
+	for _, r := range m.Ports {
+		if port >= r.From && port <= r.To {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Matcher) matchNetwork(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range m.Networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Matcher) matchDomain(domain string) bool {
+	if domain == "" {
+		return false
+	}
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for _, d := range m.Domains {
+		d = strings.ToLower(strings.TrimPrefix(d, "*."))
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package socks5
+
+import (
+	"time"
+
+	"github.com/archervanderwaal/JadeSocks/metrics"
+)
+
+// Reasons a connection is rejected before a relay is established
+const (
+	rejectBanned    = "banned"
+	rejectLimit     = "limit"
+	rejectHandshake = "handshake"
+	rejectVersion   = "version"
+	rejectAuth      = "auth"
+	rejectRequest   = "request"
+	rejectResolve   = "resolve"
+	rejectRule      = "rule"
+	rejectCommand   = "command"
+	rejectDial      = "dial"
+)
+
+var replyNames = map[uint8]string{
+	succeeded:            "succeeded",
+	serverFailure:        "server_failure",
+	ruleNotAllowed:       "rule_not_allowed",
+	networkUnreachable:   "network_unreachable",
+	hostUnreachable:      "host_unreachable",
+	connectionRefused:    "connection_refused",
+	ttlExpired:           "ttl_expired",
+	commandNotSupported:  "command_not_supported",
+	addrTypeNotSupported: "addr_type_not_supported",
+}
+
+var authMethodNames = map[uint8]string{
+	NoAuth:       "none",
+	UserPassAuth: "userpass",
+}
+
+// serverMetrics are the series a server records; all of them are nil, and
+// therefore no-ops, when ServerConfig.Metrics is not set
+type serverMetrics struct {
+	activeConns  *metrics.Gauge
+	accepted     *metrics.Counter
+	rejected     *metrics.CounterVec
+	auth         *metrics.CounterVec
+	replies      *metrics.CounterVec
+	dialDuration *metrics.Histogram
+	dnsDuration  *metrics.Histogram
+	dnsCache     *metrics.CounterVec
+	relayedBytes *metrics.CounterVec
+}
+
+func newServerMetrics(r *metrics.Registry) *serverMetrics {
+	return &serverMetrics{
+		activeConns: r.NewGauge("jadesocks_active_connections",
+			"Number of client connections currently being served."),
+		accepted: r.NewCounter("jadesocks_connections_accepted_total",
+			"Total number of client connections accepted by the listener."),
+		rejected: r.NewCounterVec("jadesocks_connections_rejected_total",
+			"Total number of client connections closed before relaying, by reason.", "reason"),
+		auth: r.NewCounterVec("jadesocks_auth_total",
+			"Total number of authentication attempts, by method and result.", "method", "result"),
+		replies: r.NewCounterVec("jadesocks_replies_total",
+			"Total number of SOCKS replies sent, by reply code.", "code"),
+		dialDuration: r.NewHistogram("jadesocks_dial_duration_seconds",
+			"Time taken to connect to the destination.", nil),
+		dnsDuration: r.NewHistogram("jadesocks_dns_duration_seconds",
+			"Time taken to resolve destination domain names.", nil),
+		dnsCache: r.NewCounterVec("jadesocks_dns_cache_total",
+			"Total number of DNS cache lookups, by result (hit or miss).", "result"),
+		relayedBytes: r.NewCounterVec("jadesocks_relayed_bytes_total",
+			"Total number of bytes relayed, by direction (up or down) and user.", "direction", "user"),
+	}
+}
+
+func (m *serverMetrics) reply(code uint8) {
+	name, ok := replyNames[code]
+	if !ok {
+		name = "unknown"
+	}
+	m.replies.With(name).Inc()
+}
+
+func (m *serverMetrics) authResult(method uint8, err error) {
+	name, ok := authMethodNames[method]
+	if !ok {
+		name = "unknown"
+	}
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	m.auth.With(name, result).Inc()
+}
+
+func sinceSeconds(start time.Time) float64 {
+	return time.Since(start).Seconds()
+}
@@ -0,0 +1,654 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// muxCommand is a private command of JadeSocks clients that turns the
+// connection into a carrier of multiplexed streams. Every stream carries a
+// SOCKS5 request without negotiation and is served as the user the carrier
+// authenticated as.
+const muxCommand = uint8(0x82)
+
+// A carrier carries frames of a version, a command, the length of the
+// payload and the ID of the stream, big endian, followed by the payload.
+// Clients open streams with a SYN, data goes in PSH frames, a FIN closes the
+// sending side of a stream and an RST aborts it. A stream sends at most
+// muxWindow bytes its peer has not read, the peer acknowledges what it read
+// with UPD frames. Both sides send NOP frames to keep the carrier alive.
+const (
+	muxVersion    = uint8(1)
+	muxHeaderSize = 8
+	muxMaxFrame   = 32 * 1024
+	muxWindow     = 256 * 1024
+)
+
+const (
+	muxSYN = uint8(0)
+	muxFIN = uint8(1)
+	muxPSH = uint8(2)
+	muxNOP = uint8(3)
+	muxUPD = uint8(4)
+	muxRST = uint8(5)
+)
+
+const (
+	defaultMuxCarriers    = 4
+	defaultMuxMaxStreams  = 128
+	defaultMuxIdleTimeout = 5 * time.Minute
+	defaultMuxKeepAlive   = 30 * time.Second
+)
+
+var (
+	errMuxClosed = errors.New("Carrier connection closed ")
+	errMuxReset  = errors.New("Stream reset by peer ")
+	errMuxIdle   = errors.New("Carrier connection idle ")
+)
+
+// Mux multiplexes the connections of an outbound as streams of a few long
+// lived carrier connections, servers with a Mux accept such carriers
+type Mux struct {
+	// Carriers is how many carriers an outbound opens at most, 4 by default
+	Carriers int
+	// MaxStreams is how many streams a carrier carries at once, 128 by
+	// default
+	MaxStreams int
+	// IdleTimeout closes the carriers of an outbound that carried no stream
+	// for that long, 5 minutes by default
+	IdleTimeout time.Duration
+	// KeepAlive is how often both sides ping a carrier, a carrier silent for
+	// three times as long is closed, 30 seconds by default
+	KeepAlive time.Duration
+}
+
+func (m *Mux) carriers() int {
+	if m.Carriers <= 0 {
+		return defaultMuxCarriers
+	}
+	return m.Carriers
+}
+
+func (m *Mux) maxStreams() int {
+	if m.MaxStreams <= 0 {
+		return defaultMuxMaxStreams
+	}
+	return m.MaxStreams
+}
+
+func (m *Mux) idleTimeout() time.Duration {
+	if m.IdleTimeout <= 0 {
+		return defaultMuxIdleTimeout
+	}
+	return m.IdleTimeout
+}
+
+func (m *Mux) keepAlive() time.Duration {
+	if m.KeepAlive <= 0 {
+		return defaultMuxKeepAlive
+	}
+	return m.KeepAlive
+}
+
+// muxSession is one end of a carrier
+type muxSession struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	mux    *Mux
+	client bool
+	// accept serves the streams clients open, on servers
+	accept func(*muxStream)
+
+	writeMu sync.Mutex
+
+	mu        sync.Mutex
+	streams   map[uint32]*muxStream
+	nextID    uint32
+	idleSince time.Time
+	err       error
+	die       chan struct{}
+	once      sync.Once
+}
+
+func newMuxSession(conn net.Conn, reader io.Reader, mux *Mux, accept func(*muxStream)) *muxSession {
+	s := &muxSession{
+		conn:      conn,
+		reader:    bufio.NewReader(reader),
+		mux:       mux,
+		client:    accept == nil,
+		accept:    accept,
+		streams:   make(map[uint32]*muxStream),
+		idleSince: time.Now(),
+		die:       make(chan struct{}),
+	}
+	go s.recvLoop()
+	go s.keepAlive()
+	return s
+}
+
+func (s *muxSession) close(err error) {
+	s.once.Do(func() {
+		s.mu.Lock()
+		s.err = err
+		s.mu.Unlock()
+		close(s.die)
+		_ = s.conn.Close()
+	})
+}
+
+func (s *muxSession) closed() bool {
+	select {
+	case <-s.die:
+		return true
+	default:
+		return false
+	}
+}
+
+// numStreams returns how many streams are open
+func (s *muxSession) numStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+func (s *muxSession) writeFrame(cmd uint8, id uint32, payload []byte) error {
+	frame := make([]byte, muxHeaderSize+len(payload))
+	frame[0], frame[1] = muxVersion, cmd
+	binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:], id)
+	copy(frame[muxHeaderSize:], payload)
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	select {
+	case <-s.die:
+		return errMuxClosed
+	default:
+	}
+	_ = s.conn.SetWriteDeadline(time.Now().Add(3 * s.mux.keepAlive()))
+	if _, err := s.conn.Write(frame); err != nil {
+		s.close(err)
+		return err
+	}
+	return nil
+}
+
+// open opens a new stream of a client carrier
+func (s *muxSession) open() (*muxStream, error) {
+	s.mu.Lock()
+	if s.closed() || s.nextID == math.MaxUint32 {
+		s.mu.Unlock()
+		s.close(errMuxClosed)
+		return nil, errMuxClosed
+	}
+	s.nextID++
+	stream := newMuxStream(s, s.nextID)
+	s.streams[stream.id] = stream
+	s.mu.Unlock()
+	if err := s.writeFrame(muxSYN, stream.id, nil); err != nil {
+		s.remove(stream.id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (s *muxSession) stream(id uint32) *muxStream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+func (s *muxSession) remove(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.streams, id)
+	if len(s.streams) == 0 {
+		s.idleSince = time.Now()
+	}
+}
+
+// idle reports whether the carrier carried no stream for the idle timeout
+func (s *muxSession) idle(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams) == 0 && now.Sub(s.idleSince) >= s.mux.idleTimeout()
+}
+
+// keepAlive pings the carrier, and closes it once idle on clients
+func (s *muxSession) keepAlive() {
+	ticker := time.NewTicker(s.mux.keepAlive())
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if s.client && s.idle(now) {
+				s.close(errMuxIdle)
+				return
+			}
+			if err := s.writeFrame(muxNOP, 0, nil); err != nil {
+				return
+			}
+		case <-s.die:
+			return
+		}
+	}
+}
+
+func (s *muxSession) recvLoop() {
+	header := make([]byte, muxHeaderSize)
+	for {
+		_ = s.conn.SetReadDeadline(time.Now().Add(3 * s.mux.keepAlive()))
+		if _, err := io.ReadFull(s.reader, header); err != nil {
+			s.close(err)
+			return
+		}
+		if header[0] != muxVersion {
+			s.close(fmt.Errorf("Unsupported mux version %d ", header[0]))
+			return
+		}
+		payload := make([]byte, binary.BigEndian.Uint16(header[2:]))
+		if _, err := io.ReadFull(s.reader, payload); err != nil {
+			s.close(err)
+			return
+		}
+		if err := s.handleFrame(header[1], binary.BigEndian.Uint32(header[4:]), payload); err != nil {
+			s.close(err)
+			return
+		}
+	}
+}
+
+func (s *muxSession) handleFrame(cmd uint8, id uint32, payload []byte) error {
+	switch cmd {
+	case muxNOP:
+		return nil
+	case muxSYN:
+		if s.client {
+			return errors.New("Unexpected stream opened by server ")
+		}
+		s.mu.Lock()
+		if _, ok := s.streams[id]; ok {
+			s.mu.Unlock()
+			return fmt.Errorf("Stream %d opened twice ", id)
+		}
+		if len(s.streams) >= s.mux.maxStreams() {
+			s.mu.Unlock()
+			return s.writeFrame(muxRST, id, nil)
+		}
+		stream := newMuxStream(s, id)
+		s.streams[id] = stream
+		s.mu.Unlock()
+		go s.accept(stream)
+		return nil
+	}
+	stream := s.stream(id)
+	if stream == nil {
+		// the stream was closed on this side
+		return nil
+	}
+	switch cmd {
+	case muxPSH:
+		return stream.push(payload)
+	case muxFIN:
+		stream.remoteClose()
+	case muxRST:
+		stream.reset()
+		s.remove(id)
+	case muxUPD:
+		if len(payload) != 4 {
+			return errors.New("Malformed window update ")
+		}
+		stream.grant(int(binary.BigEndian.Uint32(payload)))
+	default:
+		return fmt.Errorf("Unknown mux command %d ", cmd)
+	}
+	return nil
+}
+
+// muxStream is a stream of a carrier, it is a net.Conn with the addresses
+// of the carrier
+type muxStream struct {
+	id      uint32
+	session *muxSession
+
+	mu            sync.Mutex
+	buf           bytes.Buffer
+	consumed      int
+	window        int
+	remoteFin     bool
+	localFin      bool
+	aborted       bool
+	closed        bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readable      chan struct{}
+	writable      chan struct{}
+}
+
+func newMuxStream(s *muxSession, id uint32) *muxStream {
+	return &muxStream{
+		id:       id,
+		session:  s,
+		window:   muxWindow,
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// muxTimeout is returned by streams past their deadline
+type muxTimeout struct{}
+
+func (muxTimeout) Error() string   { return "i/o timeout" }
+func (muxTimeout) Timeout() bool   { return true }
+func (muxTimeout) Temporary() bool { return true }
+
+// wait blocks until ch is notified, the deadline passes or the carrier dies
+func (st *muxStream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return muxTimeout{}
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return muxTimeout{}
+	case <-st.session.die:
+		// data that arrived before the carrier died is still read
+		select {
+		case <-ch:
+			return nil
+		default:
+			return errMuxClosed
+		}
+	}
+}
+
+func (st *muxStream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.buf.Len() > 0 {
+			n, _ := st.buf.Read(p)
+			st.consumed += n
+			update := 0
+			if st.consumed >= muxWindow/2 && !st.remoteFin {
+				update, st.consumed = st.consumed, 0
+			}
+			st.mu.Unlock()
+			if update > 0 {
+				payload := make([]byte, 4)
+				binary.BigEndian.PutUint32(payload, uint32(update))
+				_ = st.session.writeFrame(muxUPD, st.id, payload)
+			}
+			return n, nil
+		}
+		switch {
+		case st.aborted:
+			st.mu.Unlock()
+			return 0, errMuxReset
+		case st.remoteFin:
+			st.mu.Unlock()
+			return 0, io.EOF
+		case st.closed:
+			st.mu.Unlock()
+			return 0, io.ErrClosedPipe
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+		if err := st.wait(st.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *muxStream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		st.mu.Lock()
+		switch {
+		case st.aborted:
+			st.mu.Unlock()
+			return written, errMuxReset
+		case st.localFin || st.closed:
+			st.mu.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		if st.window == 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+			if err := st.wait(st.writable, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		n := len(p) - written
+		if n > st.window {
+			n = st.window
+		}
+		if n > muxMaxFrame {
+			n = muxMaxFrame
+		}
+		st.window -= n
+		st.mu.Unlock()
+		if err := st.session.writeFrame(muxPSH, st.id, p[written:written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// CloseWrite tells the peer that nothing more is sent
+func (st *muxStream) CloseWrite() error {
+	st.mu.Lock()
+	if st.localFin || st.aborted || st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.localFin = true
+	st.mu.Unlock()
+	return st.session.writeFrame(muxFIN, st.id, nil)
+}
+
+// Close closes the stream, it is reset when the peer may still send
+func (st *muxStream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	cmd := muxFIN
+	if !st.remoteFin {
+		cmd = muxRST
+	}
+	send := !st.aborted && (cmd == muxRST || !st.localFin)
+	st.localFin = true
+	st.mu.Unlock()
+	notify(st.readable)
+	notify(st.writable)
+	st.session.remove(st.id)
+	if send {
+		return st.session.writeFrame(cmd, st.id, nil)
+	}
+	return nil
+}
+
+// push queues data received from the peer
+func (st *muxStream) push(data []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.buf.Len()+len(data) > muxWindow {
+		return fmt.Errorf("Stream %d overflowed its window ", st.id)
+	}
+	st.buf.Write(data)
+	notify(st.readable)
+	return nil
+}
+
+func (st *muxStream) remoteClose() {
+	st.mu.Lock()
+	st.remoteFin = true
+	st.mu.Unlock()
+	notify(st.readable)
+}
+
+func (st *muxStream) reset() {
+	st.mu.Lock()
+	st.aborted = true
+	st.mu.Unlock()
+	notify(st.readable)
+	notify(st.writable)
+}
+
+func (st *muxStream) grant(n int) {
+	st.mu.Lock()
+	st.window += n
+	st.mu.Unlock()
+	notify(st.writable)
+}
+
+func (st *muxStream) LocalAddr() net.Addr  { return st.session.conn.LocalAddr() }
+func (st *muxStream) RemoteAddr() net.Addr { return st.session.conn.RemoteAddr() }
+
+func (st *muxStream) SetDeadline(t time.Time) error {
+	_ = st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *muxStream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	notify(st.readable)
+	return nil
+}
+
+func (st *muxStream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	notify(st.writable)
+	return nil
+}
+
+// muxPool holds the carriers of an outbound
+type muxPool struct {
+	mu       sync.Mutex
+	carriers []*muxSession
+	// dialing is closed when the carrier being dialed is ready
+	dialing chan struct{}
+}
+
+// open opens a stream on the least busy carrier. A new carrier is dialed
+// while the pool is not full and every carrier is busy.
+func (p *muxPool) open(mux *Mux, dial func() (*muxSession, error)) (*muxStream, error) {
+	for {
+		p.mu.Lock()
+		live := p.carriers[:0]
+		for _, carrier := range p.carriers {
+			if !carrier.closed() {
+				live = append(live, carrier)
+			}
+		}
+		for i := len(live); i < len(p.carriers); i++ {
+			p.carriers[i] = nil
+		}
+		p.carriers = live
+		var best *muxSession
+		bestStreams := 0
+		for _, carrier := range p.carriers {
+			if n := carrier.numStreams(); n < mux.maxStreams() && (best == nil || n < bestStreams) {
+				best, bestStreams = carrier, n
+			}
+		}
+		grow := p.dialing == nil && len(p.carriers) < mux.carriers() && (best == nil || bestStreams > 0)
+		if !grow {
+			dialing := p.dialing
+			p.mu.Unlock()
+			switch {
+			case best != nil:
+				if stream, err := best.open(); err == nil {
+					return stream, nil
+				}
+			case dialing != nil:
+				<-dialing
+			default:
+				return nil, fmt.Errorf("All %d carriers carry %d streams ", mux.carriers(), mux.maxStreams())
+			}
+			continue
+		}
+		dialing := make(chan struct{})
+		p.dialing = dialing
+		p.mu.Unlock()
+
+		carrier, err := dial()
+		p.mu.Lock()
+		p.dialing = nil
+		if err == nil {
+			p.carriers = append(p.carriers, carrier)
+		}
+		p.mu.Unlock()
+		close(dialing)
+		if err != nil {
+			if best == nil {
+				return nil, err
+			}
+			carrier = best
+		}
+		if stream, err := carrier.open(); err == nil {
+			return stream, nil
+		}
+	}
+}
+
+// handleMux serves the streams of a carrier until it is closed
+func (server *Server) handleMux(req *Request, conn net.Conn) error {
+	conf := req.session.conf
+	if err := server.sendReply(req.session, succeeded, nil); err != nil {
+		conf.Logger.Errorf("Failed to send response: %v ", err)
+		return err
+	}
+	conf.Logger.Infof("Carrier connected from %s", clientAddr(conn))
+	carrier := newMuxSession(conn, req.reader, conf.Mux, func(stream *muxStream) {
+		_ = server.handleStream(conf, stream, req.AuthContext)
+	})
+	<-carrier.die
+	conf.Logger.Infof("Carrier from %s closed: %v", clientAddr(conn), carrier.err)
+	return nil
+}
+
+// handleStream serves the request of a stream as the user of its carrier
+func (server *Server) handleStream(conf *ServerConfig, stream *muxStream, authContext *AuthContext) error {
+	defer stream.Close()
+	server.metrics.activeConns.Inc()
+	defer server.metrics.activeConns.Dec()
+	sess := newSession(conf, stream)
+	server.trackSession(sess)
+	defer server.untrackSession(sess)
+	if conf.HandshakeTimeout > 0 {
+		_ = stream.SetDeadline(time.Now().Add(conf.HandshakeTimeout))
+	}
+	return server.handleRequest(sess, stream, stream, authContext)
+}
@@ -0,0 +1,152 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMux_Streams(t *testing.T) {
+	echo := startEchoServer(t)
+	server, addr := startTestServer(t, &ServerConfig{
+		AuthMethods: []Authenticator{UserPassAuthenticator{Accounts: Accounts{MemoryUser: MemoryUser{"alice": "secret"}}}},
+		Mux:         &Mux{},
+	})
+	outbound := &Socks5Outbound{Address: addr, Username: "alice", Password: "secret", Timeout: 5 * time.Second, Mux: &Mux{Carriers: 2}}
+
+	// more than a window each way, so that streams wait for window updates
+	payload := bytes.Repeat([]byte("multiplexed"), 50000)
+	const streams = 20
+	var wg sync.WaitGroup
+	conns := make(chan io.Closer, streams)
+	errs := make(chan error, streams)
+	for i := 0; i < streams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := outbound.Dial("tcp", *addrSpec(echo.IP, echo.Port))
+			if err != nil {
+				errs <- err
+				return
+			}
+			conns <- conn
+			_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+			go func() { _, _ = conn.Write(payload) }()
+			data := make([]byte, len(payload))
+			if _, err := io.ReadFull(conn, data); err != nil || !bytes.Equal(data, payload) {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("stream failed: %v", err)
+	}
+
+	// every stream is a session of its own, the carriers are sessions too
+	connects, carriers := 0, 0
+	for _, sess := range server.Sessions() {
+		switch sess.Command {
+		case "connect":
+			connects++
+			if sess.User != "alice" || sess.BytesUp != uint64(len(payload)) {
+				t.Fatalf("unexpected stream session %+v", sess)
+			}
+		case "mux":
+			carriers++
+		}
+	}
+	if connects != streams || carriers < 1 || carriers > 2 {
+		t.Fatalf("%d stream sessions over %d carriers", connects, carriers)
+	}
+	close(conns)
+	for conn := range conns {
+		_ = conn.Close()
+	}
+}
+
+func TestMux_IdleCarriers(t *testing.T) {
+	echo := startEchoServer(t)
+	server, addr := startTestServer(t, &ServerConfig{
+		AuthMethods: []Authenticator{NoAuthAuthenticator{}},
+		Mux:         &Mux{KeepAlive: 50 * time.Millisecond},
+	})
+	outbound := &Socks5Outbound{
+		Address: addr,
+		Timeout: 5 * time.Second,
+		Mux:     &Mux{IdleTimeout: 200 * time.Millisecond, KeepAlive: 50 * time.Millisecond},
+	}
+	conn, err := outbound.Dial("tcp", *addrSpec(echo.IP, echo.Port))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	// keepalives hold a carrier with a stream open beyond the idle timeout
+	time.Sleep(400 * time.Millisecond)
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_ = conn.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(server.Sessions()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("idle carrier not closed: %+v", server.Sessions())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	// a new carrier replaces the closed one
+	conn, err = outbound.Dial("tcp", *addrSpec(echo.IP, echo.Port))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_ = conn.Close()
+}
+
+func TestMux_Limits(t *testing.T) {
+	echo := startEchoServer(t)
+	_, addr := startTestServer(t, &ServerConfig{
+		AuthMethods: []Authenticator{NoAuthAuthenticator{}},
+		Mux:         &Mux{MaxStreams: 1},
+	})
+	dest := *addrSpec(echo.IP, echo.Port)
+
+	outbound := &Socks5Outbound{Address: addr, Timeout: 5 * time.Second, Mux: &Mux{Carriers: 1, MaxStreams: 1}}
+	conn, err := outbound.Dial("tcp", dest)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := outbound.Dial("tcp", dest); err == nil {
+		t.Fatalf("expected a full pool to refuse streams")
+	}
+	_ = conn.Close()
+
+	// the server resets streams beyond its own limit
+	outbound = &Socks5Outbound{Address: addr, Timeout: 5 * time.Second, Mux: &Mux{Carriers: 1}}
+	conn, err = outbound.Dial("tcp", dest)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	if _, err := outbound.Dial("tcp", dest); err == nil {
+		t.Fatalf("expected the server to refuse a second stream")
+	}
+}
+
+func TestMux_Rejected(t *testing.T) {
+	if _, err := New(&ServerConfig{Protocol: ProtocolHTTP, AuthMethods: []Authenticator{NoAuthAuthenticator{}}, Mux: &Mux{}}); err == nil {
+		t.Fatalf("expected carriers on an HTTP server to be rejected")
+	}
+	echo := startEchoServer(t)
+	_, addr := startTestServer(t, &ServerConfig{AuthMethods: []Authenticator{NoAuthAuthenticator{}}})
+	outbound := &Socks5Outbound{Address: addr, Timeout: 5 * time.Second, Mux: &Mux{}}
+	if _, err := outbound.Dial("tcp", *addrSpec(echo.IP, echo.Port)); err == nil {
+		t.Fatalf("expected a server without mux to refuse carriers")
+	}
+}
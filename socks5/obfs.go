@@ -0,0 +1,653 @@
+package socks5
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// An obfuscated connection starts with a hello of a random salt, the time of
+// the client masked under the key and a tag over both that proves the client
+// knows the key, followed by records sealed with AES-256-GCM under keys
+// derived from the key and the salt. The plaintext of a record is the length
+// of its data, the data and random padding. Without camouflage the hello is
+// 40 bytes and records start with their sealed length. With camouflage the
+// salt and tag are the random of a TLS ClientHello and the masked time starts
+// its session ID, the server answers with a ServerHello, and records are TLS
+// application data.
+const (
+	obfsSaltSize  = 16
+	obfsStampSize = 8
+	obfsTagSize   = 16
+	obfsHelloSize = obfsSaltSize + obfsStampSize + obfsTagSize
+	// obfsMaxPlaintext bounds the plaintext of a record like TLS does
+	obfsMaxPlaintext = 16384
+	tlsRecordHeader  = 5
+)
+
+const (
+	defaultObfsPaddedRecords = 8
+	// obfsPaddedMin and obfsPaddedMax bound the size padded records are
+	// brought up to
+	obfsPaddedMin = 200
+	obfsPaddedMax = 1400
+	// obfsFallbackTimeout bounds dials to the fallback web server
+	obfsFallbackTimeout = 10 * time.Second
+	defaultObfsWindow   = 2 * time.Minute
+	// defaultReplayCapacity is how many hellos a replay filter holds before
+	// it rotates
+	defaultReplayCapacity = 100000
+)
+
+const (
+	tlsChangeCipherSpec = byte(20)
+	tlsAlert            = byte(21)
+	tlsHandshake        = byte(22)
+	tlsApplicationData  = byte(23)
+)
+
+// httpMethodPrefixes are the first bytes of HTTP requests, peers starting
+// with them are answered as web clients without waiting for a whole hello
+var httpMethodPrefixes = []string{"GET ", "HEAD", "POST", "PUT ", "DELE", "OPTI", "PATC", "CONN", "TRAC", "PRI "}
+
+// Obfs hides the tunnel to resist protocol fingerprinting. Both ends share
+// Key, peers that do not prove they know it are answered like a web server.
+type Obfs struct {
+	Key string
+	// Users gives each user of a server a key of their own, the password of
+	// the account. Servers accept these keys besides Key and tell which user
+	// a client is from the key alone, the name never goes over the wire.
+	// Such clients authenticate as that user when they offer no
+	// authentication, whatever the AuthMethods of the server allow.
+	Users Accounts
+	// Window is how far the clock of a client may be off from that of the
+	// server, 2 minutes by default. Servers refuse hellos outside of it and
+	// hellos they have seen before.
+	Window time.Duration
+	// ReplayCapacity is how many hellos the replay filter of a server holds
+	// before it forgets the oldest, 100000 by default
+	ReplayCapacity int
+	// Camouflage makes the connection look like TLS 1.3, the client sends a
+	// ClientHello for SNI
+	Camouflage bool
+	SNI        string
+	// PaddedRecords is how many records each side starts with that are
+	// padded to a random size, hiding the sizes of handshakes, 8 by default
+	PaddedRecords int
+	// MaxRecord bounds the plaintext of records, writes larger than that are
+	// split into records of random sizes, 16384 by default
+	MaxRecord int
+	// Fallback is the host:port of a web server that servers relay
+	// unauthenticated peers to, the bytes they sent included. Without it
+	// servers answer HTTP requests with Decoy and refuse TLS handshakes.
+	Fallback string
+	Decoy    []byte
+
+	replayOnce sync.Once
+	replay     *replayFilter
+}
+
+func (o *Obfs) paddedRecords() int {
+	if o.PaddedRecords == 0 {
+		return defaultObfsPaddedRecords
+	}
+	if o.PaddedRecords < 0 {
+		return 0
+	}
+	return o.PaddedRecords
+}
+
+func (o *Obfs) maxRecord() int {
+	if o.MaxRecord <= 2 || o.MaxRecord > obfsMaxPlaintext {
+		return obfsMaxPlaintext
+	}
+	return o.MaxRecord
+}
+
+func (o *Obfs) window() time.Duration {
+	if o.Window <= 0 {
+		return defaultObfsWindow
+	}
+	return o.Window
+}
+
+// replayFilter returns the filter of the hellos the server has seen, salts
+// are remembered for at least twice the window so that a hello is refused
+// for as long as its time is within the window
+func (o *Obfs) replayFilter() *replayFilter {
+	o.replayOnce.Do(func() {
+		o.replay = newReplayFilter(o.replayCapacity(), 2*o.window())
+	})
+	return o.replay
+}
+
+func (o *Obfs) replayCapacity() int {
+	if o.ReplayCapacity <= 0 {
+		return defaultReplayCapacity
+	}
+	return o.ReplayCapacity
+}
+
+// inherit takes over the replay filter of old, the configuration o replaces
+// on a reload, so that hellos seen before the reload stay refused
+func (o *Obfs) inherit(old *Obfs) {
+	replay := old.replayFilter()
+	replay.resize(o.replayCapacity(), 2*o.window())
+	o.replayOnce.Do(func() { o.replay = replay })
+}
+
+// identify finds the key that the tag of hello was made with, it returns the
+// key, its user, "" for the shared key, and the time of the client
+func (o *Obfs) identify(hello []byte) ([]byte, string, time.Time, bool) {
+	salt, stamp, tag := hello[:obfsSaltSize], hello[obfsSaltSize:obfsSaltSize+obfsStampSize], hello[obfsSaltSize+obfsStampSize:]
+	try := func(secret string) ([]byte, time.Time, bool) {
+		key := obfsKey(secret)
+		unmasked := xorBytes(stamp, obfsMask(key, salt))
+		if !hmac.Equal(tag, obfsTag(key, salt, unmasked)) {
+			return nil, time.Time{}, false
+		}
+		return key, time.Unix(int64(binary.BigEndian.Uint64(unmasked)), 0), true
+	}
+	if o.Key != "" {
+		if key, at, ok := try(o.Key); ok {
+			return key, "", at, true
+		}
+	}
+	for user, secret := range o.Users.MemoryUser {
+		if key, at, ok := try(secret); ok {
+			return key, user, at, true
+		}
+	}
+	return nil, "", time.Time{}, false
+}
+
+// keyAuth is the outcome of authenticating with the obfuscation key of user
+func keyAuth(user string) *AuthContext {
+	return &AuthContext{Method: NoAuth, Payload: map[string]string{"Username": user, "Key": "verified"}}
+}
+
+// obfsKey derives the key that hellos and records are keyed with from a
+// secret
+func obfsKey(secret string) []byte {
+	key := sha256.Sum256([]byte(secret))
+	return key[:]
+}
+
+func obfsTag(key, salt, stamp []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(salt)
+	mac.Write(stamp)
+	return mac.Sum(nil)[:obfsTagSize]
+}
+
+// obfsMask returns what the time in the hello of salt is masked with
+func obfsMask(key, salt []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("jadesocks obfs time"))
+	mac.Write(salt)
+	return mac.Sum(nil)[:obfsStampSize]
+}
+
+func xorBytes(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
+
+// obfsAEAD returns the cipher of one direction of the connection of salt
+func obfsAEAD(key, salt []byte, label string) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// dialObfs obfuscates conn for a client, the hello goes out with the first
+// record
+func dialObfs(conn net.Conn, obfs *Obfs) (net.Conn, error) {
+	salt := make([]byte, obfsSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key := obfsKey(obfs.Key)
+	stamp := make([]byte, obfsStampSize)
+	binary.BigEndian.PutUint64(stamp, uint64(time.Now().Unix()))
+	masked := xorBytes(stamp, obfsMask(key, salt))
+	tag := obfsTag(key, salt, stamp)
+	hello := append(append(append([]byte(nil), salt...), masked...), tag...)
+	if obfs.Camouflage {
+		var err error
+		if hello, err = clientHello(append(append([]byte(nil), salt...), tag...), masked, obfs.SNI); err != nil {
+			return nil, err
+		}
+	}
+	return newObfsConn(conn, bufio.NewReader(conn), obfs, key, salt, true, hello)
+}
+
+// acceptObfs checks the hello of a client. Peers that fail are answered like
+// a web server and an error is returned.
+func acceptObfs(conn net.Conn, obfs *Obfs, timeout time.Duration) (*obfsConn, error) {
+	if timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(timeout))
+	}
+	reader := bufio.NewReaderSize(conn, tlsRecordHeader+obfsMaxPlaintext+2048)
+	hello, sessionID, length, err := readObfsHello(reader, obfs)
+	var key []byte
+	var user string
+	if err == nil {
+		var at time.Time
+		var ok bool
+		key, user, at, ok = obfs.identify(hello)
+		switch {
+		case !ok:
+			err = errors.New("Unauthenticated obfuscation hello ")
+		case at.Before(time.Now().Add(-obfs.window())) || at.After(time.Now().Add(obfs.window())):
+			err = fmt.Errorf("Obfuscation hello from %s is outside the time window ", at.Format(time.RFC3339))
+		case obfs.replayFilter().seen(hello[:obfsSaltSize]):
+			err = errors.New("Replayed obfuscation hello ")
+		}
+	}
+	if err != nil {
+		obfs.refuse(conn, reader)
+		return nil, err
+	}
+	salt, sessionID := append([]byte(nil), hello[:obfsSaltSize]...), append([]byte(nil), sessionID...)
+	_, _ = reader.Discard(length)
+	if obfs.Camouflage {
+		hello, err := serverHello(sessionID)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write(hello); err != nil {
+			return nil, err
+		}
+	}
+	_ = conn.SetDeadline(time.Time{})
+	c, err := newObfsConn(conn, reader, obfs, key, salt, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.user = user
+	return c, nil
+}
+
+// readObfsHello peeks at the hello of a client, it returns the salt, masked
+// time and tag, the session ID of a ClientHello and the length of the hello
+func readObfsHello(reader *bufio.Reader, obfs *Obfs) ([]byte, []byte, int, error) {
+	prefix, err := reader.Peek(4)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	for _, method := range httpMethodPrefixes {
+		if string(prefix) == method {
+			return nil, nil, 0, errors.New("HTTP request instead of an obfuscation hello ")
+		}
+	}
+	if !obfs.Camouflage {
+		hello, err := reader.Peek(obfsHelloSize)
+		return append([]byte(nil), hello...), nil, len(hello), err
+	}
+	header, err := reader.Peek(tlsRecordHeader)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	length := int(binary.BigEndian.Uint16(header[3:]))
+	if header[0] != tlsHandshake || header[1] != 3 || length > obfsMaxPlaintext {
+		return nil, nil, 0, errors.New("Not a TLS handshake ")
+	}
+	record, err := reader.Peek(tlsRecordHeader + length)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	// type, length and version of the ClientHello, then random and session ID
+	hello := record[tlsRecordHeader:]
+	if len(hello) < 4+2+32+1 || hello[0] != 1 {
+		return nil, nil, 0, errors.New("Not a ClientHello ")
+	}
+	random := hello[6:38]
+	sessionID := hello[39:]
+	if int(hello[38]) > len(sessionID) || hello[38] < obfsStampSize {
+		return nil, nil, 0, errors.New("Malformed ClientHello ")
+	}
+	sessionID = sessionID[:hello[38]]
+	salted := append(append(append([]byte(nil), random[:obfsSaltSize]...), sessionID[:obfsStampSize]...), random[obfsSaltSize:]...)
+	return salted, sessionID, len(record), nil
+}
+
+// refuse answers a peer that did not authenticate like the web server the
+// obfuscated server poses as
+func (o *Obfs) refuse(conn net.Conn, reader *bufio.Reader) {
+	if o.Fallback != "" {
+		relayFallback(conn, reader, o.Fallback)
+		return
+	}
+	if first, err := reader.Peek(1); err == nil && first[0] == tlsHandshake {
+		// handshake_failure, as servers without a certificate for the SNI do
+		_, _ = conn.Write([]byte{tlsAlert, 3, 3, 0, 2, 2, 40})
+		return
+	}
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			_, _ = io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		}
+		return
+	}
+	writeDecoy(conn, req, o.Decoy)
+}
+
+// relayFallback relays conn, with what was read of it so far, to the web
+// server at fallback
+func relayFallback(conn net.Conn, reader *bufio.Reader, fallback string) {
+	target, err := net.DialTimeout("tcp", fallback, obfsFallbackTimeout)
+	if err != nil {
+		return
+	}
+	defer target.Close()
+	_ = conn.SetDeadline(time.Time{})
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(target, reader)
+		if cw, ok := target.(closeWriter); ok {
+			_ = cw.CloseWrite()
+		}
+		close(done)
+	}()
+	_, _ = io.Copy(conn, target)
+	_ = conn.Close()
+	<-done
+}
+
+// obfsConn reads and writes the records of an obfuscated connection
+type obfsConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	obfs       *Obfs
+	camouflage bool
+	// user is the user whose key the client used, "" for the shared key
+	user string
+
+	writeMu   sync.Mutex
+	seal      cipher.AEAD
+	sealNonce []byte
+	// pending is written ahead of the first record, the hello of a client
+	pending []byte
+	padded  int
+
+	open      cipher.AEAD
+	openNonce []byte
+	data      []byte
+}
+
+func newObfsConn(conn net.Conn, reader *bufio.Reader, obfs *Obfs, key, salt []byte, client bool, pending []byte) (*obfsConn, error) {
+	up, err := obfsAEAD(key, salt, "jadesocks obfs up")
+	if err != nil {
+		return nil, err
+	}
+	down, err := obfsAEAD(key, salt, "jadesocks obfs down")
+	if err != nil {
+		return nil, err
+	}
+	c := &obfsConn{
+		Conn:       conn,
+		reader:     reader,
+		obfs:       obfs,
+		camouflage: obfs.Camouflage,
+		seal:       down,
+		open:       up,
+		pending:    pending,
+		padded:     obfs.paddedRecords(),
+	}
+	if client {
+		c.seal, c.open = up, down
+	}
+	c.sealNonce = make([]byte, c.seal.NonceSize())
+	c.openNonce = make([]byte, c.open.NonceSize())
+	return c, nil
+}
+
+func incrementNonce(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+func (c *obfsConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	written := 0
+	for written < len(p) {
+		n := c.recordSize(len(p) - written)
+		if _, err := c.Conn.Write(c.record(p[written : written+n])); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// recordSize picks how much of a write of n bytes goes in the next record,
+// writes too large for one record are split at random sizes
+func (c *obfsConn) recordSize(n int) int {
+	max := c.obfs.maxRecord() - 2
+	if n <= max {
+		return n
+	}
+	return max/2 + mrand.Intn(max/2+1)
+}
+
+// record seals data in a record, after the pending hello
+func (c *obfsConn) record(data []byte) []byte {
+	padding := 0
+	if c.padded > 0 {
+		c.padded--
+		if target := obfsPaddedMin + mrand.Intn(obfsPaddedMax-obfsPaddedMin); target > len(data) {
+			padding = target - len(data)
+		}
+		if len(data)+padding > obfsMaxPlaintext-2 {
+			padding = obfsMaxPlaintext - 2 - len(data)
+		}
+	}
+	plaintext := make([]byte, 2+len(data)+padding)
+	binary.BigEndian.PutUint16(plaintext, uint16(len(data)))
+	copy(plaintext[2:], data)
+
+	out := c.pending
+	c.pending = nil
+	size := len(plaintext) + c.seal.Overhead()
+	if c.camouflage {
+		out = append(out, tlsApplicationData, 3, 3, byte(size>>8), byte(size))
+	} else {
+		out = c.seal.Seal(out, c.sealNonce, []byte{byte(size >> 8), byte(size)}, nil)
+		incrementNonce(c.sealNonce)
+	}
+	out = c.seal.Seal(out, c.sealNonce, plaintext, nil)
+	incrementNonce(c.sealNonce)
+	return out
+}
+
+// flush sends the pending hello, so that a client reading first does not
+// wait for a server waiting for the hello
+func (c *obfsConn) flush() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.pending == nil {
+		return nil
+	}
+	_, err := c.Conn.Write(c.record(nil))
+	return err
+}
+
+func (c *obfsConn) Read(p []byte) (int, error) {
+	if err := c.flush(); err != nil {
+		return 0, err
+	}
+	for len(c.data) == 0 {
+		data, err := c.readRecord()
+		if err != nil {
+			return 0, err
+		}
+		c.data = data
+	}
+	n := copy(p, c.data)
+	c.data = c.data[n:]
+	return n, nil
+}
+
+// readRecord returns the data of the next record
+func (c *obfsConn) readRecord() ([]byte, error) {
+	var size int
+	if c.camouflage {
+		header := make([]byte, tlsRecordHeader)
+		for {
+			if _, err := io.ReadFull(c.reader, header); err != nil {
+				return nil, err
+			}
+			size = int(binary.BigEndian.Uint16(header[3:]))
+			if header[0] == tlsApplicationData {
+				break
+			}
+			// the ServerHello and ChangeCipherSpec of the camouflage
+			if header[0] != tlsHandshake && header[0] != tlsChangeCipherSpec {
+				return nil, fmt.Errorf("Unexpected TLS record type %d ", header[0])
+			}
+			if _, err := c.reader.Discard(size); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		sealed := make([]byte, 2+c.open.Overhead())
+		if _, err := io.ReadFull(c.reader, sealed); err != nil {
+			return nil, err
+		}
+		length, err := c.open.Open(sealed[:0], c.openNonce, sealed, nil)
+		if err != nil {
+			return nil, errors.New("Corrupt obfuscated record ")
+		}
+		incrementNonce(c.openNonce)
+		size = int(binary.BigEndian.Uint16(length))
+	}
+	if size < 2+c.open.Overhead() || size > obfsMaxPlaintext+c.open.Overhead() {
+		return nil, fmt.Errorf("Invalid obfuscated record size %d ", size)
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(c.reader, sealed); err != nil {
+		return nil, err
+	}
+	plaintext, err := c.open.Open(sealed[:0], c.openNonce, sealed, nil)
+	if err != nil {
+		return nil, errors.New("Corrupt obfuscated record ")
+	}
+	incrementNonce(c.openNonce)
+	n := int(binary.BigEndian.Uint16(plaintext))
+	if n > len(plaintext)-2 {
+		return nil, errors.New("Corrupt obfuscated record ")
+	}
+	return plaintext[2 : 2+n], nil
+}
+
+func (c *obfsConn) CloseWrite() error {
+	if err := c.flush(); err != nil {
+		return err
+	}
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// clientHello returns a TLS 1.3 ClientHello record for sni with random as
+// its random and a session ID starting with prefix, shaped like those of
+// common browsers
+func clientHello(random, prefix []byte, sni string) ([]byte, error) {
+	keys := make([]byte, 64)
+	if _, err := rand.Read(keys); err != nil {
+		return nil, err
+	}
+	sessionID, keyShare := keys[:32], keys[32:]
+	copy(sessionID, prefix)
+
+	var ext []byte
+	if sni != "" {
+		name := append(appendUint16(nil, uint16(len(sni)+3)), 0)
+		name = append(appendUint16(name, uint16(len(sni))), sni...)
+		ext = appendExtension(ext, 0x0000, name)
+	}
+	ext = appendExtension(ext, 0x0017, nil)
+	ext = appendExtension(ext, 0xff01, []byte{0})
+	ext = appendExtension(ext, 0x000a, []byte{0, 8, 0, 0x1d, 0, 0x17, 0, 0x18, 0, 0x19})
+	ext = appendExtension(ext, 0x000b, []byte{1, 0})
+	ext = appendExtension(ext, 0x0010, []byte{0, 12, 2, 'h', '2', 8, 'h', 't', 't', 'p', '/', '1', '.', '1'})
+	ext = appendExtension(ext, 0x000d, []byte{0, 16, 4, 3, 8, 4, 4, 1, 5, 3, 8, 5, 5, 1, 8, 6, 6, 1})
+	ext = appendExtension(ext, 0x002b, []byte{4, 3, 4, 3, 3})
+	ext = appendExtension(ext, 0x002d, []byte{1, 1})
+	ext = appendExtension(ext, 0x0033, append([]byte{0, 36, 0, 0x1d, 0, 32}, keyShare...))
+
+	suites := []uint16{0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035}
+	body := append([]byte{3, 3}, random...)
+	body = append(append(body, byte(len(sessionID))), sessionID...)
+	body = appendUint16(body, uint16(2*len(suites)))
+	for _, suite := range suites {
+		body = appendUint16(body, suite)
+	}
+	body = append(body, 1, 0)
+	body = append(appendUint16(body, uint16(len(ext))), ext...)
+	return handshakeRecord(1, 1, body), nil
+}
+
+// serverHello returns the ServerHello and ChangeCipherSpec records that
+// answer a ClientHello with sessionID
+func serverHello(sessionID []byte) ([]byte, error) {
+	keys := make([]byte, 64)
+	if _, err := rand.Read(keys); err != nil {
+		return nil, err
+	}
+	var ext []byte
+	ext = appendExtension(ext, 0x002b, []byte{3, 4})
+	ext = appendExtension(ext, 0x0033, append([]byte{0, 0x1d, 0, 32}, keys[32:]...))
+	body := append([]byte{3, 3}, keys[:32]...)
+	body = append(append(body, byte(len(sessionID))), sessionID...)
+	body = append(body, 0x13, 0x01, 0)
+	body = append(appendUint16(body, uint16(len(ext))), ext...)
+	return append(handshakeRecord(2, 3, body), tlsChangeCipherSpec, 3, 3, 0, 1, 1), nil
+}
+
+// handshakeRecord wraps a handshake message in a record of TLS 1.minor
+func handshakeRecord(kind byte, minor byte, body []byte) []byte {
+	record := []byte{tlsHandshake, 3, minor}
+	record = appendUint16(record, uint16(len(body)+4))
+	record = append(record, kind, byte(len(body)>>16), byte(len(body)>>8), byte(len(body)))
+	return append(record, body...)
+}
+
+func appendExtension(b []byte, kind uint16, data []byte) []byte {
+	b = appendUint16(b, kind)
+	b = appendUint16(b, uint16(len(data)))
+	return append(b, data...)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
@@ -0,0 +1,305 @@
+package socks5
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestObfs_Tunnel(t *testing.T) {
+	echo := startEchoServer(t)
+	for _, camouflage := range []bool{false, true} {
+		_, addr := startTestServer(t, &ServerConfig{
+			AuthMethods: []Authenticator{NoAuthAuthenticator{}},
+			Obfs:        &Obfs{Key: "secret", Camouflage: camouflage},
+		})
+		outbound := &Socks5Outbound{
+			Address: addr,
+			Timeout: 5 * time.Second,
+			Obfs:    &Obfs{Key: "secret", Camouflage: camouflage, SNI: "www.example.com", MaxRecord: 4096},
+		}
+		conn, err := outbound.Dial("tcp", *addrSpec(echo.IP, echo.Port))
+		if err != nil {
+			t.Fatalf("camouflage %v: %v", camouflage, err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		payload := make([]byte, 300000)
+		_, _ = rand.Read(payload)
+		go func() {
+			_, _ = conn.Write(payload)
+			_ = conn.(closeWriter).CloseWrite()
+		}()
+		data, err := ioutil.ReadAll(conn)
+		if err != nil || !bytes.Equal(data, payload) {
+			t.Fatalf("camouflage %v: echoed %d bytes, want %d: %v", camouflage, len(data), len(payload), err)
+		}
+		_ = conn.Close()
+
+		outbound.Obfs = &Obfs{Key: "wrong", Camouflage: camouflage}
+		if _, err := outbound.Dial("tcp", *addrSpec(echo.IP, echo.Port)); err == nil {
+			t.Fatalf("camouflage %v: expected a wrong key to be refused", camouflage)
+		}
+	}
+}
+
+// recordingConn records the size of every write
+type recordingConn struct {
+	net.Conn
+	mu     sync.Mutex
+	writes []int
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.writes = append(c.writes, len(p))
+	c.mu.Unlock()
+	return c.Conn.Write(p)
+}
+
+func TestObfs_Shaping(t *testing.T) {
+	clientSide, serverSide := net.Pipe()
+	defer serverSide.Close()
+	obfs := &Obfs{Key: "secret", PaddedRecords: 2, MaxRecord: 1024}
+	recorder := &recordingConn{Conn: clientSide}
+	client, err := dialObfs(recorder, obfs)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	large := bytes.Repeat([]byte("x"), 20000)
+	go func() {
+		for _, p := range [][]byte{{5, 1, 0}, {5, 0}, large} {
+			_, _ = client.Write(p)
+		}
+		_ = clientSide.Close()
+	}()
+	server, err := acceptObfs(serverSide, obfs, 5*time.Second)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	data, _ := ioutil.ReadAll(server)
+	if want := append([]byte{5, 1, 0, 5, 0}, large...); !bytes.Equal(data, want) {
+		t.Fatalf("received %d bytes, want %d", len(data), len(want))
+	}
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	// the hello goes out with the first record, and both short handshake
+	// messages are padded
+	if recorder.writes[0] < obfsHelloSize+obfsPaddedMin || recorder.writes[1] < obfsPaddedMin {
+		t.Fatalf("handshake records not padded: %v", recorder.writes)
+	}
+	sizes := make(map[int]bool)
+	for _, size := range recorder.writes[2:] {
+		if size > 1024+2*16+2 {
+			t.Fatalf("record of %d bytes larger than the maximum: %v", size, recorder.writes)
+		}
+		sizes[size] = true
+	}
+	if len(sizes) < 2 {
+		t.Fatalf("records of a large write all have the same size: %v", recorder.writes)
+	}
+}
+
+func TestObfs_ClientHello(t *testing.T) {
+	clientSide, serverSide := net.Pipe()
+	defer clientSide.Close()
+	defer serverSide.Close()
+	client, err := dialObfs(clientSide, &Obfs{Key: "secret", Camouflage: true, SNI: "www.example.com"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go func() { _, _ = client.Write([]byte{5, 1, 0}) }()
+	go func() { _, _ = io.Copy(ioutil.Discard, clientSide) }()
+
+	// crypto/tls takes the camouflage for a TLS 1.3 ClientHello
+	hellos := make(chan *tls.ClientHelloInfo, 1)
+	_ = tls.Server(serverSide, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			hellos <- hello
+			return nil, errors.New("stop")
+		},
+	}).Handshake()
+	select {
+	case hello := <-hellos:
+		tls13 := false
+		for _, version := range hello.SupportedVersions {
+			tls13 = tls13 || version == tls.VersionTLS13
+		}
+		if hello.ServerName != "www.example.com" || !tls13 || len(hello.SupportedProtos) != 2 {
+			t.Fatalf("unexpected ClientHello %+v", hello)
+		}
+	default:
+		t.Fatalf("ClientHello not parsed")
+	}
+}
+
+func TestObfs_Probes(t *testing.T) {
+	_, addr := startTestServer(t, &ServerConfig{
+		AuthMethods:      []Authenticator{NoAuthAuthenticator{}},
+		HandshakeTimeout: time.Second,
+		Obfs:             &Obfs{Key: "secret", Decoy: []byte("<h1>It works!</h1>")},
+	})
+	probe := func(addr string, data []byte) string {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write(data); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		reply, _ := ioutil.ReadAll(conn)
+		return string(reply)
+	}
+
+	// web clients get the decoy page
+	resp, err := http.Get("http://" + addr + "/")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "<h1>It works!</h1>" {
+		t.Fatalf("unexpected decoy %d %q", resp.StatusCode, body)
+	}
+	// garbage is a bad request, a SOCKS5 greeting gets no SOCKS5 reply
+	garbage := make([]byte, 64)
+	_, _ = rand.Read(garbage)
+	if reply := probe(addr, append(garbage, "\r\n\r\n"...)); !strings.HasPrefix(reply, "HTTP/1.1 400 ") {
+		t.Fatalf("unexpected reply to garbage %q", reply)
+	}
+	if reply := probe(addr, []byte{Socks5Version, 1, NoAuth}); strings.HasPrefix(reply, string([]byte{Socks5Version})) {
+		t.Fatalf("unexpected reply to a SOCKS5 greeting %q", reply)
+	}
+
+	// with camouflage, TLS clients fail the handshake like on a server
+	// without a certificate for them
+	_, tlsAddr := startTestServer(t, &ServerConfig{
+		AuthMethods: []Authenticator{NoAuthAuthenticator{}},
+		Obfs:        &Obfs{Key: "secret", Camouflage: true},
+	})
+	if _, err := tls.Dial("tcp", tlsAddr, &tls.Config{ServerName: "www.example.com"}); err == nil ||
+		!strings.Contains(err.Error(), "handshake failure") {
+		t.Fatalf("unexpected TLS handshake result: %v", err)
+	}
+
+	// and are relayed to the fallback web server when there is one
+	fallback := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, "fallback")
+	}))
+	defer fallback.Close()
+	_, fallbackAddr := startTestServer(t, &ServerConfig{
+		AuthMethods: []Authenticator{NoAuthAuthenticator{}},
+		Obfs:        &Obfs{Key: "secret", Camouflage: true, Fallback: fallback.Listener.Addr().String()},
+	})
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	defer client.CloseIdleConnections()
+	resp, err = client.Get("https://" + fallbackAddr + "/")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if string(body) != "fallback" {
+		t.Fatalf("unexpected fallback response %q", body)
+	}
+}
+
+func TestObfs_UserKeys(t *testing.T) {
+	echo := startEchoServer(t)
+	for _, camouflage := range []bool{false, true} {
+		server, addr := startTestServer(t, &ServerConfig{
+			AuthMethods: []Authenticator{UserPassAuthenticator{Accounts: Accounts{MemoryUser: MemoryUser{"alice": "secret"}}}},
+			Obfs:        &Obfs{Users: Accounts{MemoryUser: MemoryUser{"alice": "alice key", "bob": "bob key"}}, Camouflage: camouflage},
+		})
+		// the key alone authenticates bob, who has no password
+		outbound := &Socks5Outbound{Address: addr, Timeout: 5 * time.Second, Obfs: &Obfs{Key: "bob key", Camouflage: camouflage}}
+		conn, err := outbound.Dial("tcp", *addrSpec(echo.IP, echo.Port))
+		if err != nil {
+			t.Fatalf("camouflage %v: %v", camouflage, err)
+		}
+		var users []string
+		for _, sess := range server.Sessions() {
+			users = append(users, sess.User)
+		}
+		_ = conn.Close()
+		if len(users) != 1 || users[0] != "bob" {
+			t.Fatalf("camouflage %v: sessions of %v, want bob", camouflage, users)
+		}
+
+		outbound.Obfs = &Obfs{Key: "secret", Camouflage: camouflage}
+		if _, err := outbound.Dial("tcp", *addrSpec(echo.IP, echo.Port)); err == nil {
+			t.Fatalf("camouflage %v: expected a password that is no key to be refused", camouflage)
+		}
+	}
+}
+
+// obfsHello returns a plain hello for secret as of at
+func obfsHello(secret string, at time.Time) []byte {
+	key, salt := obfsKey(secret), make([]byte, obfsSaltSize)
+	_, _ = rand.Read(salt)
+	stamp := make([]byte, obfsStampSize)
+	binary.BigEndian.PutUint64(stamp, uint64(at.Unix()))
+	hello := append(append([]byte(nil), salt...), xorBytes(stamp, obfsMask(key, salt))...)
+	return append(hello, obfsTag(key, salt, stamp)...)
+}
+
+func TestObfs_Replays(t *testing.T) {
+	conf := func() *ServerConfig {
+		return &ServerConfig{
+			AuthMethods:      []Authenticator{NoAuthAuthenticator{}},
+			HandshakeTimeout: 500 * time.Millisecond,
+			Obfs:             &Obfs{Key: "secret", Window: time.Minute},
+		}
+	}
+	server, addr := startTestServer(t, conf())
+	// accepted hellos are waited on for a record, refused ones are answered
+	// like a bad HTTP request
+	refused := func(hello []byte) bool {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write(append(hello, "\r\n\r\n"...)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		reply, _ := ioutil.ReadAll(conn)
+		return strings.HasPrefix(string(reply), "HTTP/1.1 400 ")
+	}
+
+	hello := obfsHello("secret", time.Now())
+	if refused(hello) {
+		t.Fatalf("fresh hello refused")
+	}
+	if !refused(hello) {
+		t.Fatalf("replayed hello accepted")
+	}
+	// the hellos seen are remembered across reloads
+	if err := server.Reload(conf()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !refused(hello) {
+		t.Fatalf("hello replayed after a reload accepted")
+	}
+	if !refused(obfsHello("secret", time.Now().Add(-2*time.Minute))) || !refused(obfsHello("secret", time.Now().Add(2*time.Minute))) {
+		t.Fatalf("hello outside the time window accepted")
+	}
+	if refused(obfsHello("secret", time.Now().Add(-30*time.Second))) {
+		t.Fatalf("hello within the time window refused")
+	}
+}
@@ -0,0 +1,296 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ErrRejected is returned by RejectOutbound, clients are told the connection
+// is not allowed by the ruleset
+var ErrRejected = errors.New("Connection rejected by outbound ")
+
+// Outbound opens connections to destinations on behalf of clients
+type Outbound interface {
+	Dial(network string, addr AddrSpec) (net.Conn, error)
+}
+
+// clientDialer is implemented by outbounds that treat clients differently,
+// the server dials them with the client of the request
+type clientDialer interface {
+	dialFor(network string, from *client, addr AddrSpec) (net.Conn, error)
+}
+
+// DirectOutbound connects to destinations from this host
+type DirectOutbound struct {
+	Timeout time.Duration
+	// ProxyProtocol sends a PROXY protocol header of that version, 1 or 2,
+	// ahead of TCP connections so the destination sees the client's address
+	ProxyProtocol int
+	SocketOptions
+}
+
+func (d *DirectOutbound) Dial(network string, addr AddrSpec) (net.Conn, error) {
+	return d.dialFor(network, nil, addr)
+}
+
+func (d *DirectOutbound) dialFor(network string, from *client, addr AddrSpec) (net.Conn, error) {
+	conn, err := d.dial(network, hostPort(addr), d.Timeout, from, addr.IP)
+	if err != nil {
+		return nil, err
+	}
+	if err := sendProxyHeader(conn, d.ProxyProtocol, from); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// sendProxyHeader announces a connection from the client to the peer of conn
+// when version is not 0, the header is a health check one when the client's
+// address is unknown
+func sendProxyHeader(conn net.Conn, version int, from *client) error {
+	peer := remoteAddrSpec(conn.RemoteAddr())
+	if version == 0 || peer == nil {
+		return nil
+	}
+	var src *AddrSpec
+	if from != nil {
+		src = from.addr
+	}
+	return writeProxyHeader(conn, version, src, peer)
+}
+
+// RejectOutbound refuses every connection
+type RejectOutbound struct{}
+
+func (RejectOutbound) Dial(string, AddrSpec) (net.Conn, error) {
+	return nil, ErrRejected
+}
+
+// Socks5Outbound connects through an upstream SOCKS5 server. Domains are
+// passed on unresolved so the upstream resolves them.
+type Socks5Outbound struct {
+	Address  string
+	Username string
+	Password string
+	Timeout  time.Duration
+	// ProxyProtocol sends a PROXY protocol header of that version, 1 or 2,
+	// to the upstream server ahead of the SOCKS5 handshake
+	ProxyProtocol int
+	// Obfs obfuscates the connection to the upstream server, after the PROXY
+	// protocol header
+	Obfs *Obfs
+	// TLS connects to the upstream server over TLS, after the PROXY protocol
+	// header and obfuscation. The server name defaults to the host of Address.
+	TLS *tls.Config
+	// WebSocket carries the connection in a WebSocket, over TLS when TLS is
+	// set
+	WebSocket *WebSocket
+	// HTTPProxy is the http:// URL of a proxy that the upstream server is
+	// reached through with CONNECT, it may carry credentials
+	HTTPProxy *url.URL
+	// Mux carries the connections as streams of a few carrier connections
+	// to the upstream server, which must accept carriers. The PROXY protocol
+	// header of a carrier, shared by clients, is a health check one.
+	Mux *Mux
+	SocketOptions
+
+	pool muxPool
+}
+
+func (s *Socks5Outbound) Dial(network string, addr AddrSpec) (net.Conn, error) {
+	return s.dialFor(network, nil, addr)
+}
+
+func (s *Socks5Outbound) dialFor(network string, from *client, addr AddrSpec) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, fmt.Errorf("Unsupported network %q for SOCKS5 outbound ", network)
+	}
+	if s.Mux != nil {
+		return s.dialStream(addr)
+	}
+	conn, err := s.dialUpstream(from)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := clientHandshake(conn, s.Username, s.Password, connectCommand, addr); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("Upstream %s: %w ", s.Address, err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// dialStream connects to addr through a stream of a carrier
+func (s *Socks5Outbound) dialStream(addr AddrSpec) (net.Conn, error) {
+	stream, err := s.pool.open(s.Mux, func() (*muxSession, error) {
+		conn, err := s.dialUpstream(nil)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := clientHandshake(conn, s.Username, s.Password, muxCommand, AddrSpec{IP: net.IPv4zero}); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("Upstream %s: %w ", s.Address, err)
+		}
+		_ = conn.SetDeadline(time.Time{})
+		return newMuxSession(conn, conn, s.Mux, nil), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if s.Timeout > 0 {
+		_ = stream.SetDeadline(time.Now().Add(s.Timeout))
+	}
+	if _, err := clientRequest(stream, connectCommand, addr); err != nil {
+		_ = stream.Close()
+		return nil, fmt.Errorf("Upstream %s: %w ", s.Address, err)
+	}
+	_ = stream.SetDeadline(time.Time{})
+	return stream, nil
+}
+
+// dialUpstream connects to the upstream server, through the HTTP proxy, TLS
+// and WebSocket as configured, the connection is left with the deadline of
+// the timeout
+func (s *Socks5Outbound) dialUpstream(from *client) (net.Conn, error) {
+	address := s.Address
+	if s.HTTPProxy != nil {
+		address = s.HTTPProxy.Host
+	}
+	var upstream net.IP
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		upstream = net.ParseIP(host)
+	}
+	conn, err := s.dial("tcp", address, s.Timeout, from, upstream)
+	if err != nil {
+		return nil, err
+	}
+	if s.Timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(s.Timeout))
+	}
+	if s.HTTPProxy != nil {
+		if _, err := dialHTTPProxy(conn, s.HTTPProxy, s.Address); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	if err := sendProxyHeader(conn, s.ProxyProtocol, from); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if s.Obfs != nil {
+		obfsConn, err := dialObfs(conn, s.Obfs)
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = obfsConn
+	}
+	if s.TLS != nil {
+		tlsConn, err := dialTLS(conn, s.TLS, s.Address)
+		if err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("Upstream %s: %w ", s.Address, err)
+		}
+		conn = tlsConn
+	}
+	if s.WebSocket != nil {
+		wsConn, err := dialWebSocket(conn, s.WebSocket, s.Address)
+		if err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("Upstream %s: %w ", s.Address, err)
+		}
+		conn = wsConn
+	}
+	return conn, nil
+}
+
+// clientHandshake negotiates authentication and sends a request over conn,
+// it returns the bound address of a successful reply
+func clientHandshake(conn io.ReadWriter, username, password string, command uint8, addr AddrSpec) (*AddrSpec, error) {
+	method := NoAuth
+	if username != "" {
+		method = UserPassAuth
+	}
+	if _, err := conn.Write([]byte{Socks5Version, 1, method}); err != nil {
+		return nil, err
+	}
+	reply := []byte{0, 0}
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+	if reply[0] != Socks5Version || reply[1] != method {
+		return nil, fmt.Errorf("authentication method %d not accepted", method)
+	}
+	if method == UserPassAuth {
+		req := bytesCombine([]byte{userAuthVersion, byte(len(username))}, []byte(username),
+			[]byte{byte(len(password))}, []byte(password))
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return nil, err
+		}
+		if reply[1] != authSuccess {
+			return nil, errors.New("authentication failed")
+		}
+	}
+	return clientRequest(conn, command, addr)
+}
+
+// clientRequest sends a request over conn once authenticated, it returns the
+// bound address of a successful reply
+func clientRequest(conn io.ReadWriter, command uint8, addr AddrSpec) (*AddrSpec, error) {
+	req := appendAddr([]byte{Socks5Version, command, 0}, addr)
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	header := []byte{0, 0, 0}
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != Socks5Version {
+		return nil, fmt.Errorf("unexpected reply version %d", header[0])
+	}
+	bind, err := parseAddrSpec(conn)
+	if err != nil {
+		return nil, err
+	}
+	if header[1] != succeeded {
+		return nil, &ReplyError{Code: header[1], Err: fmt.Errorf("request failed with reply %d", header[1])}
+	}
+	return bind, nil
+}
+
+// appendAddr appends the address type, address and port of addr in the
+// encoding of SOCKS5 requests
+func appendAddr(b []byte, addr AddrSpec) []byte {
+	switch {
+	case addr.Domain != "":
+		b = append(b, DomainAddress, byte(len(addr.Domain)))
+		b = append(b, addr.Domain...)
+	case addr.IP.To4() != nil:
+		b = append(b, IPV4Address)
+		b = append(b, addr.IP.To4()...)
+	default:
+		b = append(b, IPV6Address)
+		b = append(b, addr.IP.To16()...)
+	}
+	return append(b, byte(addr.Port>>8), byte(addr.Port))
+}
+
+// hostPort prefers the resolved address and falls back to the domain
+func hostPort(addr AddrSpec) string {
+	host := addr.Domain
+	if addr.IP != nil {
+		host = addr.IP.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(addr.Port)))
+}
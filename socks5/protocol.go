@@ -23,11 +23,11 @@ type ResponseWriter interface {
 }
 
 type UserPassAuthRequest struct {
-	Ver    	byte
-	Ulen   	byte
-	Uname  	[]byte
-	Plen   	byte
-	Passwd 	[]byte
+	Ver    byte
+	Ulen   byte
+	Uname  []byte
+	Plen   byte
+	Passwd []byte
 }
 
 type NegotiationRequest struct {
@@ -37,10 +37,10 @@ type NegotiationRequest struct {
 }
 
 type Response struct {
-	Ver  byte
-	Rep  byte
-	Rsv  byte // 0x00
-	Atyp byte
+	Ver     byte
+	Rep     byte
+	Rsv     byte // 0x00
+	Atyp    byte
 	BndAddr []byte
 	BndPort []byte
 }
@@ -95,4 +95,4 @@ func (req *NegotiationRequest) Write(w io.Writer) error {
 
 func bytesCombine(pBytes ...[]byte) []byte {
 	return bytes.Join(pBytes, []byte(""))
-}
\ No newline at end of file
+}
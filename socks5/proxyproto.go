@@ -0,0 +1,240 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyV2Signature starts a binary PROXY protocol version 2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	// proxyV1MaxLength is the longest header of PROXY protocol version 1
+	proxyV1MaxLength = 107
+
+	proxyV2Local = 0x20
+	proxyV2Proxy = 0x21
+
+	proxyV2Unspec = 0x00
+	proxyV2TCP4   = 0x11
+	proxyV2TCP6   = 0x21
+)
+
+// proxyConn is a connection that arrived through a load balancer, its
+// addresses are those of the client's original connection
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *proxyConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// isTrusted reports whether conn comes from a network allowed to send a PROXY
+// protocol header
+func isTrusted(conn net.Conn, trusted []*net.IPNet) bool {
+	addr := remoteAddrSpec(conn.RemoteAddr())
+	if addr == nil {
+		return false
+	}
+	for _, network := range trusted {
+		if network.Contains(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptProxyHeader reads the PROXY protocol header a load balancer sends
+// ahead of the client's data and returns the connection with the client's
+// addresses. Headers for health checks (LOCAL and UNKNOWN) keep the addresses
+// of the connection itself.
+func acceptProxyHeader(conn net.Conn, timeout time.Duration) (net.Conn, error) {
+	if timeout > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(timeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	reader := bufio.NewReader(conn)
+	remote, local, err := readProxyHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	proxied := &proxyConn{Conn: conn, reader: reader, remote: conn.RemoteAddr(), local: conn.LocalAddr()}
+	if remote != nil {
+		proxied.remote, proxied.local = remote, local
+	}
+	return proxied, nil
+}
+
+// readProxyHeader reads a version 1 or 2 header, the addresses are nil when
+// the header carries none
+func readProxyHeader(r *bufio.Reader) (*net.TCPAddr, *net.TCPAddr, error) {
+	// a version 1 header may be followed by nothing, so only the signature
+	// of version 2 is peeked at in full
+	v1 := []byte("PROXY ")
+	start, err := r.Peek(len(v1))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Missing PROXY protocol header: %v ", err)
+	}
+	if bytes.Equal(start, v1) {
+		return readProxyV1(r)
+	}
+	if start, err = r.Peek(len(proxyV2Signature)); err != nil {
+		return nil, nil, fmt.Errorf("Missing PROXY protocol header: %v ", err)
+	}
+	if bytes.Equal(start, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	return nil, nil, errors.New("Missing PROXY protocol header ")
+}
+
+func readProxyV1(r *bufio.Reader) (*net.TCPAddr, *net.TCPAddr, error) {
+	line := make([]byte, 0, proxyV1MaxLength)
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+		if len(line) == proxyV1MaxLength {
+			return nil, nil, errors.New("PROXY protocol header too long ")
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("PROXY protocol header not terminated by CRLF ")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("Invalid PROXY protocol header %q ", line)
+	}
+	src, err := parseProxyAddr(fields[2], fields[4], fields[1] == "TCP4")
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseProxyAddr(fields[3], fields[5], fields[1] == "TCP4")
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseProxyAddr(host, port string, ipv4 bool) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || (ip.To4() != nil) != ipv4 {
+		return nil, fmt.Errorf("Invalid address %q in PROXY protocol header ", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid port %q in PROXY protocol header ", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (*net.TCPAddr, *net.TCPAddr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	command, family := header[12], header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+	switch command {
+	case proxyV2Local:
+		return nil, nil, nil
+	case proxyV2Proxy:
+	default:
+		return nil, nil, fmt.Errorf("Unsupported PROXY protocol command %#x ", command)
+	}
+	// the addresses are followed by TLVs, which are ignored
+	size := 0
+	switch family {
+	case proxyV2TCP4:
+		size = net.IPv4len
+	case proxyV2TCP6:
+		size = net.IPv6len
+	default:
+		// unix sockets and datagrams carry no address to use
+		return nil, nil, nil
+	}
+	if len(payload) < 2*size+4 {
+		return nil, nil, errors.New("PROXY protocol header too short for its addresses ")
+	}
+	src := &net.TCPAddr{IP: net.IP(payload[:size]), Port: int(binary.BigEndian.Uint16(payload[2*size:]))}
+	dst := &net.TCPAddr{IP: net.IP(payload[size : 2*size]), Port: int(binary.BigEndian.Uint16(payload[2*size+2:]))}
+	return src, dst, nil
+}
+
+// writeProxyHeader sends a version 1 or 2 header announcing a connection from
+// src to dst, either may be nil when the client's address is unknown
+func writeProxyHeader(w io.Writer, version int, src, dst *AddrSpec) error {
+	known := src != nil && dst != nil && len(src.IP) > 0 && len(dst.IP) > 0 &&
+		(src.IP.To4() != nil) == (dst.IP.To4() != nil)
+	ipv4 := known && src.IP.To4() != nil
+	b := &bytes.Buffer{}
+	if version == 1 {
+		switch {
+		case !known:
+			b.WriteString("PROXY UNKNOWN\r\n")
+		case ipv4:
+			fmt.Fprintf(b, "PROXY TCP4 %s %s %d %d\r\n", src.IP.To4(), dst.IP.To4(), src.Port, dst.Port)
+		default:
+			fmt.Fprintf(b, "PROXY TCP6 %s %s %d %d\r\n", src.IP.To16(), dst.IP.To16(), src.Port, dst.Port)
+		}
+		_, err := w.Write(b.Bytes())
+		return err
+	}
+	b.Write(proxyV2Signature)
+	switch {
+	case !known:
+		// LOCAL would announce a connection of the proxy itself, a relayed
+		// client whose address is unknown is a PROXY of an unspecified family
+		b.Write([]byte{proxyV2Proxy, proxyV2Unspec, 0, 0})
+	case ipv4:
+		b.Write([]byte{proxyV2Proxy, proxyV2TCP4, 0, 12})
+		b.Write(src.IP.To4())
+		b.Write(dst.IP.To4())
+	default:
+		b.Write([]byte{proxyV2Proxy, proxyV2TCP6, 0, 36})
+		b.Write(src.IP.To16())
+		b.Write(dst.IP.To16())
+	}
+	if known {
+		_ = binary.Write(b, binary.BigEndian, []uint16{src.Port, dst.Port})
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
@@ -0,0 +1,169 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(payload ...byte) string {
+		return string(proxyV2Signature) + string(payload)
+	}
+	cases := []struct {
+		header string
+		src    string
+		dst    string
+		err    bool
+	}{
+		{header: "PROXY TCP4 203.0.113.7 192.0.2.1 4000 1080\r\n", src: "203.0.113.7:4000", dst: "192.0.2.1:1080"},
+		{header: "PROXY TCP6 2001:db8::7 2001:db8::1 4000 1080\r\n", src: "[2001:db8::7]:4000", dst: "[2001:db8::1]:1080"},
+		{header: "PROXY UNKNOWN\r\n"},
+		{header: "PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n"},
+		// with an ALPN TLV after the addresses
+		{header: v2(0x21, 0x11, 0, 17, 203, 0, 113, 7, 192, 0, 2, 1, 0x0f, 0xa0, 0x04, 0x38, 0x01, 0, 2, 'h', '2'),
+			src: "203.0.113.7:4000", dst: "192.0.2.1:1080"},
+		{header: v2(0x20, 0x00, 0, 0)},
+		{header: "PROXY TCP4 203.0.113.7 192.0.2.1 4000\r\n", err: true},
+		{header: "PROXY TCP4 2001:db8::7 192.0.2.1 4000 1080\r\n", err: true},
+		{header: "PROXY TCP4 203.0.113.7 192.0.2.1 4000 1080\n", err: true},
+		{header: v2(0x21, 0x11, 0, 4, 203, 0, 113, 7), err: true},
+		{header: "\x05\x01\x00 not a PROXY header", err: true},
+	}
+	for _, c := range cases {
+		r := bufio.NewReader(strings.NewReader(c.header + "data"))
+		src, dst, err := readProxyHeader(r)
+		if c.err {
+			if err == nil {
+				t.Fatalf("%q: expected an error", c.header)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %v", c.header, err)
+		}
+		if c.src == "" {
+			if src != nil || dst != nil {
+				t.Fatalf("%q: unexpected addresses %v %v", c.header, src, dst)
+			}
+		} else if src.String() != c.src || dst.String() != c.dst {
+			t.Fatalf("%q: unexpected addresses %v %v", c.header, src, dst)
+		}
+		if rest, _ := ioutil.ReadAll(r); string(rest) != "data" {
+			t.Fatalf("%q: header not consumed exactly, %q left", c.header, rest)
+		}
+	}
+	// the shortest header, with nothing after it
+	if src, dst, err := readProxyHeader(bufio.NewReader(strings.NewReader("PROXY UNKNOWN\r\n"))); err != nil || src != nil || dst != nil {
+		t.Fatalf("unexpected result %v %v: %v", src, dst, err)
+	}
+}
+
+func TestWriteProxyHeader(t *testing.T) {
+	src := &AddrSpec{IP: net.ParseIP("203.0.113.7"), Port: 4000}
+	dst := &AddrSpec{IP: net.ParseIP("192.0.2.1"), Port: 1080}
+	for _, version := range []int{1, 2} {
+		b := &bytes.Buffer{}
+		if err := writeProxyHeader(b, version, src, dst); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		gotSrc, gotDst, err := readProxyHeader(bufio.NewReader(b))
+		if err != nil || gotSrc.String() != "203.0.113.7:4000" || gotDst.String() != "192.0.2.1:1080" {
+			t.Fatalf("version %d: unexpected addresses %v %v: %v", version, gotSrc, gotDst, err)
+		}
+		b.Reset()
+		if err := writeProxyHeader(b, version, nil, dst); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if version == 2 && !bytes.Equal(b.Bytes()[12:], []byte{proxyV2Proxy, proxyV2Unspec, 0, 0}) {
+			t.Fatalf("expected a PROXY command of an unspecified family, got %x", b.Bytes()[12:])
+		}
+		if gotSrc, _, err := readProxyHeader(bufio.NewReader(b)); err != nil || gotSrc != nil {
+			t.Fatalf("version %d: expected a header without addresses: %v %v", version, gotSrc, err)
+		}
+	}
+}
+
+func TestServer_ProxyProtocol(t *testing.T) {
+	echo := startEchoServer(t)
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	server, addr := startTestServer(t, &ServerConfig{
+		AuthMethods:    []Authenticator{NoAuthAuthenticator{}},
+		TrustedProxies: []*net.IPNet{loopback},
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	header := &bytes.Buffer{}
+	_ = writeProxyHeader(header, 2, &AddrSpec{IP: net.ParseIP("203.0.113.7"), Port: 4000}, &AddrSpec{IP: net.ParseIP("192.0.2.1"), Port: 1080})
+	req := append(header.Bytes(), Socks5Version, 1, NoAuth, Socks5Version, connectCommand, 0, IPV4Address)
+	req = append(req, echo.IP.To4()...)
+	req = append(req, byte(echo.Port>>8), byte(echo.Port))
+	if _, err := conn.Write(req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	reply := make([]byte, 2+10)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[3] != succeeded {
+		t.Fatalf("unexpected reply %v: %v", reply, err)
+	}
+	if sessions := server.Sessions(); len(sessions) != 1 || sessions[0].ClientAddr != "203.0.113.7:4000" {
+		t.Fatalf("unexpected sessions %+v", sessions)
+	}
+
+	// a trusted proxy must send the header
+	bare, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer bare.Close()
+	_ = bare.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := bare.Write(req[header.Len():]); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := bare.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("expected a connection without a header to be refused")
+	}
+}
+
+func TestDirectOutbound_ProxyProtocol(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer listener.Close()
+	headers := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		src, dst, err := readProxyHeader(bufio.NewReader(conn))
+		if err != nil {
+			headers <- err.Error()
+			return
+		}
+		headers <- src.String() + " " + dst.String()
+	}()
+
+	port := uint16(listener.Addr().(*net.TCPAddr).Port)
+	outbound := &DirectOutbound{ProxyProtocol: 1}
+	conn, err := outbound.dialFor("tcp", &client{addr: &AddrSpec{IP: net.ParseIP("203.0.113.7"), Port: 4000}},
+		AddrSpec{IP: net.ParseIP("127.0.0.1"), Port: port, AddrType: IPV4Address})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	if got, want := <-headers, "203.0.113.7:4000 "+listener.Addr().String(); got != want {
+		t.Fatalf("unexpected header %q, want %q", got, want)
+	}
+}
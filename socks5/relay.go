@@ -0,0 +1,149 @@
+package socks5
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/archervanderwaal/JadeSocks/metrics"
+)
+
+// relayBufferSize is the size of the buffers of relays that cannot splice
+const relayBufferSize = 32 * 1024
+
+var relayBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, relayBufferSize)
+		return &buf
+	},
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// bufferedConn reads a connection through a buffer during the handshake, the
+// relay writes out what is left in the buffer and then reads the connection
+// directly
+type bufferedConn struct {
+	*bufio.Reader
+	conn net.Conn
+}
+
+func newBufferedConn(conn net.Conn) *bufferedConn {
+	return &bufferedConn{Reader: bufio.NewReader(conn), conn: conn}
+}
+
+// countingWriter adds every byte written through it to counter and total and
+// records the time of the last write in activity
+type countingWriter struct {
+	io.Writer
+	counter  *metrics.Counter
+	total    *uint64
+	activity *int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.count(n)
+	return n, err
+}
+
+// count records n bytes that reached the writer without going through Write
+func (w *countingWriter) count(n int) {
+	w.counter.Add(float64(n))
+	atomic.AddUint64(w.total, uint64(n))
+	atomic.StoreInt64(w.activity, time.Now().UnixNano())
+}
+
+func (w *countingWriter) CloseWrite() error {
+	if c, ok := w.Writer.(closeWriter); ok {
+		return c.CloseWrite()
+	}
+	return nil
+}
+
+// relayResult reports how one direction of a relay finished, reason is the
+// close reason to record when it finishes first
+type relayResult struct {
+	reason string
+	err    error
+}
+
+func copyData(dst *countingWriter, src io.Reader, reason string, errCh chan relayResult) {
+	err := relay(dst, src)
+	_ = dst.CloseWrite()
+	errCh <- relayResult{reason: reason, err: err}
+}
+
+// relay copies src to dst until EOF. Bytes buffered during the handshake are
+// written first, then TCP connections are spliced where the platform allows
+// it and everything else is copied through a pooled buffer.
+func relay(dst *countingWriter, src io.Reader) error {
+	src, err := relaySource(dst, src)
+	if err != nil {
+		return err
+	}
+	if spliced, err := splice(dst, src); spliced {
+		return err
+	}
+	buf := relayBuffers.Get().(*[]byte)
+	defer relayBuffers.Put(buf)
+	// hide WriterTo so the copy uses the pooled buffer
+	_, err = io.CopyBuffer(dst, struct{ io.Reader }{src}, *buf)
+	return err
+}
+
+// relaySource writes out the buffered bytes of src and returns the
+// connection underneath it, readers that cannot be unwrapped are returned as
+// they are
+func relaySource(dst io.Writer, src io.Reader) (io.Reader, error) {
+	for {
+		switch r := src.(type) {
+		case *bufferedConn:
+			if err := drainBuffer(dst, r.Reader); err != nil {
+				return nil, err
+			}
+			src = r.conn
+		case *proxyConn:
+			if err := drainBuffer(dst, r.reader); err != nil {
+				return nil, err
+			}
+			src = r.Conn
+		case *attachedConn:
+			src = r.reader
+		default:
+			return src, nil
+		}
+	}
+}
+
+func drainBuffer(dst io.Writer, r *bufio.Reader) error {
+	n := r.Buffered()
+	if n == 0 {
+		return nil
+	}
+	buffered, _ := r.Peek(n)
+	if _, err := dst.Write(buffered); err != nil {
+		return err
+	}
+	_, _ = r.Discard(n)
+	return nil
+}
+
+// relayConn is the connection that writes to w end up on
+func relayConn(w io.Writer) io.Writer {
+	for {
+		switch c := w.(type) {
+		case *proxyConn:
+			w = c.Conn
+		case *attachedConn:
+			w = c.Conn
+		default:
+			return w
+		}
+	}
+}
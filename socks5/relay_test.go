@@ -0,0 +1,164 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(tb testing.TB) (*net.TCPConn, *net.TCPConn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("err: %v", err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		tb.Fatalf("err: %v", err)
+	}
+	server := <-accepted
+	if server == nil {
+		tb.Fatalf("accept failed")
+	}
+	tb.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
+
+func newCountingWriter(w io.Writer) *countingWriter {
+	return &countingWriter{Writer: w, total: new(uint64), activity: new(int64)}
+}
+
+func TestRelay_DrainsBuffer(t *testing.T) {
+	srcClient, srcServer := tcpPair(t)
+	dstClient, dstServer := tcpPair(t)
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+
+	// the handshake reads part of the stream into the buffer
+	if _, err := srcClient.Write([]byte("handshake")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	reader := newBufferedConn(srcServer)
+	if _, err := reader.Peek(len("handshake")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go func() {
+		_, _ = srcClient.Write(payload)
+		_ = srcClient.CloseWrite()
+	}()
+	received := make(chan []byte, 1)
+	go func() {
+		data, _ := ioutil.ReadAll(dstServer)
+		received <- data
+	}()
+
+	dst := newCountingWriter(dstClient)
+	errCh := make(chan relayResult, 1)
+	copyData(dst, reader, closeClientClosed, errCh)
+	if result := <-errCh; result.err != nil {
+		t.Fatalf("err: %v", result.err)
+	}
+	want := append([]byte("handshake"), payload...)
+	if data := <-received; !bytes.Equal(data, want) {
+		t.Fatalf("relayed %d bytes, want %d", len(data), len(want))
+	}
+	if *dst.total != uint64(len(want)) || *dst.activity == 0 {
+		t.Fatalf("bad accounting: %d bytes", *dst.total)
+	}
+}
+
+func TestRelay_NotConn(t *testing.T) {
+	var out bytes.Buffer
+	dst := newCountingWriter(&out)
+	if err := relay(dst, io.MultiReader(bytes.NewReader([]byte("GET / ")), bytes.NewReader([]byte("HTTP/1.1")))); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.String() != "GET / HTTP/1.1" || *dst.total != uint64(out.Len()) {
+		t.Fatalf("bad relay: %q %d", out.String(), *dst.total)
+	}
+}
+
+// benchmarkStream relays b.N chunks from one loopback connection to another
+func benchmarkStream(b *testing.B, copy func(dst *countingWriter, src *net.TCPConn) error) {
+	const chunk = 64 * 1024
+	srcClient, srcServer := tcpPair(b)
+	dstClient, dstServer := tcpPair(b)
+	go func() {
+		buf := make([]byte, chunk)
+		for i := 0; i < b.N; i++ {
+			if _, err := srcClient.Write(buf); err != nil {
+				return
+			}
+		}
+		_ = srcClient.CloseWrite()
+	}()
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, dstServer)
+		close(done)
+	}()
+	b.SetBytes(chunk)
+	b.ReportAllocs()
+	b.ResetTimer()
+	dst := newCountingWriter(dstClient)
+	if err := copy(dst, srcServer); err != nil {
+		b.Fatalf("err: %v", err)
+	}
+	_ = dstClient.CloseWrite()
+	<-done
+}
+
+func BenchmarkRelay(b *testing.B) {
+	benchmarkStream(b, func(dst *countingWriter, src *net.TCPConn) error {
+		return relay(dst, newBufferedConn(src))
+	})
+}
+
+func BenchmarkRelay_PooledBuffer(b *testing.B) {
+	benchmarkStream(b, func(dst *countingWriter, src *net.TCPConn) error {
+		return relay(dst, struct{ io.Reader }{src})
+	})
+}
+
+func BenchmarkRelay_BufioCopy(b *testing.B) {
+	benchmarkStream(b, func(dst *countingWriter, src *net.TCPConn) error {
+		_, err := io.Copy(dst, bufio.NewReader(src))
+		return err
+	})
+}
+
+// benchmarkShort relays a small exchange per operation, as most connections
+// are, to show the buffer allocated for each relay
+func benchmarkShort(b *testing.B, copy func(dst *countingWriter, src io.Reader) error) {
+	payload := make([]byte, 512)
+	dst := newCountingWriter(ioutil.Discard)
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := copy(dst, struct{ io.Reader }{bytes.NewReader(payload)}); err != nil {
+			b.Fatalf("err: %v", err)
+		}
+	}
+}
+
+func BenchmarkRelay_Short(b *testing.B) {
+	benchmarkShort(b, relay)
+}
+
+func BenchmarkRelay_ShortIOCopy(b *testing.B) {
+	benchmarkShort(b, func(dst *countingWriter, src io.Reader) error {
+		_, err := io.Copy(dst, src)
+		return err
+	})
+}
@@ -0,0 +1,104 @@
+package socks5
+
+import (
+	"hash/maphash"
+	"math"
+	"sync"
+	"time"
+)
+
+// replayFalsePositives is the rate at which a replay filter takes a new
+// hello for one it has seen
+const replayFalsePositives = 1e-6
+
+// replayFilter remembers the salts of recent hellos in two bloom filters, the
+// current one and the one before it. The current one becomes the previous
+// one when it is full or older than period, so a salt is remembered for at
+// least period unless more than the capacity of salts come in meanwhile.
+// Without a period the filters only rotate when full.
+type replayFilter struct {
+	mu       sync.Mutex
+	capacity int
+	period   time.Duration
+	current  *bloomFilter
+	previous *bloomFilter
+	rotated  time.Time
+}
+
+func newReplayFilter(capacity int, period time.Duration) *replayFilter {
+	return &replayFilter{capacity: capacity, period: period}
+}
+
+// resize changes the capacity and period of the filter, the salts it
+// remembers are kept
+func (f *replayFilter) resize(capacity int, period time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.capacity, f.period = capacity, period
+}
+
+// seen reports whether salt was seen before and remembers it otherwise
+func (f *replayFilter) seen(salt []byte) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	if f.current == nil {
+		f.current, f.rotated = newBloomFilter(f.capacity), now
+	}
+	if f.previous != nil && f.previous.contains(salt) || f.current.contains(salt) {
+		return true
+	}
+	if f.current.count >= f.current.capacity || f.period > 0 && now.Sub(f.rotated) >= f.period {
+		f.previous, f.current, f.rotated = f.current, newBloomFilter(f.capacity), now
+	}
+	f.current.add(salt)
+	return false
+}
+
+// bloomFilter is a bloom filter sized for a capacity of items at the rate of
+// replayFalsePositives
+type bloomFilter struct {
+	bits     []uint64
+	hashes   int
+	count    int
+	capacity int
+	seeds    [2]maphash.Seed
+}
+
+func newBloomFilter(capacity int) *bloomFilter {
+	bits := math.Ceil(-float64(capacity) * math.Log(replayFalsePositives) / (math.Ln2 * math.Ln2))
+	return &bloomFilter{
+		bits:     make([]uint64, int(bits)/64+1),
+		hashes:   int(math.Ceil(-math.Log2(replayFalsePositives))),
+		capacity: capacity,
+		seeds:    [2]maphash.Seed{maphash.MakeSeed(), maphash.MakeSeed()},
+	}
+}
+
+// positions calls fn with the bit positions of item, derived by double
+// hashing
+func (b *bloomFilter) positions(item []byte, fn func(word int, mask uint64)) {
+	var h maphash.Hash
+	h.SetSeed(b.seeds[0])
+	_, _ = h.Write(item)
+	h1 := h.Sum64()
+	h.SetSeed(b.seeds[1])
+	_, _ = h.Write(item)
+	h2 := h.Sum64() | 1
+	size := uint64(len(b.bits) * 64)
+	for i := 0; i < b.hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % size
+		fn(int(bit/64), 1<<(bit%64))
+	}
+}
+
+func (b *bloomFilter) add(item []byte) {
+	b.positions(item, func(word int, mask uint64) { b.bits[word] |= mask })
+	b.count++
+}
+
+func (b *bloomFilter) contains(item []byte) bool {
+	found := true
+	b.positions(item, func(word int, mask uint64) { found = found && b.bits[word]&mask != 0 })
+	return found
+}
@@ -0,0 +1,32 @@
+package socks5
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestReplayFilter(t *testing.T) {
+	filter := newReplayFilter(100, time.Minute)
+	for i := 0; i < 100; i++ {
+		if filter.seen([]byte(fmt.Sprintf("salt %d", i))) {
+			t.Fatalf("salt %d taken for a replay", i)
+		}
+	}
+	if !filter.seen([]byte("salt 0")) || !filter.seen([]byte("salt 99")) {
+		t.Fatalf("replays not detected")
+	}
+
+	// a full filter rotates, salts of the previous filter are still seen
+	if filter.seen([]byte("salt 100")) || !filter.seen([]byte("salt 0")) || !filter.seen([]byte("salt 100")) {
+		t.Fatalf("replays not detected across a rotation")
+	}
+	// and forgotten after the next rotation, which is also due by time
+	filter.rotated = filter.rotated.Add(-time.Minute)
+	if filter.seen([]byte("salt 101")) || filter.seen([]byte("salt 0")) {
+		t.Fatalf("salts remembered beyond two filters")
+	}
+	if !filter.seen([]byte("salt 100")) || !filter.seen([]byte("salt 101")) {
+		t.Fatalf("recent salts forgotten")
+	}
+}
@@ -0,0 +1,73 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// ReplyError is a dial error that carries the reply code to send to the
+// client, Dial functions and outbounds return it to pick the reply instead
+// of having it derived from the error
+type ReplyError struct {
+	Code uint8
+	Err  error
+}
+
+func (e *ReplyError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("Request failed with reply %d ", e.Code)
+	}
+	return e.Err.Error()
+}
+
+func (e *ReplyError) Unwrap() error {
+	return e.Err
+}
+
+// errnoReplies maps the errors of connect(2) to reply codes
+var errnoReplies = []struct {
+	errno syscall.Errno
+	code  uint8
+}{
+	{syscall.ECONNREFUSED, connectionRefused},
+	{syscall.ENETUNREACH, networkUnreachable},
+	{syscall.EHOSTUNREACH, hostUnreachable},
+	{syscall.EHOSTDOWN, hostUnreachable},
+	{syscall.ETIMEDOUT, ttlExpired},
+	{syscall.EACCES, ruleNotAllowed},
+	{syscall.EPERM, ruleNotAllowed},
+}
+
+// replyCode picks the reply code for an error of a dial or a name
+// resolution, errors that are not recognised are reported as
+// hostUnreachable
+func replyCode(err error) uint8 {
+	var replyErr *ReplyError
+	if errors.As(err, &replyErr) {
+		return replyErr.Code
+	}
+	if errors.Is(err, ErrRejected) {
+		return ruleNotAllowed
+	}
+	for _, r := range errnoReplies {
+		if errors.Is(err, r.errno) {
+			return r.code
+		}
+	}
+	// a timed out lookup is still a host that could not be found
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return hostUnreachable
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ttlExpired
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ttlExpired
+	}
+	return hostUnreachable
+}
@@ -0,0 +1,337 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSendResponse(t *testing.T) {
+	cases := []struct {
+		name string
+		addr *AddrSpec
+		bnd  []byte
+	}{
+		{"nil", nil, []byte{IPV4Address, 0, 0, 0, 0, 0, 0}},
+		{"ipv4", &AddrSpec{IP: net.IPv4(10, 0, 0, 1), Port: 1080, AddrType: IPV4Address},
+			[]byte{IPV4Address, 10, 0, 0, 1, 0x04, 0x38}},
+		{"ipv6", &AddrSpec{IP: net.ParseIP("2001:db8::1"), Port: 443, AddrType: IPV6Address},
+			[]byte{IPV6Address, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x01, 0xbb}},
+		{"domain", &AddrSpec{Domain: "proxy.example", Port: 8080, AddrType: DomainAddress},
+			append(append([]byte{DomainAddress, 13}, "proxy.example"...), 0x1f, 0x90)},
+		{"untyped ipv4", &AddrSpec{IP: net.ParseIP("192.0.2.7"), Port: 80},
+			[]byte{IPV4Address, 192, 0, 2, 7, 0, 80}},
+		{"untyped ipv6", &AddrSpec{IP: net.IPv6loopback, Port: 80},
+			[]byte{IPV6Address, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 80}},
+		{"untyped domain", &AddrSpec{Domain: "a", Port: 1},
+			[]byte{DomainAddress, 1, 'a', 0, 1}},
+	}
+	codes := []uint8{succeeded, serverFailure, ruleNotAllowed, networkUnreachable, hostUnreachable,
+		connectionRefused, ttlExpired, commandNotSupported, addrTypeNotSupported}
+	for _, c := range cases {
+		for _, code := range codes {
+			var buf bytes.Buffer
+			if err := sendResponse(&buf, code, c.addr); err != nil {
+				t.Fatalf("%s %d: err: %v", c.name, code, err)
+			}
+			want := append([]byte{Socks5Version, code, 0}, c.bnd...)
+			if !bytes.Equal(buf.Bytes(), want) {
+				t.Fatalf("%s %d: bad reply: %v, want %v", c.name, code, buf.Bytes(), want)
+			}
+		}
+	}
+}
+
+func TestSendResponse_Invalid(t *testing.T) {
+	invalid := []*AddrSpec{
+		{Domain: "", AddrType: DomainAddress},
+		{Domain: string(make([]byte, 256)), AddrType: DomainAddress},
+		{IP: net.IPv6loopback, AddrType: IPV4Address},
+		{IP: net.IPv4(127, 0, 0, 1), AddrType: 0x09},
+	}
+	for _, addr := range invalid {
+		var buf bytes.Buffer
+		if err := sendResponse(&buf, succeeded, addr); err == nil {
+			t.Fatalf("expected an error for %#v", addr)
+		}
+		if buf.Len() != 0 {
+			t.Fatalf("wrote a partial reply: %v", buf.Bytes())
+		}
+	}
+}
+
+type namedAddr string
+
+func (a namedAddr) Network() string { return "custom" }
+func (a namedAddr) String() string  { return string(a) }
+
+// namedConn is a connection with a local address that is not an IP socket
+type namedConn struct {
+	net.Conn
+	local net.Addr
+}
+
+func (c *namedConn) LocalAddr() net.Addr { return c.local }
+
+func TestBindAddr(t *testing.T) {
+	cases := []struct {
+		addr net.Addr
+		want string
+		atyp uint8
+	}{
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 80}, "127.0.0.1:80", IPV4Address},
+		{&net.TCPAddr{IP: net.IPv6loopback, Port: 80}, "[::1]:80", IPV6Address},
+		{namedAddr("192.0.2.1:53"), "192.0.2.1:53", IPV4Address},
+		{namedAddr("[2001:db8::2]:53"), "[2001:db8::2]:53", IPV6Address},
+		{namedAddr("proxy.example:8080"), "proxy.example:8080", DomainAddress},
+		{namedAddr(":8080"), "0.0.0.0:8080", IPV4Address},
+		{namedAddr("pipe"), "0.0.0.0:0", IPV4Address},
+	}
+	for _, c := range cases {
+		spec := bindAddr(c.addr)
+		if spec.String() != c.want || spec.AddrType != c.atyp {
+			t.Fatalf("%v: bad bind address: %v (%d)", c.addr, spec, spec.AddrType)
+		}
+	}
+}
+
+// socksRequest sends a no-auth SOCKS5 request and returns the whole reply
+func socksRequest(t *testing.T, proxy string, request []byte) (net.Conn, []byte) {
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(append([]byte{Socks5Version, 1, NoAuth}, request...)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var rest []byte
+	switch reply[3] {
+	case IPV4Address:
+		rest = make([]byte, 4+2)
+	case IPV6Address:
+		rest = make([]byte, 16+2)
+	case DomainAddress:
+		n := []byte{0}
+		if _, err := io.ReadFull(conn, n); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		reply = append(reply, n[0])
+		rest = make([]byte, int(n[0])+2)
+	default:
+		t.Fatalf("bad address type: %v", reply)
+	}
+	if _, err := io.ReadFull(conn, rest); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return conn, append(reply, rest...)
+}
+
+func connectRequest(command uint8, dest *net.TCPAddr) []byte {
+	req := []byte{Socks5Version, command, 0}
+	if ip4 := dest.IP.To4(); ip4 != nil {
+		req = append(append(req, IPV4Address), ip4...)
+	} else {
+		req = append(append(req, IPV6Address), dest.IP.To16()...)
+	}
+	return append(req, byte(dest.Port>>8), byte(dest.Port))
+}
+
+type failingResolver struct{}
+
+func (failingResolver) Resolve(name string) (net.IP, error) {
+	return nil, errors.New("no such host")
+}
+
+func dialErrno(errno syscall.Errno) func(string, AddrSpec) (net.Conn, error) {
+	return func(network string, addr AddrSpec) (net.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: os.NewSyscallError("connect", errno)}
+	}
+}
+
+func TestServer_FailureReplies(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	closed := listener.Addr().(*net.TCPAddr)
+	_ = listener.Close()
+	dest := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 80}
+	domain := append(append([]byte{Socks5Version, connectCommand, 0, DomainAddress, 12}, "host.invalid"...), 0, 80)
+
+	cases := []struct {
+		name    string
+		conf    ServerConfig
+		request []byte
+		code    uint8
+	}{
+		{"no outbound", ServerConfig{Router: &Router{Default: "missing"}},
+			connectRequest(connectCommand, dest), serverFailure},
+		{"denied", ServerConfig{Rules: PermitNone()},
+			connectRequest(connectCommand, dest), ruleNotAllowed},
+		{"network unreachable", ServerConfig{Dial: dialErrno(syscall.ENETUNREACH)},
+			connectRequest(connectCommand, dest), networkUnreachable},
+		{"unresolved", ServerConfig{Resolver: failingResolver{}},
+			domain, hostUnreachable},
+		{"refused", ServerConfig{},
+			connectRequest(connectCommand, closed), connectionRefused},
+		{"bind", ServerConfig{},
+			connectRequest(bindCommand, dest), commandNotSupported},
+		{"unknown command", ServerConfig{},
+			connectRequest(0x09, dest), commandNotSupported},
+		{"unknown address type", ServerConfig{},
+			[]byte{Socks5Version, connectCommand, 0, 0x09, 0, 0, 0, 0, 0, 80}, addrTypeNotSupported},
+	}
+	for _, c := range cases {
+		conf := c.conf
+		conf.AuthMethods = []Authenticator{NoAuthAuthenticator{}}
+		_, addr := startTestServer(t, &conf)
+		_, reply := socksRequest(t, addr, c.request)
+		want := []byte{Socks5Version, c.code, 0, IPV4Address, 0, 0, 0, 0, 0, 0}
+		if !bytes.Equal(reply, want) {
+			t.Fatalf("%s: bad reply: %v, want %v", c.name, reply, want)
+		}
+	}
+}
+
+func TestServer_ConnectReplyIPv4(t *testing.T) {
+	echo := startEchoServer(t)
+	_, addr := startTestServer(t, &ServerConfig{AuthMethods: []Authenticator{NoAuthAuthenticator{}}})
+	_, reply := socksRequest(t, addr, connectRequest(connectCommand, echo))
+	if len(reply) != 10 || !bytes.Equal(reply[:8], []byte{Socks5Version, succeeded, 0, IPV4Address, 127, 0, 0, 1}) {
+		t.Fatalf("bad reply: %v", reply)
+	}
+	if reply[8] == 0 && reply[9] == 0 {
+		t.Fatalf("bad bind port: %v", reply)
+	}
+}
+
+func TestServer_ConnectReplyIPv6(t *testing.T) {
+	listener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	_, addr := startTestServer(t, &ServerConfig{AuthMethods: []Authenticator{NoAuthAuthenticator{}}})
+	conn, reply := socksRequest(t, addr, connectRequest(connectCommand, listener.Addr().(*net.TCPAddr)))
+	want := append([]byte{Socks5Version, succeeded, 0, IPV6Address}, net.IPv6loopback...)
+	if len(reply) != 22 || !bytes.Equal(reply[:20], want) {
+		t.Fatalf("bad reply: %v", reply)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	echoed := make([]byte, 4)
+	if _, err := io.ReadFull(conn, echoed); err != nil || string(echoed) != "ping" {
+		t.Fatalf("bad echo: %q %v", echoed, err)
+	}
+}
+
+func TestServer_ConnectReplyDomain(t *testing.T) {
+	conf := &ServerConfig{
+		AuthMethods: []Authenticator{NoAuthAuthenticator{}},
+		Dial: func(network string, addr AddrSpec) (net.Conn, error) {
+			local, remote := net.Pipe()
+			t.Cleanup(func() { _ = remote.Close() })
+			return &namedConn{Conn: local, local: namedAddr("proxy.example:8080")}, nil
+		},
+	}
+	_, addr := startTestServer(t, conf)
+	_, reply := socksRequest(t, addr, connectRequest(connectCommand, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 80}))
+	want := append(append([]byte{Socks5Version, succeeded, 0, DomainAddress, 13}, "proxy.example"...), 0x1f, 0x90)
+	if !bytes.Equal(reply, want) {
+		t.Fatalf("bad reply: %v, want %v", reply, want)
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestReplyCode(t *testing.T) {
+	opErr := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+	}
+	cases := []struct {
+		err  error
+		code uint8
+	}{
+		{opErr(syscall.ECONNREFUSED), connectionRefused},
+		{opErr(syscall.ENETUNREACH), networkUnreachable},
+		{opErr(syscall.EHOSTUNREACH), hostUnreachable},
+		{opErr(syscall.ETIMEDOUT), ttlExpired},
+		{opErr(syscall.EACCES), ruleNotAllowed},
+		{ErrRejected, ruleNotAllowed},
+		{fmt.Errorf("Upstream: %w", ErrRejected), ruleNotAllowed},
+		{&net.DNSError{Err: "no such host", Name: "host.invalid", IsNotFound: true}, hostUnreachable},
+		{&net.DNSError{Err: "i/o timeout", Name: "slow.test", IsTimeout: true}, hostUnreachable},
+		{context.DeadlineExceeded, ttlExpired},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}, ttlExpired},
+		{&ReplyError{Code: serverFailure, Err: opErr(syscall.ECONNREFUSED)}, serverFailure},
+		{fmt.Errorf("Upstream: %w", &ReplyError{Code: networkUnreachable}), networkUnreachable},
+		{errors.New("something else"), hostUnreachable},
+	}
+	for _, c := range cases {
+		if code := replyCode(c.err); code != c.code {
+			t.Fatalf("%v: bad reply code %d, want %d", c.err, code, c.code)
+		}
+	}
+}
+
+func TestServer_DialReplyError(t *testing.T) {
+	conf := &ServerConfig{
+		AuthMethods: []Authenticator{NoAuthAuthenticator{}},
+		Dial: func(network string, addr AddrSpec) (net.Conn, error) {
+			return nil, &ReplyError{Code: ttlExpired, Err: errors.New("hop limit reached")}
+		},
+	}
+	_, addr := startTestServer(t, conf)
+	_, reply := socksRequest(t, addr, connectRequest(connectCommand, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 80}))
+	want := []byte{Socks5Version, ttlExpired, 0, IPV4Address, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(reply, want) {
+		t.Fatalf("bad reply: %v, want %v", reply, want)
+	}
+}
+
+func TestSocks5Outbound_ReplyCode(t *testing.T) {
+	_, upstream := startTestServer(t, &ServerConfig{AuthMethods: []Authenticator{NoAuthAuthenticator{}}, Rules: PermitNone()})
+	router := &Router{
+		Outbounds: map[string]Outbound{"upstream": &Socks5Outbound{Address: upstream}},
+		Default:   "upstream",
+	}
+	_, addr := startTestServer(t, &ServerConfig{AuthMethods: []Authenticator{NoAuthAuthenticator{}}, Router: router})
+	_, reply := socksRequest(t, addr, connectRequest(connectCommand, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 80}))
+	if reply[1] != ruleNotAllowed {
+		t.Fatalf("expected the upstream reply, got %v", reply)
+	}
+}
@@ -1,11 +1,13 @@
 package socks5
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"strconv"
-	"strings"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -36,11 +38,17 @@ const (
 )
 
 type Request struct {
-	Version    uint8
-	Command    uint8
+	Version     uint8
+	Command     uint8
+	AuthContext *AuthContext
+	// RemoteAddr is the address of the client, nil for clients without an
+	// IP address such as those of unix sockets. They are not banned or
+	// limited per address and PROXY headers announce them without an
+	// address, UNKNOWN in version 1 and an unspecified family in version 2.
 	RemoteAddr *AddrSpec
 	DestAddr   *AddrSpec
 	reader     io.Reader
+	session    *session
 }
 
 type AddrSpec struct {
@@ -50,11 +58,21 @@ type AddrSpec struct {
 	Port     uint16
 }
 
+// String returns host:port, IPv6 addresses are in brackets
 func (addr *AddrSpec) String() string {
 	if len(addr.Domain) != 0 {
-		return strings.Join([]string{addr.Domain, strconv.Itoa(int(addr.Port))}, ":")
+		return net.JoinHostPort(addr.Domain, strconv.Itoa(int(addr.Port)))
 	}
-	return strings.Join([]string{addr.IP.String(), strconv.Itoa(int(addr.Port))}, ":")
+	return net.JoinHostPort(addr.IP.String(), strconv.Itoa(int(addr.Port)))
+}
+
+// addrSpec returns the address of ip and port with the type of ip
+func addrSpec(ip net.IP, port int) *AddrSpec {
+	spec := &AddrSpec{IP: ip, Port: uint16(port), AddrType: IPV6Address}
+	if ip4 := ip.To4(); ip4 != nil {
+		spec.IP, spec.AddrType = ip4, IPV4Address
+	}
+	return spec
 }
 
 func NewRequest(reader io.Reader) (*Request, error) {
@@ -78,18 +96,33 @@ func NewRequest(reader io.Reader) (*Request, error) {
 }
 
 func (server *Server) process(req *Request, conn net.Conn) error {
+	conf := req.session.conf
+	if conf.Agents != nil {
+		switch req.Command {
+		case registerCommand:
+			return server.handleRegister(req, conn)
+		case attachCommand:
+			return server.handleAttach(req, conn)
+		}
+	}
+	if _, stream := conn.(*muxStream); conf.Mux != nil && req.Command == muxCommand && !stream {
+		return server.handleMux(req, conn)
+	}
 	dest := req.DestAddr
 	if dest.Domain != "" {
-		addr, err := server.Config.Resolver.Resolve(dest.Domain)
+		addr, err := server.resolve(conf, dest.Domain)
 		if err != nil {
-			if err = sendResponse(conn, hostUnreachable, nil); err != nil {
-				server.Config.Logger.Errorf("Failed to send response %v ", err)
+			server.metrics.rejected.With(rejectResolve).Inc()
+			req.session.setReason(closeResolve)
+			if err := server.sendReply(req.session, replyCode(err), nil); err != nil {
+				conf.Logger.Errorf("Failed to send response %v ", err)
 				return fmt.Errorf("Failed to send response %v ", err)
 			}
-			server.Config.Logger.Errorf("Failed to resolve destination '%v': %v ", dest.Domain, err)
+			conf.Logger.Errorf("Failed to resolve destination '%v': %v ", dest.Domain, err)
 			return fmt.Errorf("Failed to resolve destination '%v': %v ", dest.Domain, err)
 		}
 		dest.IP = addr
+		req.session.setResolved(addr)
 	}
 	switch req.Command {
 	case connectCommand:
@@ -99,88 +132,121 @@ func (server *Server) process(req *Request, conn net.Conn) error {
 	case associateCommand:
 		return server.handleAssociate(req, conn)
 	default:
-		if err := sendResponse(conn, commandNotSupported, nil); err != nil {
-			server.Config.Logger.Errorf("Failed to send response: %v", err)
+		server.metrics.rejected.With(rejectCommand).Inc()
+		req.session.setReason(closeUnsupported)
+		if err := server.sendReply(req.session, commandNotSupported, nil); err != nil {
+			conf.Logger.Errorf("Failed to send response: %v", err)
 			return err
 		}
-		server.Config.Logger.Errorf("Unsupported command: %v ", req.Command)
+		conf.Logger.Errorf("Unsupported command: %v ", req.Command)
 		return fmt.Errorf("Unsupported command: %v ", req.Command)
 	}
 }
 
 func (server *Server) handleConnect(req *Request, conn net.Conn) error {
+	conf := req.session.conf
 	if err := server.checkRules(req, conn); err != nil {
 		return err
 	}
-	dial := server.Config.Dial
-	if dial == nil {
-		dial = func(network string, addr AddrSpec) (net.Conn, error) {
-			return net.DialTCP(network, nil, &net.TCPAddr{IP: addr.IP, Port:int(addr.Port)})
+	dial, err := server.dialer(req)
+	if err != nil {
+		server.metrics.rejected.With(rejectDial).Inc()
+		req.session.setReason(closeDial)
+		if err := server.sendReply(req.session, serverFailure, nil); err != nil {
+			conf.Logger.Errorf("Failed to send response: %v ", err)
+			return err
 		}
+		conf.Logger.Errorf("No outbound for %v: %v", req.DestAddr, err)
+		return err
 	}
+	start := time.Now()
 	target, err := dial("tcp", *req.DestAddr)
-	if err != nil {
-		msg := err.Error()
-		resp := hostUnreachable
-		if strings.Contains(msg, "refused") {
-			resp = connectionRefused
-		} else if strings.Contains(msg, "network is unreachable") {
-			resp = networkUnreachable
+	server.metrics.dialDuration.Observe(sinceSeconds(start))
+	if errors.Is(err, ErrRejected) {
+		server.metrics.rejected.With(rejectRule).Inc()
+		req.session.setReason(closeRule)
+		if err := server.sendReply(req.session, ruleNotAllowed, nil); err != nil {
+			conf.Logger.Errorf("Failed to send response: %v ", err)
+			return err
 		}
-		if err := sendResponse(conn, resp, nil); err != nil {
-			server.Config.Logger.Errorf("Failed to send response: %v ", err)
+		return fmt.Errorf("Connect to %v rejected by outbound ", req.DestAddr)
+	}
+	if err != nil {
+		server.metrics.rejected.With(rejectDial).Inc()
+		req.session.setReason(closeDial)
+		if err := server.sendReply(req.session, replyCode(err), nil); err != nil {
+			conf.Logger.Errorf("Failed to send response: %v ", err)
 			return err
 		}
-		server.Config.Logger.Errorf("Connect to %v failed: %s", req.DestAddr, msg)
+		conf.Logger.Errorf("Connect to %v failed: %v", req.DestAddr, err)
 		return err
 	}
-	server.Config.Logger.Infof("Connect remote %s success", req.DestAddr.String())
+	conf.Logger.Infof("Connect remote %s success", req.DestAddr.String())
 	defer target.Close()
-	local := target.LocalAddr().(*net.TCPAddr)
-	bind := AddrSpec{
-		IP:       local.IP,
-		Port:     uint16(local.Port),
-		AddrType: IPV4Address,
-	}
-	if err := sendResponse(conn, succeeded, &bind); err != nil {
-		server.Config.Logger.Errorf("Failed to send response: %v ", err)
+	if !req.session.setTarget(target) {
+		return errors.New("Session killed while connecting ")
+	}
+	if err := server.sendReply(req.session, succeeded, bindAddr(target.LocalAddr())); err != nil {
+		conf.Logger.Errorf("Failed to send response: %v ", err)
 		return err
 	}
 
-	errCh := make(chan error, 2)
-	go copyData(target, req.reader, errCh)
-	go copyData(conn, target, errCh)
+	user := req.AuthContext.User()
+	up := &countingWriter{
+		Writer:   target,
+		counter:  server.metrics.relayedBytes.With("up", user),
+		total:    &req.session.bytesUp,
+		activity: &req.session.lastActivity,
+	}
+	down := &countingWriter{
+		Writer:   conn,
+		counter:  server.metrics.relayedBytes.With("down", user),
+		total:    &req.session.bytesDown,
+		activity: &req.session.lastActivity,
+	}
+	if conf.IdleTimeout > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go watchIdle(req.session, conf.IdleTimeout, stop)
+	}
+	errCh := make(chan relayResult, 2)
+	go copyData(up, req.reader, closeClientClosed, errCh)
+	go copyData(down, target, closeRemoteClosed, errCh)
 
 	for i := 0; i < 2; i++ {
-		e := <-errCh
-		if e != nil {
-			return e
+		result := <-errCh
+		if result.err != nil {
+			req.session.setReason(closeRelayError)
+			return result.err
 		}
+		req.session.setReason(result.reason)
 	}
 	return nil
 }
 
 func (server *Server) handleBind(req *Request, conn net.Conn) error {
+	conf := req.session.conf
 	if err := server.checkRules(req, conn); err != nil {
 		return err
 	}
-	if err := sendResponse(conn, commandNotSupported, nil); err != nil {
-		server.Config.Logger.Errorf("Failed to send response: %v ", err)
+	if err := server.sendReply(req.session, commandNotSupported, nil); err != nil {
+		conf.Logger.Errorf("Failed to send response: %v ", err)
 		return err
 	}
-	server.Config.Logger.Infof("Bind command is temporarily not supported")
+	conf.Logger.Infof("Bind command is temporarily not supported")
 	return nil
 }
 
 func (server *Server) handleAssociate(req *Request, conn net.Conn) error {
+	conf := req.session.conf
 	if err := server.checkRules(req, conn); err != nil {
 		return err
 	}
-	if err := sendResponse(conn, commandNotSupported, nil); err != nil {
-		server.Config.Logger.Errorf("Failed to send response: %v ", err)
+	if err := server.sendReply(req.session, commandNotSupported, nil); err != nil {
+		conf.Logger.Errorf("Failed to send response: %v ", err)
 		return err
 	}
-	server.Config.Logger.Infof("Associate command is temporarily not supported")
+	conf.Logger.Infof("Associate command is temporarily not supported")
 	return nil
 }
 
@@ -233,54 +299,169 @@ func parseAddrSpec(r io.Reader) (*AddrSpec, error) {
 	return addrSpec, nil
 }
 
+// sendResponse writes a reply, failure replies carry no address and are sent
+// with the IPv4 zero address. An address without a type is written as the
+// type of its IP or domain.
 func sendResponse(writer io.Writer, resp uint8, addr *AddrSpec) error {
-	rep := &Response{}
-	rep.Ver = Socks5Version
-	rep.Rep = resp
-	rep.Rsv = uint8(0)
-	rep.Atyp = 0
+	rep := &Response{Ver: Socks5Version, Rep: resp, Rsv: 0}
 	if addr == nil {
-		rep.Atyp = IPV4Address
-		rep.BndAddr = []byte{0, 0, 0, 0}
-		rep.BndPort = []byte{0, 0}
-		return nil
+		addr = &AddrSpec{IP: net.IPv4zero, AddrType: IPV4Address}
 	}
 	rep.Atyp = addr.AddrType
+	if rep.Atyp == 0 {
+		switch {
+		case addr.Domain != "":
+			rep.Atyp = DomainAddress
+		case addr.IP.To4() != nil:
+			rep.Atyp = IPV4Address
+		default:
+			rep.Atyp = IPV6Address
+		}
+	}
 	rep.BndPort = []byte{byte(addr.Port >> 8), byte(addr.Port & 0xff)}
-	switch addr.AddrType {
+	switch rep.Atyp {
 	case IPV4Address:
 		rep.BndAddr = addr.IP.To4()
 	case DomainAddress:
+		if len(addr.Domain) == 0 || len(addr.Domain) > 255 {
+			return fmt.Errorf("Failed to format address: %v ", addr)
+		}
 		rep.BndAddr = bytesCombine([]byte{byte(len(addr.Domain))}, []byte(addr.Domain))
 	case IPV6Address:
 		rep.BndAddr = addr.IP.To16()
 	default:
 		return fmt.Errorf("Failed to format address: %v ", addr)
 	}
+	if rep.BndAddr == nil {
+		return fmt.Errorf("Failed to format address: %v ", addr)
+	}
 	_, err := writer.Write(bytesCombine([]byte{rep.Ver, rep.Rep, rep.Rsv, rep.Atyp}, rep.BndAddr, rep.BndPort))
 	return err
 }
 
-type closeWriter interface {
-	CloseWrite() error
+// bindAddr is the BND.ADDR and BND.PORT of a reply for the local address of
+// an outbound connection. Connections that are not IP sockets, such as those
+// of a custom Dial, are reported by host name or with the zero address.
+func bindAddr(addr net.Addr) *AddrSpec {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return addrSpec(tcp.IP, tcp.Port)
+	}
+	host, portStr, err := net.SplitHostPort(addr.String())
+	port, portErr := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || portErr != nil {
+		return addrSpec(net.IPv4zero, 0)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return addrSpec(ip, int(port))
+	}
+	if host == "" || len(host) > 255 {
+		return addrSpec(net.IPv4zero, int(port))
+	}
+	return &AddrSpec{Domain: host, Port: uint16(port), AddrType: DomainAddress}
+}
+
+// sendReply records the reply code and writes it to the client
+func (server *Server) sendReply(sess *session, resp uint8, addr *AddrSpec) error {
+	server.metrics.reply(resp)
+	sess.setReply(resp)
+	return sess.writeReply(resp, addr)
+}
+
+// resolve looks up name with the configured resolver and records how long it
+// took and, for caching resolvers, whether the cache answered
+func (server *Server) resolve(conf *ServerConfig, name string) (net.IP, error) {
+	start := time.Now()
+	defer func() {
+		server.metrics.dnsDuration.Observe(sinceSeconds(start))
+	}()
+	if cached, ok := conf.Resolver.(cachedResolver); ok {
+		ip, hit, err := cached.ResolveCached(name)
+		if err == nil {
+			if hit {
+				server.metrics.dnsCache.With("hit").Inc()
+			} else {
+				server.metrics.dnsCache.With("miss").Inc()
+			}
+		}
+		return ip, err
+	}
+	return conf.Resolver.Resolve(name)
+}
+
+// dialer returns how the destination of req is reached: the Dial hook when it
+// is set, otherwise the Outbound of the server or the one the router picks
+func (server *Server) dialer(req *Request) (func(network string, addr AddrSpec) (net.Conn, error), error) {
+	conf := req.session.conf
+	if conf.Dial != nil {
+		return conf.Dial, nil
+	}
+	if conf.Router == nil {
+		direct := &DirectOutbound{Timeout: conf.DialTimeout}
+		return direct.Dial, nil
+	}
+	var outbound Outbound
+	var err error
+	if conf.Outbound != "" {
+		outbound, err = conf.Router.outbound(conf.Outbound)
+	} else {
+		var route string
+		route, outbound, err = conf.Router.Select(req)
+		req.session.setRoute(route)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if dialer, ok := outbound.(clientDialer); ok {
+		from := &client{addr: req.RemoteAddr, user: req.AuthContext.User()}
+		return func(network string, addr AddrSpec) (net.Conn, error) {
+			return dialer.dialFor(network, from, addr)
+		}, nil
+	}
+	return outbound.Dial, nil
+}
+
+// watchIdle kills the session once nothing was relayed for timeout
+func watchIdle(sess *session, timeout time.Duration, stop chan struct{}) {
+	interval := timeout / 4
+	if interval < 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			last := time.Unix(0, atomic.LoadInt64(&sess.lastActivity))
+			if now.Sub(last) >= timeout {
+				sess.setReason(closeIdle)
+				sess.kill()
+				return
+			}
+		}
+	}
 }
 
 // checkRules is used to check request command is allowed
-func (server *Server) checkRules(req* Request, conn net.Conn) error {
-	if ok := server.Config.Rules.Allow(req); !ok {
-		if err := sendResponse(conn, ruleNotAllowed, nil); err != nil {
-			server.Config.Logger.Errorf("Failed to send response: %v ", err)
+func (server *Server) checkRules(req *Request, conn net.Conn) error {
+	conf := req.session.conf
+	var ok bool
+	if named, isNamed := conf.Rules.(namedRuleSet); isNamed {
+		var rule string
+		rule, ok = named.Match(req)
+		req.session.setRule(rule)
+	} else {
+		ok = conf.Rules.Allow(req)
+	}
+	if !ok {
+		server.metrics.rejected.With(rejectRule).Inc()
+		req.session.setReason(closeRule)
+		if err := server.sendReply(req.session, ruleNotAllowed, nil); err != nil {
+			conf.Logger.Errorf("Failed to send response: %v ", err)
 			return err
 		}
 		return fmt.Errorf("command %d to %v blocked by rules ", req.Command, req.DestAddr)
 	}
 	return nil
 }
-
-func copyData(dst io.Writer, src io.Reader, errCh chan error) {
-	_, err := io.Copy(dst, src)
-	if tcpConn, ok := dst.(closeWriter); ok {
-		_ = tcpConn.CloseWrite()
-	}
-	errCh <- err
-}
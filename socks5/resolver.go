@@ -1,13 +1,24 @@
 package socks5
 
 import (
+	"context"
+	"errors"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type NameResolver interface {
 	Resolve(name string) (net.IP, error)
 }
 
+// cachedResolver is implemented by resolvers that can tell whether an answer
+// came from a local cache, which lets the server report the cache hit rate
+type cachedResolver interface {
+	ResolveCached(name string) (ip net.IP, hit bool, err error)
+}
+
 type DNSResolver struct{}
 
 func (d DNSResolver) Resolve(name string) (net.IP, error) {
@@ -17,3 +28,126 @@ func (d DNSResolver) Resolve(name string) (net.IP, error) {
 	}
 	return addr.IP, err
 }
+
+// ServerResolver queries the given DNS servers instead of the system
+// configuration, servers are used in turn
+type ServerResolver struct {
+	// Servers are "host:port" addresses of DNS servers
+	Servers []string
+	Timeout time.Duration
+
+	next     uint32
+	resolver *net.Resolver
+	once     sync.Once
+}
+
+func (d *ServerResolver) Resolve(name string) (net.IP, error) {
+	d.once.Do(func() {
+		dialer := &net.Dialer{}
+		d.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				i := atomic.AddUint32(&d.next, 1)
+				return dialer.DialContext(ctx, network, d.Servers[int(i)%len(d.Servers)])
+			},
+		}
+	})
+	if len(d.Servers) == 0 {
+		return nil, errors.New("No DNS servers configured ")
+	}
+	ctx := context.Background()
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	addrs, err := d.resolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return addrs[0].IP, nil
+}
+
+// defaultDNSCacheSize bounds the names a CachingResolver remembers
+const defaultDNSCacheSize = 10000
+
+// CachingResolver remembers successful answers of Resolver for TTL
+type CachingResolver struct {
+	Resolver NameResolver
+	TTL      time.Duration
+	// MaxEntries bounds the names remembered, 10000 by default. Clients pick
+	// the names, so a random name is forgotten when a new one does not fit.
+	MaxEntries int
+
+	mu    sync.Mutex
+	cache map[string]cacheEntry
+	// swept is when the expired names were last forgotten
+	swept time.Time
+}
+
+type cacheEntry struct {
+	ip      net.IP
+	expires time.Time
+}
+
+func NewCachingResolver(resolver NameResolver, ttl time.Duration) *CachingResolver {
+	return &CachingResolver{Resolver: resolver, TTL: ttl}
+}
+
+func (c *CachingResolver) Resolve(name string) (net.IP, error) {
+	ip, _, err := c.ResolveCached(name)
+	return ip, err
+}
+
+func (c *CachingResolver) ResolveCached(name string) (net.IP, bool, error) {
+	now := time.Now()
+	c.mu.Lock()
+	if entry, ok := c.cache[name]; ok {
+		if now.Before(entry.expires) {
+			c.mu.Unlock()
+			return entry.ip, true, nil
+		}
+		delete(c.cache, name)
+	}
+	c.mu.Unlock()
+
+	ip, err := c.Resolver.Resolve(name)
+	if err != nil {
+		return nil, false, err
+	}
+	c.mu.Lock()
+	c.store(name, ip, now)
+	c.mu.Unlock()
+	return ip, false, nil
+}
+
+// store remembers the answer for name, expired names are swept once per TTL.
+// c.mu must be held.
+func (c *CachingResolver) store(name string, ip net.IP, now time.Time) {
+	if c.cache == nil {
+		c.cache, c.swept = make(map[string]cacheEntry), now
+	}
+	if now.Sub(c.swept) >= c.TTL {
+		for n, entry := range c.cache {
+			if !now.Before(entry.expires) {
+				delete(c.cache, n)
+			}
+		}
+		c.swept = now
+	}
+	max := c.MaxEntries
+	if max <= 0 {
+		max = defaultDNSCacheSize
+	}
+	if _, ok := c.cache[name]; !ok && len(c.cache) >= max {
+		// the order of map iteration is random
+		for n := range c.cache {
+			delete(c.cache, n)
+			break
+		}
+	}
+	c.cache[name] = cacheEntry{ip: ip, expires: now.Add(c.TTL)}
+}
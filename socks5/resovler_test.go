@@ -1,7 +1,10 @@
 package socks5
 
 import (
+	"fmt"
+	"net"
 	"testing"
+	"time"
 )
 
 func TestDNSResolver(t *testing.T) {
@@ -16,3 +19,34 @@ func TestDNSResolver(t *testing.T) {
 		t.Fatalf("expected loopback")
 	}
 }
+
+// loopbackResolver resolves every name to the loopback address
+type loopbackResolver struct{}
+
+func (loopbackResolver) Resolve(name string) (net.IP, error) {
+	return net.IPv4(127, 0, 0, 1), nil
+}
+
+func TestCachingResolver_Bounded(t *testing.T) {
+	c := &CachingResolver{Resolver: loopbackResolver{}, TTL: time.Hour, MaxEntries: 3}
+	for i := 0; i < 10; i++ {
+		if _, err := c.Resolve(fmt.Sprintf("host%d.example.com", i)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if len(c.cache) != 3 {
+		t.Fatalf("expected 3 names to be remembered, got %d", len(c.cache))
+	}
+	if _, cached, _ := c.ResolveCached("host9.example.com"); !cached {
+		t.Fatalf("expected the latest name to be remembered")
+	}
+
+	c = &CachingResolver{Resolver: loopbackResolver{}, TTL: 10 * time.Millisecond}
+	_, _ = c.Resolve("a.example.com")
+	_, _ = c.Resolve("b.example.com")
+	time.Sleep(20 * time.Millisecond)
+	_, _ = c.Resolve("c.example.com")
+	if len(c.cache) != 1 {
+		t.Fatalf("expected the expired names to be swept, got %d names", len(c.cache))
+	}
+}
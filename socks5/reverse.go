@@ -0,0 +1,352 @@
+package socks5
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// registerCommand and attachCommand are private commands of JadeSocks
+// agents. An agent registers a control connection as the user it
+// authenticated as, then attaches a new connection for every destination the
+// server asks it to reach through the control connection.
+const (
+	registerCommand = uint8(0x80)
+	attachCommand   = uint8(0x81)
+)
+
+// The messages of a control connection. The server sends pings, which the
+// agent answers, and opens, which carry an ID and a destination in the
+// encoding of SOCKS5 requests. The agent reports the destinations it failed
+// to reach with a fail, which carries the ID and a reply code.
+const (
+	agentPing = uint8(0)
+	agentOpen = uint8(1)
+	agentFail = uint8(2)
+)
+
+const (
+	// agentHeartbeat is how often the server pings agents, either side drops
+	// a control connection silent for three heartbeats
+	agentHeartbeat = 30 * time.Second
+	agentIDLength  = 16
+	// defaultAttachTimeout bounds how long a ReverseOutbound without a
+	// Timeout waits for the agent to attach a connection
+	defaultAttachTimeout = 30 * time.Second
+)
+
+// Agents tracks the agents connected to servers. It is shared by the servers
+// that accept agents and the ReverseOutbounds that reach them.
+type Agents struct {
+	mu      sync.Mutex
+	allowed map[string]bool
+	agents  map[string]*agentConn
+	pending map[string]*pendingAttach
+}
+
+func NewAgents() *Agents {
+	return &Agents{
+		allowed: make(map[string]bool),
+		agents:  make(map[string]*agentConn),
+		pending: make(map[string]*pendingAttach),
+	}
+}
+
+// Allow sets the names of the agents that may register, an agent's name is
+// the user it authenticates as. Connected agents no longer allowed are
+// disconnected.
+func (a *Agents) Allow(names []string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.allowed = make(map[string]bool, len(names))
+	for _, name := range names {
+		a.allowed[name] = true
+	}
+	for name, agent := range a.agents {
+		if !a.allowed[name] {
+			agent.close()
+		}
+	}
+}
+
+// Connected returns the names of the connected agents
+func (a *Agents) Connected() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	names := make([]string, 0, len(a.agents))
+	for name := range a.agents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// agentConn is the control connection of a registered agent
+type agentConn struct {
+	name    string
+	conn    net.Conn
+	writeMu sync.Mutex
+	done    chan struct{}
+	once    sync.Once
+}
+
+func (c *agentConn) send(msg []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(agentHeartbeat))
+	_, err := c.conn.Write(msg)
+	return err
+}
+
+func (c *agentConn) close() {
+	c.once.Do(func() {
+		close(c.done)
+		_ = c.conn.Close()
+	})
+}
+
+// pendingAttach waits for the connection an agent attaches for an open
+type pendingAttach struct {
+	agent  string
+	result chan attachResult
+}
+
+// attachResult is the attached connection, or the reply code of the agent's
+// failure when conn is nil
+type attachResult struct {
+	conn net.Conn
+	code uint8
+}
+
+// register makes conn the control connection of the agent name, replacing
+// the one it had, it returns nil when name may not register
+func (a *Agents) register(name string, conn net.Conn) *agentConn {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.allowed[name] {
+		return nil
+	}
+	if old, ok := a.agents[name]; ok {
+		old.close()
+	}
+	agent := &agentConn{name: name, conn: conn, done: make(chan struct{})}
+	a.agents[name] = agent
+	return agent
+}
+
+func (a *Agents) unregister(agent *agentConn) {
+	agent.close()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.agents[agent.name] == agent {
+		delete(a.agents, agent.name)
+	}
+}
+
+// claim removes the pending attach id of the agent name, it returns nil
+// when there is none because it timed out or belongs to another agent
+func (a *Agents) claim(id, name string) *pendingAttach {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	pending, ok := a.pending[id]
+	if !ok || pending.agent != name {
+		return nil
+	}
+	delete(a.pending, id)
+	return pending
+}
+
+// serve answers the control connection of agent until it is closed or
+// silent for three heartbeats
+func (a *Agents) serve(agent *agentConn, reader io.Reader) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(agentHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := agent.send([]byte{agentPing}); err != nil {
+					agent.close()
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	r := bufio.NewReader(reader)
+	for {
+		_ = agent.conn.SetReadDeadline(time.Now().Add(3 * agentHeartbeat))
+		kind, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch kind {
+		case agentPing:
+		case agentFail:
+			msg := make([]byte, agentIDLength+1)
+			if _, err := io.ReadFull(r, msg); err != nil {
+				return err
+			}
+			if pending := a.claim(hex.EncodeToString(msg[:agentIDLength]), agent.name); pending != nil {
+				pending.result <- attachResult{code: msg[agentIDLength]}
+			}
+		default:
+			return fmt.Errorf("Unknown message %d from agent %s ", kind, agent.name)
+		}
+	}
+}
+
+// dial asks the agent name to connect to addr and waits for the connection
+// it attaches
+func (a *Agents) dial(name string, addr AddrSpec, timeout time.Duration) (net.Conn, error) {
+	id := make([]byte, agentIDLength)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	key := hex.EncodeToString(id)
+	pending := &pendingAttach{agent: name, result: make(chan attachResult, 1)}
+	a.mu.Lock()
+	agent, ok := a.agents[name]
+	if ok {
+		a.pending[key] = pending
+	}
+	a.mu.Unlock()
+	if !ok {
+		return nil, &ReplyError{Code: networkUnreachable, Err: fmt.Errorf("Agent %s is not connected ", name)}
+	}
+
+	if err := agent.send(appendAddr(append([]byte{agentOpen}, id...), addr)); err != nil {
+		a.claim(key, name)
+		agent.close()
+		return nil, &ReplyError{Code: networkUnreachable, Err: fmt.Errorf("Agent %s: %v ", name, err)}
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var result attachResult
+	select {
+	case result = <-pending.result:
+	case <-timer.C:
+		if a.claim(key, name) != nil {
+			return nil, &ReplyError{Code: ttlExpired, Err: fmt.Errorf("Agent %s did not connect to %v in time ", name, &addr)}
+		}
+		result = <-pending.result
+	case <-agent.done:
+		if a.claim(key, name) != nil {
+			return nil, &ReplyError{Code: networkUnreachable, Err: fmt.Errorf("Agent %s disconnected ", name)}
+		}
+		result = <-pending.result
+	}
+	if result.conn == nil {
+		return nil, &ReplyError{Code: result.code, Err: fmt.Errorf("Agent %s failed to connect to %v ", name, &addr)}
+	}
+	return result.conn, nil
+}
+
+// attachedConn is a connection an agent attached, it reads through the
+// buffer of the handshake and tells the server when it is closed
+type attachedConn struct {
+	net.Conn
+	reader io.Reader
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (c *attachedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *attachedConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
+
+func (c *attachedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// handleRegister serves the control connection of an agent
+func (server *Server) handleRegister(req *Request, conn net.Conn) error {
+	conf := req.session.conf
+	name := req.AuthContext.User()
+	var agent *agentConn
+	if req.AuthContext.Method == UserPassAuth {
+		agent = conf.Agents.register(name, conn)
+	}
+	if agent == nil {
+		server.metrics.rejected.With(rejectRule).Inc()
+		req.session.setReason(closeRule)
+		if err := server.sendReply(req.session, ruleNotAllowed, nil); err != nil {
+			return err
+		}
+		return fmt.Errorf("Agent %q may not register ", name)
+	}
+	defer conf.Agents.unregister(agent)
+	if err := server.sendReply(req.session, succeeded, nil); err != nil {
+		conf.Logger.Errorf("Failed to send response: %v ", err)
+		return err
+	}
+	conf.Logger.Infof("Agent %s connected from %s", name, clientAddr(conn))
+	err := conf.Agents.serve(agent, req.reader)
+	conf.Logger.Infof("Agent %s disconnected: %v", name, err)
+	return nil
+}
+
+// handleAttach hands a connection of an agent to the dial waiting for it and
+// waits until the dial's relay closes it
+func (server *Server) handleAttach(req *Request, conn net.Conn) error {
+	conf := req.session.conf
+	var pending *pendingAttach
+	if req.AuthContext.Method == UserPassAuth {
+		pending = conf.Agents.claim(req.DestAddr.Domain, req.AuthContext.User())
+	}
+	if pending == nil {
+		server.metrics.rejected.With(rejectRule).Inc()
+		req.session.setReason(closeRule)
+		if err := server.sendReply(req.session, ruleNotAllowed, nil); err != nil {
+			return err
+		}
+		return errors.New("Attach for an unknown connection ")
+	}
+	if err := server.sendReply(req.session, succeeded, nil); err != nil {
+		pending.result <- attachResult{code: serverFailure}
+		return err
+	}
+	attached := &attachedConn{Conn: conn, reader: req.reader, done: make(chan struct{})}
+	pending.result <- attachResult{conn: attached}
+	<-attached.done
+	return nil
+}
+
+// ReverseOutbound connects to destinations through an agent, which reaches
+// them from its own network
+type ReverseOutbound struct {
+	Agents *Agents
+	// Agent is the name of the agent, the user it authenticates as
+	Agent string
+	// Timeout bounds how long the agent may take to connect
+	Timeout time.Duration
+}
+
+func (r *ReverseOutbound) Dial(network string, addr AddrSpec) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, fmt.Errorf("Unsupported network %q for reverse outbound ", network)
+	}
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = defaultAttachTimeout
+	}
+	return r.Agents.dial(r.Agent, addr, timeout)
+}
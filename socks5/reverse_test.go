@@ -0,0 +1,183 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startAgentServer serves SOCKS5 with agents allowed to register as home
+func startAgentServer(t *testing.T) (*Agents, string) {
+	agents := NewAgents()
+	agents.Allow([]string{"home"})
+	accounts := Accounts{MemoryUser: MemoryUser{"home": "secret", "guest": "guest"}}
+	_, addr := startTestServer(t, &ServerConfig{
+		AuthMethods: []Authenticator{UserPassAuthenticator{Accounts: accounts}},
+		Agents:      agents,
+	})
+	return agents, addr
+}
+
+// startAgent runs agent until the test ends and waits for it to register
+func startAgent(t *testing.T, agents *Agents, agent *Agent) {
+	go func() { _ = agent.Run() }()
+	t.Cleanup(func() { _ = agent.Close() })
+	waitConnected(t, agents, agent.Username)
+}
+
+// waitConnected waits until the agents connected are names
+func waitConnected(t *testing.T, agents *Agents, names ...string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if fmt.Sprint(agents.Connected()) == fmt.Sprint(names) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("agents %v did not connect, connected: %v", names, agents.Connected())
+}
+
+func TestReverse_Connect(t *testing.T) {
+	echo := startEchoServer(t)
+	agents, server := startAgentServer(t)
+	startAgent(t, agents, &Agent{Server: server, Username: "home", Password: "secret"})
+
+	router := &Router{
+		Outbounds: map[string]Outbound{"home": &ReverseOutbound{Agents: agents, Agent: "home"}},
+	}
+	_, addr := startTestServer(t, &ServerConfig{
+		Protocol:      ProtocolForward,
+		ForwardTarget: echo.String(),
+		Router:        router,
+		Outbound:      "home",
+	})
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("unexpected echo %q: %v", buf, err)
+		}
+		_ = conn.Close()
+	}
+}
+
+func TestReverse_Failures(t *testing.T) {
+	agents, server := startAgentServer(t)
+	denied := startEchoServer(t)
+	startAgent(t, agents, &Agent{
+		Server:   server,
+		Username: "home",
+		Password: "secret",
+		Rules: &RuleList{
+			Rules:        []Rule{{Name: "denied", Matcher: Matcher{Ports: []PortRange{{From: uint16(denied.Port), To: uint16(denied.Port)}}}}},
+			DefaultAllow: true,
+		},
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	closed := listener.Addr().(*net.TCPAddr)
+	_ = listener.Close()
+
+	for _, tc := range []struct {
+		agent string
+		dest  *net.TCPAddr
+		code  uint8
+	}{
+		{"home", closed, connectionRefused},
+		{"home", denied, ruleNotAllowed},
+		{"office", denied, networkUnreachable},
+	} {
+		outbound := &ReverseOutbound{Agents: agents, Agent: tc.agent, Timeout: 5 * time.Second}
+		conn, err := outbound.Dial("tcp", *addrSpec(tc.dest.IP, tc.dest.Port))
+		if err == nil {
+			_ = conn.Close()
+			t.Fatalf("%s %v: expected a failure", tc.agent, tc.dest)
+		}
+		if code := replyCode(err); code != tc.code {
+			t.Fatalf("%s %v: reply code %d, want %d: %v", tc.agent, tc.dest, code, tc.code, err)
+		}
+	}
+	if _, err := (&ReverseOutbound{Agents: agents, Agent: "home"}).Dial("udp", *addrSpec(denied.IP, denied.Port)); err == nil {
+		t.Fatalf("expected UDP to be rejected")
+	}
+}
+
+func TestReverse_Rejected(t *testing.T) {
+	agents, server := startAgentServer(t)
+	for _, tc := range []struct {
+		user    string
+		command uint8
+		addr    AddrSpec
+	}{
+		{"guest", registerCommand, AddrSpec{IP: net.IPv4zero, AddrType: IPV4Address}},
+		{"home", attachCommand, AddrSpec{Domain: "00112233445566778899aabbccddeeff", AddrType: DomainAddress}},
+	} {
+		conn, err := net.Dial("tcp", server)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = clientHandshake(conn, tc.user, map[string]string{"guest": "guest", "home": "secret"}[tc.user], tc.command, tc.addr)
+		var replyErr *ReplyError
+		if !errors.As(err, &replyErr) || replyErr.Code != ruleNotAllowed {
+			t.Fatalf("%s command %d: expected a rejection, got %v", tc.user, tc.command, err)
+		}
+		_ = conn.Close()
+	}
+	if connected := agents.Connected(); len(connected) != 0 {
+		t.Fatalf("unexpected agents %v", connected)
+	}
+
+	// agents are not accepted on servers without Agents
+	_, plain := startTestServer(t, &ServerConfig{AuthMethods: []Authenticator{UserPassAuthenticator{
+		Accounts: Accounts{MemoryUser: MemoryUser{"home": "secret"}},
+	}}})
+	conn, err := net.Dial("tcp", plain)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = clientHandshake(conn, "home", "secret", registerCommand, AddrSpec{IP: net.IPv4zero, AddrType: IPV4Address})
+	if replyCode(err) != commandNotSupported {
+		t.Fatalf("expected the command not to be supported, got %v", err)
+	}
+}
+
+func TestReverse_Reconnect(t *testing.T) {
+	echo := startEchoServer(t)
+	agents, server := startAgentServer(t)
+	startAgent(t, agents, &Agent{Server: server, Username: "home", Password: "secret"})
+
+	// disallowing the agent drops it, it registers again once allowed
+	agents.Allow(nil)
+	waitConnected(t, agents)
+	agents.Allow([]string{"home"})
+	waitConnected(t, agents, "home")
+
+	conn, err := (&ReverseOutbound{Agents: agents, Agent: "home"}).Dial("tcp", *addrSpec(echo.IP, echo.Port))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("unexpected echo %q: %v", buf, err)
+	}
+}
@@ -0,0 +1,61 @@
+package socks5
+
+import (
+	"fmt"
+
+	"github.com/archervanderwaal/JadeSocks/routing"
+)
+
+const (
+	// DirectOutboundName and RejectOutboundName are always available
+	DirectOutboundName = routing.DirectOutboundName
+	RejectOutboundName = routing.RejectOutboundName
+
+	defaultRouteName = "default"
+)
+
+// Route sends the requests its Matcher selects to the named outbound
+type Route struct {
+	Name     string
+	Outbound string
+	Matcher
+}
+
+// Router picks the outbound of a request, the first matching route wins and
+// requests no route matches use the Default outbound
+type Router struct {
+	Routes    []Route
+	Outbounds map[string]Outbound
+	// Default is the outbound name used when no route matches, "direct" when
+	// empty
+	Default string
+}
+
+// Select returns the name of the matched route and its outbound
+func (r *Router) Select(req *Request) (string, Outbound, error) {
+	for i := range r.Routes {
+		if r.Routes[i].Match(req) {
+			outbound, err := r.outbound(r.Routes[i].Outbound)
+			return r.Routes[i].Name, outbound, err
+		}
+	}
+	name := r.Default
+	if name == "" {
+		name = DirectOutboundName
+	}
+	outbound, err := r.outbound(name)
+	return defaultRouteName, outbound, err
+}
+
+func (r *Router) outbound(name string) (Outbound, error) {
+	if outbound, ok := r.Outbounds[name]; ok {
+		return outbound, nil
+	}
+	switch name {
+	case DirectOutboundName:
+		return &DirectOutbound{}, nil
+	case RejectOutboundName:
+		return RejectOutbound{}, nil
+	}
+	return nil, fmt.Errorf("Unknown outbound %q ", name)
+}
@@ -0,0 +1,140 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func testRequest(command uint8, user string, dest AddrSpec) *Request {
+	return &Request{
+		Command:     command,
+		AuthContext: &AuthContext{Method: UserPassAuth, Payload: map[string]string{"Username": user}},
+		DestAddr:    &dest,
+	}
+}
+
+func TestMatcher(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("10.0.0.0/8")
+	ports, _ := ParsePortRange("8000-8080")
+	m := &Matcher{
+		Commands: []uint8{connectCommand},
+		Networks: []*net.IPNet{lan},
+		Domains:  []string{"*.example.com"},
+		Ports:    []PortRange{ports},
+	}
+	cases := []struct {
+		req   *Request
+		match bool
+	}{
+		{testRequest(connectCommand, "", AddrSpec{IP: net.ParseIP("10.1.2.3"), Port: 8080}), true},
+		{testRequest(connectCommand, "", AddrSpec{Domain: "www.example.com.", Port: 8000}), true},
+		{testRequest(connectCommand, "", AddrSpec{Domain: "example.com", Port: 8000}), true},
+		{testRequest(connectCommand, "", AddrSpec{Domain: "badexample.com", Port: 8000}), false},
+		{testRequest(connectCommand, "", AddrSpec{IP: net.ParseIP("11.1.2.3"), Port: 8080}), false},
+		{testRequest(connectCommand, "", AddrSpec{IP: net.ParseIP("10.1.2.3"), Port: 80}), false},
+		{testRequest(bindCommand, "", AddrSpec{IP: net.ParseIP("10.1.2.3"), Port: 8080}), false},
+	}
+	for i, c := range cases {
+		if m.Match(c.req) != c.match {
+			t.Fatalf("case %d: expected match %v", i, c.match)
+		}
+	}
+
+	users := &Matcher{Users: []string{"alice"}}
+	if !users.Match(testRequest(connectCommand, "alice", AddrSpec{})) || users.Match(testRequest(connectCommand, "bob", AddrSpec{})) {
+		t.Fatalf("bad user match")
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	if r, err := ParsePortRange("443"); err != nil || r.From != 443 || r.To != 443 {
+		t.Fatalf("bad range %v: %v", r, err)
+	}
+	for _, s := range []string{"", "70000", "80-20", "a-b"} {
+		if _, err := ParsePortRange(s); err == nil {
+			t.Fatalf("expected %q to be rejected", s)
+		}
+	}
+}
+
+func TestRuleList(t *testing.T) {
+	rules := &RuleList{
+		Rules: []Rule{
+			{Name: "smtp", Allow: false, Matcher: Matcher{Ports: []PortRange{{From: 25, To: 25}}}},
+			{Name: "alice", Allow: true, Matcher: Matcher{Users: []string{"alice"}}},
+		},
+	}
+	if name, allow := rules.Match(testRequest(connectCommand, "alice", AddrSpec{Port: 25})); name != "smtp" || allow {
+		t.Fatalf("expected smtp to be denied, got %q %v", name, allow)
+	}
+	if name, allow := rules.Match(testRequest(connectCommand, "alice", AddrSpec{Port: 443})); name != "alice" || !allow {
+		t.Fatalf("expected alice to be allowed, got %q %v", name, allow)
+	}
+	if rules.Allow(testRequest(connectCommand, "bob", AddrSpec{Port: 443})) {
+		t.Fatalf("expected the default to deny")
+	}
+}
+
+func TestRouter_Select(t *testing.T) {
+	router := &Router{
+		Routes:    []Route{{Name: "blocked", Outbound: RejectOutboundName, Matcher: Matcher{Domains: []string{"blocked.test"}}}},
+		Outbounds: map[string]Outbound{},
+	}
+	route, outbound, err := router.Select(testRequest(connectCommand, "", AddrSpec{Domain: "a.blocked.test"}))
+	if err != nil || route != "blocked" {
+		t.Fatalf("bad route %q: %v", route, err)
+	}
+	if _, err := outbound.Dial("tcp", AddrSpec{}); err != ErrRejected {
+		t.Fatalf("expected the reject outbound, got %v", err)
+	}
+	route, outbound, err = router.Select(testRequest(connectCommand, "", AddrSpec{Domain: "example.com"}))
+	if _, ok := outbound.(*DirectOutbound); err != nil || route != defaultRouteName || !ok {
+		t.Fatalf("expected the direct outbound, got %q %T %v", route, outbound, err)
+	}
+
+	router.Default = "missing"
+	if _, _, err := router.Select(testRequest(connectCommand, "", AddrSpec{})); err == nil {
+		t.Fatalf("expected an unknown outbound to fail")
+	}
+}
+
+func TestSocks5Outbound(t *testing.T) {
+	echo := startEchoServer(t)
+	accounts := Accounts{MemoryUser: map[string]string{"user": "pass"}}
+	_, upstream := startTestServer(t, &ServerConfig{AuthMethods: []Authenticator{UserPassAuthenticator{Accounts: accounts}}})
+	router := &Router{
+		Outbounds: map[string]Outbound{"upstream": &Socks5Outbound{Address: upstream, Username: "user", Password: "pass"}},
+		Default:   "upstream",
+	}
+	_, addr := startTestServer(t, &ServerConfig{AuthMethods: []Authenticator{NoAuthAuthenticator{}}, Router: router})
+
+	conn, reply := dialConnect(t, addr, echo)
+	if reply[1] != succeeded {
+		t.Fatalf("unexpected reply %v", reply)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("unexpected echo %q: %v", buf, err)
+	}
+}
+
+func TestServer_MaxConnectionsPerIP(t *testing.T) {
+	echo := startEchoServer(t)
+	_, addr := startTestServer(t, &ServerConfig{AuthMethods: []Authenticator{NoAuthAuthenticator{}}, MaxConnectionsPerIP: 1})
+
+	if _, reply := dialConnect(t, addr, echo); reply[1] != succeeded {
+		t.Fatalf("unexpected reply %v", reply)
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("expected the second connection to be refused")
+	}
+}
@@ -13,8 +13,8 @@ func PermitNone() RuleSet {
 }
 
 type PermitCommand struct {
-	EnableConnect bool
-	EnableBind bool
+	EnableConnect   bool
+	EnableBind      bool
 	EnableAssociate bool
 }
 
@@ -29,4 +29,38 @@ func (p *PermitCommand) Allow(req *Request) bool {
 	default:
 		return false
 	}
-}
\ No newline at end of file
+}
+
+// namedRuleSet is implemented by rule sets that can tell which rule decided,
+// the name ends up in the access log
+type namedRuleSet interface {
+	Match(req *Request) (rule string, allow bool)
+}
+
+// Rule allows or denies the requests its Matcher selects
+type Rule struct {
+	Name  string
+	Allow bool
+	Matcher
+}
+
+// RuleList applies the first rule that matches a request, requests that no
+// rule matches are allowed when DefaultAllow is set
+type RuleList struct {
+	Rules        []Rule
+	DefaultAllow bool
+}
+
+func (r *RuleList) Allow(req *Request) bool {
+	_, allow := r.Match(req)
+	return allow
+}
+
+func (r *RuleList) Match(req *Request) (string, bool) {
+	for i := range r.Rules {
+		if r.Rules[i].Match(req) {
+			return r.Rules[i].Name, r.Rules[i].Allow
+		}
+	}
+	return "", r.DefaultAllow
+}
@@ -1,32 +1,165 @@
 package socks5
 
 import (
-	"bufio"
+	"crypto/tls"
 	"errors"
 	"fmt"
-	"github.com/archervanderwaal/JadeSocks/logger"
-	go_logger "github.com/phachon/go-logger"
+	"github.com/archervanderwaal/JadeSocks/metrics"
 	"io"
 	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// ProtocolSOCKS5 and ProtocolHTTP are the protocols a server speaks to
+	// its clients, a ProtocolTransparent server serves connections redirected
+	// to it by the firewall without any protocol, a ProtocolForward server
+	// connects every client to the same destination, a ProtocolShadowsocks
+	// server serves Shadowsocks clients and a ProtocolTrojan server Trojan
+	// clients over TLS
+	ProtocolSOCKS5      = "socks5"
+	ProtocolHTTP        = "http"
+	ProtocolTransparent = "transparent"
+	ProtocolForward     = "forward"
+	ProtocolShadowsocks = "shadowsocks"
+	ProtocolTrojan      = "trojan"
 )
 
 type ServerConfig struct {
+	// Name identifies the server in sessions and access records
+	Name string
+	// Protocol is ProtocolSOCKS5 (the default) or ProtocolHTTP, an HTTP proxy
+	// accepts CONNECT and absolute-URI requests and authenticates them with
+	// the user/password authenticator through Proxy-Authorization.
+	// Transparent and forward servers serve anonymous clients and need no
+	// AuthMethods, nor do Shadowsocks and Trojan servers, whose clients
+	// authenticate with their keys and passwords.
+	Protocol    string
 	AuthMethods []Authenticator
 	Resolver    NameResolver
-	Rules 		RuleSet
-	Network 	string
-	ListenAddr  string
-	Logger      *go_logger.Logger
-	Dial        func(network string, addr AddrSpec) (net.Conn, error)
+	Rules       RuleSet
+	// Network is tcp (the default), tcp4, tcp6 or unix, ListenAddr is a
+	// socket path for unix
+	Network    string
+	ListenAddr string
+	// SocketMode and SocketOwner ("user", "user:group" or ":group") are
+	// applied to a unix socket, which otherwise follows the umask and the
+	// process's user
+	SocketMode  os.FileMode
+	SocketOwner string
+	// TransparentMode is TransparentRedirect (the default) or
+	// TransparentTProxy for transparent servers, TransparentUDP also relays
+	// UDP diverted with TPROXY, which ListenPacket and ServeUDP serve
+	TransparentMode string
+	TransparentUDP  bool
+	// ForwardTarget is the host:port every client of a forward server is
+	// connected to, ForwardUDP also relays the UDP datagrams received on
+	// ListenAddr to it, which ListenPacket and ServeUDP serve
+	ForwardTarget string
+	ForwardUDP    bool
+	// Shadowsocks is the cipher and keys of a Shadowsocks server,
+	// ShadowsocksUDP also serves Shadowsocks UDP on ListenAddr, which
+	// ListenPacket and ServeUDP serve
+	Shadowsocks    *Shadowsocks
+	ShadowsocksUDP bool
+	// Trojan is the users and fallback of a Trojan server, which requires
+	// TLS
+	Trojan *Trojan
+	// TrustedProxies lists the networks of load balancers that send a PROXY
+	// protocol version 1 or 2 header ahead of each connection, the client
+	// address of the header is used for limits, bans, rules and logs.
+	// Connections from other addresses are taken as they are.
+	TrustedProxies []*net.IPNet
+	// Obfs serves SOCKS5 clients in obfuscated connections, under TLS and
+	// WebSocket when they are set, and answers other peers like a web server.
+	// Clients using the key of one of its Users authenticate as that user.
+	Obfs *Obfs
+	// TLS serves SOCKS5 and HTTP clients over TLS. Clients presenting a
+	// certificate that verifies against ClientCAs authenticate as its
+	// CertificateIdentity when they offer no authentication, or send no
+	// Proxy-Authorization to an HTTP server, whatever AuthMethods allow.
+	TLS *tls.Config
+	// WebSocket serves SOCKS5 clients in WebSocket connections, over TLS
+	// when TLS is set, and answers other HTTP requests with a decoy page
+	WebSocket *WebSocket
+	// Logger receives the server's diagnostics, nothing is logged when it
+	// is nil
+	Logger Logger
+	// Dial connects to destinations, it takes precedence over Router
+	Dial func(network string, addr AddrSpec) (net.Conn, error)
+	// Router picks an outbound per request, destinations are connected to
+	// directly when both Dial and Router are nil
+	Router *Router
+	// Outbound names the outbound of Router that every request goes
+	// through, the routes are not consulted when it is set
+	Outbound string
+	// Mux accepts carriers of multiplexed streams from JadeSocks outbounds
+	// on a SOCKS5 server, MaxStreams and KeepAlive apply
+	Mux *Mux
+	// Agents accepts JadeSocks agents on a SOCKS5 server, an agent
+	// authenticates with the user/password method as a user Agents allows
+	Agents *Agents
+	// DialTimeout bounds direct dials when no Router is set
+	DialTimeout time.Duration
+	// HandshakeTimeout bounds negotiation, authentication and the request
+	HandshakeTimeout time.Duration
+	// IdleTimeout closes relays that carried no data for that long
+	IdleTimeout time.Duration
+	// MaxConnections and MaxConnectionsPerIP limit concurrent client
+	// connections, 0 means unlimited
+	MaxConnections      int
+	MaxConnectionsPerIP int
+	// Metrics receives the server's counters and histograms, metrics are
+	// not recorded when it is nil
+	Metrics *metrics.Registry
+	// Bans blocks client addresses, nothing is blocked when it is nil
+	Bans *BanList
+	// BanAfterAuthFailures bans a client address for BanDuration after that
+	// many authentication failures within 15 minutes, 0 disables it
+	BanAfterAuthFailures int
+	BanDuration          time.Duration
+	// AccessLog receives one record per session when it ends
+	AccessLog AccessLogger
 }
 
 type Server struct {
+	// Config is the configuration the server was created with, Reload does
+	// not replace it and CurrentConfig returns the one new sessions use
 	Config *ServerConfig
+
+	mu      sync.RWMutex
+	config  *ServerConfig
+	metrics *serverMetrics
+
+	sessionsMu sync.Mutex
+	sessions   map[string]*session
+
+	connsMu    sync.Mutex
+	conns      int
+	connsPerIP map[string]int
+	listeners  map[io.Closer]struct{}
+	closed     bool
 }
 
 func New(conf *ServerConfig) (*Server, error) {
-	if len(conf.AuthMethods) == 0 {
-		return nil, errors.New("Ensure we have at least one authentication method enabled ")
+	if err := prepareConfig(conf); err != nil {
+		return nil, err
+	}
+	server := &Server{
+		Config:  conf,
+		config:  conf,
+		metrics: newServerMetrics(conf.Metrics),
+	}
+	return server, nil
+}
+
+func prepareConfig(conf *ServerConfig) error {
+	anonymous := conf.Protocol == ProtocolTransparent || conf.Protocol == ProtocolForward ||
+		conf.Protocol == ProtocolShadowsocks || conf.Protocol == ProtocolTrojan
+	if len(conf.AuthMethods) == 0 && !anonymous {
+		return errors.New("Ensure we have at least one authentication method enabled ")
 	}
 	if conf.Resolver == nil {
 		conf.Resolver = DNSResolver{}
@@ -35,99 +168,401 @@ func New(conf *ServerConfig) (*Server, error) {
 		conf.Rules = PermitAll()
 	}
 	if conf.Logger == nil {
-		conf.Logger = logger.Logger
+		conf.Logger = nopLogger{}
 	}
 	if conf.Network == "" {
 		conf.Network = "tcp"
 	}
-	server := &Server{
-		Config: conf,
+	switch conf.Protocol {
+	case "":
+		conf.Protocol = ProtocolSOCKS5
+	case ProtocolSOCKS5, ProtocolHTTP:
+	case ProtocolTransparent:
+		switch conf.TransparentMode {
+		case "":
+			conf.TransparentMode = TransparentRedirect
+		case TransparentRedirect, TransparentTProxy:
+		default:
+			return fmt.Errorf("Unknown transparent mode %q ", conf.TransparentMode)
+		}
+		if conf.TransparentUDP && conf.TransparentMode != TransparentTProxy {
+			return errors.New("Transparent UDP requires TPROXY ")
+		}
+	case ProtocolForward:
+		if _, err := forwardTarget(conf.ForwardTarget); err != nil {
+			return err
+		}
+	case ProtocolShadowsocks:
+		if conf.Shadowsocks == nil {
+			return errors.New("A Shadowsocks server requires a method and key ")
+		}
+		if _, err := conf.Shadowsocks.prepare(); err != nil {
+			return err
+		}
+	case ProtocolTrojan:
+		if conf.Trojan == nil {
+			return errors.New("A Trojan server requires users ")
+		}
+		if err := conf.Trojan.Check(); err != nil {
+			return err
+		}
+		if conf.TLS == nil {
+			return errors.New("A Trojan server requires TLS ")
+		}
+	default:
+		return fmt.Errorf("Unknown protocol %q ", conf.Protocol)
 	}
-	return server, nil
+	if conf.Outbound != "" && conf.Router == nil {
+		return errors.New("An outbound requires a router ")
+	}
+	if conf.TLS != nil && conf.Protocol != ProtocolSOCKS5 && conf.Protocol != ProtocolHTTP && conf.Protocol != ProtocolTrojan {
+		return errors.New("Only SOCKS5, HTTP and Trojan servers serve TLS ")
+	}
+	if conf.Obfs != nil && conf.Protocol != ProtocolSOCKS5 {
+		return errors.New("Only SOCKS5 servers serve obfuscation ")
+	}
+	if conf.WebSocket != nil && conf.Protocol != ProtocolSOCKS5 {
+		return errors.New("Only SOCKS5 servers serve WebSocket ")
+	}
+	if conf.Mux != nil && conf.Protocol != ProtocolSOCKS5 {
+		return errors.New("Only SOCKS5 servers accept carriers ")
+	}
+	if conf.Agents != nil && conf.Protocol != ProtocolSOCKS5 {
+		return errors.New("Only SOCKS5 servers accept agents ")
+	}
+	return nil
+}
+
+// CurrentConfig returns the configuration used for new sessions
+func (server *Server) CurrentConfig() *ServerConfig {
+	server.mu.RLock()
+	defer server.mu.RUnlock()
+	return server.config
+}
+
+// Reload replaces the configuration used for new sessions, sessions already
+// being served keep the configuration they started with. The name, protocol,
+// listen address, network, socket permissions, transparent mode, UDP and
+// metrics registry of a running server cannot be changed.
+func (server *Server) Reload(conf *ServerConfig) error {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	keepRestartOnly(conf, server.config)
+	if err := prepareConfig(conf); err != nil {
+		return err
+	}
+	// the replay filters and UDP sessions outlive the configuration
+	if conf.Obfs != nil && server.config.Obfs != nil {
+		conf.Obfs.inherit(server.config.Obfs)
+	}
+	if conf.Shadowsocks != nil && server.config.Shadowsocks != nil {
+		conf.Shadowsocks.inherit(server.config.Shadowsocks)
+	}
+	server.config = conf
+	return nil
+}
+
+// CheckReload reports whether Reload would accept conf without applying it,
+// so that several servers can be reloaded together or not at all
+func (server *Server) CheckReload(conf *ServerConfig) error {
+	check := *conf
+	keepRestartOnly(&check, server.CurrentConfig())
+	return prepareConfig(&check)
+}
+
+// keepRestartOnly copies the settings of the running configuration that
+// only change with a restart to conf
+func keepRestartOnly(conf, running *ServerConfig) {
+	conf.Name = running.Name
+	conf.Protocol = running.Protocol
+	conf.Network = running.Network
+	conf.ListenAddr = running.ListenAddr
+	conf.SocketMode = running.SocketMode
+	conf.SocketOwner = running.SocketOwner
+	conf.TransparentMode = running.TransparentMode
+	conf.TransparentUDP = running.TransparentUDP
+	conf.ForwardUDP = running.ForwardUDP
+	conf.ShadowsocksUDP = running.ShadowsocksUDP
+	conf.Metrics = running.Metrics
 }
 
 func (server *Server) ListenAndServe() error {
-	listener, err := net.Listen(server.Config.Network, server.Config.ListenAddr)
+	conf := server.CurrentConfig()
+	listener, err := server.Listen()
 	if err != nil {
-		server.Config.Logger.Errorf("Failed listen to %s:%s %v", server.Config.Network, server.Config.ListenAddr, err)
+		conf.Logger.Errorf("Failed listen to %s:%s %v", conf.Network, conf.ListenAddr, err)
 		return err
 	}
-	server.Config.Logger.Infof("Successfully listen to %s:%s", server.Config.Network, server.Config.ListenAddr)
-	return server.serve(listener)
+	conf.Logger.Infof("Successfully listen to %s:%s", conf.Network, conf.ListenAddr)
+	return server.Serve(listener)
 }
 
-func (server *Server) serve(listener net.Listener) error {
+// Serve accepts clients on listener, which may have been opened by Listen or
+// handed over by the service manager. It closes the listener when it returns.
+func (server *Server) Serve(listener net.Listener) error {
+	defer listener.Close()
+	if !server.trackListener(listener) {
+		return ErrServerClosed
+	}
 	for {
 		conn, err := listener.Accept()
-		server.Config.Logger.Infof("TCP connection established successfully, %s -> %s", conn.RemoteAddr(), conn.LocalAddr())
+		conf := server.CurrentConfig()
 		if err != nil {
-			server.Config.Logger.Errorf("TCP connection established failed, %s -> %s", conn.RemoteAddr(), conn.LocalAddr())
+			if server.isClosed() {
+				return ErrServerClosed
+			}
+			conf.Logger.Errorf("TCP connection established failed on %s: %v", listener.Addr(), err)
 			return err
 		}
-		go func() {
-			// 2. 处理连接
-			_ = server.handleConn(conn)
-		}()
+		go server.serveConn(conf, conn, listener.Addr())
 	}
 }
 
-func (server *Server) handleConn(conn net.Conn) error {
-	server.Config.Logger.Infof("Start handle connection, remoteAddr: %s:%s", conn.RemoteAddr().Network(), conn.RemoteAddr().String())
+// serveConn checks a new client connection against bans and limits, after
+// taking its address from a PROXY protocol header when it comes from a
+// trusted proxy, and serves it in the protocol of the server
+func (server *Server) serveConn(conf *ServerConfig, conn net.Conn, listenAddr net.Addr) {
+	if isTrusted(conn, conf.TrustedProxies) {
+		proxied, err := acceptProxyHeader(conn, conf.HandshakeTimeout)
+		if err != nil {
+			conf.Logger.Warnf("Refused connection from %s: %v", clientAddr(conn), err)
+			server.metrics.rejected.With(rejectHandshake).Inc()
+			_ = conn.Close()
+			return
+		}
+		conn = proxied
+	}
+	if client := remoteAddrSpec(conn.RemoteAddr()); client != nil && conf.Bans.Banned(client.IP) {
+		conf.Logger.Warnf("Refused connection from banned address %s", client.IP)
+		server.metrics.rejected.With(rejectBanned).Inc()
+		_ = conn.Close()
+		return
+	}
+	if !server.acquireConn(conf, conn) {
+		conf.Logger.Warnf("Refused connection from %s, connection limit reached", clientAddr(conn))
+		server.metrics.rejected.With(rejectLimit).Inc()
+		_ = conn.Close()
+		return
+	}
+	defer server.releaseConn(conn)
+	conf.Logger.Infof("TCP connection established successfully, %s -> %s", clientAddr(conn), conn.LocalAddr())
+	keyUser := ""
+	if conf.Obfs != nil {
+		obfsConn, err := acceptObfs(conn, conf.Obfs, conf.HandshakeTimeout)
+		if err != nil {
+			conf.Logger.Warnf("Refused connection from %s: %v", clientAddr(conn), err)
+			server.metrics.rejected.With(rejectHandshake).Inc()
+			_ = conn.Close()
+			return
+		}
+		conn, keyUser = obfsConn, obfsConn.user
+	}
+	if conf.TLS != nil {
+		tlsConn, err := acceptTLS(conn, conf.TLS, conf.HandshakeTimeout)
+		if err != nil {
+			conf.Logger.Warnf("Refused connection from %s: %v", clientAddr(conn), err)
+			server.metrics.rejected.With(rejectHandshake).Inc()
+			_ = conn.Close()
+			return
+		}
+		conn = tlsConn
+	}
+	if conf.WebSocket != nil {
+		wsConn, err := acceptWebSocket(conn, conf.WebSocket, conf.HandshakeTimeout)
+		if err != nil {
+			conf.Logger.Warnf("Refused connection from %s: %v", clientAddr(conn), err)
+			server.metrics.rejected.With(rejectHandshake).Inc()
+			_ = conn.Close()
+			return
+		}
+		conn = wsConn
+	}
+	server.metrics.accepted.Inc()
+	// 2. 处理连接
+	switch conf.Protocol {
+	case ProtocolHTTP:
+		_ = server.handleHTTPConn(conf, conn)
+	case ProtocolTransparent:
+		_ = server.handleTransparentConn(conf, conn, listenAddr)
+	case ProtocolForward:
+		_ = server.handleForwardConn(conf, conn)
+	case ProtocolShadowsocks:
+		_ = server.handleShadowsocksConn(conf, conn)
+	case ProtocolTrojan:
+		_ = server.handleTrojanConn(conf, conn)
+	default:
+		_ = server.handleConn(conf, conn, keyUser)
+	}
+}
+
+// handleConn serves a SOCKS5 client, keyUser is the user whose obfuscation
+// key the client used
+func (server *Server) handleConn(conf *ServerConfig, conn net.Conn, keyUser string) error {
+	conf.Logger.Infof("Start handle connection, remoteAddr: %s", clientAddr(conn))
 	defer conn.Close()
-	bufConn := bufio.NewReader(conn)
+	server.metrics.activeConns.Inc()
+	defer server.metrics.activeConns.Dec()
+	sess := newSession(conf, conn)
+	sess.keyUser = keyUser
+	server.trackSession(sess)
+	defer server.untrackSession(sess)
+	if conf.HandshakeTimeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(conf.HandshakeTimeout))
+	}
+	bufConn := newBufferedConn(conn)
 
 	negotiationRequest := &NegotiationRequest{}
 	err := negotiationRequest.Read(conn)
 	if err != nil {
-		server.Config.Logger.Errorf("Failed to parse socks5 negotiation request: %v", err)
+		server.metrics.rejected.With(rejectHandshake).Inc()
+		sess.setReason(closeHandshake)
+		conf.Logger.Errorf("Failed to parse socks5 negotiation request: %v", err)
 		return err
 	}
 
 	if negotiationRequest.Ver != Socks5Version {
+		server.metrics.rejected.With(rejectVersion).Inc()
+		sess.setReason(closeHandshake)
 		err := fmt.Errorf("Unsupported SOCKS version: %v ", negotiationRequest.Ver)
-		server.Config.Logger.Errorf("%v", err)
+		conf.Logger.Errorf("%v", err)
 		return err
 	}
 
-	if err := server.authenticate(conn, bufConn, negotiationRequest); err != nil {
+	authContext, err := server.authenticate(sess, bufConn, negotiationRequest)
+	if err != nil {
+		server.metrics.rejected.With(rejectAuth).Inc()
+		sess.setReason(closeAuth)
 		return err
 	}
+	return server.handleRequest(sess, conn, bufConn, authContext)
+}
 
-	request, err := NewRequest(bufConn)
+// handleRequest reads the request of an authenticated client from reader and
+// processes it
+func (server *Server) handleRequest(sess *session, conn net.Conn, reader io.Reader, authContext *AuthContext) error {
+	conf := sess.conf
+	request, err := NewRequest(reader)
 	if err != nil {
+		server.metrics.rejected.With(rejectRequest).Inc()
+		sess.setReason(closeBadRequest)
 		if err == UnrecognizedAddrType {
-			if err = sendResponse(conn, addrTypeNotSupported, nil); err != nil {
+			if err = server.sendReply(sess, addrTypeNotSupported, nil); err != nil {
 				return fmt.Errorf("Failed to send response: %v ", err)
 			}
 		}
 		return fmt.Errorf("Failed to read destination address: %v ", err)
 	}
-
-	if client, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
-		request.RemoteAddr = &AddrSpec{IP: client.IP, Port: uint16(client.Port)}
+	request.AuthContext = authContext
+	request.session = sess
+	if conf.HandshakeTimeout > 0 {
+		_ = conn.SetDeadline(time.Time{})
 	}
 
+	request.RemoteAddr = remoteAddrSpec(conn.RemoteAddr())
+	sess.setRequest(request)
+
 	// process client request
 	if err := server.process(request, conn); err != nil {
 		err = fmt.Errorf("Failed to handle request: %v ", err)
-		server.Config.Logger.Errorf("%v ", err)
+		conf.Logger.Errorf("%v ", err)
 		return err
 	}
 	return nil
 }
 
-func (server *Server) authenticate(conn io.Writer, reader io.Reader, request *NegotiationRequest) error {
+func (server *Server) authenticate(sess *session, reader io.Reader, request *NegotiationRequest) (*AuthContext, error) {
+	conf, conn := sess.conf, sess.conn
+	if identified := identifiedAuth(sess); identified != nil {
+		for _, method := range request.Methods {
+			if method == NoAuth {
+				_, err := conn.Write([]byte{Socks5Version, NoAuth})
+				server.recordAuth(sess, NoAuth, err)
+				if err != nil {
+					return nil, err
+				}
+				return identified, nil
+			}
+		}
+	}
 	for _, method := range request.Methods {
-		for _, authenticator := range server.Config.AuthMethods {
+		for _, authenticator := range conf.AuthMethods {
 			if authenticator.GetCode() == method {
-				if err := authenticator.Authenticate(reader, conn); err != nil {
-					server.Config.Logger.Errorf("Use the %d method of authentication failed", authenticator.GetCode())
-					return err
+				authContext, err := authenticate(authenticator, reader, conn)
+				server.recordAuth(sess, method, err)
+				if err != nil {
+					return nil, err
 				}
-				server.Config.Logger.Infof("Use the %d method of authentication success", authenticator.GetCode())
-				return nil
+				return authContext, nil
 			}
 		}
 	}
-	return NoAcceptableAuth(conn)
-}
\ No newline at end of file
+	return nil, NoAcceptableAuth(conn)
+}
+
+// identifiedAuth is the authentication of a client that its certificate or
+// its obfuscation key identifies, nil for other clients
+func identifiedAuth(sess *session) *AuthContext {
+	if user := peerIdentity(sess.conn); user != "" {
+		return certificateAuth(user)
+	}
+	if sess.keyUser != "" {
+		return keyAuth(sess.keyUser)
+	}
+	return nil
+}
+
+// recordAuth counts the outcome of an authentication and bans clients that
+// keep failing
+func (server *Server) recordAuth(sess *session, method uint8, err error) {
+	conf := sess.conf
+	server.metrics.authResult(method, err)
+	client := remoteAddrSpec(sess.conn.RemoteAddr())
+	if err != nil {
+		conf.Logger.Errorf("Use the %d method of authentication failed", method)
+		if client != nil && conf.Bans.authFailed(client.IP, conf.BanAfterAuthFailures, conf.BanDuration) {
+			conf.Logger.Warnf("Banned %s after %d authentication failures", client.IP, conf.BanAfterAuthFailures)
+		}
+		return
+	}
+	if client != nil {
+		conf.Bans.authSucceeded(client.IP)
+	}
+	conf.Logger.Infof("Use the %d method of authentication success", method)
+}
+
+// acquireConn counts a new client connection against the limits and reports
+// whether it may be served
+func (server *Server) acquireConn(conf *ServerConfig, conn net.Conn) bool {
+	host := clientHost(conn)
+	server.connsMu.Lock()
+	defer server.connsMu.Unlock()
+	if conf.MaxConnections > 0 && server.conns >= conf.MaxConnections {
+		return false
+	}
+	if conf.MaxConnectionsPerIP > 0 && server.connsPerIP[host] >= conf.MaxConnectionsPerIP {
+		return false
+	}
+	if server.connsPerIP == nil {
+		server.connsPerIP = make(map[string]int)
+	}
+	server.conns++
+	server.connsPerIP[host]++
+	return true
+}
+
+func (server *Server) releaseConn(conn net.Conn) {
+	host := clientHost(conn)
+	server.connsMu.Lock()
+	defer server.connsMu.Unlock()
+	server.conns--
+	if server.connsPerIP[host]--; server.connsPerIP[host] <= 0 {
+		delete(server.connsPerIP, host)
+	}
+}
+
+func clientHost(conn net.Conn) string {
+	if client := remoteAddrSpec(conn.RemoteAddr()); client != nil {
+		return client.IP.String()
+	}
+	return clientAddr(conn)
+}
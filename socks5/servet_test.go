@@ -35,4 +35,30 @@ func TestServer_WithNoAuthAuthenticator(t *testing.T) {
 		t.Fail()
 		return
 	}
-}
\ No newline at end of file
+}
+
+func TestServer_CheckReload(t *testing.T) {
+	server, err := New(&ServerConfig{Name: "main", AuthMethods: []Authenticator{NoAuthAuthenticator{}}})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	running := server.CurrentConfig()
+	if err := server.CheckReload(&ServerConfig{}); err == nil {
+		t.Fatalf("expected a configuration without auth methods to be rejected")
+	}
+	// the protocol only changes with a restart, so the check is against
+	// socks5
+	next := &ServerConfig{Protocol: ProtocolForward, AuthMethods: []Authenticator{NoAuthAuthenticator{}}}
+	if err := server.CheckReload(next); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if server.CurrentConfig() != running || next.Protocol != ProtocolForward {
+		t.Fatalf("expected the check to leave both configurations alone")
+	}
+	if err := server.Reload(next); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if conf := server.CurrentConfig(); conf != next || conf.Name != "main" || conf.Protocol != ProtocolSOCKS5 {
+		t.Fatalf("unexpected configuration %+v", conf)
+	}
+}
@@ -0,0 +1,246 @@
+package socks5
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var commandNames = map[uint8]string{
+	connectCommand:   "connect",
+	bindCommand:      "bind",
+	associateCommand: "associate",
+	registerCommand:  "register",
+	attachCommand:    "attach",
+	muxCommand:       "mux",
+}
+
+// Session is a snapshot of a client connection being served
+type Session struct {
+	ID          string    `json:"id"`
+	Inbound     string    `json:"inbound"`
+	User        string    `json:"user"`
+	ClientAddr  string    `json:"client"`
+	Destination string    `json:"destination"`
+	Command     string    `json:"command"`
+	Start       time.Time `json:"start"`
+	BytesUp     uint64    `json:"bytes_up"`
+	BytesDown   uint64    `json:"bytes_down"`
+}
+
+// session tracks a live client connection. The configuration is captured
+// when the connection is accepted, so a reload only affects new sessions.
+type session struct {
+	// accessed atomically, kept first for 64-bit alignment
+	bytesUp      uint64
+	bytesDown    uint64
+	lastActivity int64
+
+	id    string
+	conf  *ServerConfig
+	conn  net.Conn
+	start time.Time
+	// keyUser is the user whose obfuscation key the client used
+	keyUser string
+	// writeReply sends a reply code to the client in the protocol of the
+	// server, it is set before the request is processed
+	writeReply func(resp uint8, addr *AddrSpec) error
+
+	mu       sync.Mutex
+	user     string
+	dest     string
+	command  string
+	resolved string
+	rule     string
+	route    string
+	reply    int
+	reason   string
+	target   net.Conn
+	closed   bool
+}
+
+func newSession(conf *ServerConfig, conn net.Conn) *session {
+	return &session{
+		id:    newSessionID(),
+		conf:  conf,
+		conn:  conn,
+		start: time.Now(),
+		reply: noReplyCode,
+		writeReply: func(resp uint8, addr *AddrSpec) error {
+			return sendResponse(conn, resp, addr)
+		},
+		// the relay has not started yet, but the idle clock starts now
+		lastActivity: time.Now().UnixNano(),
+	}
+}
+
+func newSessionID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return hex.EncodeToString([]byte(time.Now().Format("150405.000")))
+	}
+	return hex.EncodeToString(b)
+}
+
+func (s *session) setRequest(req *Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.user = req.AuthContext.User()
+	s.dest = req.DestAddr.String()
+	s.command = commandNames[req.Command]
+}
+
+func (s *session) setResolved(ip net.IP) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.resolved = ip.String()
+}
+
+func (s *session) setRule(rule string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rule = rule
+}
+
+func (s *session) setRoute(route string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.route = route
+}
+
+func (s *session) setReply(code uint8) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reply = int(code)
+}
+
+// setReason records why the session ended, the first reason wins
+func (s *session) setReason(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reason == "" {
+		s.reason = reason
+	}
+}
+
+// setTarget records the outbound connection so that kill can close it, it
+// reports false when the session has already been killed
+func (s *session) setTarget(target net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.target = target
+	return !s.closed
+}
+
+func (s *session) kill() {
+	s.mu.Lock()
+	s.closed = true
+	if s.reason == "" {
+		s.reason = closeKilled
+	}
+	target := s.target
+	s.mu.Unlock()
+	_ = s.conn.Close()
+	if target != nil {
+		_ = target.Close()
+	}
+}
+
+func (s *session) snapshot() Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Session{
+		ID:          s.id,
+		Inbound:     s.conf.Name,
+		User:        s.user,
+		ClientAddr:  clientAddr(s.conn),
+		Destination: s.dest,
+		Command:     s.command,
+		Start:       s.start,
+		BytesUp:     atomic.LoadUint64(&s.bytesUp),
+		BytesDown:   atomic.LoadUint64(&s.bytesDown),
+	}
+}
+
+// record builds the access record of a session that has ended
+func (s *session) record() *AccessRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reason := s.reason
+	if reason == "" {
+		reason = closeCompleted
+	}
+	return &AccessRecord{
+		SessionID:   s.id,
+		Inbound:     s.conf.Name,
+		Time:        s.start,
+		Client:      clientAddr(s.conn),
+		User:        s.user,
+		Command:     s.command,
+		Destination: s.dest,
+		ResolvedIP:  s.resolved,
+		Rule:        s.rule,
+		Route:       s.route,
+		ReplyCode:   s.reply,
+		BytesUp:     atomic.LoadUint64(&s.bytesUp),
+		BytesDown:   atomic.LoadUint64(&s.bytesDown),
+		Duration:    time.Since(s.start).Seconds(),
+		CloseReason: reason,
+	}
+}
+
+func (server *Server) trackSession(s *session) {
+	server.sessionsMu.Lock()
+	defer server.sessionsMu.Unlock()
+	if server.sessions == nil {
+		server.sessions = make(map[string]*session)
+	}
+	server.sessions[s.id] = s
+}
+
+// untrackSession forgets a session that has ended and writes its access record
+func (server *Server) untrackSession(s *session) {
+	server.sessionsMu.Lock()
+	delete(server.sessions, s.id)
+	server.sessionsMu.Unlock()
+	if s.conf.AccessLog != nil {
+		s.conf.AccessLog.Log(s.record())
+	}
+}
+
+// Sessions returns the sessions currently being served, oldest first
+func (server *Server) Sessions() []Session {
+	server.sessionsMu.Lock()
+	live := make([]*session, 0, len(server.sessions))
+	for _, s := range server.sessions {
+		live = append(live, s)
+	}
+	server.sessionsMu.Unlock()
+
+	sessions := make([]Session, 0, len(live))
+	for _, s := range live {
+		sessions = append(sessions, s.snapshot())
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Start.Before(sessions[j].Start)
+	})
+	return sessions
+}
+
+// KillSession closes the client and destination connections of a session,
+// it reports whether a session with that ID was found
+func (server *Server) KillSession(id string) bool {
+	server.sessionsMu.Lock()
+	s, ok := server.sessions[id]
+	server.sessionsMu.Unlock()
+	if !ok {
+		return false
+	}
+	s.conf.Logger.Infof("Killing session %s from %s", id, clientAddr(s.conn))
+	s.kill()
+	return true
+}
@@ -0,0 +1,129 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startTestServer serves conf on a loopback listener until the test ends
+func startTestServer(t *testing.T, conf *ServerConfig) (*Server, string) {
+	server, err := New(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() { _ = server.Serve(listener) }()
+	return server, listener.Addr().String()
+}
+
+// startEchoServer echoes every connection back until the test ends
+func startEchoServer(t *testing.T) *net.TCPAddr {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr)
+}
+
+// dialConnect performs a no-auth SOCKS5 CONNECT to dest and returns the reply
+func dialConnect(t *testing.T, proxy string, dest *net.TCPAddr) (net.Conn, []byte) {
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	req := []byte{Socks5Version, 1, NoAuth, Socks5Version, connectCommand, 0, IPV4Address}
+	req = append(req, dest.IP.To4()...)
+	req = append(req, byte(dest.Port>>8), byte(dest.Port))
+	if _, err := conn.Write(req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	reply := make([]byte, 2+10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return conn, reply[2:]
+}
+
+func TestServer_SessionsAndKill(t *testing.T) {
+	echo := startEchoServer(t)
+	server, addr := startTestServer(t, &ServerConfig{AuthMethods: []Authenticator{NoAuthAuthenticator{}}})
+
+	conn, reply := dialConnect(t, addr, echo)
+	if reply[1] != succeeded {
+		t.Fatalf("unexpected reply %v", reply)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("unexpected echo %q: %v", buf, err)
+	}
+
+	sessions := server.Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("expected one session, got %+v", sessions)
+	}
+	s := sessions[0]
+	if s.Destination != echo.String() || s.Command != "connect" || s.BytesUp != 4 || s.BytesDown != 4 {
+		t.Fatalf("unexpected session %+v", s)
+	}
+
+	if !server.KillSession(s.ID) {
+		t.Fatalf("expected session %s to be killed", s.ID)
+	}
+	if _, err := conn.Read(buf); err == nil {
+		t.Fatalf("expected the killed connection to be closed")
+	}
+	if server.KillSession("unknown") {
+		t.Fatalf("expected unknown session not to be found")
+	}
+}
+
+// legacyAuthenticator only implements Authenticator
+type legacyAuthenticator struct{}
+
+func (legacyAuthenticator) GetCode() uint8 {
+	return NoAuth
+}
+
+func (legacyAuthenticator) Authenticate(_ io.Reader, writer io.Writer) error {
+	_, err := writer.Write([]byte{Socks5Version, NoAuth})
+	return err
+}
+
+func TestServer_LegacyAuthenticator(t *testing.T) {
+	echo := startEchoServer(t)
+	conf := &ServerConfig{AuthMethods: []Authenticator{legacyAuthenticator{}}}
+	server, addr := startTestServer(t, conf)
+	if server.Config != conf {
+		t.Fatalf("expected Config to be the configuration the server was created with")
+	}
+	if _, reply := dialConnect(t, addr, echo); reply[1] != succeeded {
+		t.Fatalf("unexpected reply %v", reply)
+	}
+	if sessions := server.Sessions(); len(sessions) != 1 || sessions[0].User != "" {
+		t.Fatalf("unexpected sessions %+v", sessions)
+	}
+}
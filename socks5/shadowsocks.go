@@ -0,0 +1,745 @@
+package socks5
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mrand "math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/archervanderwaal/JadeSocks/shadowsocks"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"lukechampine.com/blake3"
+)
+
+// A Shadowsocks TCP connection starts with a salt that the session subkey of
+// each direction is derived from, followed by chunks of a sealed length and a
+// sealed payload. The first chunk of a client carries the destination in the
+// address encoding of SOCKS5. Connections of the 2022 edition put a sealed
+// header of a type and timestamp ahead of the chunks, the header of a client
+// holds the destination and that of a server the salt of the client.
+const (
+	ssTagSize = 16
+	// ssMaxPayload and ss2022MaxPayload bound the payload of chunks
+	ssMaxPayload     = 0x3fff
+	ss2022MaxPayload = 0xffff
+	// ss2022Window is how far the timestamps of the 2022 edition may be off
+	ss2022Window = 30 * time.Second
+	// ss2022MaxPadding bounds the padding of requests without payload
+	ss2022MaxPadding = 900
+	// ssReplayCapacity is how many salts a server remembers
+	ssReplayCapacity = 100000
+
+	ss2022Request  = byte(0)
+	ss2022Response = byte(1)
+)
+
+// ssMethod describes a Shadowsocks cipher
+type ssMethod struct {
+	keySize     int
+	edition2022 bool
+	chacha      bool
+}
+
+// lookupSSMethod returns the method called name
+func lookupSSMethod(name string) (ssMethod, bool) {
+	m, ok := shadowsocks.LookupMethod(name)
+	return ssMethod{keySize: m.KeySize, edition2022: m.Edition2022, chacha: m.ChaCha}, ok
+}
+
+func (m ssMethod) aead(key []byte) (cipher.AEAD, error) {
+	if m.chacha {
+		return chacha20poly1305.New(key)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sessionAEAD returns the cipher of the session of salt, with the subkey
+// derived from key
+func (m ssMethod) sessionAEAD(key, salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, m.keySize)
+	if m.edition2022 {
+		blake3.DeriveKey(subkey, "shadowsocks 2022 session subkey", append(append([]byte(nil), key...), salt...))
+	} else {
+		if _, err := io.ReadFull(hkdf.New(sha1.New, key, salt, []byte("ss-subkey")), subkey); err != nil {
+			return nil, err
+		}
+	}
+	return m.aead(subkey)
+}
+
+func (m ssMethod) maxPayload() int {
+	if m.edition2022 {
+		return ss2022MaxPayload
+	}
+	return ssMaxPayload
+}
+
+// ss2022Hash is how 2022 identity headers name a key
+func ss2022Hash(key []byte) [16]byte {
+	sum := blake3.Sum256(key)
+	var hash [16]byte
+	copy(hash[:], sum[:16])
+	return hash
+}
+
+// ss2022IdentityBlock returns the cipher of the identity header that key
+// protects in the session of salt
+func ss2022IdentityBlock(key, salt []byte) (cipher.Block, error) {
+	subkey := make([]byte, len(key))
+	blake3.DeriveKey(subkey, "shadowsocks 2022 identity subkey", append(append([]byte(nil), key...), salt...))
+	return aes.NewCipher(subkey)
+}
+
+// Shadowsocks is the cipher and keys of a Shadowsocks server or client
+type Shadowsocks struct {
+	// Method is aes-128-gcm, aes-256-gcm or chacha20-ietf-poly1305, whose
+	// key is derived from Password, or 2022-blake3-aes-128-gcm,
+	// 2022-blake3-aes-256-gcm or 2022-blake3-chacha20-poly1305 of the 2022
+	// edition, whose key is Password in base64
+	Method   string
+	Password string
+	// Users gives each user of a server a password of their own, clients
+	// using it authenticate as that user. Servers find the user of an AEAD
+	// method by trying the passwords, and that of an AES method of the 2022
+	// edition from the identity header, Password is then the identity key.
+	// Clients of such servers join the identity key and their own with a
+	// colon.
+	Users Accounts
+
+	once sync.Once
+	keys *ssKeys
+	err  error
+
+	replayOnce sync.Once
+	replay     *replayFilter
+
+	udpOnce sync.Once
+	udp     *ssUDPSessions
+}
+
+// ssKeys are the keys of a Shadowsocks server or client
+type ssKeys struct {
+	method ssMethod
+	// key is that of a client, and that of a server besides users
+	key []byte
+	// identity are the identity keys of a client, the first one is that of
+	// the server and the next one that of the hop after it, the last one
+	// protects the hash of key
+	identity [][]byte
+	// users are the keys of the users of a server, identityKey protects
+	// their hashes on the 2022 edition
+	users       map[string][]byte
+	hashes      map[[16]byte]string
+	identityKey []byte
+}
+
+// prepare checks the method and decodes the keys
+func (s *Shadowsocks) prepare() (*ssKeys, error) {
+	s.once.Do(func() {
+		s.keys, s.err = s.parseKeys()
+	})
+	return s.keys, s.err
+}
+
+// Check reports whether the method is known and the keys fit it
+func (s *Shadowsocks) Check() error {
+	_, err := s.prepare()
+	return err
+}
+
+func (s *Shadowsocks) parseKeys() (*ssKeys, error) {
+	parsed, err := shadowsocks.ParseKeys(s.Method, s.Password, s.Users.MemoryUser)
+	if err != nil {
+		return nil, err
+	}
+	method, _ := lookupSSMethod(s.Method)
+	keys := &ssKeys{
+		method:      method,
+		key:         parsed.Key,
+		identity:    parsed.Identity,
+		users:       parsed.Users,
+		identityKey: parsed.IdentityKey,
+	}
+	if method.edition2022 && len(keys.users) > 0 {
+		keys.hashes = make(map[[16]byte]string)
+		for user, key := range keys.users {
+			keys.hashes[ss2022Hash(key)] = user
+		}
+	}
+	return keys, nil
+}
+
+// replayFilter returns the filter of the salts the server has seen, salts
+// are remembered for twice the window of the 2022 edition and up to its
+// capacity for AEAD methods, which carry no timestamp
+func (s *Shadowsocks) replayFilter() *replayFilter {
+	s.replayOnce.Do(func() {
+		s.replay = newReplayFilter(ssReplayCapacity, s.replayPeriod())
+	})
+	return s.replay
+}
+
+func (s *Shadowsocks) replayPeriod() time.Duration {
+	if method, ok := lookupSSMethod(s.Method); ok && method.edition2022 {
+		return 2 * ss2022Window
+	}
+	return 0
+}
+
+// inherit takes over the replay filter and the UDP sessions of old, the
+// configuration s replaces on a reload, so that salts seen before the reload
+// stay refused and clients keep their sessions
+func (s *Shadowsocks) inherit(old *Shadowsocks) {
+	replay, sessions := old.replayFilter(), old.udpSessions()
+	replay.resize(ssReplayCapacity, s.replayPeriod())
+	s.replayOnce.Do(func() { s.replay = replay })
+	s.udpOnce.Do(func() { s.udp = sessions })
+}
+
+// candidates calls try with the keys of a server until it reports success,
+// it returns the user of that key
+func (k *ssKeys) candidates(try func(key []byte) bool) (string, []byte, bool) {
+	if k.key != nil && try(k.key) {
+		return "", k.key, true
+	}
+	for user, key := range k.users {
+		if try(key) {
+			return user, key, true
+		}
+	}
+	return "", nil, false
+}
+
+// identityHeaders returns the identity headers of a 2022 client for the
+// session of salt, nil without identity keys
+func (k *ssKeys) identityHeaders(salt []byte) ([]byte, error) {
+	var headers []byte
+	for i, identity := range k.identity {
+		next := k.key
+		if i+1 < len(k.identity) {
+			next = k.identity[i+1]
+		}
+		block, err := ss2022IdentityBlock(identity, salt)
+		if err != nil {
+			return nil, err
+		}
+		hash := ss2022Hash(next)
+		block.Encrypt(hash[:], hash[:])
+		headers = append(headers, hash[:]...)
+	}
+	return headers, nil
+}
+
+// checkTimestamp checks a timestamp of the 2022 edition against the window
+func checkTimestamp(stamp []byte) error {
+	at := time.Unix(int64(binary.BigEndian.Uint64(stamp)), 0)
+	if at.Before(time.Now().Add(-ss2022Window)) || at.After(time.Now().Add(ss2022Window)) {
+		return fmt.Errorf("Shadowsocks timestamp %s is outside the time window ", at.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func appendTimestamp(b []byte) []byte {
+	var stamp [8]byte
+	binary.BigEndian.PutUint64(stamp[:], uint64(time.Now().Unix()))
+	return append(b, stamp[:]...)
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	return b, err
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// ssConn reads and writes the chunks of a Shadowsocks TCP connection
+type ssConn struct {
+	net.Conn
+	reader io.Reader
+	method ssMethod
+	client bool
+
+	writeMu   sync.Mutex
+	seal      cipher.AEAD
+	sealNonce []byte
+	// header returns what goes out ahead of the first chunk and how much of
+	// the data of the first write it carries
+	header func(data []byte) ([]byte, int, error)
+
+	open      cipher.AEAD
+	openNonce []byte
+	// readHeader reads what comes ahead of the first chunk of a server
+	readHeader func() error
+	data       []byte
+}
+
+// sealed appends data sealed with the next nonce to out
+func (c *ssConn) sealed(out, data []byte) []byte {
+	out = c.seal.Seal(out, c.sealNonce, data, nil)
+	incrementNonce(c.sealNonce)
+	return out
+}
+
+// chunk appends the length and payload of a chunk of data to out
+func (c *ssConn) chunk(out, data []byte) []byte {
+	return c.sealed(c.sealed(out, []byte{byte(len(data) >> 8), byte(len(data))}), data)
+}
+
+func (c *ssConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	var out []byte
+	written := 0
+	if c.header != nil {
+		header, n, err := c.header(p)
+		if err != nil {
+			return 0, err
+		}
+		c.header = nil
+		out, written = header, n
+	}
+	for written < len(p) {
+		n := minInt(len(p)-written, c.method.maxPayload())
+		out = c.chunk(out, p[written:written+n])
+		written += n
+	}
+	if len(out) == 0 {
+		return 0, nil
+	}
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// flush sends the request of a client, so that a client reading first does
+// not wait for a server waiting for the request
+func (c *ssConn) flush() error {
+	if !c.client {
+		return nil
+	}
+	c.writeMu.Lock()
+	pending := c.header != nil
+	c.writeMu.Unlock()
+	if !pending {
+		return nil
+	}
+	_, err := c.Write(nil)
+	return err
+}
+
+func (c *ssConn) Read(p []byte) (int, error) {
+	if err := c.flush(); err != nil {
+		return 0, err
+	}
+	if c.readHeader != nil {
+		readHeader := c.readHeader
+		c.readHeader = nil
+		if err := readHeader(); err != nil {
+			return 0, err
+		}
+	}
+	for len(c.data) == 0 {
+		data, err := c.readChunk()
+		if err != nil {
+			return 0, err
+		}
+		c.data = data
+	}
+	n := copy(p, c.data)
+	c.data = c.data[n:]
+	return n, nil
+}
+
+// readSealed reads and opens a sealed block of n bytes of plaintext
+func (c *ssConn) readSealed(n int) ([]byte, error) {
+	sealed := make([]byte, n+ssTagSize)
+	if _, err := io.ReadFull(c.reader, sealed); err != nil {
+		return nil, err
+	}
+	plaintext, err := c.open.Open(sealed[:0], c.openNonce, sealed, nil)
+	if err != nil {
+		return nil, errors.New("Corrupt Shadowsocks chunk ")
+	}
+	incrementNonce(c.openNonce)
+	return plaintext, nil
+}
+
+func (c *ssConn) readChunk() ([]byte, error) {
+	length, err := c.readSealed(2)
+	if err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(length))
+	if n > c.method.maxPayload() {
+		return nil, fmt.Errorf("Invalid Shadowsocks chunk size %d ", n)
+	}
+	return c.readSealed(n)
+}
+
+func (c *ssConn) CloseWrite() error {
+	if err := c.flush(); err != nil {
+		return err
+	}
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (c *ssConn) setOpen(aead cipher.AEAD) {
+	c.open, c.openNonce = aead, make([]byte, aead.NonceSize())
+}
+
+// dialShadowsocks starts a Shadowsocks connection to dest over conn, the
+// request goes out with the first write
+func dialShadowsocks(conn net.Conn, keys *ssKeys, dest AddrSpec) (*ssConn, error) {
+	method := keys.method
+	salt, err := randomBytes(method.keySize)
+	if err != nil {
+		return nil, err
+	}
+	seal, err := method.sessionAEAD(keys.key, salt)
+	if err != nil {
+		return nil, err
+	}
+	c := &ssConn{Conn: conn, reader: conn, method: method, client: true, seal: seal, sealNonce: make([]byte, seal.NonceSize())}
+	addr := appendAddr(nil, dest)
+	// the server answers with a salt of its own
+	readSalt := func() error {
+		serverSalt := make([]byte, method.keySize)
+		if _, err := io.ReadFull(conn, serverSalt); err != nil {
+			return err
+		}
+		open, err := method.sessionAEAD(keys.key, serverSalt)
+		if err != nil {
+			return err
+		}
+		c.setOpen(open)
+		return nil
+	}
+	if !method.edition2022 {
+		c.header = func(data []byte) ([]byte, int, error) {
+			n := minInt(len(data), ssMaxPayload-len(addr))
+			return c.chunk(append([]byte(nil), salt...), append(addr, data[:n]...)), n, nil
+		}
+		c.readHeader = readSalt
+		return c, nil
+	}
+
+	c.header = func(data []byte) ([]byte, int, error) {
+		identity, err := keys.identityHeaders(salt)
+		if err != nil {
+			return nil, 0, err
+		}
+		n := minInt(len(data), ss2022MaxPayload-len(addr)-2)
+		padding := 0
+		if n == 0 {
+			padding = 1 + mrand.Intn(ss2022MaxPadding)
+		}
+		variable := append(addr, byte(padding>>8), byte(padding))
+		variable = append(variable, make([]byte, padding)...)
+		variable = append(variable, data[:n]...)
+		fixed := appendTimestamp([]byte{ss2022Request})
+		fixed = append(fixed, byte(len(variable)>>8), byte(len(variable)))
+		out := append(append([]byte(nil), salt...), identity...)
+		return c.sealed(c.sealed(out, fixed), variable), n, nil
+	}
+	c.readHeader = func() error {
+		if err := readSalt(); err != nil {
+			return err
+		}
+		fixed, err := c.readSealed(1 + 8 + method.keySize + 2)
+		if err != nil {
+			return err
+		}
+		if fixed[0] != ss2022Response || !bytes.Equal(fixed[9:9+method.keySize], salt) {
+			return errors.New("Unexpected Shadowsocks response header ")
+		}
+		if err := checkTimestamp(fixed[1:9]); err != nil {
+			return err
+		}
+		c.data, err = c.readSealed(int(binary.BigEndian.Uint16(fixed[9+method.keySize:])))
+		return err
+	}
+	return c, nil
+}
+
+// acceptShadowsocks reads the request of a Shadowsocks client, it returns the
+// connection, the user of the key and the destination. Peers that fail are
+// read from until they give up, like a server that cannot make sense of them
+// would.
+func acceptShadowsocks(conn net.Conn, ss *Shadowsocks) (*ssConn, string, *AddrSpec, error) {
+	keys, err := ss.prepare()
+	if err != nil {
+		return nil, "", nil, err
+	}
+	var c *ssConn
+	var user string
+	var dest *AddrSpec
+	if keys.method.edition2022 {
+		c, user, dest, err = accept2022(conn, ss, keys)
+	} else {
+		c, user, dest, err = acceptAEAD(conn, ss, keys)
+	}
+	if err != nil {
+		var netErr net.Error
+		if !errors.Is(err, io.EOF) && !errors.As(err, &netErr) {
+			_, _ = io.Copy(ioutil.Discard, conn)
+		}
+		return nil, "", nil, err
+	}
+	return c, user, dest, nil
+}
+
+func acceptAEAD(conn net.Conn, ss *Shadowsocks, keys *ssKeys) (*ssConn, string, *AddrSpec, error) {
+	method := keys.method
+	head := make([]byte, method.keySize+2+ssTagSize)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return nil, "", nil, err
+	}
+	salt, length := head[:method.keySize], head[method.keySize:]
+	var open cipher.AEAD
+	user, key, ok := keys.candidates(func(key []byte) bool {
+		aead, err := method.sessionAEAD(key, salt)
+		if err != nil {
+			return false
+		}
+		if _, err := aead.Open(nil, make([]byte, aead.NonceSize()), length, nil); err != nil {
+			return false
+		}
+		open = aead
+		return true
+	})
+	if !ok {
+		return nil, "", nil, errors.New("Unauthenticated Shadowsocks request ")
+	}
+	if ss.replayFilter().seen(salt) {
+		return nil, "", nil, errors.New("Replayed Shadowsocks request ")
+	}
+	serverSalt, err := randomBytes(method.keySize)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	seal, err := method.sessionAEAD(key, serverSalt)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	c := &ssConn{
+		Conn:      conn,
+		reader:    io.MultiReader(bytes.NewReader(length), conn),
+		method:    method,
+		seal:      seal,
+		sealNonce: make([]byte, seal.NonceSize()),
+		header: func([]byte) ([]byte, int, error) {
+			return serverSalt, 0, nil
+		},
+	}
+	c.setOpen(open)
+	dest, err := parseAddrSpec(c)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return c, user, dest, nil
+}
+
+func accept2022(conn net.Conn, ss *Shadowsocks, keys *ssKeys) (*ssConn, string, *AddrSpec, error) {
+	method := keys.method
+	salt := make([]byte, method.keySize)
+	if _, err := io.ReadFull(conn, salt); err != nil {
+		return nil, "", nil, err
+	}
+	key, user := keys.key, ""
+	if keys.identityKey != nil {
+		header := make([]byte, 16)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return nil, "", nil, err
+		}
+		block, err := ss2022IdentityBlock(keys.identityKey, salt)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		var hash [16]byte
+		block.Decrypt(hash[:], header)
+		var ok bool
+		if user, ok = keys.hashes[hash]; !ok {
+			return nil, "", nil, errors.New("Unknown Shadowsocks identity ")
+		}
+		key = keys.users[user]
+	}
+	open, err := method.sessionAEAD(key, salt)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	c := &ssConn{Conn: conn, reader: conn, method: method}
+	c.setOpen(open)
+	fixed, err := c.readSealed(1 + 8 + 2)
+	if err != nil {
+		return nil, "", nil, errors.New("Unauthenticated Shadowsocks request ")
+	}
+	if fixed[0] != ss2022Request {
+		return nil, "", nil, errors.New("Unexpected Shadowsocks request header ")
+	}
+	if err := checkTimestamp(fixed[1:9]); err != nil {
+		return nil, "", nil, err
+	}
+	if ss.replayFilter().seen(salt) {
+		return nil, "", nil, errors.New("Replayed Shadowsocks request ")
+	}
+	variable, err := c.readSealed(int(binary.BigEndian.Uint16(fixed[9:])))
+	if err != nil {
+		return nil, "", nil, err
+	}
+	reader := bytes.NewReader(variable)
+	dest, err := parseAddrSpec(reader)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	var padding uint16
+	if err := binary.Read(reader, binary.BigEndian, &padding); err != nil || int(padding) > reader.Len() {
+		return nil, "", nil, errors.New("Malformed Shadowsocks request header ")
+	}
+	c.data = variable[len(variable)-reader.Len()+int(padding):]
+
+	serverSalt, err := randomBytes(method.keySize)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if c.seal, err = method.sessionAEAD(key, serverSalt); err != nil {
+		return nil, "", nil, err
+	}
+	c.sealNonce = make([]byte, c.seal.NonceSize())
+	c.header = func(data []byte) ([]byte, int, error) {
+		n := minInt(len(data), ss2022MaxPayload)
+		fixed := appendTimestamp([]byte{ss2022Response})
+		fixed = append(append(fixed, salt...), byte(n>>8), byte(n))
+		return c.sealed(c.sealed(append([]byte(nil), serverSalt...), fixed), data[:n]), n, nil
+	}
+	return c, user, dest, nil
+}
+
+// shadowsocksAuth is the outcome of authenticating with the key of user, ""
+// for the key of the server
+func shadowsocksAuth(user string) *AuthContext {
+	if user == "" {
+		return anonymous()
+	}
+	return &AuthContext{Method: NoAuth, Payload: map[string]string{"Username": user, "Key": "verified"}}
+}
+
+// handleShadowsocksConn serves a connection to a Shadowsocks server. Its
+// request is processed like a SOCKS5 CONNECT by the user of the key, there
+// is no reply.
+func (server *Server) handleShadowsocksConn(conf *ServerConfig, conn net.Conn) error {
+	conf.Logger.Infof("Start handle shadowsocks connection, remoteAddr: %s", clientAddr(conn))
+	defer conn.Close()
+	server.metrics.activeConns.Inc()
+	defer server.metrics.activeConns.Dec()
+	sess := newSession(conf, conn)
+	server.trackSession(sess)
+	defer server.untrackSession(sess)
+	sess.writeReply = func(uint8, *AddrSpec) error {
+		return nil
+	}
+
+	if conf.HandshakeTimeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(conf.HandshakeTimeout))
+	}
+	ssConn, user, dest, err := acceptShadowsocks(conn, conf.Shadowsocks)
+	if err != nil {
+		server.metrics.rejected.With(rejectHandshake).Inc()
+		sess.setReason(closeHandshake)
+		conf.Logger.Errorf("Refused shadowsocks connection from %s: %v", clientAddr(conn), err)
+		return err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	request := &Request{
+		Version:     Socks5Version,
+		Command:     connectCommand,
+		AuthContext: shadowsocksAuth(user),
+		DestAddr:    dest,
+		reader:      ssConn,
+		session:     sess,
+	}
+	request.RemoteAddr = remoteAddrSpec(conn.RemoteAddr())
+	sess.setRequest(request)
+
+	if err := server.process(request, ssConn); err != nil {
+		err = fmt.Errorf("Failed to handle shadowsocks connection: %v ", err)
+		conf.Logger.Errorf("%v ", err)
+		return err
+	}
+	return nil
+}
+
+// ShadowsocksOutbound connects through a Shadowsocks server, over TCP for
+// TCP connections and in UDP packets for UDP flows
+type ShadowsocksOutbound struct {
+	Address     string
+	Shadowsocks *Shadowsocks
+	Timeout     time.Duration
+	SocketOptions
+}
+
+func (s *ShadowsocksOutbound) Dial(network string, addr AddrSpec) (net.Conn, error) {
+	return s.dialFor(network, nil, addr)
+}
+
+func (s *ShadowsocksOutbound) dialFor(network string, from *client, addr AddrSpec) (net.Conn, error) {
+	if network != "tcp" && network != "udp" {
+		return nil, fmt.Errorf("Unsupported network %q for Shadowsocks outbound ", network)
+	}
+	keys, err := s.Shadowsocks.prepare()
+	if err != nil {
+		return nil, err
+	}
+	var upstream net.IP
+	if host, _, err := net.SplitHostPort(s.Address); err == nil {
+		upstream = net.ParseIP(host)
+	}
+	conn, err := s.dial(network, s.Address, s.Timeout, from, upstream)
+	if err != nil {
+		return nil, err
+	}
+	if network == "udp" {
+		return newSSPacketConn(conn, keys, addr)
+	}
+	ssConn, err := dialShadowsocks(conn, keys, addr)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return ssConn, nil
+}
+
+// ParseShadowsocksURI parses an ss:// URI of SIP002, whose user info is the
+// method and password in URL-safe base64 or percent-encoded, or the legacy
+// form that encodes all of method:password@host:port in base64
+func ParseShadowsocksURI(uri string) (*ShadowsocksOutbound, error) {
+	method, password, address, err := shadowsocks.ParseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	return &ShadowsocksOutbound{Address: address, Shadowsocks: &Shadowsocks{Method: method, Password: password}}, nil
+}
@@ -0,0 +1,287 @@
+package socks5
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func ssKey(size int, fill byte) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(fill), size)))
+}
+
+// ssEcho sends msg through conn and expects it back
+func ssEcho(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != msg {
+		t.Fatalf("unexpected echo %q: %v", buf, err)
+	}
+}
+
+func TestShadowsocks_Methods(t *testing.T) {
+	echo := startEchoServer(t)
+	for method, password := range map[string]string{
+		"aes-128-gcm":                   "secret",
+		"aes-256-gcm":                   "secret",
+		"chacha20-ietf-poly1305":        "secret",
+		"2022-blake3-aes-128-gcm":       ssKey(16, 'k'),
+		"2022-blake3-aes-256-gcm":       ssKey(32, 'k'),
+		"2022-blake3-chacha20-poly1305": ssKey(32, 'k'),
+	} {
+		_, addr := startTestServer(t, &ServerConfig{
+			Protocol:    ProtocolShadowsocks,
+			Shadowsocks: &Shadowsocks{Method: method, Password: password},
+		})
+		outbound := &ShadowsocksOutbound{Address: addr, Shadowsocks: &Shadowsocks{Method: method, Password: password}, Timeout: 5 * time.Second}
+		conn, err := outbound.Dial("tcp", *addrSpec(echo.IP, echo.Port))
+		if err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		ssEcho(t, conn, "ping")
+		// larger than a chunk
+		ssEcho(t, conn, strings.Repeat("x", 3*ss2022MaxPayload))
+		_ = conn.Close()
+
+		// the server reads a request that does not open until the client
+		// gives up
+		wrong := "other"
+		if strings.HasPrefix(method, "2022") {
+			m, _ := lookupSSMethod(method)
+			wrong = ssKey(m.keySize, 'w')
+		}
+		outbound.Shadowsocks = &Shadowsocks{Method: method, Password: wrong}
+		if conn, err = outbound.Dial("tcp", *addrSpec(echo.IP, echo.Port)); err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(200 * time.Millisecond))
+		_, _ = conn.Write([]byte("ping"))
+		if _, err := conn.Read(make([]byte, 4)); err == nil {
+			t.Fatalf("%s: expected the wrong key to be refused", method)
+		}
+		_ = conn.Close()
+	}
+}
+
+func TestShadowsocks_Users(t *testing.T) {
+	echo := startEchoServer(t)
+	identity := ssKey(16, 'i')
+	for _, c := range []struct {
+		method, password string
+		users            MemoryUser
+		client           string
+	}{
+		{"aes-256-gcm", "", MemoryUser{"alice": "alice secret", "bob": "bob secret"}, "bob secret"},
+		{"2022-blake3-aes-128-gcm", identity, MemoryUser{"alice": ssKey(16, 'a'), "bob": ssKey(16, 'b')}, identity + ":" + ssKey(16, 'b')},
+	} {
+		server, addr := startTestServer(t, &ServerConfig{
+			Protocol:    ProtocolShadowsocks,
+			Shadowsocks: &Shadowsocks{Method: c.method, Password: c.password, Users: Accounts{MemoryUser: c.users}},
+		})
+		outbound := &ShadowsocksOutbound{Address: addr, Shadowsocks: &Shadowsocks{Method: c.method, Password: c.client}, Timeout: 5 * time.Second}
+		conn, err := outbound.Dial("tcp", *addrSpec(echo.IP, echo.Port))
+		if err != nil {
+			t.Fatalf("%s: %v", c.method, err)
+		}
+		ssEcho(t, conn, "ping")
+		sessions := server.Sessions()
+		_ = conn.Close()
+		if len(sessions) != 1 || sessions[0].User != "bob" {
+			t.Fatalf("%s: unexpected sessions %+v", c.method, sessions)
+		}
+	}
+
+	if _, err := New(&ServerConfig{
+		Protocol:    ProtocolShadowsocks,
+		Shadowsocks: &Shadowsocks{Method: "2022-blake3-chacha20-poly1305", Password: ssKey(32, 'i'), Users: Accounts{MemoryUser: MemoryUser{"alice": ssKey(32, 'a')}}},
+	}); err == nil {
+		t.Fatalf("expected users of a ChaCha20 method of the 2022 edition to be rejected")
+	}
+	if _, err := New(&ServerConfig{Protocol: ProtocolShadowsocks, Shadowsocks: &Shadowsocks{Method: "2022-blake3-aes-256-gcm", Password: ssKey(16, 'k')}}); err == nil {
+		t.Fatalf("expected a key of the wrong size to be rejected")
+	}
+}
+
+func TestShadowsocks_Replays(t *testing.T) {
+	echo := startEchoServer(t)
+	for _, method := range []string{"aes-128-gcm", "2022-blake3-aes-128-gcm"} {
+		password := ssKey(16, 'k')
+		server, addr := startTestServer(t, &ServerConfig{
+			Protocol:    ProtocolShadowsocks,
+			Shadowsocks: &Shadowsocks{Method: method, Password: password},
+		})
+		// record the request of a client and send it again
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		recorder := &capturingConn{Conn: conn}
+		keys, _ := (&Shadowsocks{Method: method, Password: password}).prepare()
+		ssConn, _ := dialShadowsocks(recorder, keys, *addrSpec(echo.IP, echo.Port))
+		ssEcho(t, ssConn, "ping")
+		_ = conn.Close()
+		// the salts seen are remembered across reloads
+		if err := server.Reload(&ServerConfig{
+			Protocol:    ProtocolShadowsocks,
+			Shadowsocks: &Shadowsocks{Method: method, Password: password},
+		}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		replay, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		_ = replay.SetDeadline(time.Now().Add(200 * time.Millisecond))
+		_, _ = replay.Write(recorder.written)
+		if n, err := replay.Read(make([]byte, 64)); err == nil {
+			t.Fatalf("%s: expected the replay to go unanswered, got %d bytes", method, n)
+		}
+		_ = replay.Close()
+	}
+}
+
+// capturingConn keeps what is written to it
+type capturingConn struct {
+	net.Conn
+	written []byte
+}
+
+func (c *capturingConn) Write(p []byte) (int, error) {
+	c.written = append(c.written, p...)
+	return c.Conn.Write(p)
+}
+
+func TestShadowsocks_UDP(t *testing.T) {
+	echo, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteTo(buf[:n], addr)
+		}
+	}()
+	dest := echo.LocalAddr().(*net.UDPAddr)
+
+	identity := ssKey(16, 'i')
+	for _, c := range []struct {
+		method, password string
+		users            MemoryUser
+		client, user     string
+	}{
+		{"chacha20-ietf-poly1305", "secret", nil, "secret", ""},
+		{"aes-128-gcm", "", MemoryUser{"alice": "alice secret"}, "alice secret", "alice"},
+		{"2022-blake3-chacha20-poly1305", ssKey(32, 'k'), nil, ssKey(32, 'k'), ""},
+		{"2022-blake3-aes-128-gcm", identity, MemoryUser{"alice": ssKey(16, 'a')}, identity + ":" + ssKey(16, 'a'), "alice"},
+	} {
+		server, err := New(&ServerConfig{
+			Protocol:       ProtocolShadowsocks,
+			Shadowsocks:    &Shadowsocks{Method: c.method, Password: c.password, Users: Accounts{MemoryUser: c.users}},
+			ShadowsocksUDP: true,
+			Network:        "tcp4",
+			ListenAddr:     "127.0.0.1:0",
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", c.method, err)
+		}
+		conn, err := server.ListenPacket()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		go func() { _ = server.ServeUDP(conn) }()
+
+		outbound := &ShadowsocksOutbound{Address: conn.LocalAddr().String(), Shadowsocks: &Shadowsocks{Method: c.method, Password: c.client}}
+		client, err := outbound.Dial("udp", *addrSpec(dest.IP, dest.Port))
+		if err != nil {
+			t.Fatalf("%s: %v", c.method, err)
+		}
+		_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+		for _, msg := range []string{"ping", "pong"} {
+			if _, err := client.Write([]byte(msg)); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			buf := make([]byte, 16)
+			n, err := client.Read(buf)
+			if err != nil || string(buf[:n]) != msg {
+				t.Fatalf("%s: unexpected reply %q: %v", c.method, buf[:n], err)
+			}
+		}
+		sessions := server.Sessions()
+		_ = client.Close()
+		_ = server.Close()
+		if len(sessions) != 1 || sessions[0].Command != "associate" || sessions[0].User != c.user {
+			t.Fatalf("%s: unexpected sessions %+v", c.method, sessions)
+		}
+	}
+}
+
+func TestShadowsocks_InheritUDPSessions(t *testing.T) {
+	old := &Shadowsocks{Method: "2022-blake3-aes-128-gcm", Password: ssKey(16, 'k')}
+	key := []byte("key")
+	session, err := old.udpSessions().session(1, key)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	next := &Shadowsocks{Method: old.Method, Password: old.Password}
+	next.inherit(old)
+	if kept, err := next.udpSessions().session(1, key); err != nil || kept != session {
+		t.Fatalf("expected the session to survive the reload, got %p %v", kept, err)
+	}
+}
+
+func TestPacketWindow(t *testing.T) {
+	var w packetWindow
+	for _, c := range []struct {
+		id   uint64
+		want bool
+	}{
+		{5, true}, {5, false}, {3, true}, {3, false}, {2000, true},
+		{5, false}, {2000 - ssPacketWindow + 1, true}, {1999, true}, {1999, false},
+	} {
+		if got := w.check(c.id); got != c.want {
+			t.Fatalf("packet %d: got %v, want %v", c.id, got, c.want)
+		}
+	}
+}
+
+func TestParseShadowsocksURI(t *testing.T) {
+	for uri, want := range map[string][3]string{
+		"ss://YWVzLTI1Ni1nY206c2VjcmV0@203.0.113.1:8388#example":                                                    {"203.0.113.1:8388", "aes-256-gcm", "secret"},
+		"ss://YWVzLTI1Ni1nY206c2VjcmV0QHNzLmV4YW1wbGUuY29tOjQ0Mw==#legacy":                                          {"ss.example.com:443", "aes-256-gcm", "secret"},
+		"ss://2022-blake3-aes-128-gcm:" + ssKey(16, 'k') + "@[2001:db8::1]:8388":                                    {"[2001:db8::1]:8388", "2022-blake3-aes-128-gcm", ssKey(16, 'k')},
+		"ss://2022-blake3-aes-128-gcm:" + strings.Replace(ssKey(16, 'k'), "=", "%3D", -1) + "@ss.example.com:8388/": {"ss.example.com:8388", "2022-blake3-aes-128-gcm", ssKey(16, 'k')},
+	} {
+		outbound, err := ParseShadowsocksURI(uri)
+		if err != nil {
+			t.Fatalf("%s: %v", uri, err)
+		}
+		if got := [3]string{outbound.Address, outbound.Shadowsocks.Method, outbound.Shadowsocks.Password}; got != want {
+			t.Fatalf("%s: got %v, want %v", uri, got, want)
+		}
+	}
+	for _, uri := range []string{
+		"socks5://203.0.113.1:1080",
+		"ss://YWVzLTI1Ni1nY206c2VjcmV0@203.0.113.1",
+		"ss://cmM0LW1kNTpzZWNyZXQ@203.0.113.1:8388",
+		"ss://YWVzLTI1Ni1nY206c2VjcmV0@203.0.113.1:8388/?plugin=obfs-local",
+		"ss://2022-blake3-aes-128-gcm:short@203.0.113.1:8388",
+	} {
+		if _, err := ParseShadowsocksURI(uri); err == nil {
+			t.Fatalf("expected %s to be rejected", uri)
+		}
+	}
+}
@@ -0,0 +1,484 @@
+package socks5
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// A Shadowsocks datagram of an AEAD method is a salt followed by the sealed
+// address and payload. Datagrams of the 2022 edition belong to sessions: AES
+// methods encrypt a header of the session and packet IDs on its own and seal
+// the body with the subkey of the session, ChaCha20 seals both with
+// XChaCha20-Poly1305 under a random nonce. The body of a client holds the
+// destination, that of a server the source and the session of the client.
+const (
+	// ssPacketWindow is how far behind the latest packet ID of a session a
+	// packet may be
+	ssPacketWindow = 1024
+	// ssSessionTimeout forgets the 2022 sessions of clients gone quiet
+	ssSessionTimeout = 5 * time.Minute
+)
+
+// packetWindow is the sliding window of the packet IDs a session has seen
+type packetWindow struct {
+	started bool
+	last    uint64
+	bits    [ssPacketWindow / 64]uint64
+}
+
+// check reports whether id is new, and remembers it then
+func (w *packetWindow) check(id uint64) bool {
+	bit := func(id uint64) (int, uint64) {
+		pos := id % ssPacketWindow
+		return int(pos / 64), 1 << (pos % 64)
+	}
+	switch {
+	case !w.started || id > w.last:
+		if !w.started || id-w.last >= ssPacketWindow {
+			w.bits = [ssPacketWindow / 64]uint64{}
+		} else {
+			for skipped := w.last + 1; skipped < id; skipped++ {
+				word, mask := bit(skipped)
+				w.bits[word] &^= mask
+			}
+		}
+		w.started, w.last = true, id
+	case w.last-id >= ssPacketWindow:
+		return false
+	default:
+		if word, mask := bit(id); w.bits[word]&mask != 0 {
+			return false
+		}
+	}
+	word, mask := bit(id)
+	w.bits[word] |= mask
+	return true
+}
+
+// sealAEADPacket seals a datagram of an AEAD method
+func sealAEADPacket(method ssMethod, key, plaintext []byte) ([]byte, error) {
+	salt, err := randomBytes(method.keySize)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := method.sessionAEAD(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(salt, make([]byte, aead.NonceSize()), plaintext, nil), nil
+}
+
+// openAEADPacket opens a datagram of an AEAD method with the key that opens
+// it, it returns the user of that key
+func openAEADPacket(keys *ssKeys, packet []byte) (string, []byte, []byte, error) {
+	method := keys.method
+	if len(packet) < method.keySize+ssTagSize {
+		return "", nil, nil, errors.New("Short Shadowsocks datagram ")
+	}
+	salt, sealed := packet[:method.keySize], packet[method.keySize:]
+	var plaintext []byte
+	user, key, ok := keys.candidates(func(key []byte) bool {
+		aead, err := method.sessionAEAD(key, salt)
+		if err != nil {
+			return false
+		}
+		plaintext, err = aead.Open(nil, make([]byte, aead.NonceSize()), sealed, nil)
+		return err == nil
+	})
+	if !ok {
+		return "", nil, nil, errors.New("Unauthenticated Shadowsocks datagram ")
+	}
+	return user, key, plaintext, nil
+}
+
+// seal2022Packet seals a datagram of the 2022 edition with the key of a
+// session, identity are the identity keys ahead of it whose headers follow
+// the separate header
+func seal2022Packet(method ssMethod, key []byte, identity [][]byte, sessionID, packetID uint64, body []byte) ([]byte, error) {
+	var header [16]byte
+	binary.BigEndian.PutUint64(header[:8], sessionID)
+	binary.BigEndian.PutUint64(header[8:], packetID)
+	if method.chacha {
+		aead, err := chacha20poly1305.NewX(key)
+		if err != nil {
+			return nil, err
+		}
+		nonce, err := randomBytes(aead.NonceSize())
+		if err != nil {
+			return nil, err
+		}
+		return aead.Seal(nonce, nonce, append(header[:], body...), nil), nil
+	}
+	headerKey := key
+	if len(identity) > 0 {
+		headerKey = identity[0]
+	}
+	block, err := aes.NewCipher(headerKey)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 16)
+	block.Encrypt(out, header[:])
+	for i, identityKey := range identity {
+		next := key
+		if i+1 < len(identity) {
+			next = identity[i+1]
+		}
+		block, err := aes.NewCipher(identityKey)
+		if err != nil {
+			return nil, err
+		}
+		hash := ss2022Hash(next)
+		eih := xorBytes(hash[:], header[:])
+		block.Encrypt(eih, eih)
+		out = append(out, eih...)
+	}
+	aead, err := method.sessionAEAD(key, header[:8])
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, header[4:16], body, nil), nil
+}
+
+// open2022Packet opens a datagram of the 2022 edition, it returns the user
+// and key it was sealed with, its session and packet IDs and its body
+func open2022Packet(keys *ssKeys, packet []byte) (string, []byte, uint64, uint64, []byte, error) {
+	method := keys.method
+	fail := func(err error) (string, []byte, uint64, uint64, []byte, error) {
+		return "", nil, 0, 0, nil, err
+	}
+	if method.chacha {
+		aead, err := chacha20poly1305.NewX(keys.key)
+		if err != nil {
+			return fail(err)
+		}
+		if len(packet) < aead.NonceSize()+16+ssTagSize {
+			return fail(errors.New("Short Shadowsocks datagram "))
+		}
+		plaintext, err := aead.Open(nil, packet[:aead.NonceSize()], packet[aead.NonceSize():], nil)
+		if err != nil {
+			return fail(errors.New("Unauthenticated Shadowsocks datagram "))
+		}
+		return "", keys.key, binary.BigEndian.Uint64(plaintext[:8]), binary.BigEndian.Uint64(plaintext[8:16]), plaintext[16:], nil
+	}
+
+	user, key, headerKey := "", keys.key, keys.key
+	if keys.identityKey != nil {
+		headerKey = keys.identityKey
+	}
+	if len(packet) < 16+ssTagSize {
+		return fail(errors.New("Short Shadowsocks datagram "))
+	}
+	block, err := aes.NewCipher(headerKey)
+	if err != nil {
+		return fail(err)
+	}
+	header := make([]byte, 16)
+	block.Decrypt(header, packet[:16])
+	packet = packet[16:]
+	if keys.identityKey != nil {
+		if len(packet) < 16+ssTagSize {
+			return fail(errors.New("Short Shadowsocks datagram "))
+		}
+		eih := make([]byte, 16)
+		block.Decrypt(eih, packet[:16])
+		var hash [16]byte
+		copy(hash[:], xorBytes(eih, header))
+		var ok bool
+		if user, ok = keys.hashes[hash]; !ok {
+			return fail(errors.New("Unknown Shadowsocks identity "))
+		}
+		key, packet = keys.users[user], packet[16:]
+	}
+	aead, err := method.sessionAEAD(key, header[:8])
+	if err != nil {
+		return fail(err)
+	}
+	body, err := aead.Open(nil, header[4:16], packet, nil)
+	if err != nil {
+		return fail(errors.New("Unauthenticated Shadowsocks datagram "))
+	}
+	return user, key, binary.BigEndian.Uint64(header[:8]), binary.BigEndian.Uint64(header[8:]), body, nil
+}
+
+// parse2022Body parses the body of a 2022 datagram of type kind, it returns
+// the session of the client a server put in it, the address and the payload
+func parse2022Body(body []byte, kind byte) (uint64, *AddrSpec, []byte, error) {
+	reader := bytes.NewReader(body)
+	var head struct {
+		Type  byte
+		Stamp [8]byte
+	}
+	if err := binary.Read(reader, binary.BigEndian, &head); err != nil || head.Type != kind {
+		return 0, nil, nil, errors.New("Unexpected Shadowsocks datagram type ")
+	}
+	if err := checkTimestamp(head.Stamp[:]); err != nil {
+		return 0, nil, nil, err
+	}
+	var clientSession uint64
+	if kind == ss2022Response {
+		if err := binary.Read(reader, binary.BigEndian, &clientSession); err != nil {
+			return 0, nil, nil, errors.New("Malformed Shadowsocks datagram ")
+		}
+	}
+	var padding uint16
+	if err := binary.Read(reader, binary.BigEndian, &padding); err != nil || int(padding) > reader.Len() {
+		return 0, nil, nil, errors.New("Malformed Shadowsocks datagram ")
+	}
+	_, _ = reader.Seek(int64(padding), 1)
+	addr, err := parseAddrSpec(reader)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return clientSession, addr, body[len(body)-reader.Len():], nil
+}
+
+// append2022Body appends the body of a 2022 datagram without padding
+func append2022Body(b []byte, kind byte, clientSession uint64, addr AddrSpec, payload []byte) []byte {
+	b = appendTimestamp(append(b, kind))
+	if kind == ss2022Response {
+		var id [8]byte
+		binary.BigEndian.PutUint64(id[:], clientSession)
+		b = append(b, id[:]...)
+	}
+	b = append(b, 0, 0)
+	return append(appendAddr(b, addr), payload...)
+}
+
+// ssUDPSession is the 2022 session of a client of a server, and the session
+// of the server's replies to it
+type ssUDPSession struct {
+	mu       sync.Mutex
+	key      []byte
+	window   packetWindow
+	lastSeen time.Time
+
+	id       uint64
+	packetID uint64
+}
+
+// ssUDPPeer is the client a Shadowsocks datagram came from
+type ssUDPPeer struct {
+	method ssMethod
+	user   string
+	key    []byte
+	// session is the 2022 session of the client, clientSession its ID
+	session       *ssUDPSession
+	clientSession uint64
+}
+
+// flowKey tells the flows of a client apart by session
+func (p *ssUDPPeer) flowKey() string {
+	return fmt.Sprintf("%s/%x", p.user, p.clientSession)
+}
+
+// seal seals a reply from src to the client
+func (p *ssUDPPeer) seal(src AddrSpec, payload []byte) ([]byte, error) {
+	if p.session == nil {
+		return sealAEADPacket(p.method, p.key, append(appendAddr(nil, src), payload...))
+	}
+	body := append2022Body(nil, ss2022Response, p.clientSession, src, payload)
+	return seal2022Packet(p.method, p.key, nil, p.session.id, atomic.AddUint64(&p.session.packetID, 1)-1, body)
+}
+
+// openPacket opens a datagram a client sent to a server, it returns the
+// client, the destination and the payload
+func (s *Shadowsocks) openPacket(packet []byte) (*ssUDPPeer, *AddrSpec, []byte, error) {
+	keys, err := s.prepare()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if !keys.method.edition2022 {
+		user, key, plaintext, err := openAEADPacket(keys, packet)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		reader := bytes.NewReader(plaintext)
+		dest, err := parseAddrSpec(reader)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return &ssUDPPeer{method: keys.method, user: user, key: key}, dest, plaintext[len(plaintext)-reader.Len():], nil
+	}
+
+	user, key, sessionID, packetID, body, err := open2022Packet(keys, packet)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	_, dest, payload, err := parse2022Body(body, ss2022Request)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	session, err := s.udpSessions().session(sessionID, key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	session.mu.Lock()
+	fresh := session.window.check(packetID)
+	session.lastSeen = time.Now()
+	session.mu.Unlock()
+	if !fresh {
+		return nil, nil, nil, errors.New("Replayed Shadowsocks datagram ")
+	}
+	return &ssUDPPeer{method: keys.method, user: user, key: key, session: session, clientSession: sessionID}, dest, payload, nil
+}
+
+// ssUDPSessions are the 2022 sessions of the clients of a server by their
+// session ID, sessions idle for ssSessionTimeout are forgotten
+type ssUDPSessions struct {
+	mu       sync.Mutex
+	sessions map[uint64]*ssUDPSession
+	pruned   time.Time
+}
+
+// udpSessions returns the sessions of the clients of the server
+func (s *Shadowsocks) udpSessions() *ssUDPSessions {
+	s.udpOnce.Do(func() {
+		s.udp = &ssUDPSessions{sessions: make(map[uint64]*ssUDPSession), pruned: time.Now()}
+	})
+	return s.udp
+}
+
+// session returns the session id of a client using key
+func (t *ssUDPSessions) session(id uint64, key []byte) (*ssUDPSession, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if now.Sub(t.pruned) >= ssSessionTimeout {
+		for sessionID, session := range t.sessions {
+			session.mu.Lock()
+			idle := now.Sub(session.lastSeen) >= ssSessionTimeout
+			session.mu.Unlock()
+			if idle {
+				delete(t.sessions, sessionID)
+			}
+		}
+		t.pruned = now
+	}
+	if session, ok := t.sessions[id]; ok {
+		if !bytes.Equal(session.key, key) {
+			return nil, errors.New("Shadowsocks session of another user ")
+		}
+		return session, nil
+	}
+	serverID, err := randomBytes(8)
+	if err != nil {
+		return nil, err
+	}
+	session := &ssUDPSession{key: key, lastSeen: now, id: binary.BigEndian.Uint64(serverID)}
+	t.sessions[id] = session
+	return session, nil
+}
+
+// ssUDPClientConn is the client side of a UDP flow of a Shadowsocks server,
+// replies are sealed for the client with the destination as their source
+type ssUDPClientConn struct {
+	*udpClientConn
+	peer   *ssUDPPeer
+	source AddrSpec
+}
+
+func (c *ssUDPClientConn) Write(p []byte) (int, error) {
+	packet, err := c.peer.seal(c.source, p)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.udpClientConn.Write(packet); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ssPacketConn carries the datagrams of a UDP flow to dest in Shadowsocks
+// datagrams over conn, a UDP socket connected to the server
+type ssPacketConn struct {
+	net.Conn
+	keys *ssKeys
+	dest AddrSpec
+
+	sessionID uint64
+	packetID  uint64
+
+	mu            sync.Mutex
+	serverSession uint64
+	window        packetWindow
+}
+
+func newSSPacketConn(conn net.Conn, keys *ssKeys, dest AddrSpec) (*ssPacketConn, error) {
+	id, err := randomBytes(8)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return &ssPacketConn{Conn: conn, keys: keys, dest: dest, sessionID: binary.BigEndian.Uint64(id)}, nil
+}
+
+func (c *ssPacketConn) Write(p []byte) (int, error) {
+	var packet []byte
+	var err error
+	if c.keys.method.edition2022 {
+		body := append2022Body(nil, ss2022Request, 0, c.dest, p)
+		packet, err = seal2022Packet(c.keys.method, c.keys.key, c.keys.identity, c.sessionID, atomic.AddUint64(&c.packetID, 1)-1, body)
+	} else {
+		packet, err = sealAEADPacket(c.keys.method, c.keys.key, append(appendAddr(nil, c.dest), p...))
+	}
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.Conn.Write(packet); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Read returns the payload of the next reply, datagrams that do not open or
+// belong to another session are dropped
+func (c *ssPacketConn) Read(p []byte) (int, error) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := c.Conn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		if payload, ok := c.open(buf[:n]); ok {
+			return copy(p, payload), nil
+		}
+	}
+}
+
+func (c *ssPacketConn) open(packet []byte) ([]byte, bool) {
+	if !c.keys.method.edition2022 {
+		_, _, plaintext, err := openAEADPacket(c.keys, packet)
+		if err != nil {
+			return nil, false
+		}
+		reader := bytes.NewReader(plaintext)
+		if _, err := parseAddrSpec(reader); err != nil {
+			return nil, false
+		}
+		return plaintext[len(plaintext)-reader.Len():], true
+	}
+	_, _, serverSession, packetID, body, err := open2022Packet(c.keys, packet)
+	if err != nil {
+		return nil, false
+	}
+	clientSession, _, payload, err := parse2022Body(body, ss2022Response)
+	if err != nil || clientSession != c.sessionID {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if serverSession != c.serverSession {
+		c.serverSession, c.window = serverSession, packetWindow{}
+	}
+	return payload, c.window.check(packetID)
+}
@@ -0,0 +1,85 @@
+package socks5
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// SocketOptions control the local side of the sockets an outbound opens
+type SocketOptions struct {
+	// SourceIPs are the addresses connections are made from, taken in turn
+	// among those of the destination's address family. The host picks one
+	// when there are none.
+	SourceIPs []net.IP
+	// UserSourceIPs replace SourceIPs for the connections of a user
+	UserSourceIPs map[string][]net.IP
+	// Interface binds sockets to a network interface (SO_BINDTODEVICE)
+	Interface string
+	// Mark sets the firewall mark (SO_MARK) for policy routing
+	Mark int
+	// KeepAlive is the TCP keepalive interval, 0 uses the default of 15
+	// seconds and a negative value disables keepalives
+	KeepAlive time.Duration
+	// Nagle enables Nagle's algorithm, TCP_NODELAY is set otherwise
+	Nagle bool
+	// FastOpen sends the first data of connections in the SYN
+	// (TCP_FASTOPEN_CONNECT)
+	FastOpen bool
+
+	next uint32
+}
+
+// client is who a connection is opened for
+type client struct {
+	addr *AddrSpec
+	user string
+}
+
+// dial connects to address with the options applied, dest is the IP the
+// address resolves to when known and picks the family of the source address
+func (o *SocketOptions) dial(network, address string, timeout time.Duration, from *client, dest net.IP) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout, KeepAlive: o.KeepAlive}
+	if ip := o.sourceIP(from, dest); ip != nil {
+		switch network {
+		case "udp", "udp4", "udp6":
+			dialer.LocalAddr = &net.UDPAddr{IP: ip}
+		default:
+			dialer.LocalAddr = &net.TCPAddr{IP: ip}
+		}
+	}
+	if o.Interface != "" || o.Mark != 0 || o.FastOpen {
+		dialer.Control = o.control
+	}
+	conn, err := dialer.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok && o.Nagle {
+		_ = tcpConn.SetNoDelay(false)
+	}
+	return conn, nil
+}
+
+func (o *SocketOptions) sourceIP(from *client, dest net.IP) net.IP {
+	pool := o.SourceIPs
+	if from != nil {
+		if ips, ok := o.UserSourceIPs[from.user]; ok {
+			pool = ips
+		}
+	}
+	if dest != nil {
+		ipv4 := dest.To4() != nil
+		matching := make([]net.IP, 0, len(pool))
+		for _, ip := range pool {
+			if (ip.To4() != nil) == ipv4 {
+				matching = append(matching, ip)
+			}
+		}
+		pool = matching
+	}
+	if len(pool) == 0 {
+		return nil
+	}
+	return pool[int(atomic.AddUint32(&o.next, 1)-1)%len(pool)]
+}
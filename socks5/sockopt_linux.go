@@ -0,0 +1,39 @@
+//go:build linux
+// +build linux
+
+package socks5
+
+import (
+	"os"
+	"syscall"
+)
+
+// tcpFastOpenConnect is TCP_FASTOPEN_CONNECT
+const tcpFastOpenConnect = 30
+
+func (o *SocketOptions) control(network, _ string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		if o.Interface != "" {
+			if err := syscall.BindToDevice(int(fd), o.Interface); err != nil {
+				sockErr = os.NewSyscallError("setsockopt SO_BINDTODEVICE", err)
+				return
+			}
+		}
+		if o.Mark != 0 {
+			if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, o.Mark); err != nil {
+				sockErr = os.NewSyscallError("setsockopt SO_MARK", err)
+				return
+			}
+		}
+		if o.FastOpen && (network == "tcp" || network == "tcp4" || network == "tcp6") {
+			if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpenConnect, 1); err != nil {
+				sockErr = os.NewSyscallError("setsockopt TCP_FASTOPEN_CONNECT", err)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package socks5
+
+import (
+	"errors"
+	"syscall"
+)
+
+func (o *SocketOptions) control(string, string, syscall.RawConn) error {
+	return errors.New("Interface binding, marks and TCP Fast Open are only supported on Linux ")
+}
@@ -0,0 +1,78 @@
+package socks5
+
+import (
+	"net"
+	"runtime"
+	"testing"
+)
+
+func TestSocketOptions_SourceIP(t *testing.T) {
+	o := &SocketOptions{
+		SourceIPs: []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.2")},
+		UserSourceIPs: map[string][]net.IP{
+			"alice": {net.ParseIP("192.0.2.9")},
+		},
+	}
+	dest := net.ParseIP("198.51.100.1")
+	var got []string
+	for i := 0; i < 4; i++ {
+		got = append(got, o.sourceIP(&client{user: "bob"}, dest).String())
+	}
+	// the pool rotates over the IPv4 addresses only
+	for _, ip := range got {
+		if ip != "192.0.2.1" && ip != "192.0.2.2" {
+			t.Fatalf("unexpected source %v", got)
+		}
+	}
+	if got[0] == got[1] || got[0] != got[2] {
+		t.Fatalf("unexpected rotation %v", got)
+	}
+	if ip := o.sourceIP(&client{user: "alice"}, dest); !ip.Equal(net.ParseIP("192.0.2.9")) {
+		t.Fatalf("unexpected source for alice %v", ip)
+	}
+	if ip := o.sourceIP(nil, net.ParseIP("2001:db8::2")); !ip.Equal(net.ParseIP("2001:db8::1")) {
+		t.Fatalf("unexpected IPv6 source %v", ip)
+	}
+	if ip := (&SocketOptions{}).sourceIP(nil, dest); ip != nil {
+		t.Fatalf("expected the host to pick the source, got %v", ip)
+	}
+}
+
+func TestDirectOutbound_SourceIP(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("127.0.0.2 is only local on Linux")
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Addr, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn.RemoteAddr()
+		conn.Close()
+	}()
+
+	outbound := &DirectOutbound{SocketOptions: SocketOptions{
+		SourceIPs: []net.IP{net.ParseIP("127.0.0.2")},
+		Interface: "lo",
+	}}
+	port := uint16(listener.Addr().(*net.TCPAddr).Port)
+	conn, err := outbound.Dial("tcp", AddrSpec{IP: net.ParseIP("127.0.0.1"), Port: port, AddrType: IPV4Address})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	if addr := (<-accepted).(*net.TCPAddr); !addr.IP.Equal(net.ParseIP("127.0.0.2")) {
+		t.Fatalf("unexpected source %v", addr)
+	}
+
+	outbound = &DirectOutbound{SocketOptions: SocketOptions{Interface: "no-such-interface"}}
+	if _, err := outbound.Dial("tcp", AddrSpec{IP: net.ParseIP("127.0.0.1"), Port: port}); err == nil {
+		t.Fatalf("expected binding to a missing interface to fail")
+	}
+}
@@ -0,0 +1,119 @@
+//go:build linux
+// +build linux
+
+package socks5
+
+import (
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+const (
+	spliceMove     = 0x1
+	spliceNonblock = 0x2
+	// maxSpliceSize is the most moved through the pipe at once, the default
+	// capacity of a pipe
+	maxSpliceSize = 64 * 1024
+)
+
+// splice moves src to dst through a pipe with splice(2) when both are TCP
+// connections, the bytes never reach user space. It reports false when the
+// connections cannot be spliced and nothing was moved.
+func splice(dst *countingWriter, src io.Reader) (bool, error) {
+	from, ok := src.(*net.TCPConn)
+	if !ok {
+		return false, nil
+	}
+	to, ok := relayConn(dst.Writer).(*net.TCPConn)
+	if !ok {
+		return false, nil
+	}
+	rc, err := from.SyscallConn()
+	if err != nil {
+		return false, nil
+	}
+	wc, err := to.SyscallConn()
+	if err != nil {
+		return false, nil
+	}
+	p := &pipe{dst: dst}
+	if err := syscall.Pipe2(p.fds[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		return false, nil
+	}
+	defer syscall.Close(p.fds[0])
+	defer syscall.Close(p.fds[1])
+
+	// the callbacks are bound once, not for every chunk
+	fill, flush := p.fill, p.flush
+	moved := false
+	for {
+		p.err = nil
+		if err := rc.Read(fill); err != nil {
+			return true, err
+		}
+		if p.err != nil {
+			if !moved && (p.err == syscall.EINVAL || p.err == syscall.ENOSYS) {
+				return false, nil
+			}
+			return true, os.NewSyscallError("splice", p.err)
+		}
+		if p.n == 0 {
+			return true, nil
+		}
+		moved = true
+		if err := wc.Write(flush); err != nil {
+			return true, err
+		}
+		if p.err != nil {
+			return true, os.NewSyscallError("splice", p.err)
+		}
+	}
+}
+
+// pipe carries the bytes of a splice from one socket to the other, n is the
+// number of bytes in it
+type pipe struct {
+	fds [2]int
+	n   int
+	err error
+	dst *countingWriter
+}
+
+// fill moves what the socket fd has into the pipe, it returns false to wait
+// until the socket is readable. Nothing moved is the end of the stream.
+func (p *pipe) fill(fd uintptr) bool {
+	for {
+		moved, err := syscall.Splice(int(fd), nil, p.fds[1], nil, maxSpliceSize, spliceMove|spliceNonblock)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == syscall.EAGAIN {
+			return false
+		}
+		p.n, p.err = int(moved), err
+		return true
+	}
+}
+
+// flush moves the contents of the pipe to the socket fd and counts them as
+// they are written, it returns false to wait until the socket is writable
+func (p *pipe) flush(fd uintptr) bool {
+	for p.n > 0 {
+		moved, err := syscall.Splice(p.fds[0], nil, int(fd), nil, p.n, spliceMove|spliceNonblock)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == syscall.EAGAIN {
+			return false
+		}
+		if err != nil {
+			p.err = err
+			return true
+		}
+		p.n -= int(moved)
+		p.dst.count(int(moved))
+	}
+	return true
+}
@@ -0,0 +1,42 @@
+//go:build linux
+// +build linux
+
+package socks5
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestSplice(t *testing.T) {
+	srcClient, srcServer := tcpPair(t)
+	dstClient, dstServer := tcpPair(t)
+	payload := bytes.Repeat([]byte("splice"), 200*1024)
+	go func() {
+		_, _ = srcClient.Write(payload)
+		_ = srcClient.CloseWrite()
+	}()
+	received := make(chan []byte, 1)
+	go func() {
+		data, _ := ioutil.ReadAll(dstServer)
+		received <- data
+	}()
+
+	dst := newCountingWriter(dstClient)
+	spliced, err := splice(dst, srcServer)
+	if !spliced || err != nil {
+		t.Fatalf("expected a splice, got %v %v", spliced, err)
+	}
+	_ = dstClient.CloseWrite()
+	if data := <-received; !bytes.Equal(data, payload) {
+		t.Fatalf("spliced %d bytes, want %d", len(data), len(payload))
+	}
+	if *dst.total != uint64(len(payload)) {
+		t.Fatalf("counted %d bytes, want %d", *dst.total, len(payload))
+	}
+
+	if spliced, _ := splice(newCountingWriter(ioutil.Discard), srcServer); spliced {
+		t.Fatalf("expected a writer that is not a connection not to be spliced")
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package socks5
+
+import "io"
+
+// splice is only available on Linux, other platforms copy through a buffer
+func splice(*countingWriter, io.Reader) (bool, error) {
+	return false, nil
+}
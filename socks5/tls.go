@@ -0,0 +1,150 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// certificateCheckInterval is how often CertificateFile looks for renewed
+// files, at most once per handshake
+const certificateCheckInterval = 10 * time.Second
+
+// CertificateFile is a certificate and key read from PEM files. The files are
+// read again when either changes, so that renewed certificates are used
+// without a restart. A renewal that fails to load keeps the previous pair.
+type CertificateFile struct {
+	CertFile string
+	KeyFile  string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	certTime time.Time
+	keyTime  time.Time
+	checked  time.Time
+}
+
+// LoadCertificateFile reads the certificate and key of certFile and keyFile
+func LoadCertificateFile(certFile, keyFile string) (*CertificateFile, error) {
+	c := &CertificateFile{CertFile: certFile, KeyFile: keyFile}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *CertificateFile) load() error {
+	certInfo, err := os.Stat(c.CertFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(c.KeyFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return fmt.Errorf("Failed to load certificate %s: %v ", c.CertFile, err)
+	}
+	c.cert, c.certTime, c.keyTime = &cert, certInfo.ModTime(), keyInfo.ModTime()
+	c.checked = time.Now()
+	return nil
+}
+
+// Certificate returns the current pair, reading the files again when they
+// changed since they were last read
+func (c *CertificateFile) Certificate() *tls.Certificate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) < certificateCheckInterval {
+		return c.cert
+	}
+	c.checked = time.Now()
+	certInfo, certErr := os.Stat(c.CertFile)
+	keyInfo, keyErr := os.Stat(c.KeyFile)
+	if certErr != nil || keyErr != nil {
+		return c.cert
+	}
+	if !certInfo.ModTime().Equal(c.certTime) || !keyInfo.ModTime().Equal(c.keyTime) {
+		_ = c.load()
+	}
+	return c.cert
+}
+
+// GetCertificate serves as tls.Config.GetCertificate of servers
+func (c *CertificateFile) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.Certificate(), nil
+}
+
+// GetClientCertificate serves as tls.Config.GetClientCertificate of clients
+func (c *CertificateFile) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return c.Certificate(), nil
+}
+
+// CertificateIdentity is the user a verified client certificate authenticates
+// as: the common name of its subject, or its first DNS, email or URI
+// subject alternative name when the subject has none
+func CertificateIdentity(cert *x509.Certificate) string {
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	}
+	return ""
+}
+
+// peerIdentity returns the identity of the verified client certificate of a
+// TLS connection, or "" when there is none
+func peerIdentity(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return CertificateIdentity(state.VerifiedChains[0][0])
+}
+
+// certificateAuth is the outcome of authenticating with a client certificate
+func certificateAuth(user string) *AuthContext {
+	return &AuthContext{Method: NoAuth, Payload: map[string]string{"Username": user, "Certificate": "verified"}}
+}
+
+// acceptTLS performs the server side of the TLS handshake of a client within
+// timeout
+func acceptTLS(conn net.Conn, config *tls.Config, timeout time.Duration) (*tls.Conn, error) {
+	tlsConn := tls.Server(conn, config)
+	if timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(timeout))
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, fmt.Errorf("TLS handshake failed: %v ", err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// dialTLS performs the client side of the TLS handshake over conn, the
+// server name defaults to the host of address
+func dialTLS(conn net.Conn, config *tls.Config, address string) (*tls.Conn, error) {
+	if config.ServerName == "" && !config.InsecureSkipVerify {
+		config = config.Clone()
+		config.ServerName, _, _ = net.SplitHostPort(address)
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, fmt.Errorf("TLS handshake failed: %v ", err)
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,240 @@
+package socks5
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for the tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "JadeSocks Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue returns a certificate for template in PEM along with its key
+func (ca *testCA) issue(t *testing.T, template *x509.Certificate) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func (ca *testCA) keyPair(t *testing.T, template *x509.Certificate) tls.Certificate {
+	certPEM, keyPEM := ca.issue(t, template)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return cert
+}
+
+func TestTLS_ClientCertificate(t *testing.T) {
+	echo := startEchoServer(t)
+	ca := newTestCA(t)
+	serverCert := ca.keyPair(t, &x509.Certificate{Subject: pkix.Name{CommonName: "proxy"}, DNSNames: []string{"proxy.test"}})
+	server, addr := startTestServer(t, &ServerConfig{
+		AuthMethods: []Authenticator{UserPassAuthenticator{Accounts: Accounts{MemoryUser: MemoryUser{"bob": "secret"}}}},
+		Rules: &RuleList{Rules: []Rule{{Name: "alice", Allow: true, Matcher: Matcher{Users: []string{"alice"}}}},
+			DefaultAllow: false},
+		TLS: &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+			ClientCAs:    ca.pool,
+		},
+	})
+
+	dial := func(cert *tls.Certificate) error {
+		config := &tls.Config{RootCAs: ca.pool, ServerName: "proxy.test"}
+		if cert != nil {
+			config.Certificates = []tls.Certificate{*cert}
+		}
+		conn, err := (&Socks5Outbound{Address: addr, TLS: config, Timeout: 5 * time.Second}).Dial("tcp", *addrSpec(echo.IP, echo.Port))
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			return err
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("unexpected echo %q: %v", buf, err)
+		}
+		if sessions := server.Sessions(); len(sessions) != 1 || sessions[0].User != "alice" {
+			t.Fatalf("unexpected sessions %+v", sessions)
+		}
+		return nil
+	}
+
+	alice := ca.keyPair(t, &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}})
+	if err := dial(&alice); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	// without a certificate the client must authenticate with a password
+	if err := dial(nil); err == nil {
+		t.Fatalf("expected a client without a certificate to be refused")
+	}
+	// certificates of other authorities are refused by the handshake
+	other := newTestCA(t).keyPair(t, &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}})
+	if err := dial(&other); err == nil {
+		t.Fatalf("expected a certificate of another authority to be refused")
+	}
+}
+
+func TestTLS_Rejected(t *testing.T) {
+	if _, err := New(&ServerConfig{Protocol: ProtocolForward, ForwardTarget: "db.internal:5432", TLS: &tls.Config{}}); err == nil {
+		t.Fatalf("expected TLS on a forward server to be rejected")
+	}
+	ca := newTestCA(t)
+	_, addr := startTestServer(t, &ServerConfig{
+		AuthMethods: []Authenticator{NoAuthAuthenticator{}},
+		TLS:         &tls.Config{Certificates: []tls.Certificate{ca.keyPair(t, &x509.Certificate{DNSNames: []string{"proxy.test"}})}},
+	})
+	// a client speaking plain SOCKS5 fails the handshake
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte{Socks5Version, 1, NoAuth}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_ = conn.(*net.TCPConn).CloseWrite()
+	if reply, err := ioutil.ReadAll(conn); len(reply) >= 2 && reply[0] == Socks5Version {
+		t.Fatalf("unexpected SOCKS5 reply %v: %v", reply, err)
+	}
+	// and so does a client that does not trust the certificate
+	_, err = (&Socks5Outbound{Address: addr, TLS: &tls.Config{ServerName: "proxy.test"}, Timeout: 5 * time.Second}).Dial("tcp", AddrSpec{IP: net.IPv4(127, 0, 0, 1), Port: 80})
+	if err == nil {
+		t.Fatalf("expected an untrusted certificate to be refused")
+	}
+}
+
+func TestCertificateFile_Reload(t *testing.T) {
+	ca := newTestCA(t)
+	dir, err := ioutil.TempDir("", "jadesocks-tls")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	write := func(name string, modTime time.Time) {
+		certPEM, keyPEM := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: name}})
+		for file, data := range map[string][]byte{certFile: certPEM, keyFile: keyPEM} {
+			if err := ioutil.WriteFile(file, data, 0600); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if err := os.Chtimes(file, modTime, modTime); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+	}
+	commonName := func(c *CertificateFile) string {
+		cert, err := c.GetCertificate(nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		return leaf.Subject.CommonName
+	}
+
+	write("first", time.Now().Add(-time.Minute))
+	c, err := LoadCertificateFile(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	write("second", time.Now())
+	if name := commonName(c); name != "first" {
+		t.Fatalf("expected the files not to be checked again yet, got %s", name)
+	}
+	c.checked = time.Time{}
+	if name := commonName(c); name != "second" {
+		t.Fatalf("expected the renewed certificate, got %s", name)
+	}
+
+	// a broken renewal keeps the previous certificate
+	if err := ioutil.WriteFile(keyFile, []byte("garbage"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_ = os.Chtimes(keyFile, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	c.checked = time.Time{}
+	if name := commonName(c); name != "second" {
+		t.Fatalf("expected the previous certificate, got %s", name)
+	}
+	if _, err := LoadCertificateFile(certFile, keyFile); err == nil {
+		t.Fatalf("expected the broken key to be rejected")
+	}
+}
+
+func TestCertificateIdentity(t *testing.T) {
+	uri, _ := url.Parse("spiffe://example.org/laptop")
+	for _, tc := range []struct {
+		cert *x509.Certificate
+		want string
+	}{
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "alice"}, DNSNames: []string{"alice.example.org"}}, "alice"},
+		{&x509.Certificate{DNSNames: []string{"laptop.example.org"}}, "laptop.example.org"},
+		{&x509.Certificate{EmailAddresses: []string{"bob@example.org"}}, "bob@example.org"},
+		{&x509.Certificate{URIs: []*url.URL{uri}}, "spiffe://example.org/laptop"},
+		{&x509.Certificate{}, ""},
+	} {
+		if got := CertificateIdentity(tc.cert); got != tc.want {
+			t.Fatalf("identity %q, want %q", got, tc.want)
+		}
+	}
+}
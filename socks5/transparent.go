@@ -0,0 +1,400 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// TransparentRedirect reads the destination of connections redirected
+	// with iptables REDIRECT from the connection tracking of the kernel
+	TransparentRedirect = "redirect"
+	// TransparentTProxy takes the destination of connections and datagrams
+	// diverted with iptables TPROXY from their local address, it requires
+	// CAP_NET_ADMIN
+	TransparentTProxy = "tproxy"
+)
+
+// defaultUDPIdleTimeout ends UDP flows of servers without an IdleTimeout,
+// UDP has no close to end them
+const defaultUDPIdleTimeout = time.Minute
+
+// errTransparentUnsupported is returned on platforms without transparent
+// proxying
+var errTransparentUnsupported = errors.New("Transparent proxying is only supported on Linux ")
+
+// handleTransparentConn serves a connection redirected to a transparent
+// server. It is processed like a SOCKS5 CONNECT to its original destination
+// by an anonymous client, there is no handshake and no reply.
+func (server *Server) handleTransparentConn(conf *ServerConfig, conn net.Conn, listenAddr net.Addr) error {
+	conf.Logger.Infof("Start handle transparent connection, remoteAddr: %s", clientAddr(conn))
+	defer conn.Close()
+	server.metrics.activeConns.Inc()
+	defer server.metrics.activeConns.Dec()
+	sess := newSession(conf, conn)
+	server.trackSession(sess)
+	defer server.untrackSession(sess)
+	sess.writeReply = func(uint8, *AddrSpec) error {
+		return nil
+	}
+
+	dest, err := transparentDestination(conf, conn)
+	if err == nil && isProxyAddr(dest, listenAddr) {
+		err = errors.New("Connection was not redirected ")
+	}
+	if err != nil {
+		server.metrics.rejected.With(rejectRequest).Inc()
+		sess.setReason(closeBadRequest)
+		conf.Logger.Errorf("Failed to get the original destination of %s: %v", clientAddr(conn), err)
+		return err
+	}
+	request := &Request{
+		Version:     Socks5Version,
+		Command:     connectCommand,
+		AuthContext: anonymous(),
+		DestAddr:    addrSpec(dest.IP, dest.Port),
+		reader:      conn,
+		session:     sess,
+	}
+	request.RemoteAddr = remoteAddrSpec(conn.RemoteAddr())
+	sess.setRequest(request)
+
+	if err := server.process(request, conn); err != nil {
+		err = fmt.Errorf("Failed to handle transparent connection: %v ", err)
+		conf.Logger.Errorf("%v ", err)
+		return err
+	}
+	return nil
+}
+
+// transparentDestination returns where a redirected connection was headed
+func transparentDestination(conf *ServerConfig, conn net.Conn) (*net.TCPAddr, error) {
+	if conf.TransparentMode == TransparentTProxy {
+		local, ok := conn.LocalAddr().(*net.TCPAddr)
+		if !ok {
+			return nil, errors.New("Not a TCP connection ")
+		}
+		return local, nil
+	}
+	return originalDestination(conn)
+}
+
+// isProxyAddr reports whether dest is the address the server listens on, a
+// client connecting to it directly would otherwise make the server connect
+// to itself over and over
+func isProxyAddr(dest *net.TCPAddr, listenAddr net.Addr) bool {
+	listen, ok := listenAddr.(*net.TCPAddr)
+	if !ok || dest.Port != listen.Port {
+		return false
+	}
+	if !listen.IP.IsUnspecified() {
+		return dest.IP.Equal(listen.IP)
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(dest.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func anonymous() *AuthContext {
+	return &AuthContext{Method: NoAuth, Payload: map[string]string{}}
+}
+
+// ListenPacket opens the UDP socket of a transparent server with
+// TransparentUDP, which receives the datagrams TPROXY diverts to ListenAddr,
+// of a forward server with ForwardUDP or of a Shadowsocks server with
+// ShadowsocksUDP
+func (server *Server) ListenPacket() (net.PacketConn, error) {
+	conf := server.CurrentConfig()
+	switch {
+	case conf.Protocol == ProtocolTransparent && conf.TransparentUDP:
+		return listenTransparentUDP(udpNetwork(conf.Network), conf.ListenAddr)
+	case conf.Protocol == ProtocolForward && conf.ForwardUDP,
+		conf.Protocol == ProtocolShadowsocks && conf.ShadowsocksUDP:
+		return net.ListenPacket(udpNetwork(conf.Network), conf.ListenAddr)
+	}
+	return nil, errors.New("UDP is only served by transparent servers with TransparentUDP, forward servers with ForwardUDP and Shadowsocks servers with ShadowsocksUDP ")
+}
+
+// udpNetwork returns the UDP network of the same address family as network
+func udpNetwork(network string) string {
+	switch network {
+	case "tcp4":
+		return "udp4"
+	case "tcp6":
+		return "udp6"
+	}
+	return "udp"
+}
+
+// ServeUDP relays the datagrams received on conn, which must have been opened
+// by ListenPacket. Every client and destination pair is a flow that goes
+// through the rules and router like a SOCKS5 UDP ASSOCIATE and is served as a
+// session of its own until it is idle for IdleTimeout, or a minute when no
+// IdleTimeout is set. The destination is the original one of transparent
+// servers, ForwardTarget for forward servers and the one a Shadowsocks
+// datagram carries for Shadowsocks servers, whose flows are those of a
+// client's session and user.
+func (server *Server) ServeUDP(conn net.PacketConn) error {
+	defer conn.Close()
+	if !server.trackListener(conn) {
+		return ErrServerClosed
+	}
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok {
+		return errors.New("ServeUDP requires a UDP socket ")
+	}
+	flows := &udpFlows{flows: make(map[string]*udpFlow)}
+	buf := make([]byte, 64*1024)
+	oob := make([]byte, 1024)
+	for {
+		n, oobn, _, client, err := udpConn.ReadMsgUDP(buf, oob)
+		conf := server.CurrentConfig()
+		if err != nil {
+			if server.isClosed() {
+				return ErrServerClosed
+			}
+			conf.Logger.Errorf("UDP receive failed on %s: %v", conn.LocalAddr(), err)
+			return err
+		}
+		payload := buf[:n]
+		var peer *ssUDPPeer
+		var dest *AddrSpec
+		if conf.Protocol == ProtocolShadowsocks {
+			peer, dest, payload, err = conf.Shadowsocks.openPacket(payload)
+		} else {
+			dest, err = udpDestination(conf, oob[:oobn])
+		}
+		if err != nil {
+			conf.Logger.Errorf("Dropped datagram from %s: %v", client, err)
+			continue
+		}
+		key := client.String() + ">" + dest.String()
+		if peer != nil {
+			key = client.String() + "/" + peer.flowKey() + ">" + dest.String()
+		}
+		flow := flows.get(key)
+		if flow == nil {
+			if flow = server.startUDPFlow(conf, flows, key, udpConn, client, dest, peer); flow == nil {
+				continue
+			}
+		}
+		packet := make([]byte, len(payload))
+		copy(packet, payload)
+		select {
+		case flow.packets <- packet:
+		default:
+			// the flow is still dialing or its destination is slow, UDP may
+			// drop datagrams
+		}
+	}
+}
+
+// udpFlow is the datagrams of one client to one destination
+type udpFlow struct {
+	packets chan []byte
+}
+
+type udpFlows struct {
+	mu    sync.Mutex
+	flows map[string]*udpFlow
+}
+
+func (f *udpFlows) get(key string) *udpFlow {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.flows[key]
+}
+
+func (f *udpFlows) set(key string, flow *udpFlow) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.flows[key] = flow
+}
+
+// remove forgets flow unless another flow of the same key replaced it
+func (f *udpFlows) remove(key string, flow *udpFlow) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.flows[key] == flow {
+		delete(f.flows, key)
+	}
+}
+
+// udpDestination returns where a datagram received by the server is relayed
+func udpDestination(conf *ServerConfig, oob []byte) (*AddrSpec, error) {
+	if conf.Protocol == ProtocolForward {
+		return forwardTarget(conf.ForwardTarget)
+	}
+	dest, err := originalDestinationUDP(oob)
+	if err != nil {
+		return nil, err
+	}
+	return addrSpec(dest.IP, dest.Port), nil
+}
+
+// startUDPFlow opens the connection that answers the client and serves the
+// flow, it returns nil when the flow is refused. Transparent servers answer
+// from the original destination with a socket of its own, forward servers
+// from their socket and Shadowsocks servers seal the replies for peer.
+func (server *Server) startUDPFlow(conf *ServerConfig, flows *udpFlows, key string, listener *net.UDPConn, client *net.UDPAddr, dest *AddrSpec, peer *ssUDPPeer) *udpFlow {
+	if conf.Bans.Banned(client.IP) {
+		server.metrics.rejected.With(rejectBanned).Inc()
+		return nil
+	}
+	var conn net.Conn = newUDPClientConn(listener, client)
+	auth := anonymous()
+	var err error
+	if conf.Protocol == ProtocolTransparent {
+		conn, err = dialTransparentUDP(&net.UDPAddr{IP: dest.IP, Port: int(dest.Port)}, client)
+	}
+	if peer != nil {
+		conn = &ssUDPClientConn{udpClientConn: conn.(*udpClientConn), peer: peer, source: *dest}
+		auth = shadowsocksAuth(peer.user)
+	}
+	if err != nil {
+		conf.Logger.Errorf("Failed to open a reply socket for %s -> %s: %v", client, dest, err)
+		return nil
+	}
+	if !server.acquireConn(conf, conn) {
+		conf.Logger.Warnf("Refused UDP flow from %s, connection limit reached", client)
+		server.metrics.rejected.With(rejectLimit).Inc()
+		_ = conn.Close()
+		return nil
+	}
+	server.metrics.accepted.Inc()
+	flow := &udpFlow{packets: make(chan []byte, 64)}
+	flows.set(key, flow)
+	go func() {
+		defer server.releaseConn(conn)
+		defer flows.remove(key, flow)
+		_ = server.handleUDPFlow(conf, conn, flow, dest, auth)
+	}()
+	return flow
+}
+
+func (server *Server) handleUDPFlow(conf *ServerConfig, conn net.Conn, flow *udpFlow, dest *AddrSpec, auth *AuthContext) error {
+	conf.Logger.Infof("Start handle %s UDP flow, %s -> %s", conf.Protocol, conn.RemoteAddr(), dest)
+	defer conn.Close()
+	server.metrics.activeConns.Inc()
+	defer server.metrics.activeConns.Dec()
+	sess := newSession(conf, conn)
+	server.trackSession(sess)
+	defer server.untrackSession(sess)
+	sess.writeReply = func(uint8, *AddrSpec) error {
+		return nil
+	}
+	req := &Request{
+		Version:     Socks5Version,
+		Command:     associateCommand,
+		AuthContext: auth,
+		DestAddr:    dest,
+		session:     sess,
+	}
+	req.RemoteAddr = remoteAddrSpec(conn.RemoteAddr())
+	sess.setRequest(req)
+
+	var err error
+	if dest.Domain != "" {
+		var ip net.IP
+		if ip, err = server.resolve(conf, dest.Domain); err != nil {
+			server.metrics.rejected.With(rejectResolve).Inc()
+			sess.setReason(closeResolve)
+			_ = server.sendReply(sess, replyCode(err), nil)
+			conf.Logger.Errorf("Failed to resolve destination '%v': %v ", dest.Domain, err)
+			return err
+		}
+		dest.IP = ip
+		sess.setResolved(ip)
+	}
+	if err := server.checkRules(req, conn); err != nil {
+		return err
+	}
+	dial, err := server.dialer(req)
+	if err == nil {
+		start := time.Now()
+		var target net.Conn
+		target, err = dial("udp", *req.DestAddr)
+		server.metrics.dialDuration.Observe(sinceSeconds(start))
+		if err == nil {
+			return server.relayUDPFlow(req, conn, target, flow)
+		}
+	}
+	if errors.Is(err, ErrRejected) {
+		server.metrics.rejected.With(rejectRule).Inc()
+		sess.setReason(closeRule)
+	} else {
+		server.metrics.rejected.With(rejectDial).Inc()
+		sess.setReason(closeDial)
+	}
+	// there is no reply to send, but the outcome is recorded like one
+	_ = server.sendReply(sess, replyCode(err), nil)
+	conf.Logger.Errorf("UDP to %v failed: %v", req.DestAddr, err)
+	return err
+}
+
+// relayUDPFlow copies datagrams between the client and target until the flow
+// is idle or the session is killed
+func (server *Server) relayUDPFlow(req *Request, conn, target net.Conn, flow *udpFlow) error {
+	conf := req.session.conf
+	defer target.Close()
+	if !req.session.setTarget(target) {
+		return errors.New("Session killed while connecting ")
+	}
+	_ = server.sendReply(req.session, succeeded, nil)
+	conf.Logger.Infof("Relay UDP to %s", req.DestAddr)
+
+	user := req.AuthContext.User()
+	up := &countingWriter{
+		Writer:   target,
+		counter:  server.metrics.relayedBytes.With("up", user),
+		total:    &req.session.bytesUp,
+		activity: &req.session.lastActivity,
+	}
+	down := &countingWriter{
+		Writer:   conn,
+		counter:  server.metrics.relayedBytes.With("down", user),
+		total:    &req.session.bytesDown,
+		activity: &req.session.lastActivity,
+	}
+	idle := conf.IdleTimeout
+	if idle <= 0 {
+		idle = defaultUDPIdleTimeout
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go watchIdle(req.session, idle, stop)
+	// datagrams reach the flow through the server's socket until the reply
+	// socket exists, and through the reply socket afterwards
+	go func() {
+		for {
+			select {
+			case packet := <-flow.packets:
+				_, _ = up.Write(packet)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	errCh := make(chan relayResult, 2)
+	go copyData(up, conn, closeClientClosed, errCh)
+	go copyData(down, target, closeRemoteClosed, errCh)
+	// a UDP flow normally ends by idling or being killed, which close both
+	// sides, anything else is an error such as an ICMP unreachable
+	result := <-errCh
+	if result.err != nil {
+		req.session.setReason(closeRelayError)
+	}
+	req.session.kill()
+	<-errCh
+	return result.err
+}
@@ -0,0 +1,176 @@
+//go:build linux
+// +build linux
+
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// soOriginalDst is SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST
+	soOriginalDst = 80
+	// ipv6Transparent is IPV6_TRANSPARENT
+	ipv6Transparent = 75
+	// ipv6RecvOrigDstAddr is IPV6_RECVORIGDSTADDR, and IPV6_ORIGDSTADDR the
+	// type of the control message it enables
+	ipv6RecvOrigDstAddr = 74
+)
+
+// originalDestination asks the connection tracking of the kernel where a
+// connection redirected with iptables REDIRECT was headed
+func originalDestination(conn net.Conn) (*net.TCPAddr, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("Not a TCP connection ")
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	ipv4 := conn.LocalAddr().(*net.TCPAddr).IP.To4() != nil
+	var dest *net.TCPAddr
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		// the getsockopt wrappers of the syscall package read the sockaddr
+		// into structs of at least its size
+		if ipv4 {
+			var mreq *syscall.IPv6Mreq
+			if mreq, sockErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst); sockErr == nil {
+				sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(&mreq.Multiaddr))
+				dest = &net.TCPAddr{IP: net.IP(append([]byte(nil), sa.Addr[:]...)), Port: ntohs(sa.Port)}
+			}
+			return
+		}
+		var info *syscall.IPv6MTUInfo
+		if info, sockErr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst); sockErr == nil {
+			dest = &net.TCPAddr{IP: net.IP(append([]byte(nil), info.Addr.Addr[:]...)), Port: ntohs(info.Addr.Port)}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, os.NewSyscallError("getsockopt", sockErr)
+	}
+	return dest, nil
+}
+
+// ntohs converts a port as stored in a sockaddr
+func ntohs(port uint16) int {
+	b := (*[2]byte)(unsafe.Pointer(&port))
+	return int(b[0])<<8 | int(b[1])
+}
+
+// transparentControl lets a socket accept connections and datagrams to
+// addresses that are not local, and for UDP report their destination
+func transparentControl(network, _ string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		udp := network == "udp" || network == "udp4" || network == "udp6"
+		sockErr = setTransparent(int(fd), network != "tcp4" && network != "udp4", udp)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+func setTransparent(fd int, ipv6, udp bool) error {
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_TRANSPARENT, 1); err != nil {
+		return os.NewSyscallError("setsockopt IP_TRANSPARENT", err)
+	}
+	if ipv6 {
+		// dual-stack sockets also need the option for IPv6, IPv4-only
+		// sockets reject it
+		_ = syscall.SetsockoptInt(fd, syscall.SOL_IPV6, ipv6Transparent, 1)
+	}
+	if !udp {
+		return nil
+	}
+	// reply sockets bind to destinations the server's socket listens on too
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		return os.NewSyscallError("setsockopt SO_REUSEADDR", err)
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, 1); err != nil {
+		return os.NewSyscallError("setsockopt IP_RECVORIGDSTADDR", err)
+	}
+	if ipv6 {
+		_ = syscall.SetsockoptInt(fd, syscall.SOL_IPV6, ipv6RecvOrigDstAddr, 1)
+	}
+	return nil
+}
+
+func listenTransparentTCP(network, addr string) (net.Listener, error) {
+	lc := &net.ListenConfig{Control: transparentControl}
+	return lc.Listen(context.Background(), network, addr)
+}
+
+func listenTransparentUDP(network, addr string) (net.PacketConn, error) {
+	lc := &net.ListenConfig{Control: transparentControl}
+	return lc.ListenPacket(context.Background(), network, addr)
+}
+
+// originalDestinationUDP reads the destination of a datagram diverted with
+// TPROXY from the control message IP_RECVORIGDSTADDR adds
+func originalDestinationUDP(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range msgs {
+		switch {
+		case msg.Header.Level == syscall.SOL_IP && msg.Header.Type == syscall.IP_ORIGDSTADDR &&
+			len(msg.Data) >= syscall.SizeofSockaddrInet4:
+			sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(&msg.Data[0]))
+			return &net.UDPAddr{IP: net.IP(append([]byte(nil), sa.Addr[:]...)), Port: ntohs(sa.Port)}, nil
+		case msg.Header.Level == syscall.SOL_IPV6 && msg.Header.Type == ipv6RecvOrigDstAddr &&
+			len(msg.Data) >= syscall.SizeofSockaddrInet6:
+			sa := (*syscall.RawSockaddrInet6)(unsafe.Pointer(&msg.Data[0]))
+			return &net.UDPAddr{IP: net.IP(append([]byte(nil), sa.Addr[:]...)), Port: ntohs(sa.Port)}, nil
+		}
+	}
+	return nil, errors.New("Datagram without its original destination ")
+}
+
+// dialTransparentUDP opens a UDP socket bound to local, which need not be an
+// address of this host, and connected to remote. Replies sent through it
+// reach the client as if they came from the original destination.
+func dialTransparentUDP(local, remote *net.UDPAddr) (net.Conn, error) {
+	family, ipv6 := syscall.AF_INET, false
+	if local.IP.To4() == nil {
+		family, ipv6 = syscall.AF_INET6, true
+	}
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, syscall.IPPROTO_UDP)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	file := os.NewFile(uintptr(fd), "udp")
+	defer file.Close()
+	if err := setTransparent(fd, ipv6, true); err != nil {
+		return nil, err
+	}
+	if err := syscall.Bind(fd, sockaddr(local, ipv6)); err != nil {
+		return nil, os.NewSyscallError("bind", err)
+	}
+	if err := syscall.Connect(fd, sockaddr(remote, ipv6)); err != nil {
+		return nil, os.NewSyscallError("connect", err)
+	}
+	return net.FileConn(file)
+}
+
+func sockaddr(addr *net.UDPAddr, ipv6 bool) syscall.Sockaddr {
+	if !ipv6 {
+		sa := &syscall.SockaddrInet4{Port: addr.Port}
+		copy(sa.Addr[:], addr.IP.To4())
+		return sa
+	}
+	sa := &syscall.SockaddrInet6{Port: addr.Port}
+	copy(sa.Addr[:], addr.IP.To16())
+	return sa
+}
@@ -0,0 +1,78 @@
+package socks5
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTransparent_UDP(t *testing.T) {
+	echo, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	dests := make(chan AddrSpec, 1)
+	server, err := New(&ServerConfig{
+		Protocol:        ProtocolTransparent,
+		TransparentMode: TransparentTProxy,
+		TransparentUDP:  true,
+		Network:         "tcp4",
+		ListenAddr:      "0.0.0.0:0",
+		Dial: func(network string, addr AddrSpec) (net.Conn, error) {
+			dests <- addr
+			return net.Dial(network, echo.LocalAddr().String())
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn, err := server.ListenPacket()
+	if err != nil {
+		if sysErr, ok := err.(*os.SyscallError); ok && sysErr.Err == syscall.EPERM {
+			t.Skipf("transparent sockets need CAP_NET_ADMIN: %v", err)
+		}
+		t.Fatalf("err: %v", err)
+	}
+	defer server.Close()
+	go func() { _ = server.ServeUDP(conn) }()
+
+	// 127.0.0.2 stands in for a destination diverted with TPROXY
+	dest := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: conn.LocalAddr().(*net.UDPAddr).Port}
+	client, err := net.DialUDP("udp4", nil, dest)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer client.Close()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	for _, msg := range []string{"ping", "pong"} {
+		if _, err := client.Write([]byte(msg)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		buf := make([]byte, 16)
+		n, err := client.Read(buf)
+		if err != nil || string(buf[:n]) != msg {
+			t.Fatalf("unexpected reply %q: %v", buf[:n], err)
+		}
+	}
+	if addr := <-dests; addr.String() != dest.String() {
+		t.Fatalf("unexpected destination %v", addr)
+	}
+	sessions := server.Sessions()
+	if len(sessions) != 1 || sessions[0].Command != "associate" || sessions[0].BytesUp != 8 || sessions[0].BytesDown != 8 {
+		t.Fatalf("unexpected sessions %+v", sessions)
+	}
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+// +build !linux
+
+package socks5
+
+import (
+	"net"
+)
+
+func originalDestination(net.Conn) (*net.TCPAddr, error) {
+	return nil, errTransparentUnsupported
+}
+
+func listenTransparentTCP(string, string) (net.Listener, error) {
+	return nil, errTransparentUnsupported
+}
+
+func listenTransparentUDP(string, string) (net.PacketConn, error) {
+	return nil, errTransparentUnsupported
+}
+
+func originalDestinationUDP([]byte) (*net.UDPAddr, error) {
+	return nil, errTransparentUnsupported
+}
+
+func dialTransparentUDP(*net.UDPAddr, *net.UDPAddr) (net.Conn, error) {
+	return nil, errTransparentUnsupported
+}
@@ -0,0 +1,106 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startTransparentServer serves a TPROXY transparent server on every address
+// of a free port, connections to 127.0.0.2 stand in for diverted ones
+func startTransparentServer(t *testing.T, conf *ServerConfig) (*Server, int) {
+	conf.Protocol = ProtocolTransparent
+	conf.TransparentMode = TransparentTProxy
+	server, err := New(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	listener, err := net.Listen("tcp4", "0.0.0.0:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { _ = server.Close() })
+	go func() { _ = server.Serve(listener) }()
+	return server, listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestTransparent_Connect(t *testing.T) {
+	echo := startEchoServer(t)
+	dests := make(chan AddrSpec, 1)
+	server, port := startTransparentServer(t, &ServerConfig{
+		Dial: func(network string, addr AddrSpec) (net.Conn, error) {
+			dests <- addr
+			return net.Dial(network, echo.String())
+		},
+	})
+
+	dest := net.JoinHostPort("127.0.0.2", strconv.Itoa(port))
+	conn, err := net.DialTimeout("tcp", dest, 5*time.Second)
+	if err != nil {
+		t.Skipf("127.0.0.2 is not local: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("unexpected echo %q: %v", buf, err)
+	}
+	if addr := <-dests; addr.String() != dest || addr.AddrType != IPV4Address {
+		t.Fatalf("unexpected destination %v", addr)
+	}
+	sessions := server.Sessions()
+	if len(sessions) != 1 || sessions[0].Command != "connect" || sessions[0].Destination != dest {
+		t.Fatalf("unexpected sessions %+v", sessions)
+	}
+}
+
+func TestTransparent_NotRedirected(t *testing.T) {
+	_, port := startTransparentServer(t, &ServerConfig{
+		Dial: func(string, AddrSpec) (net.Conn, error) {
+			t.Errorf("a connection to the proxy itself must not be dialed")
+			return nil, io.EOF
+		},
+	})
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the connection to be closed: %v", err)
+	}
+}
+
+func TestTransparent_Config(t *testing.T) {
+	conf := &ServerConfig{Protocol: ProtocolTransparent, TransparentUDP: true}
+	if _, err := New(conf); err == nil {
+		t.Fatalf("expected UDP without TPROXY to be rejected")
+	}
+	conf = &ServerConfig{Protocol: ProtocolTransparent}
+	if _, err := New(conf); err != nil || conf.TransparentMode != TransparentRedirect {
+		t.Fatalf("unexpected mode %q: %v", conf.TransparentMode, err)
+	}
+}
+
+func TestUDPFlows_Remove(t *testing.T) {
+	flows := &udpFlows{flows: make(map[string]*udpFlow)}
+	expired, next := &udpFlow{}, &udpFlow{}
+	flows.set("key", expired)
+	// a new flow of the same client and destination takes over before the
+	// expired one is done
+	flows.set("key", next)
+	flows.remove("key", expired)
+	if flows.get("key") != next {
+		t.Fatalf("expected the new flow to be kept")
+	}
+	flows.remove("key", next)
+	if flows.get("key") != nil {
+		t.Fatalf("expected the flow to be removed")
+	}
+}
@@ -0,0 +1,438 @@
+package socks5
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// A Trojan client sends the SHA-224 of its password in hex, a CRLF, a
+// command and a destination in the address encoding of SOCKS5 and another
+// CRLF over TLS, what follows is relayed. For UDP the stream carries packets
+// of an address, a length, a CRLF and the payload in both directions, the
+// address being the destination of the client's packets and the source of
+// the server's.
+const (
+	trojanHashSize = sha256.Size224 * 2
+	trojanConnect  = byte(1)
+	trojanUDP      = byte(3)
+	// trojanMaxPacket bounds the payload of UDP packets
+	trojanMaxPacket = 0xffff
+)
+
+var trojanCRLF = []byte("\r\n")
+
+// trojanHash returns the hash a Trojan client authenticates with
+func trojanHash(password string) string {
+	sum := sha256.Sum224([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// Trojan is the users of a Trojan server, who authenticate with the hash of
+// their password, and the web server other peers are relayed to
+type Trojan struct {
+	Users Accounts
+	// Fallback is the host:port of a web server that peers sending anything
+	// but the hash of a password are relayed to, with what they sent so
+	// far. Without it they are answered with 400 Bad Request.
+	Fallback string
+
+	once   sync.Once
+	hashes map[string]string
+}
+
+// Check reports users that are missing or share a password, whose clients
+// could not be told apart
+func (t *Trojan) Check() error {
+	if len(t.Users.MemoryUser) == 0 {
+		return errors.New("A Trojan server requires users ")
+	}
+	owners := make(map[string]string, len(t.Users.MemoryUser))
+	for user, password := range t.Users.MemoryUser {
+		if other, ok := owners[password]; ok {
+			if other > user {
+				user, other = other, user
+			}
+			return fmt.Errorf("Trojan users %q and %q share a password ", other, user)
+		}
+		owners[password] = user
+	}
+	return nil
+}
+
+// user returns the user whose password hash is hash
+func (t *Trojan) user(hash string) (string, bool) {
+	t.once.Do(func() {
+		t.hashes = make(map[string]string, len(t.Users.MemoryUser))
+		for user, password := range t.Users.MemoryUser {
+			t.hashes[trojanHash(password)] = user
+		}
+	})
+	user, ok := t.hashes[hash]
+	return user, ok
+}
+
+// readTrojanHash peeks at the hash and CRLF of a client, leaving them to the
+// fallback of unknown passwords. It stops at the first byte that cannot
+// belong to them so that other protocols go to the fallback without waiting
+// for more.
+func readTrojanHash(reader *bufio.Reader) (string, error) {
+	for i := 0; i < trojanHashSize+len(trojanCRLF); i++ {
+		peeked, err := reader.Peek(i + 1)
+		if err != nil {
+			return "", err
+		}
+		b := peeked[i]
+		switch {
+		case i < trojanHashSize && ('0' <= b && b <= '9' || 'a' <= b && b <= 'f'):
+		case i >= trojanHashSize && b == trojanCRLF[i-trojanHashSize]:
+		default:
+			return "", errors.New("Not a Trojan request ")
+		}
+	}
+	peeked, _ := reader.Peek(trojanHashSize)
+	return string(peeked), nil
+}
+
+func readCRLF(r io.Reader) error {
+	var crlf [2]byte
+	if _, err := io.ReadFull(r, crlf[:]); err != nil {
+		return err
+	}
+	if crlf != [2]byte{'\r', '\n'} {
+		return errors.New("Missing CRLF ")
+	}
+	return nil
+}
+
+// acceptTrojan reads the request of a Trojan client, it returns the user,
+// the command and the destination. Peers without the hash of a password are
+// relayed to the fallback and reported with an error.
+func acceptTrojan(conn net.Conn, reader *bufio.Reader, trojan *Trojan) (string, byte, *AddrSpec, error) {
+	hash, err := readTrojanHash(reader)
+	if err == nil {
+		var ok bool
+		var user string
+		if user, ok = trojan.user(hash); ok {
+			_, _ = reader.Discard(trojanHashSize + len(trojanCRLF))
+			var command [1]byte
+			if _, err := io.ReadFull(reader, command[:]); err != nil {
+				return "", 0, nil, err
+			}
+			dest, err := parseAddrSpec(reader)
+			if err != nil {
+				return "", 0, nil, err
+			}
+			if err := readCRLF(reader); err != nil {
+				return "", 0, nil, err
+			}
+			return user, command[0], dest, nil
+		}
+		err = errors.New("Unknown Trojan password ")
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() || errors.Is(err, io.EOF) {
+		return "", 0, nil, err
+	}
+	if trojan.Fallback != "" {
+		relayFallback(conn, reader, trojan.Fallback)
+	} else {
+		_, _ = io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+	}
+	return "", 0, nil, err
+}
+
+// handleTrojanConn serves a connection to a Trojan server, over TLS. A
+// connect request is processed like a SOCKS5 CONNECT by the user of the
+// password, a UDP request relays the packets of the connection.
+func (server *Server) handleTrojanConn(conf *ServerConfig, conn net.Conn) error {
+	conf.Logger.Infof("Start handle trojan connection, remoteAddr: %s", clientAddr(conn))
+	defer conn.Close()
+	server.metrics.activeConns.Inc()
+	defer server.metrics.activeConns.Dec()
+	sess := newSession(conf, conn)
+	server.trackSession(sess)
+	defer server.untrackSession(sess)
+	sess.writeReply = func(uint8, *AddrSpec) error {
+		return nil
+	}
+
+	if conf.HandshakeTimeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(conf.HandshakeTimeout))
+	}
+	reader := bufio.NewReader(conn)
+	user, command, dest, err := acceptTrojan(conn, reader, conf.Trojan)
+	if err != nil {
+		server.metrics.rejected.With(rejectHandshake).Inc()
+		sess.setReason(closeHandshake)
+		conf.Logger.Errorf("Refused trojan connection from %s: %v", clientAddr(conn), err)
+		return err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	request := &Request{
+		Version:     Socks5Version,
+		Command:     connectCommand,
+		AuthContext: &AuthContext{Method: UserPassAuth, Payload: map[string]string{"Username": user}},
+		DestAddr:    dest,
+		reader:      reader,
+		session:     sess,
+	}
+	request.RemoteAddr = remoteAddrSpec(conn.RemoteAddr())
+
+	switch command {
+	case trojanConnect:
+		sess.setRequest(request)
+		err = server.process(request, conn)
+	case trojanUDP:
+		request.Command = associateCommand
+		sess.setRequest(request)
+		err = server.relayTrojanUDP(request, conn)
+	default:
+		server.metrics.rejected.With(rejectRequest).Inc()
+		sess.setReason(closeBadRequest)
+		err = fmt.Errorf("Unsupported trojan command %d ", command)
+	}
+	if err != nil {
+		err = fmt.Errorf("Failed to handle trojan connection: %v ", err)
+		conf.Logger.Errorf("%v ", err)
+		return err
+	}
+	return nil
+}
+
+// relayTrojanUDP relays the UDP packets of a Trojan connection, each
+// destination goes through the rules and router on its first packet and is
+// relayed over a UDP connection of its own until the client goes away
+func (server *Server) relayTrojanUDP(req *Request, conn net.Conn) error {
+	conf := req.session.conf
+	_ = server.sendReply(req.session, succeeded, nil)
+	conf.Logger.Infof("Relay trojan UDP for %s", clientAddr(conn))
+
+	// the payloads are counted, not the packets carrying them
+	user := req.AuthContext.User()
+	up := &countingWriter{
+		counter:  server.metrics.relayedBytes.With("up", user),
+		total:    &req.session.bytesUp,
+		activity: &req.session.lastActivity,
+	}
+	down := &countingWriter{
+		counter:  server.metrics.relayedBytes.With("down", user),
+		total:    &req.session.bytesDown,
+		activity: &req.session.lastActivity,
+	}
+	writer := &trojanPacketWriter{conn: conn}
+	if conf.IdleTimeout > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go watchIdle(req.session, conf.IdleTimeout, stop)
+	}
+	targets := make(map[string]net.Conn)
+	defer func() {
+		for _, target := range targets {
+			_ = target.Close()
+		}
+	}()
+	for {
+		dest, payload, err := readTrojanPacket(req.reader)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				req.session.setReason(closeClientClosed)
+				return nil
+			}
+			req.session.setReason(closeRelayError)
+			return err
+		}
+		key := dest.String()
+		target, ok := targets[key]
+		if !ok {
+			if target, err = server.dialTrojanUDP(req, conn, dest); err != nil {
+				conf.Logger.Errorf("Trojan UDP to %v failed: %v", dest, err)
+				continue
+			}
+			targets[key] = target
+			go relayTrojanReplies(target, *dest, writer, down)
+		}
+		if n, err := target.Write(payload); err == nil {
+			up.count(n)
+		}
+	}
+}
+
+// dialTrojanUDP opens the UDP connection to dest for a Trojan client
+func (server *Server) dialTrojanUDP(req *Request, conn net.Conn, dest *AddrSpec) (net.Conn, error) {
+	conf := req.session.conf
+	packetReq := *req
+	packetReq.DestAddr = dest
+	if dest.Domain != "" {
+		ip, err := server.resolve(conf, dest.Domain)
+		if err != nil {
+			server.metrics.rejected.With(rejectResolve).Inc()
+			return nil, err
+		}
+		dest.IP = ip
+	}
+	if err := server.checkRules(&packetReq, conn); err != nil {
+		return nil, err
+	}
+	dial, err := server.dialer(&packetReq)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	target, err := dial("udp", *dest)
+	server.metrics.dialDuration.Observe(sinceSeconds(start))
+	if err != nil {
+		if errors.Is(err, ErrRejected) {
+			server.metrics.rejected.With(rejectRule).Inc()
+		} else {
+			server.metrics.rejected.With(rejectDial).Inc()
+		}
+		return nil, err
+	}
+	return target, nil
+}
+
+// relayTrojanReplies writes the datagrams target receives to the client as
+// packets from source
+func relayTrojanReplies(target net.Conn, source AddrSpec, writer io.Writer, down *countingWriter) {
+	buf := make([]byte, trojanMaxPacket)
+	for {
+		n, err := target.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err := writer.Write(appendTrojanPacket(nil, source, buf[:n])); err != nil {
+			return
+		}
+		down.count(n)
+	}
+}
+
+// trojanPacketWriter writes whole packets to a Trojan connection, one at a
+// time
+type trojanPacketWriter struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (w *trojanPacketWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.conn.Write(p)
+}
+
+func appendTrojanPacket(b []byte, addr AddrSpec, payload []byte) []byte {
+	b = appendAddr(b, addr)
+	b = append(b, byte(len(payload)>>8), byte(len(payload)))
+	b = append(b, trojanCRLF...)
+	return append(b, payload...)
+}
+
+func readTrojanPacket(r io.Reader) (*AddrSpec, []byte, error) {
+	addr, err := parseAddrSpec(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, nil, err
+	}
+	if err := readCRLF(r); err != nil {
+		return nil, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+	return addr, payload, nil
+}
+
+// TrojanOutbound connects through a Trojan server over TLS, for TCP
+// connections and UDP flows
+type TrojanOutbound struct {
+	Address  string
+	Password string
+	// TLS verifies the server, the host of Address is its name by default
+	TLS     *tls.Config
+	Timeout time.Duration
+	SocketOptions
+}
+
+func (t *TrojanOutbound) Dial(network string, addr AddrSpec) (net.Conn, error) {
+	return t.dialFor(network, nil, addr)
+}
+
+func (t *TrojanOutbound) dialFor(network string, from *client, addr AddrSpec) (net.Conn, error) {
+	command := trojanConnect
+	switch network {
+	case "tcp":
+	case "udp":
+		command = trojanUDP
+	default:
+		return nil, fmt.Errorf("Unsupported network %q for Trojan outbound ", network)
+	}
+	var upstream net.IP
+	if host, _, err := net.SplitHostPort(t.Address); err == nil {
+		upstream = net.ParseIP(host)
+	}
+	conn, err := t.dial("tcp", t.Address, t.Timeout, from, upstream)
+	if err != nil {
+		return nil, err
+	}
+	if t.Timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(t.Timeout))
+	}
+	config := t.TLS
+	if config == nil {
+		config = &tls.Config{}
+	}
+	tlsConn, err := dialTLS(conn, config, t.Address)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("Upstream %s: %w ", t.Address, err)
+	}
+	request := append([]byte(trojanHash(t.Password)), trojanCRLF...)
+	request = append(appendAddr(append(request, command), addr), trojanCRLF...)
+	if _, err := tlsConn.Write(request); err != nil {
+		_ = tlsConn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	if command == trojanUDP {
+		return &trojanPacketConn{Conn: tlsConn, dest: addr}, nil
+	}
+	return tlsConn, nil
+}
+
+// trojanPacketConn carries the datagrams of a UDP flow to dest in the
+// packets of a Trojan connection
+type trojanPacketConn struct {
+	net.Conn
+	dest AddrSpec
+}
+
+func (c *trojanPacketConn) Write(p []byte) (int, error) {
+	if len(p) > trojanMaxPacket {
+		return 0, errors.New("Datagram too large for Trojan ")
+	}
+	if _, err := c.Conn.Write(appendTrojanPacket(nil, c.dest, p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *trojanPacketConn) Read(p []byte) (int, error) {
+	_, payload, err := readTrojanPacket(c.Conn)
+	if err != nil {
+		return 0, err
+	}
+	return copy(p, payload), nil
+}
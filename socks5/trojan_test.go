@@ -0,0 +1,140 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// startTrojanServer starts a Trojan server for alice and bob, only alice may
+// connect, other peers go to fallback
+func startTrojanServer(t *testing.T, fallback string) (*Server, string, *tls.Config) {
+	ca := newTestCA(t)
+	server, addr := startTestServer(t, &ServerConfig{
+		Protocol: ProtocolTrojan,
+		Trojan:   &Trojan{Users: Accounts{MemoryUser: MemoryUser{"alice": "alice secret", "bob": "bob secret"}}, Fallback: fallback},
+		TLS:      &tls.Config{Certificates: []tls.Certificate{ca.keyPair(t, &x509.Certificate{DNSNames: []string{"trojan.test"}})}},
+		Rules:    &RuleList{Rules: []Rule{{Name: "alice", Allow: true, Matcher: Matcher{Users: []string{"alice"}}}}},
+	})
+	return server, addr, &tls.Config{RootCAs: ca.pool, ServerName: "trojan.test"}
+}
+
+func TestTrojan_Connect(t *testing.T) {
+	echo := startEchoServer(t)
+	server, addr, config := startTrojanServer(t, "")
+	outbound := &TrojanOutbound{Address: addr, Password: "alice secret", TLS: config, Timeout: 5 * time.Second}
+	conn, err := outbound.Dial("tcp", *addrSpec(echo.IP, echo.Port))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("unexpected echo %q: %v", buf, err)
+	}
+	sessions := server.Sessions()
+	_ = conn.Close()
+	if len(sessions) != 1 || sessions[0].User != "alice" || sessions[0].Command != "connect" {
+		t.Fatalf("unexpected sessions %+v", sessions)
+	}
+
+	// bob authenticates but the rules only allow alice
+	outbound.Password = "bob secret"
+	if conn, err = outbound.Dial("tcp", *addrSpec(echo.IP, echo.Port)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, _ = conn.Write([]byte("ping"))
+	if _, err := conn.Read(buf); err == nil {
+		t.Fatalf("expected bob to be refused by the rules")
+	}
+	_ = conn.Close()
+}
+
+func TestTrojan_Fallback(t *testing.T) {
+	// the fallback echoes, so peers get back exactly what it was sent
+	fallback := startEchoServer(t)
+	_, addr, config := startTrojanServer(t, fallback.String())
+	for _, request := range []string{
+		"GET / HTTP/1.1\r\nHost: trojan.test\r\n\r\n",
+		// the hash of a password nobody has
+		trojanHash("wrong") + "\r\n\x01\x01\x7f\x00\x00\x01\x00\x50\r\n",
+	} {
+		conn, err := tls.Dial("tcp", addr, config)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.WriteString(conn, request); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		_ = conn.CloseWrite()
+		response, err := ioutil.ReadAll(conn)
+		_ = conn.Close()
+		if err != nil || string(response) != request {
+			t.Fatalf("unexpected fallback response %q: %v", response, err)
+		}
+	}
+}
+
+func TestTrojan_UDP(t *testing.T) {
+	echo, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteTo(buf[:n], addr)
+		}
+	}()
+	dest := echo.LocalAddr().(*net.UDPAddr)
+
+	server, addr, config := startTrojanServer(t, "")
+	outbound := &TrojanOutbound{Address: addr, Password: "alice secret", TLS: config, Timeout: 5 * time.Second}
+	conn, err := outbound.Dial("udp", *addrSpec(dest.IP, dest.Port))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	for _, msg := range []string{"ping", "pong"} {
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		buf := make([]byte, 16)
+		n, err := conn.Read(buf)
+		if err != nil || string(buf[:n]) != msg {
+			t.Fatalf("unexpected reply %q: %v", buf[:n], err)
+		}
+	}
+	sessions := server.Sessions()
+	if len(sessions) != 1 || sessions[0].User != "alice" || sessions[0].Command != "associate" || sessions[0].BytesUp != 8 {
+		t.Fatalf("unexpected sessions %+v", sessions)
+	}
+}
+
+func TestTrojan_Rejected(t *testing.T) {
+	if _, err := New(&ServerConfig{Protocol: ProtocolTrojan, Trojan: &Trojan{Users: Accounts{MemoryUser: MemoryUser{"alice": "secret"}}}}); err == nil {
+		t.Fatalf("expected a Trojan server without TLS to be rejected")
+	}
+	if _, err := New(&ServerConfig{Protocol: ProtocolTrojan, Trojan: &Trojan{}, TLS: &tls.Config{}}); err == nil {
+		t.Fatalf("expected a Trojan server without users to be rejected")
+	}
+	shared := &Trojan{Users: Accounts{MemoryUser: MemoryUser{"alice": "secret", "bob": "secret"}}}
+	if _, err := New(&ServerConfig{Protocol: ProtocolTrojan, Trojan: shared, TLS: &tls.Config{}}); err == nil {
+		t.Fatalf("expected Trojan users sharing a password to be rejected")
+	}
+}
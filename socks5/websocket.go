@@ -0,0 +1,374 @@
+package socks5
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// websocketGUID is appended to the key of an upgrade request to compute the
+// accept header of the response, see RFC 6455 section 1.3
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// The WebSocket opcodes the tunnel uses
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// defaultDecoy is the page WebSocket servers answer other requests with when
+// no Decoy is configured
+var defaultDecoy = []byte(`<!DOCTYPE html>
+<html>
+<head><title>Welcome</title></head>
+<body><h1>It works!</h1></body>
+</html>
+`)
+
+// WebSocket carries the SOCKS5 stream in the binary messages of a WebSocket
+// connection, which passes through HTTP proxies and CDNs that only forward
+// HTTP. Host and Header apply to clients, Decoy to servers.
+type WebSocket struct {
+	// Path is the path of the upgrade request, "/" by default
+	Path string
+	// Host is the Host header of the upgrade request, the host of the
+	// server's address by default
+	Host string
+	// Header holds extra headers of the upgrade request, such as those a CDN
+	// expects
+	Header http.Header
+	// Decoy is the HTML page served to requests that are not an upgrade to
+	// Path, a placeholder page when it is empty
+	Decoy []byte
+}
+
+func (ws *WebSocket) path() string {
+	if ws.Path == "" {
+		return "/"
+	}
+	return ws.Path
+}
+
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerContains reports whether the comma separated header name of h lists
+// token, case insensitively
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range h[http.CanonicalHeaderKey(name)] {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// acceptWebSocket reads the HTTP request of a client within timeout. An
+// upgrade to the WebSocket path returns the tunnel, any other request is
+// answered with the decoy page and ends the connection with an error.
+func acceptWebSocket(conn net.Conn, ws *WebSocket, timeout time.Duration) (net.Conn, error) {
+	if timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(timeout))
+	}
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read WebSocket upgrade: %v ", err)
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if req.Method != http.MethodGet || req.URL.Path != ws.path() || key == "" ||
+		!headerContains(req.Header, "Connection", "upgrade") || !headerContains(req.Header, "Upgrade", "websocket") {
+		writeDecoy(conn, req, ws.Decoy)
+		return nil, fmt.Errorf("Served the decoy page for %s %s ", req.Method, req.URL.Path)
+	}
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n\r\n"
+	if _, err := io.WriteString(conn, response); err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return newWSConn(conn, reader, false), nil
+}
+
+// writeDecoy answers req like an ordinary web server would
+func writeDecoy(w io.Writer, req *http.Request, decoy []byte) {
+	if len(decoy) == 0 {
+		decoy = defaultDecoy
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		_, _ = io.WriteString(w, "HTTP/1.1 405 Method Not Allowed\r\nAllow: GET, HEAD\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		return
+	}
+	_, _ = fmt.Fprintf(w, "HTTP/1.1 200 OK\r\nContent-Type: text/html; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n", len(decoy))
+	if req.Method == http.MethodGet {
+		_, _ = w.Write(decoy)
+	}
+}
+
+// dialWebSocket upgrades conn, connected to the server at address, to a
+// WebSocket tunnel
+func dialWebSocket(conn net.Conn, ws *WebSocket, address string) (net.Conn, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	host := ws.Host
+	if host == "" {
+		host = address
+	}
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: ws.path()},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       host,
+	}
+	for name, values := range ws.Header {
+		req.Header[http.CanonicalHeaderKey(name)] = values
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read WebSocket upgrade response: %v ", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("WebSocket upgrade refused with %s ", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != websocketAccept(key) {
+		return nil, errors.New("Invalid Sec-WebSocket-Accept in WebSocket upgrade response ")
+	}
+	return newWSConn(conn, reader, true), nil
+}
+
+// wsConn is a WebSocket tunnel. Writes are sent as binary messages, reads
+// return the payload of data messages and answer pings. A close message ends
+// the stream in its direction, so CloseWrite sends one.
+type wsConn struct {
+	net.Conn
+	reader *bufio.Reader
+	// client masks the frames it sends, servers require masked frames
+	client bool
+
+	// remaining is what is left to read of the payload of the current frame
+	remaining uint64
+	mask      [4]byte
+	masked    bool
+	maskPos   int
+	eof       bool
+
+	writeMu   sync.Mutex
+	closeOnce sync.Once
+}
+
+func newWSConn(conn net.Conn, reader *bufio.Reader, client bool) *wsConn {
+	return &wsConn{Conn: conn, reader: reader, client: client}
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if c.eof {
+			return 0, io.EOF
+		}
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.reader.Read(p)
+	c.unmask(p[:n])
+	c.remaining -= uint64(n)
+	return n, err
+}
+
+// nextFrame reads frame headers until one of a data frame, control frames are
+// handled on the way
+func (c *wsConn) nextFrame() error {
+	header := make([]byte, 2, 8)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return err
+	}
+	opcode := header[0] & 0x0f
+	c.masked = header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		if _, err := io.ReadFull(c.reader, header[:2]); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(header[:2]))
+	case 127:
+		if _, err := io.ReadFull(c.reader, header[:8]); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(header[:8])
+	}
+	if c.masked == c.client {
+		return errors.New("WebSocket frame masked by the wrong side ")
+	}
+	if c.masked {
+		if _, err := io.ReadFull(c.reader, c.mask[:]); err != nil {
+			return err
+		}
+	}
+	c.maskPos = 0
+	switch opcode {
+	case wsContinuation, wsText, wsBinary:
+		c.remaining = length
+		return nil
+	case wsClose, wsPing, wsPong:
+		if length > 125 {
+			return errors.New("WebSocket control frame too long ")
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.reader, payload); err != nil {
+			return err
+		}
+		c.unmask(payload)
+		switch opcode {
+		case wsClose:
+			c.eof = true
+		case wsPing:
+			return c.writeFrame(wsPong, payload)
+		}
+		return nil
+	}
+	return fmt.Errorf("Unknown WebSocket opcode %d ", opcode)
+}
+
+func (c *wsConn) unmask(p []byte) {
+	if !c.masked {
+		return
+	}
+	for i := range p {
+		p[i] ^= c.mask[c.maskPos&3]
+		c.maskPos++
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeFrame sends payload in a single final frame
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, len(payload)+14)
+	frame = append(frame, 0x80|opcode)
+	maskBit := byte(0)
+	if c.client {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, maskBit|126, byte(n>>8), byte(n))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = append(frame, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(frame[len(frame)-8:], uint64(n))
+	}
+	if c.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range frame[start:] {
+			frame[start+i] ^= mask[i&3]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// CloseWrite sends the close message, the peer reads EOF
+func (c *wsConn) CloseWrite() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.writeFrame(wsClose, []byte{0x03, 0xe8})
+	})
+	return err
+}
+
+func (c *wsConn) Close() error {
+	_ = c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_ = c.CloseWrite()
+	return c.Conn.Close()
+}
+
+// dialHTTPProxy connects to address through the HTTP proxy with CONNECT,
+// with the credentials of the proxy URL when it has any
+func dialHTTPProxy(conn net.Conn, proxy *url.URL, address string) (net.Conn, error) {
+	req := &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Opaque: address},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       address,
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read HTTP proxy response: %v ", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP proxy %s refused CONNECT with %s ", proxy.Host, resp.Status)
+	}
+	// the server waits for the client to speak first
+	if reader.Buffered() > 0 {
+		return nil, errors.New("Unexpected data after the CONNECT response of the HTTP proxy ")
+	}
+	return conn, nil
+}
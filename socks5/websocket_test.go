@@ -0,0 +1,164 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWSConn_Frames(t *testing.T) {
+	clientSide, serverSide := net.Pipe()
+	defer clientSide.Close()
+	defer serverSide.Close()
+	client := newWSConn(clientSide, bufio.NewReader(clientSide), true)
+	server := newWSConn(serverSide, bufio.NewReader(serverSide), false)
+
+	sizes := []int{1, 125, 126, 65535, 65536, 200000}
+	go func() {
+		for _, size := range sizes {
+			_, _ = client.Write(bytes.Repeat([]byte{byte(size)}, size))
+		}
+		_ = client.CloseWrite()
+	}()
+	data, err := ioutil.ReadAll(server)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var want []byte
+	for _, size := range sizes {
+		want = append(want, bytes.Repeat([]byte{byte(size)}, size)...)
+	}
+	if !bytes.Equal(data, want) {
+		t.Fatalf("received %d bytes, want %d", len(data), len(want))
+	}
+
+	// pings are answered while reading
+	pong := make(chan error, 1)
+	go func() { pong <- server.nextFrame() }()
+	go func() {
+		_ = server.writeFrame(wsPing, []byte("are you there"))
+		_, _ = server.Write([]byte("data"))
+	}()
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "data" {
+		t.Fatalf("unexpected data %q: %v", buf, err)
+	}
+	if err := <-pong; err != nil || server.remaining != 0 {
+		t.Fatalf("expected a pong, got %d bytes: %v", server.remaining, err)
+	}
+
+	// servers refuse frames that clients did not mask
+	go func() { _ = server.writeFrame(wsBinary, []byte("x")) }()
+	if _, err := newWSConn(clientSide, client.reader, false).Read(buf); err == nil {
+		t.Fatalf("expected an unmasked frame to be refused by a server")
+	}
+}
+
+func TestWebSocket_Tunnel(t *testing.T) {
+	echo := startEchoServer(t)
+	_, addr := startTestServer(t, &ServerConfig{
+		AuthMethods: []Authenticator{NoAuthAuthenticator{}},
+		WebSocket:   &WebSocket{Path: "/tunnel"},
+	})
+	_, proxy := startTestServer(t, &ServerConfig{
+		Protocol:    ProtocolHTTP,
+		AuthMethods: []Authenticator{UserPassAuthenticator{Accounts: Accounts{MemoryUser: MemoryUser{"corp": "secret"}}}},
+	})
+	for _, httpProxy := range []*url.URL{nil, {Scheme: "http", Host: proxy, User: url.UserPassword("corp", "secret")}} {
+		outbound := &Socks5Outbound{
+			Address:   addr,
+			Timeout:   5 * time.Second,
+			WebSocket: &WebSocket{Path: "/tunnel", Host: "cdn.example.com"},
+			HTTPProxy: httpProxy,
+		}
+		conn, err := outbound.Dial("tcp", *addrSpec(echo.IP, echo.Port))
+		if err != nil {
+			t.Fatalf("proxy %v: %v", httpProxy, err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		payload := bytes.Repeat([]byte("websocket"), 100000)
+		go func() {
+			_, _ = conn.Write(payload)
+			_ = conn.(closeWriter).CloseWrite()
+		}()
+		data, err := ioutil.ReadAll(conn)
+		if err != nil || !bytes.Equal(data, payload) {
+			t.Fatalf("proxy %v: echoed %d bytes, want %d: %v", httpProxy, len(data), len(payload), err)
+		}
+		_ = conn.Close()
+	}
+
+	outbound := &Socks5Outbound{
+		Address:   addr,
+		Timeout:   5 * time.Second,
+		WebSocket: &WebSocket{Path: "/tunnel"},
+		HTTPProxy: &url.URL{Scheme: "http", Host: proxy, User: url.UserPassword("corp", "wrong")},
+	}
+	if _, err := outbound.Dial("tcp", *addrSpec(echo.IP, echo.Port)); err == nil {
+		t.Fatalf("expected the HTTP proxy to refuse wrong credentials")
+	}
+	outbound = &Socks5Outbound{Address: addr, Timeout: 5 * time.Second, WebSocket: &WebSocket{Path: "/other"}}
+	if _, err := outbound.Dial("tcp", *addrSpec(echo.IP, echo.Port)); err == nil {
+		t.Fatalf("expected an upgrade to another path to be refused")
+	}
+}
+
+func TestWebSocket_Decoy(t *testing.T) {
+	_, addr := startTestServer(t, &ServerConfig{
+		AuthMethods: []Authenticator{NoAuthAuthenticator{}},
+		WebSocket:   &WebSocket{Path: "/tunnel", Decoy: []byte("<h1>Under construction</h1>")},
+	})
+	for _, tc := range []struct {
+		method, path string
+		status       int
+		body         string
+	}{
+		{http.MethodGet, "/", http.StatusOK, "<h1>Under construction</h1>"},
+		{http.MethodGet, "/tunnel", http.StatusOK, "<h1>Under construction</h1>"},
+		{http.MethodHead, "/index.html", http.StatusOK, ""},
+		{http.MethodPost, "/login", http.StatusMethodNotAllowed, ""},
+	} {
+		req, _ := http.NewRequest(tc.method, "http://"+addr+tc.path, strings.NewReader(""))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", tc.method, tc.path, err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode != tc.status || string(body) != tc.body {
+			t.Fatalf("%s %s: unexpected response %d %q", tc.method, tc.path, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestDialWebSocket_Request(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	requests := make(chan *http.Request, 1)
+	go func() {
+		req, err := http.ReadRequest(bufio.NewReader(server))
+		if err != nil {
+			close(requests)
+			return
+		}
+		requests <- req
+		_, _ = io.WriteString(server, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: wrong\r\n\r\n")
+	}()
+	ws := &WebSocket{Path: "/ws", Host: "cdn.example.com", Header: http.Header{"X-Token": {"abc"}}}
+	if _, err := dialWebSocket(client, ws, "203.0.113.1:443"); err == nil {
+		t.Fatalf("expected a wrong accept header to be refused")
+	}
+	req := <-requests
+	if req == nil || req.Host != "cdn.example.com" || req.URL.Path != "/ws" || req.Header.Get("X-Token") != "abc" ||
+		req.Header.Get("Sec-WebSocket-Version") != "13" {
+		t.Fatalf("unexpected upgrade request %+v", req)
+	}
+}
@@ -0,0 +1,63 @@
+// Package systemd implements the parts of the systemd service protocol
+// JadeSocks uses: socket activation and sd_notify readiness, stopping and
+// watchdog messages. Both are no-ops when the process was not started by
+// systemd.
+package systemd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd
+const listenFdsStart = 3
+
+// Listeners returns the sockets systemd passed to the process, keyed by the
+// FileDescriptorName= of their socket unit. Sockets without a name are keyed
+// by their position, "0", "1" and so on. The environment variables are
+// removed so that child processes do not take the sockets over.
+func Listeners() (map[string]net.Listener, error) {
+	defer func() {
+		_ = os.Unsetenv("LISTEN_PID")
+		_ = os.Unsetenv("LISTEN_FDS")
+		_ = os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	return listeners(listenFdsStart)
+}
+
+func listeners(start int) (map[string]net.Listener, error) {
+	result := make(map[string]net.Listener)
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return result, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 0 {
+		return nil, errors.New("Invalid LISTEN_FDS " + os.Getenv("LISTEN_FDS"))
+	}
+	var names []string
+	if fdnames := os.Getenv("LISTEN_FDNAMES"); fdnames != "" {
+		names = strings.Split(fdnames, ":")
+	}
+	for i := 0; i < count; i++ {
+		name := strconv.Itoa(i)
+		if i < len(names) && names[i] != "" && names[i] != "unknown" {
+			name = names[i]
+		}
+		file := os.NewFile(uintptr(start+i), name)
+		listener, err := net.FileListener(file)
+		_ = file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Socket %s passed by systemd is not a stream listener: %v ", name, err)
+		}
+		if _, dup := result[name]; dup {
+			return nil, fmt.Errorf("Duplicate socket name %q passed by systemd ", name)
+		}
+		result[name] = listener
+	}
+	return result, nil
+}
@@ -0,0 +1,89 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	if sent, err := Notify(Ready); sent || err != nil {
+		t.Fatalf("expected no notification outside of systemd: %v %v", sent, err)
+	}
+
+	dir, err := ioutil.TempDir("", "jadesocks-systemd")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	os.Setenv("NOTIFY_SOCKET", path)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	if sent, err := Notify(Ready); !sent || err != nil {
+		t.Fatalf("expected a notification: %v %v", sent, err)
+	}
+	buf := make([]byte, 64)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != Ready {
+		t.Fatalf("unexpected message %q: %v", buf[:n], err)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	os.Setenv("WATCHDOG_USEC", "4000000")
+	defer os.Unsetenv("WATCHDOG_USEC")
+	if interval, ok := WatchdogInterval(); !ok || interval != 2*time.Second {
+		t.Fatalf("unexpected interval %v %v", interval, ok)
+	}
+	os.Setenv("WATCHDOG_PID", "1")
+	defer os.Unsetenv("WATCHDOG_PID")
+	if _, ok := WatchdogInterval(); ok && os.Getpid() != 1 {
+		t.Fatalf("expected the watchdog of another process to be ignored")
+	}
+}
+
+func TestListeners(t *testing.T) {
+	if l, err := listeners(listenFdsStart); err != nil || len(l) != 0 {
+		t.Fatalf("expected no listeners outside of systemd: %v %v", l, err)
+	}
+
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer tcp.Close()
+	file, err := tcp.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer file.Close()
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "1")
+	os.Setenv("LISTEN_FDNAMES", "socks")
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	result, err := listeners(int(file.Fd()))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	listener, ok := result["socks"]
+	if !ok || listener.Addr().String() != tcp.Addr().String() {
+		t.Fatalf("unexpected listeners %v", result)
+	}
+	listener.Close()
+}